@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	accessRestore = "restore"
+	accessTempURL = "tempurl"
+)
+
+// accessEntry records who got access to backed up objects, and how.
+type accessEntry struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	Time     time.Time          `bson:"time"`
+	Actor    string             `bson:"actor"`
+	Action   string             `bson:"action"`
+	AID      string             `bson:"aid,omitempty"`
+	SubAID   string             `bson:"sub_aid,omitempty"`
+	Year     int                `bson:"year,omitempty"`
+	Month    int                `bson:"month,omitempty"`
+	RecordID primitive.ObjectID `bson:"record_id,omitempty"`
+	Objects  []string           `bson:"objects"`
+	// Detail is the destination of a restore or the method and validity of
+	// a signed URL.
+	Detail string `bson:"detail,omitempty"`
+	// PartsChecks are how the large objects of a restore were verified once
+	// reassembled (see checkParts).
+	PartsChecks []partsCheck `bson:"parts_checks,omitempty"`
+}
+
+// accessActor is who is running the command: ACCESS_ACTOR, or the local
+// user and host.
+func accessActor(conf Config) string {
+	if conf.AccessActor != "" {
+		return conf.AccessActor
+	}
+	host, _ := os.Hostname()
+	return os.Getenv("USER") + "@" + host
+}
+
+// logRestore records the restore of files of rec to dest, returning the id
+// of the entry. Access is logged
+// before anything is downloaded, so nothing is restored without a trace,
+// and even in READ_ONLY mode.
+func logRestore(ctx context.Context, conf Config, coll *mongo.Collection, rec Record, files []storage.Backup, dest string) (primitive.ObjectID, error) {
+	e := accessEntry{
+		ID:       primitive.NewObjectID(),
+		Action:   accessRestore,
+		AID:      rec.AID,
+		SubAID:   rec.SubAID,
+		Year:     rec.Year,
+		Month:    rec.Month,
+		RecordID: rec.ID,
+		Detail:   dest,
+	}
+	for _, f := range files {
+		e.Objects = append(e.Objects, f.URL)
+	}
+	return e.ID, logAccess(ctx, conf, coll, e)
+}
+
+func logAccess(ctx context.Context, conf Config, coll *mongo.Collection, e accessEntry) error {
+	e.Time = time.Now().UTC().Truncate(time.Millisecond)
+	e.Actor = accessActor(conf)
+	if _, err := coll.InsertOne(ctx, e); err != nil {
+		return fmt.Errorf("error logging access(%s):%w", e.Action, err)
+	}
+	return nil
+}
+
+// auditCmd lists the access log, newest first.
+func auditCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	aid := fs.String("aid", "", "only list accesses to this agency")
+	action := fs.String("action", "", "only list this action: restore or tempurl")
+	since := fs.Duration("since", 30*24*time.Hour, "only list accesses this recent")
+	actor := fs.String("actor", "", "only list accesses by this actor")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoAccessColl)
+
+	filter := bson.M{"time": bson.M{"$gte": time.Now().Add(-*since)}}
+	if *aid != "" {
+		agency := splitAID(strings.ToLower(*aid), conf.AIDSeparator)
+		for k, v := range agency.filter() {
+			filter[k] = v
+		}
+	}
+	if *action != "" {
+		filter["action"] = *action
+	}
+	if *actor != "" {
+		filter["actor"] = *actor
+	}
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"time": -1}))
+	if err != nil {
+		return fmt.Errorf("error querying access log:%w", err)
+	}
+	var entries []accessEntry
+	if err := cur.All(ctx, &entries); err != nil {
+		return fmt.Errorf("error decoding access log:%w", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTOR\tACTION\tAGENCY\tMONTH\tOBJECTS\tDETAIL")
+	for _, e := range entries {
+		month := ""
+		if e.Year != 0 {
+			month = fmt.Sprintf("%d/%02d", e.Year, e.Month)
+		}
+		detail := e.Detail
+		if failed := failedChecks(e.PartsChecks); len(e.PartsChecks) > 0 {
+			detail += fmt.Sprintf(" (%d large objects checked, %d failed)", len(e.PartsChecks), failed)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", e.Time.Format("2006-01-02T15:04:05Z"), e.Actor, e.Action,
+			agencyID{AID: e.AID, Sub: e.SubAID}, month, len(e.Objects), detail)
+	}
+	return w.Flush()
+}
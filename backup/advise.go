@@ -0,0 +1,304 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const gib = 1 << 30
+
+// locationPrice is what a location, a container or bucket of a backend,
+// charges per GiB. Cold locations are cheaper to keep data in than to read
+// it from, fit for the months no one reads anymore.
+type locationPrice struct {
+	StorageGiBMonth float64 `json:"storage_gib_month"`
+	RetrievalGiB    float64 `json:"retrieval_gib"`
+	EgressGiB       float64 `json:"egress_gib"`
+	Cold            bool    `json:"cold"`
+}
+
+// priceTable is the PRICE_TABLE file: the prices of every location, keyed
+// by <backend>:<container>, e.g. "swift:backups" or "s3:backups-archive".
+type priceTable struct {
+	Currency  string                   `json:"currency"`
+	Locations map[string]locationPrice `json:"locations"`
+}
+
+func readPriceTable(path string) (priceTable, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return priceTable{}, fmt.Errorf("error reading price table(%s):%w", path, err)
+	}
+	var t priceTable
+	if err := json.Unmarshal(b, &t); err != nil {
+		return priceTable{}, fmt.Errorf("error decoding price table(%s):%w", path, err)
+	}
+	if len(t.Locations) == 0 {
+		return priceTable{}, fmt.Errorf("price table(%s) has no locations", path)
+	}
+	for name, p := range t.Locations {
+		if !strings.Contains(name, ":") {
+			return priceTable{}, fmt.Errorf("invalid location %q in price table(%s): must be <backend>:<container>", name, path)
+		}
+		if p.StorageGiBMonth < 0 || p.RetrievalGiB < 0 || p.EgressGiB < 0 {
+			return priceTable{}, fmt.Errorf("invalid prices of %q in price table(%s): must not be negative", name, path)
+		}
+	}
+	return t, nil
+}
+
+// placementStats is how many bytes of the backups of a year are in a
+// location.
+type placementStats struct {
+	Key struct {
+		Backend   string `bson:"backend"`
+		Container string `bson:"container"`
+		Year      int    `bson:"year"`
+	} `bson:"_id"`
+	Bytes int64 `bson:"bytes"`
+}
+
+func (s placementStats) location() string {
+	backend := s.Key.Backend
+	if backend == "" {
+		backend = backendSwift
+	}
+	return backend + ":" + s.Key.Container
+}
+
+// loadPlacementStats aggregates the files of the backup collection matching
+// filter per location and year. Every version is counted, all of them
+// being stored.
+func loadPlacementStats(ctx context.Context, coll *mongo.Collection, filter bson.M) ([]placementStats, error) {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$unwind", Value: "$files"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"backend": bson.M{"$ifNull": bson.A{"$files.backend", ""}}, "container": "$files.container", "year": "$year"},
+			"bytes": bson.M{"$sum": "$files.bytes"},
+		}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating backup files:%w", err)
+	}
+	var stats []placementStats
+	if err := cur.All(ctx, &stats); err != nil {
+		return nil, fmt.Errorf("error decoding backup files aggregation:%w", err)
+	}
+	return stats, nil
+}
+
+// Kinds of the actions of an advice plan.
+const (
+	// adviceTier moves the old years of a location to a cold one.
+	adviceTier = "tier"
+	// adviceMigrate moves the rest to a cheaper location.
+	adviceMigrate = "migrate"
+)
+
+// adviceAction moves the files of FirstYear to LastYear in From to To.
+// MigrationCost is what it costs once, reading the files out of From, and
+// PaybackMonths how long the savings take to pay for it.
+type adviceAction struct {
+	Kind           string  `json:"kind"`
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	FirstYear      int     `json:"first_year"`
+	LastYear       int     `json:"last_year"`
+	Bytes          int64   `json:"bytes"`
+	MonthlySavings float64 `json:"monthly_savings"`
+	MigrationCost  float64 `json:"migration_cost"`
+	PaybackMonths  float64 `json:"payback_months"`
+}
+
+// advicePlan is what advise recommends, with the monthly cost of the
+// storage now and after every action is taken. Locations missing from the
+// price table are left out of both.
+type advicePlan struct {
+	GeneratedAt      time.Time      `json:"generated_at"`
+	Currency         string         `json:"currency"`
+	MonthlyCost      float64        `json:"monthly_cost"`
+	MonthlyCostAfter float64        `json:"monthly_cost_after"`
+	Actions          []adviceAction `json:"actions"`
+	Unpriced         []string       `json:"unpriced,omitempty"`
+}
+
+// cheapest returns the location of prices, cold or not, cheaper to keep
+// data in than from, if any.
+func (t priceTable) cheapest(from string, cold bool) (string, bool) {
+	best, found := "", false
+	for name, p := range t.Locations {
+		if p.Cold != cold || name == from || p.StorageGiBMonth >= t.Locations[from].StorageGiBMonth {
+			continue
+		}
+		if !found || p.StorageGiBMonth < t.Locations[best].StorageGiBMonth || (p.StorageGiBMonth == t.Locations[best].StorageGiBMonth && name < best) {
+			best, found = name, true
+		}
+	}
+	return best, found
+}
+
+// advise plans the placement of the backups of stats: the years older than
+// coldAfter years go to the cheapest cold location, the others to the
+// cheapest location that isn't, when that saves at least minSavings a
+// month. Consecutive years going the same way are a single action.
+func advise(prices priceTable, stats []placementStats, now time.Time, coldAfter int, minSavings float64) advicePlan {
+	plan := advicePlan{GeneratedAt: now.UTC(), Currency: prices.Currency}
+	unpriced := make(map[string]bool)
+	type move struct {
+		kind, from, to string
+	}
+	moves := make(map[move][]placementStats)
+	for _, s := range stats {
+		from := s.location()
+		p, ok := prices.Locations[from]
+		if !ok {
+			unpriced[from] = true
+			continue
+		}
+		cost := float64(s.Bytes) / gib * p.StorageGiBMonth
+		plan.MonthlyCost += cost
+		kind, cold := adviceMigrate, false
+		if s.Key.Year <= now.Year()-coldAfter {
+			kind, cold = adviceTier, true
+		}
+		to, ok := prices.cheapest(from, cold)
+		// recent years already in cold storage stay there.
+		if !ok || (p.Cold && !cold) {
+			plan.MonthlyCostAfter += cost
+			continue
+		}
+		moves[move{kind, from, to}] = append(moves[move{kind, from, to}], s)
+	}
+	for m, years := range moves {
+		sort.Slice(years, func(i, j int) bool { return years[i].Key.Year < years[j].Key.Year })
+		from, to := prices.Locations[m.from], prices.Locations[m.to]
+		var actions []adviceAction
+		for _, s := range years {
+			n := len(actions)
+			if n == 0 || actions[n-1].LastYear != s.Key.Year-1 {
+				actions = append(actions, adviceAction{Kind: m.kind, From: m.from, To: m.to, FirstYear: s.Key.Year})
+				n++
+			}
+			actions[n-1].LastYear = s.Key.Year
+			actions[n-1].Bytes += s.Bytes
+		}
+		for _, a := range actions {
+			gibs := float64(a.Bytes) / gib
+			a.MonthlySavings = gibs * (from.StorageGiBMonth - to.StorageGiBMonth)
+			a.MigrationCost = gibs * (from.RetrievalGiB + from.EgressGiB)
+			if a.MonthlySavings < minSavings {
+				plan.MonthlyCostAfter += gibs * from.StorageGiBMonth
+				continue
+			}
+			if a.MonthlySavings > 0 {
+				a.PaybackMonths = a.MigrationCost / a.MonthlySavings
+			}
+			plan.MonthlyCostAfter += gibs * to.StorageGiBMonth
+			plan.Actions = append(plan.Actions, a)
+		}
+	}
+	sort.Slice(plan.Actions, func(i, j int) bool {
+		a, b := plan.Actions[i], plan.Actions[j]
+		if a.MonthlySavings != b.MonthlySavings {
+			return a.MonthlySavings > b.MonthlySavings
+		}
+		return a.From+a.To < b.From+b.To
+	})
+	for l := range unpriced {
+		plan.Unpriced = append(plan.Unpriced, l)
+	}
+	sort.Strings(plan.Unpriced)
+	return plan
+}
+
+func (a adviceAction) years() string {
+	if a.FirstYear == a.LastYear {
+		return fmt.Sprint(a.FirstYear)
+	}
+	return fmt.Sprintf("%d-%d", a.FirstYear, a.LastYear)
+}
+
+// adviseCmd recommends where the backups should be kept, by the prices of
+// PRICE_TABLE and what every location holds, as a table or, with --format
+// json, as a plan the storage can be moved by. --plan writes the plan to a
+// file as well.
+func adviseCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("advise", flag.ContinueOnError)
+	agency := fs.String("aid", "", "only advise on this agency")
+	coldAfter := fs.Int("cold-after-years", 2, "send the years at least this old to cold storage")
+	minSavings := fs.Float64("min-savings", 0, "leave out actions saving less than this a month")
+	format := fs.String("format", "table", "output format: table or json")
+	planFile := fs.String("plan", "", "also write the plan, as JSON, to this file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("invalid --format %q: must be table or json", *format)
+	}
+	if *coldAfter < 0 {
+		return fmt.Errorf("invalid --cold-after-years %d: must not be negative", *coldAfter)
+	}
+	if conf.PriceTable == "" {
+		return fmt.Errorf("advise needs PRICE_TABLE")
+	}
+	prices, err := readPriceTable(conf.PriceTable)
+	if err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	filter := bson.M{}
+	if *agency != "" {
+		filter = splitAID(strings.ToLower(*agency), conf.AIDSeparator).filter()
+	}
+	stats, err := loadPlacementStats(ctx, db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl), filter)
+	if err != nil {
+		return err
+	}
+	plan := advise(prices, stats, time.Now(), *coldAfter, *minSavings)
+
+	b, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding plan:%w", err)
+	}
+	if *planFile != "" {
+		if err := ioutil.WriteFile(*planFile, append(b, '\n'), 0644); err != nil {
+			return fmt.Errorf("error writing plan(%s):%w", *planFile, err)
+		}
+	}
+	if *format == "json" {
+		_, err := fmt.Println(string(b))
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tYEARS\tFROM\tTO\tBYTES\tSAVES/MONTH\tCOSTS ONCE\tPAYBACK")
+	for _, a := range plan.Actions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s%.2f\t%s%.2f\t%.1f months\n", a.Kind, a.years(), a.From, a.To, a.Bytes, plan.Currency, a.MonthlySavings, plan.Currency, a.MigrationCost, a.PaybackMonths)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, a := range plan.Actions {
+		fmt.Printf("Moving %s from %s to %s saves %s%.2f/month\n", a.years(), a.From, a.To, plan.Currency, a.MonthlySavings)
+	}
+	fmt.Printf("Storage costs %s%.2f/month, %s%.2f/month with every action taken\n", plan.Currency, plan.MonthlyCost, plan.Currency, plan.MonthlyCostAfter)
+	if len(plan.Unpriced) > 0 {
+		fmt.Printf("Not in the price table, left out: %s\n", strings.Join(plan.Unpriced, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ageRecipient is the X25519 public key of an age recipient, decrypting
+// with "age -d -i <identity>".
+type ageRecipient []byte
+
+const ageChunkSize = 64 << 10
+
+// bech32Charset maps 5-bit values to the characters of bech32 strings.
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32Decode returns the human readable part and the data of s, which is
+// checked against its checksum.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s {
+		return "", nil, fmt.Errorf("must be lower case")
+	}
+	sep := strings.LastIndex(s, "1")
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, fmt.Errorf("invalid separator position")
+	}
+	hrp := s[:sep]
+	var data []byte
+	for _, c := range s[sep+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			return "", nil, fmt.Errorf("invalid character %q", c)
+		}
+		data = append(data, byte(i))
+	}
+	var values []byte
+	for _, c := range hrp {
+		values = append(values, byte(c>>5))
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, byte(c&31))
+	}
+	if bech32Polymod(append(values, data...)) != 1 {
+		return "", nil, fmt.Errorf("invalid checksum")
+	}
+	// regrouping the 5-bit values, checksum left out, into bytes.
+	var out []byte
+	acc, bits := uint32(0), uint(0)
+	for _, v := range data[:len(data)-6] {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return "", nil, fmt.Errorf("invalid padding")
+	}
+	return hrp, out, nil
+}
+
+// parseAgeRecipient reads an age X25519 recipient, as printed by age-keygen
+// (age1...).
+func parseAgeRecipient(s string) (ageRecipient, error) {
+	hrp, key, err := bech32Decode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient %q:%w", s, err)
+	}
+	if hrp != "age" || len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid age recipient %q: not an X25519 recipient", s)
+	}
+	return ageRecipient(key), nil
+}
+
+func ageHKDF(secret, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ageStanza wraps fileKey for r, returning the stanza of the header.
+func ageStanza(r ageRecipient, fileKey []byte) (string, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return "", err
+	}
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	shared, err := curve25519.X25519(ephemeral, r)
+	if err != nil {
+		return "", err
+	}
+	key, err := ageHKDF(shared, append(append([]byte{}, share...), r...), "age-encryption.org/v1/X25519")
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return "", err
+	}
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+	// the 32 bytes body fits in one line of at most 64 columns.
+	return fmt.Sprintf("-> X25519 %s\n%s\n", base64.RawStdEncoding.EncodeToString(share), base64.RawStdEncoding.EncodeToString(body)), nil
+}
+
+// ageEncrypt encrypts content for recipients in the age v1 format
+// (https://age-encryption.org/v1), any of them being able to decrypt it.
+func ageEncrypt(content []byte, recipients []ageRecipient) ([]byte, error) {
+	fileKey := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, fmt.Errorf("error generating age file key:%w", err)
+	}
+	var out bytes.Buffer
+	out.WriteString("age-encryption.org/v1\n")
+	for _, r := range recipients {
+		s, err := ageStanza(r, fileKey)
+		if err != nil {
+			return nil, fmt.Errorf("error wrapping age file key:%w", err)
+		}
+		out.WriteString(s)
+	}
+	out.WriteString("---")
+	macKey, err := ageHKDF(fileKey, nil, "header")
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(out.Bytes())
+	fmt.Fprintf(&out, " %s\n", base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating age nonce:%w", err)
+	}
+	out.Write(nonce)
+	payloadKey, err := ageHKDF(fileKey, nonce, "payload")
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(payloadKey)
+	if err != nil {
+		return nil, err
+	}
+	// STREAM: chunk nonces are an 11 bytes big endian counter and a byte
+	// set on the last chunk, which is only empty for empty content.
+	chunkNonce := make([]byte, chacha20poly1305.NonceSize)
+	for {
+		n := len(content)
+		if n > ageChunkSize {
+			n = ageChunkSize
+		}
+		chunk, rest := content[:n], content[n:]
+		if len(rest) == 0 {
+			chunkNonce[len(chunkNonce)-1] = 1
+		}
+		out.Write(aead.Seal(nil, chunkNonce, chunk, nil))
+		if len(rest) == 0 {
+			break
+		}
+		content = rest
+		for j := len(chunkNonce) - 2; j >= 0; j-- {
+			chunkNonce[j]++
+			if chunkNonce[j] != 0 {
+				break
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
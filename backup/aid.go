@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// agencyID identifies an agency. Composite identifiers (e.g. mpf/prr1, a
+// regional office of a federal agency) have a parent agency and a
+// sub-agency.
+type agencyID struct {
+	AID string `bson:"aid"`
+	Sub string `bson:"sub_aid,omitempty"`
+}
+
+// splitAID parses aid as <agency><sep><sub-agency>. An empty separator
+// disables composite identifiers.
+func splitAID(aid, sep string) agencyID {
+	if sep == "" {
+		return agencyID{AID: aid}
+	}
+	if i := strings.Index(aid, sep); i >= 0 {
+		return agencyID{AID: aid[:i], Sub: aid[i+len(sep):]}
+	}
+	return agencyID{AID: aid}
+}
+
+// prefix is the object name prefix of the agency's backups, sub-agencies
+// being nested under their parent.
+func (a agencyID) prefix() string {
+	if a.Sub == "" {
+		return a.AID
+	}
+	return a.AID + "/" + a.Sub
+}
+
+func (a agencyID) String() string {
+	return a.prefix()
+}
+
+// filter matches the records of exactly this agency, so a parent agency
+// doesn't match the records of its sub-agencies.
+func (a agencyID) filter() bson.M {
+	if a.Sub == "" {
+		return bson.M{"aid": a.AID, "sub_aid": bson.M{"$exists": false}}
+	}
+	return bson.M{"aid": a.AID, "sub_aid": a.Sub}
+}
@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// recordNote is an operator's note on a backup record, e.g. why a month was
+// collected again.
+type recordNote struct {
+	Time   time.Time `bson:"time" json:"time"`
+	Author string    `bson:"author,omitempty" json:"author,omitempty"`
+	Text   string    `bson:"text" json:"text"`
+}
+
+// annotateCmd appends a note to one version of a month's backup record or,
+// without --note, prints its notes.
+func annotateCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("annotate", flag.ContinueOnError)
+	m := monthFlags(fs, conf)
+	version := fs.String("version", "latest", "version to annotate: latest or v1, v2, ...")
+	note := fs.String("note", "", "text of the note")
+	author := fs.String("author", os.Getenv("USER"), "who is writing the note")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *note != "" {
+		if err := checkWritable(conf.ReadOnly, "annotate backup records"); err != nil {
+			return err
+		}
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+	coll := mdb.Collection(conf.MongoBackupColl)
+
+	recs, err := findVersions(ctx, coll, m.aid(), m.year, m.month)
+	if err != nil {
+		return err
+	}
+	rec, err := pickVersion(recs, *version)
+	if err != nil {
+		return fmt.Errorf("error picking version(%s, %d, %d):%w", m.aid(), m.year, m.month, err)
+	}
+	if *note == "" {
+		for _, n := range rec.Notes {
+			fmt.Printf("%s  %s  %s\n", n.Time.Format("2006-01-02T15:04:05Z"), n.Author, n.Text)
+		}
+		return nil
+	}
+
+	n := recordNote{Time: time.Now().UTC().Truncate(time.Millisecond), Author: *author, Text: *note}
+	if _, err := coll.UpdateByID(ctx, rec.ID, bson.M{"$push": bson.M{"notes": n}}); err != nil {
+		return fmt.Errorf("error annotating record(%s):%w", rec.ID.Hex(), err)
+	}
+	if conf.ChainLog {
+		if err := appendChain(ctx, mdb.Collection(conf.MongoChainColl), coll, rec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
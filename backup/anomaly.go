@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sizeHistoryLen is how many of the agency's latest records are used to
+// compute its typical backup size.
+const sizeHistoryLen = 24
+
+// medianBackupSize returns the median total_bytes of the latest records of
+// the agency, or zero if there is no history.
+func medianBackupSize(ctx context.Context, coll *mongo.Collection, aid agencyID) (int64, error) {
+	filter := aid.filter()
+	filter["total_bytes"] = bson.M{"$gt": 0}
+	cur, err := coll.Find(ctx, filter,
+		options.Find().
+			SetSort(bson.M{"_id": -1}).
+			SetLimit(sizeHistoryLen).
+			SetProjection(bson.M{"total_bytes": 1}))
+	if err != nil {
+		return 0, fmt.Errorf("error querying backup sizes(%s):%w", aid, err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return 0, fmt.Errorf("error decoding backup sizes(%s):%w", aid, err)
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	sizes := make([]int64, len(recs))
+	for i, r := range recs {
+		sizes[i] = r.TotalBytes
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	n := len(sizes)
+	if n%2 == 1 {
+		return sizes[n/2], nil
+	}
+	return (sizes[n/2-1] + sizes[n/2]) / 2, nil
+}
+
+// sizeAnomaly describes how total deviates from median when it is at least
+// factor times bigger or smaller, or returns an empty string otherwise.
+func sizeAnomaly(total, median int64, factor float64) string {
+	if factor <= 0 || median <= 0 {
+		return ""
+	}
+	switch ratio := float64(total) / float64(median); {
+	case ratio >= factor:
+		return fmt.Sprintf("%d bytes is %.1fx the historical median of %d bytes", total, ratio, median)
+	case ratio <= 1/factor:
+		return fmt.Sprintf("%d bytes is %.1fx smaller than the historical median of %d bytes", total, 1/ratio, median)
+	}
+	return ""
+}
@@ -0,0 +1,260 @@
+// Package backup is the salvador-backups stage as a library: the files of a
+// collection are uploaded to the configured storage backends and a Record
+// of the backup is written to the metadata sink. The salvador-backups
+// command is a thin wrapper around Main.
+//
+// Programs embedding it load a Config with LoadConfig (or fill one in),
+// call Setup once and then Run. Storage backends and metadata stores not
+// built in are plugged in with RegisterBackend and RegisterMetadataStore,
+// before Setup.
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// readConfig reads the configuration from the environment, reading it again
+// when CONFIG_OVERLAY_DIR has an overlay for the agency.
+func readConfig() (Config, error) {
+	var conf Config
+	if err := envconfig.Process("", &conf); err != nil {
+		return conf, fmt.Errorf("error loading config values from .env:%w", err)
+	}
+	if conf.ConfigOverlayDir == "" {
+		return aliasMetadataSink(conf), nil
+	}
+	applied, err := applyOverlay(conf.ConfigOverlayDir, splitAID(strings.ToLower(conf.AID), conf.AIDSeparator))
+	if err != nil {
+		return conf, fmt.Errorf("error loading config overlay:%w", err)
+	}
+	if applied {
+		conf = Config{}
+		if err := envconfig.Process("", &conf); err != nil {
+			return conf, fmt.Errorf("error loading config values from overlay:%w", err)
+		}
+	}
+	return aliasMetadataSink(conf), nil
+}
+
+// aliasMetadataSink makes METADATA_BACKEND, or else METADATA_STORE, the
+// METADATA_SINK of conf when the latter isn't set.
+func aliasMetadataSink(conf Config) Config {
+	if _, ok := os.LookupEnv("METADATA_SINK"); ok {
+		return conf
+	}
+	switch {
+	case conf.MetadataBackend != "":
+		conf.MetadataSink = conf.MetadataBackend
+	case conf.MetadataStore != "":
+		conf.MetadataSink = conf.MetadataStore
+	}
+	return conf
+}
+
+// LoadConfig reads the configuration from the environment, as the command
+// does, and validates it.
+func LoadConfig() (Config, error) {
+	conf, err := readConfig()
+	if err != nil {
+		return conf, err
+	}
+	conf.AID = strings.ToLower(conf.AID)
+	if problems := configProblems(conf); len(problems) > 0 {
+		return conf, fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return conf, nil
+}
+
+var setupDone bool
+
+// Setup applies the process wide settings of conf: logging, the proxy, the
+// memory and upload rate limits and the work dir. Run calls it with its
+// config if it wasn't called before.
+func Setup(conf Config) error {
+	if err := setupLogging(conf); err != nil {
+		return fmt.Errorf("invalid logging configuration:%w", err)
+	}
+	retryJitter = conf.RetryJitter
+	if err := setupProxy(conf); err != nil {
+		return fmt.Errorf("invalid ALL_PROXY:%w", err)
+	}
+	buffers = newBufferPool(conf.MaxMemoryMB << 20)
+	warnings = newWarner(conf)
+	uploads = newByteLimiter(float64(conf.MaxUploadRate))
+	if err := setupWorkDir(conf.WorkDir, conf.WorkDirStaleAfter); err != nil {
+		return err
+	}
+	setupDone = true
+	return nil
+}
+
+// Run backs up the files of paths (globs and directories are expanded as
+// with INPUT_EXCLUDE and INPUT_FOLLOW_SYMLINKS) as configured by conf,
+// storing the records in METADATA_SINK. Records aren't printed: with the
+// stdout sink they are only returned in the Result.
+//
+// Runs share process wide state, so calls must not overlap.
+func Run(ctx context.Context, conf Config, paths []string) (Result, error) {
+	if !setupDone {
+		if err := Setup(conf); err != nil {
+			return Result{}, err
+		}
+	}
+	if problems := append(configProblems(conf), runProblems(conf)...); len(problems) > 0 {
+		return Result{}, fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	paths, err := expandPaths(paths, conf.InputExclude, conf.InputFollowSymlinks)
+	if err != nil {
+		return Result{}, err
+	}
+	flagged, err := applyContentTypePolicy(conf, paths)
+	if err != nil {
+		return Result{}, err
+	}
+	recs, err := run(ctx, conf, paths, flagged, nil, nil)
+	notifyBackup(ctx, conf, paths, recs, err)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := storeRecords(ctx, conf, recs); err != nil {
+		return Result{}, err
+	}
+	return buildResult(conf, paths, recs)
+}
+
+// Backend is a storage backend plugged in with RegisterBackend. Its methods
+// are those the stage calls on the built in ones.
+type Backend interface {
+	// Backup uploads every file as the object of the same index in names,
+	// returning their URLs and how each one was stored. On failure, those
+	// of the files uploaded before it are returned with the error.
+	Backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error)
+	// Upload stores the content of r as the object name.
+	Upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error)
+	// Digest downloads the object of b, returning its SHA-256 and size.
+	Digest(ctx context.Context, b storage.Backup) (string, int64, error)
+	// Ping checks the backend is reachable, without writing to it.
+	Ping(ctx context.Context) error
+	// Discard deletes the object of b, stored as f by Backup.
+	Discard(ctx context.Context, b storage.Backup, f FileEntry) error
+}
+
+// MetadataStore is a metadata sink plugged in with RegisterMetadataStore.
+// As with the file and postgres sinks, records are written once the run
+// succeeded and mongo only features can't be used with it.
+type MetadataStore interface {
+	// WriteRecords stores the records of a run.
+	WriteRecords(ctx context.Context, recs []Record) error
+}
+
+var (
+	registryMu         sync.RWMutex
+	registeredBackends = map[string]Backend{}
+	registeredStores   = map[string]MetadataStore{}
+)
+
+// RegisterBackend makes b usable as name in STORAGE_BACKEND and
+// MIRROR_BACKENDS. It panics if name is already taken.
+func RegisterBackend(name string, b Backend) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	switch name {
+	case backendSwift, backendS3, backendAzure, backendGCS, backendLocal:
+		panic(fmt.Sprintf("backup: backend %q is built in", name))
+	}
+	if _, ok := registeredBackends[name]; ok {
+		panic(fmt.Sprintf("backup: backend %q registered twice", name))
+	}
+	registeredBackends[name] = b
+}
+
+// RegisterMetadataStore makes s usable as name in METADATA_SINK. It panics
+// if name is already taken.
+func RegisterMetadataStore(name string, s MetadataStore) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	switch name {
+	case sinkMongo, sinkStdout, sinkFile, sinkPostgres, sinkNone:
+		panic(fmt.Sprintf("backup: metadata sink %q is built in", name))
+	}
+	if _, ok := registeredStores[name]; ok {
+		panic(fmt.Sprintf("backup: metadata sink %q registered twice", name))
+	}
+	registeredStores[name] = s
+}
+
+func registeredBackend(name string) (Backend, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	b, ok := registeredBackends[name]
+	return b, ok
+}
+
+func registeredStore(name string) (MetadataStore, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	s, ok := registeredStores[name]
+	return s, ok
+}
+
+// pluggedBackend adapts a registered Backend to the stage.
+type pluggedBackend struct {
+	Backend
+}
+
+func (p pluggedBackend) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	return p.Backup(ctx, paths, names)
+}
+
+func (p pluggedBackend) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	return p.Upload(ctx, name, r)
+}
+
+func (p pluggedBackend) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	return p.Digest(ctx, b)
+}
+
+func (p pluggedBackend) ping(ctx context.Context) error {
+	return p.Ping(ctx)
+}
+
+func (p pluggedBackend) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	return p.Discard(ctx, b, f)
+}
+
+// canary uploads, reads back and deletes a tiny object.
+func (p pluggedBackend) canary(ctx context.Context, runID string) error {
+	content := "salvador-backups canary " + time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := p.Upload(ctx, ".canary/"+runID, strings.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("error running canary:%w", err)
+	}
+	sum, size, err := p.Digest(ctx, b)
+	if err == nil && (size != int64(len(content)) || sum != sha256Hex(content)) {
+		err = errors.New("object read back with different content")
+	}
+	if dErr := p.Discard(ctx, b, FileEntry{}); err == nil && dErr != nil {
+		err = dErr
+	}
+	if err != nil {
+		return fmt.Errorf("error running canary:%w", err)
+	}
+	return nil
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
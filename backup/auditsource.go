@@ -0,0 +1,175 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+)
+
+const sourceTimeout = 5 * time.Minute
+
+// readSources parses the file names to source URLs list recorded by the
+// crawler: one "<file name> <url>" pair per line, # starting comments.
+// Names are matched against the restored path or, without a /, the base
+// name of backed up files.
+func readSources(r io.Reader) (map[string]string, error) {
+	sources := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected <file name> <url>", n)
+		}
+		sources[fields[0]] = fields[1]
+	}
+	return sources, s.Err()
+}
+
+// sourceDigest downloads url and returns the SHA-256 of its content.
+func sourceDigest(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sourceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request(%s):%w", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading source(%s):%w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("error downloading source(%s): status %s", url, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := buffers.copy(ctx, h, resp.Body); err != nil {
+		return "", fmt.Errorf("error downloading source(%s):%w", url, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// auditSourceCmd is an experimental check of a backup against what the
+// agency publishes now: a sample of its files is downloaded again from the
+// source URLs recorded by the crawler (--sources) and compared with the
+// stored copies. Drift is evidence the agency altered published files.
+func auditSourceCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("audit-source", flag.ContinueOnError)
+	m := monthFlags(fs, conf)
+	version := fs.String("version", "latest", "version to audit: latest or v1, v2, ...")
+	sourcesFile := fs.String("sources", "", "file with the source URL of every file, as \"<file name> <url>\" lines")
+	sample := fs.Int("sample", 5, "number of files checked, picked at random (0 checks every file)")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "seed of the sample, to repeat an audit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *sourcesFile == "" {
+		return fmt.Errorf("usage: audit-source --sources <file> [--aid X --year Y --month M]")
+	}
+	f, err := os.Open(*sourcesFile)
+	if err != nil {
+		return fmt.Errorf("error opening sources(%s):%w", *sourcesFile, err)
+	}
+	sources, err := readSources(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error reading sources(%s):%w", *sourcesFile, err)
+	}
+
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+	recs, err := findVersions(ctx, coll, m.aid(), m.year, m.month)
+	if err != nil {
+		return err
+	}
+	rec, err := pickVersion(recs, *version)
+	if err != nil {
+		return fmt.Errorf("error picking version(%s, %d, %d):%w", m.aid(), m.year, m.month, err)
+	}
+
+	cloud := newSwiftClient(conf)
+	// encrypted files are compared by the digest recorded before their
+	// encryption, the stored one being of the encrypted content.
+	type audited struct{ rel, stored, sha256, source string }
+	var files []audited
+	for i, b := range rec.Backups {
+		_, name, err := cloud.objectPath(ctx, b.URL)
+		if err != nil {
+			return err
+		}
+		if len(rec.Files) == len(rec.Backups) {
+			name = rec.Files[i].originalName()
+		}
+		rel := restorePath(rec.objectPrefix(), name)
+		src, ok := sources[rel]
+		if !ok {
+			src, ok = sources[path.Base(rel)]
+		}
+		if ok {
+			a := audited{rel: rel, stored: b.URL, source: src}
+			if len(rec.Files) == len(rec.Backups) && rec.Files[i].Encryption != nil {
+				a.sha256 = rec.Files[i].SHA256
+			}
+			files = append(files, a)
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no backed up file of %s has a source URL in %s", rec.ID.Hex(), *sourcesFile)
+	}
+	if *sample > 0 && *sample < len(files) {
+		r := rand.New(rand.NewSource(*seed))
+		r.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		files = files[:*sample]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSTATUS\tSOURCE")
+	drifted, failed := 0, 0
+	for _, a := range files {
+		status := "same"
+		stored := a.sha256
+		if stored == "" {
+			if stored, _, err = cloud.digest(ctx, storage.Backup{URL: a.stored}); err != nil {
+				return err
+			}
+		}
+		switch got, err := sourceDigest(ctx, a.source); {
+		case err != nil:
+			failed++
+			status = "unreachable: " + err.Error()
+		case got != stored:
+			drifted++
+			status = fmt.Sprintf("DRIFT: stored sha256 %s, source sha256 %s", stored, got)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.rel, status, a.source)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Audited %d of %d files of record %s (seed %d)", len(files), len(rec.Backups), rec.ID.Hex(), *seed)
+	if drifted > 0 || failed > 0 {
+		return fmt.Errorf("%d file(s) drifted from the source and %d could not be downloaded", drifted, failed)
+	}
+	return nil
+}
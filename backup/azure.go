@@ -0,0 +1,447 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/dadosjusbr/storage"
+)
+
+// azureBlockSize is the size of the blocks blobs are uploaded in, each
+// one held in memory while staged.
+const azureBlockSize = 8 << 20
+
+// azureClient stores the files of the stage in a container of Azure Blob
+// Storage.
+type azureClient struct {
+	container azblob.ContainerURL
+	// base is the URL of the container, without the SAS token.
+	base       string
+	name       string
+	readOnly   bool
+	attempts   int
+	retryDelay time.Duration
+	timeout    time.Duration
+}
+
+// azureAccount is where and how to reach the storage account.
+type azureAccount struct {
+	endpoint string
+	cred     azblob.Credential
+	sas      string
+}
+
+// azureCredentials reads the account from AZURE_STORAGE_CONNECTION_STRING
+// or, without it, from AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY or
+// AZURE_STORAGE_SAS_TOKEN, as the az CLI does. endpoint, when set,
+// overrides the account's blob endpoint (e.g. of Azurite). With
+// managedIdentity, or no key nor SAS token, requests are authorized with
+// tokens of the identity of the host, see azureIdentityToken.
+func azureCredentials(endpoint string, managedIdentity bool) (azureAccount, error) {
+	vars := map[string]string{
+		"AccountName":           os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		"AccountKey":            os.Getenv("AZURE_STORAGE_KEY"),
+		"SharedAccessSignature": os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+	}
+	if cs := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); cs != "" {
+		vars = map[string]string{}
+		for _, kv := range strings.Split(cs, ";") {
+			if i := strings.Index(kv, "="); i > 0 {
+				vars[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+			}
+		}
+	}
+	account := vars["AccountName"]
+	if account == "" {
+		return azureAccount{}, fmt.Errorf("no storage account: set AZURE_STORAGE_CONNECTION_STRING or AZURE_STORAGE_ACCOUNT")
+	}
+	if endpoint == "" {
+		endpoint = vars["BlobEndpoint"]
+	}
+	if endpoint == "" {
+		protocol, suffix := vars["DefaultEndpointsProtocol"], vars["EndpointSuffix"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, account, suffix)
+	}
+	a := azureAccount{endpoint: strings.TrimRight(endpoint, "/"), sas: strings.TrimPrefix(vars["SharedAccessSignature"], "?")}
+	switch {
+	case managedIdentity:
+		cred, err := azureTokenCredential()
+		if err != nil {
+			return azureAccount{}, fmt.Errorf("error authenticating to storage account %s with a managed identity:%w", account, err)
+		}
+		a.cred, a.sas = cred, ""
+	case vars["AccountKey"] != "":
+		cred, err := azblob.NewSharedKeyCredential(account, vars["AccountKey"])
+		if err != nil {
+			return azureAccount{}, fmt.Errorf("invalid key of storage account %s:%w", account, err)
+		}
+		a.cred = cred
+	case a.sas != "":
+		a.cred = azblob.NewAnonymousCredential()
+	default:
+		cred, err := azureTokenCredential()
+		if err != nil {
+			return azureAccount{}, fmt.Errorf("no credentials for storage account %s: set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN, or run with a managed identity (%v)", account, err)
+		}
+		a.cred = cred
+	}
+	return a, nil
+}
+
+// Where azureIdentityToken gets tokens for Blob Storage from.
+const (
+	azureStorageResource = "https://storage.azure.com/"
+	azureIMDSEndpoint    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureAuthorityHost   = "https://login.microsoftonline.com/"
+	azureTokenTimeout    = 10 * time.Second
+)
+
+// azureToken is the answer of the token endpoints, expires_in being a
+// string in those of managed identities and a number in Azure AD's.
+type azureToken struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// azureIdentityToken gets a token for Blob Storage of the identity of the
+// host: the AKS workload identity of AZURE_FEDERATED_TOKEN_FILE, the
+// managed identity of App Service (IDENTITY_ENDPOINT) or that of the
+// instance metadata service, AZURE_CLIENT_ID picking a user-assigned one.
+// It returns the token and how long it is valid for.
+func azureIdentityToken(ctx context.Context) (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, azureTokenTimeout)
+	defer cancel()
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	var req *http.Request
+	var err error
+	switch {
+	case os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+		assertion, rErr := os.ReadFile(os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+		if rErr != nil {
+			return "", 0, fmt.Errorf("error reading federated token:%w", rErr)
+		}
+		authority := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authority == "" {
+			authority = azureAuthorityHost
+		}
+		form := url.Values{
+			"client_id":             {clientID},
+			"scope":                 {azureStorageResource + ".default"},
+			"grant_type":            {"client_credentials"},
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+		}
+		u := strings.TrimRight(authority, "/") + "/" + os.Getenv("AZURE_TENANT_ID") + "/oauth2/v2.0/token"
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	case os.Getenv("IDENTITY_ENDPOINT") != "":
+		q := url.Values{"api-version": {"2019-08-01"}, "resource": {azureStorageResource}}
+		if clientID != "" {
+			q.Set("client_id", clientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("IDENTITY_ENDPOINT")+"?"+q.Encode(), nil)
+		if err == nil {
+			req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+		}
+	default:
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {azureStorageResource}}
+		if clientID != "" {
+			q.Set("client_id", clientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, azureIMDSEndpoint+"?"+q.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating token request:%w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("error requesting token(%s):%w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", 0, fmt.Errorf("error requesting token(%s): %s: %s", req.URL.Host, resp.Status, bytes.TrimSpace(body))
+	}
+	var tok azureToken
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", 0, fmt.Errorf("error decoding token(%s):%w", req.URL.Host, err)
+	}
+	secs, err := strconv.Atoi(tok.ExpiresIn.String())
+	if err != nil || tok.AccessToken == "" {
+		return "", 0, fmt.Errorf("invalid token from %s", req.URL.Host)
+	}
+	return tok.AccessToken, time.Duration(secs) * time.Second, nil
+}
+
+// azureTokenCredential authorizes requests with tokens of
+// azureIdentityToken, renewed five minutes before they expire. A failed
+// renewal is a warning, tried again in a minute while the token lasts.
+func azureTokenCredential() (azblob.TokenCredential, error) {
+	token, ttl, err := azureIdentityToken(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	// the refresher is first called right away, with the token just got.
+	fresh := true
+	return azblob.NewTokenCredential(token, func(cred azblob.TokenCredential) time.Duration {
+		if !fresh {
+			var err error
+			if token, ttl, err = azureIdentityToken(context.Background()); err != nil {
+				warnings.warnf(warnBackend, "error renewing azure token:%v", err)
+				return time.Minute
+			}
+			cred.SetToken(token)
+		}
+		fresh = false
+		if ttl > 10*time.Minute {
+			return ttl - 5*time.Minute
+		}
+		return ttl / 2
+	}), nil
+}
+
+// azureSender sends the requests of the pipeline through client, as the
+// default sender does through its own.
+func azureSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			resp, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(resp), err
+		}
+	})
+}
+
+func newAzureClient(conf Config) (*azureClient, error) {
+	account, err := azureCredentials(conf.AzureEndpoint, conf.AzureManagedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(account.endpoint + "/" + conf.AzureContainer)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing azure endpoint(%s):%w", account.endpoint, err)
+	}
+	base := u.String()
+	u.RawQuery = account.sas
+	p := azblob.NewPipeline(account.cred, azblob.PipelineOptions{HTTPSender: azureSender(&http.Client{Transport: countingTransport()})})
+	return &azureClient{
+		container:  azblob.NewContainerURL(*u, p),
+		base:       base,
+		name:       conf.AzureContainer,
+		readOnly:   conf.ReadOnly,
+		attempts:   conf.UploadAttempts,
+		retryDelay: conf.UploadRetryDelay,
+		timeout:    conf.UploadTimeout,
+	}, nil
+}
+
+func (c *azureClient) objectURL(name string) string {
+	return c.base + "/" + name
+}
+
+func (c *azureClient) blobName(u string) string {
+	return strings.TrimPrefix(u, c.objectURL(""))
+}
+
+// put uploads r as the blob name in blocks, each one sent with its MD5 for
+// the service to reject it if corrupted in transit, the MD5 of the whole
+// content being stored as the Content-MD5 of the blob. It is also the hash
+// of the returned backup, as Swift's ETag is.
+func (c *azureClient) put(ctx context.Context, name string, r io.Reader, sum io.Writer) (storage.Backup, int64, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, 0, err
+	}
+	blob := c.container.NewBlockBlobURL(name)
+	r = throttledUpload(ctx, r)
+	whole := md5.New()
+	var ids []string
+	var n int64
+	buf := make([]byte, azureBlockSize)
+	for {
+		m, rErr := io.ReadFull(r, buf)
+		if m > 0 {
+			block := buf[:m]
+			whole.Write(block)
+			if sum != nil {
+				sum.Write(block)
+			}
+			blockSum := md5.Sum(block)
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+			if _, err := blob.StageBlock(ctx, id, bytes.NewReader(block), azblob.LeaseAccessConditions{}, blockSum[:], azblob.ClientProvidedKeyOptions{}); err != nil {
+				return storage.Backup{}, 0, fmt.Errorf("error uploading object(%s/%s):%w", c.name, name, err)
+			}
+			ids = append(ids, id)
+			n += int64(m)
+		}
+		if rErr == io.EOF || rErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rErr != nil {
+			return storage.Backup{}, 0, fmt.Errorf("error uploading object(%s/%s):%w", c.name, name, rErr)
+		}
+	}
+	h := azblob.BlobHTTPHeaders{ContentMD5: whole.Sum(nil)}
+	if _, err := blob.CommitBlockList(ctx, ids, h, azblob.Metadata{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}); err != nil {
+		return storage.Backup{}, 0, fmt.Errorf("error uploading object(%s/%s):%w", c.name, name, err)
+	}
+	return storage.Backup{URL: c.objectURL(name), Hash: hex.EncodeToString(h.ContentMD5)}, n, nil
+}
+
+func (c *azureClient) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	b, _, err := c.put(ctx, name, r, nil)
+	return b, err
+}
+
+func (c *azureClient) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for i, p := range paths {
+		b, f, err := retryUpload(ctx, c.attempts, c.retryDelay, c.timeout, names[i], func(ctx context.Context) (storage.Backup, FileEntry, error) {
+			return c.uploadFile(ctx, p, names[i])
+		})
+		if err != nil {
+			return backups, files, err
+		}
+		backups = append(backups, b)
+		files = append(files, f)
+	}
+	return backups, files, nil
+}
+
+func (c *azureClient) uploadFile(ctx context.Context, path, name string) (storage.Backup, FileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	entry := FileEntry{Name: name, Container: c.name, Bytes: fi.Size(), Backend: backendAzure}
+	sum := newDigestWriter()
+	b, _, err := c.put(ctx, name, f, sum)
+	if err == nil {
+		entry.SHA256, err = sum.check(path, entry.Bytes)
+	}
+	return b, entry, err
+}
+
+// discard deletes the blob f was stored as.
+func (c *azureClient) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	if err := checkWritable(c.readOnly, "delete "+f.Name); err != nil {
+		return err
+	}
+	if _, err := c.container.NewBlobURL(f.Name).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{}); err != nil {
+		return fmt.Errorf("error deleting object(%s/%s):%w", c.name, f.Name, err)
+	}
+	return nil
+}
+
+// digest returns the SHA-256 and size of the blob of b, checking its
+// content against the Content-MD5 stored with it.
+func (c *azureClient) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	name := c.blobName(b.URL)
+	resp, err := c.container.NewBlobURL(name).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("error downloading object(%s/%s):%w", c.name, name, err)
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	w := newDigestWriter()
+	h := md5.New()
+	if _, err := buffers.copy(ctx, io.MultiWriter(w, h), body); err != nil {
+		return "", 0, fmt.Errorf("error downloading object(%s/%s):%w", c.name, name, err)
+	}
+	if want := resp.ContentMD5(); len(want) > 0 && !bytes.Equal(h.Sum(nil), want) {
+		return "", 0, fmt.Errorf("object %s/%s doesn't match its Content-MD5 %s", c.name, name, hex.EncodeToString(want))
+	}
+	return w.sum(), w.n, nil
+}
+
+// ping checks the container exists.
+func (c *azureClient) ping(ctx context.Context) error {
+	if _, err := c.container.GetProperties(ctx, azblob.LeaseAccessConditions{}); err != nil {
+		return fmt.Errorf("error reading container info(%s):%w (likely cause: %s)", c.name, err, diagnoseAzure(err, c.name))
+	}
+	return nil
+}
+
+// canary writes, reads back and deletes a tiny blob.
+func (c *azureClient) canary(ctx context.Context, runID string) error {
+	name := ".canary/" + runID
+	content := []byte("salvador-backups canary " + time.Now().UTC().Format(time.RFC3339Nano))
+	if _, err := c.upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseAzure(err, c.name))
+	}
+	blob := c.container.NewBlobURL(name)
+	var got []byte
+	resp, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err == nil {
+		body := resp.Body(azblob.RetryReaderOptions{})
+		got, err = io.ReadAll(body)
+		body.Close()
+	}
+	if _, rmErr := blob.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{}); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	if err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseAzure(err, c.name))
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("error running canary: object %s read back with different content", name)
+	}
+	return nil
+}
+
+// diagnoseAzure explains the likely cause of an Azure Blob Storage error.
+func diagnoseAzure(err error, container string) string {
+	var stgErr azblob.StorageError
+	if errors.As(err, &stgErr) {
+		switch stgErr.ServiceCode() {
+		case azblob.ServiceCodeAuthenticationFailed:
+			return "authentication failed (check AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN)"
+		case azblob.ServiceCodeContainerNotFound:
+			return fmt.Sprintf("container %s not found (check AZURE_CONTAINER and the storage account)", container)
+		case azblob.ServiceCodeMd5Mismatch:
+			return "corrupted in transit"
+		}
+		if resp := stgErr.Response(); resp != nil && resp.StatusCode == http.StatusForbidden {
+			return fmt.Sprintf("access denied (check the permissions on container %s)", container)
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network error (check connectivity to the storage account)"
+	}
+	return "unexpected error"
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// setEnv sets the variable name to value while the test runs, unsetting it
+// for an empty value.
+func setEnv(t *testing.T, name, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(name)
+	if value == "" {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, value)
+	}
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestAzureCredentialsManagedIdentity(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-IDENTITY-HEADER") != "secret" || r.URL.Query().Get("resource") != azureStorageResource || r.URL.Query().Get("client_id") != "user-assigned" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+	}))
+	defer srv.Close()
+	for _, name := range []string{"AZURE_STORAGE_CONNECTION_STRING", "AZURE_STORAGE_KEY", "AZURE_STORAGE_SAS_TOKEN", "AZURE_FEDERATED_TOKEN_FILE"} {
+		setEnv(t, name, "")
+	}
+	setEnv(t, "AZURE_STORAGE_ACCOUNT", "salvador")
+	setEnv(t, "IDENTITY_ENDPOINT", srv.URL)
+	setEnv(t, "IDENTITY_HEADER", "secret")
+	setEnv(t, "AZURE_CLIENT_ID", "user-assigned")
+
+	// without a key nor SAS token, and when asked to.
+	for _, managed := range []bool{false, true} {
+		a, err := azureCredentials("", managed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cred, ok := a.cred.(azblob.TokenCredential)
+		if !ok || cred.Token() != "token" {
+			t.Errorf("credential with AZURE_MANAGED_IDENTITY=%v is %T, want the token of the managed identity", managed, a.cred)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+)
+
+const (
+	backendSwift = "swift"
+	backendS3    = "s3"
+	backendLocal = "local"
+	backendAzure = "azure"
+	backendGCS   = "gcs"
+)
+
+// backuper is where the stage stores the files of a run.
+type backuper interface {
+	// backup uploads every file as the object of the same index in names,
+	// returning their URLs and how each one was stored. On failure, those
+	// of the files uploaded before it are returned with the error.
+	backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error)
+	// upload stores the content of r as the object name.
+	upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error)
+	// canary round trips a tiny object, explaining why it failed if it did.
+	canary(ctx context.Context, runID string) error
+	// digest downloads the object of b, returning its SHA-256 and size.
+	digest(ctx context.Context, b storage.Backup) (string, int64, error)
+	// ping checks the backend is reachable, without writing to it.
+	ping(ctx context.Context) error
+	// discard deletes the object of b, stored as f by backup.
+	discard(ctx context.Context, b storage.Backup, f FileEntry) error
+}
+
+// quotaChecker is implemented by backends with storage quotas.
+type quotaChecker interface {
+	// checkQuotas warns about the quotas near ratio of the places files
+	// were stored in.
+	checkQuotas(ctx context.Context, files []FileEntry, ratio float64) error
+}
+
+// newBackuper returns the STORAGE_BACKEND client, a balancer when more than
+// one backend is configured, wrapped in a mirror when MIRROR_BACKENDS is
+// set.
+func newBackuper(conf Config) (backuper, error) {
+	var backends []backuper
+	for _, name := range conf.StorageBackend {
+		b, err := newNamedBackuper(conf, name)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	primary := backends[0]
+	if len(backends) > 1 {
+		primary = newBalancer(conf.StorageBackend, backends, conf.BackendProbeInterval)
+	}
+	if len(conf.MirrorBackends) == 0 {
+		return primary, nil
+	}
+	var replicas []backuper
+	for _, name := range conf.MirrorBackends {
+		b, err := newNamedBackuper(conf, name)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, b)
+	}
+	return newMirror(primary, conf.MirrorBackends, replicas, conf.MirrorFailurePolicy), nil
+}
+
+func newNamedBackuper(conf Config, name string) (backuper, error) {
+	switch name {
+	case backendSwift:
+		return newSwiftClient(conf), nil
+	case backendS3:
+		return newS3Client(conf)
+	case backendLocal:
+		return newLocalClient(conf)
+	case backendAzure:
+		return newAzureClient(conf)
+	case backendGCS:
+		return newGCSClient(context.Background(), conf)
+	}
+	if b, ok := registeredBackend(name); ok {
+		return pluggedBackend{b}, nil
+	}
+	return nil, fmt.Errorf("unknown STORAGE_BACKEND %q: must be %q, %q, %q, %q or %q", name, backendSwift, backendS3, backendAzure, backendGCS, backendLocal)
+}
+
+// checkStorageBackend validates STORAGE_BACKEND against the features only
+// Swift has.
+func checkStorageBackend(conf Config) error {
+	if len(conf.StorageBackend) == 0 {
+		return fmt.Errorf("no backend set: must be %q, %q, %q, %q or %q", backendSwift, backendS3, backendAzure, backendGCS, backendLocal)
+	}
+	if err := checkBackendNames(conf, conf.StorageBackend); err != nil {
+		return err
+	}
+	if len(conf.StorageBackend) > 1 && conf.BackendProbeInterval <= 0 {
+		return fmt.Errorf("BACKEND_PROBE_INTERVAL must be positive with more than one backend")
+	}
+	return nil
+}
+
+// checkBackendNames checks names lists known backends, once each, that can
+// be used with conf.
+func checkBackendNames(conf Config, names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("%q is listed more than once", name)
+		}
+		seen[name] = true
+		switch name {
+		case backendSwift:
+			continue
+		case backendS3:
+			if conf.S3Bucket == "" {
+				return fmt.Errorf("%q needs S3_BUCKET", name)
+			}
+		case backendAzure:
+			if conf.AzureContainer == "" {
+				return fmt.Errorf("%q needs AZURE_CONTAINER", name)
+			}
+		case backendGCS:
+			if conf.GCSBucket == "" {
+				return fmt.Errorf("%q needs GCS_BUCKET", name)
+			}
+		case backendLocal:
+			if conf.LocalDir == "" {
+				return fmt.Errorf("%q needs LOCAL_DIR", name)
+			}
+		default:
+			if _, ok := registeredBackend(name); !ok {
+				return fmt.Errorf("%q must be %q, %q, %q, %q, %q or a registered backend", name, backendSwift, backendS3, backendAzure, backendGCS, backendLocal)
+			}
+		}
+		if len(conf.SizeTiers) > 0 {
+			return fmt.Errorf("%q can't be used with SIZE_TIERS", name)
+		}
+		if conf.ChunkContainer != "" {
+			return fmt.Errorf("%q can't be used with CHUNK_CONTAINER", name)
+		}
+		if conf.SegmentContainer != "" {
+			return fmt.Errorf("%q can't be used with SEGMENT_CONTAINER", name)
+		}
+	}
+	return nil
+}
+
+// verifyUploads downloads every backed up object, checking it has the
+// digest and size recorded in the entry of the same index, the encrypted
+// ones for encrypted files.
+func verifyUploads(ctx context.Context, cloud backuper, backups []storage.Backup, files []FileEntry) error {
+	for i, b := range backups {
+		sum, size, err := cloud.digest(ctx, b)
+		if err != nil {
+			return fmt.Errorf("error verifying upload(%s):%w", files[i].Name, err)
+		}
+		if size != files[i].Bytes {
+			return fmt.Errorf("uploaded object %s has %d bytes, expected %d", files[i].Name, size, files[i].Bytes)
+		}
+		want := files[i].SHA256
+		if files[i].Encryption != nil {
+			want = files[i].Encryption.SHA256
+		}
+		if sum != want {
+			return fmt.Errorf("uploaded object %s has sha256 %s, expected %s", files[i].Name, sum, want)
+		}
+	}
+	return nil
+}
+
+// errUploadTimeout fails upload attempts that took longer than
+// UPLOAD_TIMEOUT.
+var errUploadTimeout = errors.New("upload timed out")
+
+// retryUpload calls upload up to attempts times until it succeeds, waiting
+// delay (doubled every time) in between. Every attempt is canceled after
+// timeout, unless zero. Permanent errors (see classifyStorageError) aren't
+// retried. The attempts are kept in the returned entry.
+func retryUpload(ctx context.Context, attempts int, delay, timeout time.Duration, name string, upload func(ctx context.Context) (storage.Backup, FileEntry, error)) (storage.Backup, FileEntry, error) {
+	lastErr := ""
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		b, entry, err := upload(actx)
+		if err != nil && ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %s: %v", errUploadTimeout, timeout, err)
+		}
+		cancel()
+		entry.Attempts = attempt
+		entry.LastError = lastErr
+		if err == nil {
+			logs.debugf(name, time.Since(start), "Uploaded %s (%d bytes, %d attempts)", name, entry.Bytes, attempt)
+			uploadStats.uploaded(entry.Bytes, time.Since(start))
+			return b, entry, nil
+		}
+		uploadStats.failed()
+		class, reason := classifyStorageError(err)
+		err = &classifiedError{class: class, reason: reason, err: err}
+		if class == errClassPermanent {
+			return b, entry, fmt.Errorf("%w (after %d attempts, %s error: %s)", err, attempt, class, reason)
+		}
+		if attempt >= attempts {
+			return b, entry, fmt.Errorf("%w (after %d attempts)", err, attempt)
+		}
+		lastErr = err.Error()
+		wait := jittered(delay)
+		warnings.warnf(warnUploadRetry, "upload attempt %d/%d of %s failed with a %s error, retrying in %s: %v", attempt, attempts, name, class, wait, err)
+		select {
+		case <-ctx.Done():
+			return b, entry, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
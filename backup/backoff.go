@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// backoffState is how the latest runs of an agency failed uploading, kept
+// with BACKOFF_STATE so a run retried by the orchestrator doesn't hit the
+// provider's rate limit again right away.
+type backoffState struct {
+	// Key is the agency, as in its object names.
+	Key    string `bson:"_id"`
+	Class  string `bson:"class"`
+	Reason string `bson:"reason,omitempty"`
+	// Throttled tells the provider throttled the run, the next one waiting
+	// until Until before uploading.
+	Throttled bool      `bson:"throttled"`
+	Until     time.Time `bson:"until,omitempty"`
+	// Delay is the backoff reached, doubled by every failed run.
+	Delay     time.Duration `bson:"delay"`
+	Failures  int           `bson:"failures"`
+	UpdatedAt time.Time     `bson:"updated_at"`
+}
+
+func loadBackoff(ctx context.Context, coll *mongo.Collection, key string) (*backoffState, error) {
+	var s backoffState
+	err := coll.FindOne(ctx, bson.M{"_id": key}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading backoff state(%s):%w", key, err)
+	}
+	return &s, nil
+}
+
+// pace waits for the backoff of a throttled previous run to be over, and
+// makes the upload retries of conf start from its delay.
+func (s *backoffState) pace(ctx context.Context, conf *Config) error {
+	if s == nil || !s.Throttled {
+		return nil
+	}
+	if s.Delay > conf.UploadRetryDelay {
+		conf.UploadRetryDelay = s.Delay
+	}
+	wait := time.Until(s.Until)
+	if wait <= 0 {
+		return nil
+	}
+	log.Printf("Previous run was throttled by the storage provider, waiting %s before uploading", wait.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+	}
+	return nil
+}
+
+// saveBackoff updates the backoff state of key, prev, after a run that
+// ended with runErr: cleared on success, backed off further when it failed
+// with a retryable storage error. Other failures leave it as it was.
+func saveBackoff(ctx context.Context, coll *mongo.Collection, key string, prev *backoffState, runErr error, conf Config) error {
+	if runErr == nil {
+		if prev == nil {
+			return nil
+		}
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+			return fmt.Errorf("error clearing backoff state(%s):%w", key, err)
+		}
+		return nil
+	}
+	var ce *classifiedError
+	if !errors.As(runErr, &ce) || ce.class != errClassRetryable {
+		return nil
+	}
+	s := backoffState{Key: key, Class: ce.class, Reason: ce.reason, Delay: conf.UploadRetryDelay, Failures: 1, UpdatedAt: time.Now().UTC()}
+	if prev != nil {
+		s.Failures = prev.Failures + 1
+		if d := prev.Delay * 2; d > s.Delay {
+			s.Delay = d
+		}
+	}
+	if s.Delay > conf.BackoffMax {
+		s.Delay = conf.BackoffMax
+	}
+	// S3 says SlowDown.
+	s.Throttled = ce.reason == "throttled" || ce.reason == "SlowDown"
+	if s.Throttled {
+		s.Until = s.UpdatedAt.Add(s.Delay)
+	}
+	if _, err := coll.ReplaceOne(ctx, bson.M{"_id": key}, s, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("error saving backoff state(%s):%w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// bagFile is a tag file of a BagIt bag (RFC 8493).
+type bagFile struct {
+	name    string
+	content []byte
+}
+
+// bagDir is the object name prefix of the tag files of a month, which are
+// the top level of the bag restore --bagit lays out.
+func bagDir(aid string, year int, months []int) string {
+	return fmt.Sprintf("%s/bagit-%d-%s", aid, year, monthsLabel(months))
+}
+
+// bagTagFiles builds the tag files of a bag whose payload is the files
+// names as laid out on restore, under data/. sizes and digests are those of
+// names, organization the Source-Organization of bag-info.txt, if any.
+func bagTagFiles(aid string, year int, months []int, names, digests []string, sizes []int64, organization string, t time.Time) []bagFile {
+	var manifest bytes.Buffer
+	var octets int64
+	for i, n := range names {
+		fmt.Fprintf(&manifest, "%s  data/%s\n", digests[i], bagPath(restorePath(aid, n)))
+		octets += sizes[i]
+	}
+	var info bytes.Buffer
+	if organization != "" {
+		fmt.Fprintf(&info, "Source-Organization: %s\n", organization)
+	}
+	fmt.Fprintf(&info, "External-Identifier: %s-%d-%s\n", strings.ReplaceAll(aid, "/", "-"), year, monthsLabel(months))
+	fmt.Fprintf(&info, "Bagging-Date: %s\n", t.UTC().Format("2006-01-02"))
+	fmt.Fprintf(&info, "Bag-Software-Agent: salvador-backups %s\n", currentBuild().Version)
+	fmt.Fprintf(&info, "Payload-Oxum: %d.%d\n", octets, len(names))
+
+	files := []bagFile{
+		{name: "bagit.txt", content: []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")},
+		{name: "bag-info.txt", content: info.Bytes()},
+		{name: "manifest-sha256.txt", content: manifest.Bytes()},
+	}
+	var tags bytes.Buffer
+	for _, f := range files {
+		sum := sha256.Sum256(f.content)
+		fmt.Fprintf(&tags, "%s  %s\n", hex.EncodeToString(sum[:]), f.name)
+	}
+	return append(files, bagFile{name: "tagmanifest-sha256.txt", content: tags.Bytes()})
+}
+
+// bagPath percent-encodes the characters manifests can't carry in a path.
+func bagPath(p string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(p)
+}
+
+// bagLayout returns where restore --bagit places an object: tag files of
+// dir at the top, the rest under data/. rel is the restored path otherwise.
+func bagLayout(dir, name, rel string) string {
+	if path.Dir(name) == dir {
+		return path.Base(name)
+	}
+	return "data/" + rel
+}
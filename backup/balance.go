@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+)
+
+// balancer spreads the files of a run over several backends. Each file goes
+// to a backend picked at random, weighted by how fast it answered the last
+// probe. A backend failing a probe or an upload gets no new files until a
+// later probe finds it healthy again.
+type balancer struct {
+	names    []string
+	backends []backuper
+	interval time.Duration
+	rand     *rand.Rand
+
+	runID   string
+	weights []float64
+	probed  time.Time
+	// served maps the URL of every stored object to its backend.
+	served map[string]backuper
+	// mu guards rand, weights, probed and served, files being stored
+	// concurrently with BACKUP_CONCURRENCY.
+	mu sync.Mutex
+}
+
+func newBalancer(names []string, backends []backuper, interval time.Duration) *balancer {
+	return &balancer{
+		names:    names,
+		backends: backends,
+		interval: interval,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		runID:    newRunID(),
+		weights:  make([]float64, len(backends)),
+		served:   make(map[string]backuper),
+	}
+}
+
+// probe round trips a tiny object to every backend, weighting each by the
+// inverse of the time it took. It is called with mu held.
+func (b *balancer) probe(ctx context.Context) {
+	for i, be := range b.backends {
+		start := time.Now()
+		if err := be.canary(ctx, b.runID); err != nil {
+			b.weights[i] = 0
+			warnings.warnf(warnBackend, "storage backend %s failed its probe: %v", b.names[i], err)
+			continue
+		}
+		b.weights[i] = 1 / time.Since(start).Seconds()
+	}
+	b.probed = time.Now()
+	log.Printf("Storage backend weights: %s", b.describe())
+}
+
+func (b *balancer) describe() string {
+	var total float64
+	for _, w := range b.weights {
+		total += w
+	}
+	var s string
+	for i, w := range b.weights {
+		if i > 0 {
+			s += ", "
+		}
+		share := 0.0
+		if total > 0 {
+			share = w / total
+		}
+		s += fmt.Sprintf("%s %.0f%%", b.names[i], share*100)
+	}
+	return s
+}
+
+// pick returns a healthy backend not in tried, probing them again when the
+// last probe is older than the interval.
+func (b *balancer) pick(ctx context.Context, tried map[int]bool) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.probed) >= b.interval {
+		b.probe(ctx)
+	}
+	var total float64
+	for i, w := range b.weights {
+		if !tried[i] {
+			total += w
+		}
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("no healthy storage backend left (weights: %s)", b.describe())
+	}
+	r := b.rand.Float64() * total
+	last := 0
+	for i, w := range b.weights {
+		if tried[i] || w == 0 {
+			continue
+		}
+		if r < w {
+			return i, nil
+		}
+		r -= w
+		last = i
+	}
+	return last, nil
+}
+
+// store calls put with picked backends until one of them succeeds. The
+// backends that failed get no more files until probed healthy again.
+func (b *balancer) store(ctx context.Context, name string, put func(be backuper) (storage.Backup, FileEntry, error)) (storage.Backup, FileEntry, error) {
+	tried := make(map[int]bool)
+	for {
+		i, err := b.pick(ctx, tried)
+		if err != nil {
+			return storage.Backup{}, FileEntry{}, fmt.Errorf("error storing %s:%w", name, err)
+		}
+		bk, entry, err := put(b.backends[i])
+		if err == nil {
+			b.mu.Lock()
+			b.served[bk.URL] = b.backends[i]
+			b.mu.Unlock()
+			return bk, entry, nil
+		}
+		if ctx.Err() != nil {
+			return storage.Backup{}, FileEntry{}, err
+		}
+		tried[i] = true
+		b.mu.Lock()
+		b.weights[i] = 0
+		b.mu.Unlock()
+		warnings.warnf(warnBackend, "storing %s in backend %s failed, trying another one: %v", name, b.names[i], err)
+	}
+}
+
+func (b *balancer) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for i := range paths {
+		bk, f, err := b.store(ctx, names[i], func(be backuper) (storage.Backup, FileEntry, error) {
+			bs, fs, err := be.backup(ctx, paths[i:i+1], names[i:i+1])
+			if err != nil {
+				return storage.Backup{}, FileEntry{}, err
+			}
+			return bs[0], fs[0], nil
+		})
+		if err != nil {
+			return backups, files, err
+		}
+		backups = append(backups, bk)
+		files = append(files, f)
+	}
+	return backups, files, nil
+}
+
+// upload keeps the content of r in memory, to be sent again to another
+// backend if the picked one fails. It is only used for small generated
+// files.
+func (b *balancer) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error reading content(%s):%w", name, err)
+	}
+	bk, _, err := b.store(ctx, name, func(be backuper) (storage.Backup, FileEntry, error) {
+		bk, err := be.upload(ctx, name, bytes.NewReader(content))
+		return bk, FileEntry{}, err
+	})
+	return bk, err
+}
+
+// canary probes every backend, failing only when none of them is healthy.
+func (b *balancer) canary(ctx context.Context, runID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probe(ctx)
+	for _, w := range b.weights {
+		if w > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("error running canary: every storage backend failed its probe")
+}
+
+// ping checks every backend, as a run could store files in any of them.
+func (b *balancer) ping(ctx context.Context) error {
+	for i, be := range b.backends {
+		if err := be.ping(ctx); err != nil {
+			return fmt.Errorf("error pinging backend %s:%w", b.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (b *balancer) digest(ctx context.Context, bk storage.Backup) (string, int64, error) {
+	b.mu.Lock()
+	be, ok := b.served[bk.URL]
+	b.mu.Unlock()
+	if !ok {
+		return "", 0, fmt.Errorf("object %s was not stored by this run", bk.URL)
+	}
+	return be.digest(ctx, bk)
+}
+
+// discard deletes the object of bk from the backend that stored it.
+func (b *balancer) discard(ctx context.Context, bk storage.Backup, f FileEntry) error {
+	b.mu.Lock()
+	be, ok := b.served[bk.URL]
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("object %s was not stored by this run", bk.URL)
+	}
+	return be.discard(ctx, bk, f)
+}
+
+// checkQuotas checks the quotas of the backends that have them, each for the
+// files it stored.
+func (b *balancer) checkQuotas(ctx context.Context, files []FileEntry, ratio float64) error {
+	for i, be := range b.backends {
+		q, ok := be.(quotaChecker)
+		if !ok {
+			continue
+		}
+		var own []FileEntry
+		for _, f := range files {
+			if f.Backend == b.names[i] {
+				own = append(own, f)
+			}
+		}
+		if len(own) == 0 {
+			continue
+		}
+		if err := q.checkQuotas(ctx, own, ratio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
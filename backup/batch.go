@@ -0,0 +1,296 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// batchJob is a line of a BATCH_FILE, shaped as the NATS jobs.
+type batchJob struct {
+	natsJob
+	line int
+}
+
+// batchResult is how a job of the batch went.
+type batchResult struct {
+	job    batchJob
+	conf   Config
+	files  int
+	bytes  int64
+	status string
+	err    error
+}
+
+const (
+	batchOK      = "ok"
+	batchFailed  = "failed"
+	batchSkipped = "skipped"
+)
+
+// readBatchFile reads the jobs of the BATCH_FILE at path: a CSV file, by its
+// .csv extension, with an aid, year, month (or months) and paths header, the
+// paths of a row separated by ;, or else JSON lines, or a JSON array, of
+// jobs as taken from NATS. Paths may be globs. Lines are numbered as rows
+// for CSV files, fields spanning lines aside.
+func readBatchFile(path string) ([]batchJob, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading batch file(%s):%w", path, err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		jobs, err := readBatchCSV(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch file(%s):%w", path, err)
+		}
+		return jobs, nil
+	}
+	jobs, err := readBatchJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("error reading batch file(%s):%w", path, err)
+	}
+	return jobs, nil
+}
+
+func readBatchCSV(r io.Reader) ([]batchJob, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cols := map[string]int{}
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, h := range []string{"aid", "year", "paths"} {
+		if _, ok := cols[h]; !ok {
+			return nil, fmt.Errorf("header must have an %s column", h)
+		}
+	}
+	_, hasMonth := cols["month"]
+	_, hasMonths := cols["months"]
+	if !hasMonth && !hasMonths {
+		return nil, fmt.Errorf("header must have a month or months column")
+	}
+	var jobs []batchJob
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return jobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+		job := batchJob{line: line}
+		job.AID = field("aid")
+		job.IdempotencyKey = field("idempotency_key")
+		if job.Year, err = strconv.Atoi(field("year")); err != nil {
+			return nil, fmt.Errorf("line %d: invalid year %q", line, field("year"))
+		}
+		if m := field("month"); m != "" {
+			if job.Month, err = strconv.Atoi(m); err != nil {
+				return nil, fmt.Errorf("line %d: invalid month %q", line, m)
+			}
+		}
+		if m := field("months"); m != "" {
+			if job.Months, err = parseMonths(m); err != nil {
+				return nil, fmt.Errorf("line %d: invalid months %q:%w", line, m, err)
+			}
+		}
+		for _, p := range strings.Split(field("paths"), ";") {
+			if p = strings.TrimSpace(p); p != "" {
+				job.Paths = append(job.Paths, p)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+func readBatchJSON(b []byte) ([]batchJob, error) {
+	var jobs []batchJob
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		var list []natsJob
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, err
+		}
+		for i, j := range list {
+			jobs = append(jobs, batchJob{natsJob: j, line: i + 1})
+		}
+		return jobs, nil
+	}
+	for i, l := range bytes.Split(b, []byte("\n")) {
+		l = bytes.TrimSpace(l)
+		if len(l) == 0 || l[0] == '#' {
+			continue
+		}
+		var j natsJob
+		if err := json.Unmarshal(l, &j); err != nil {
+			return nil, fmt.Errorf("line %d:%w", i+1, err)
+		}
+		jobs = append(jobs, batchJob{natsJob: j, line: i + 1})
+	}
+	return jobs, nil
+}
+
+// runBatch backs up every job of the BATCH_FILE in turn, in this process,
+// as many runs of the stage would, a failed job not stopping the others.
+// Every job is checked before the first one starts. The status of each job
+// is logged as it ends, and the summary of the batch printed to stderr, the
+// records of the stdout sink being printed to stdout once all jobs ran. It
+// fails if any job did.
+func runBatch(ctx context.Context, conf Config) error {
+	jobs, err := readBatchFile(conf.BatchFile)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("batch file(%s) has no jobs", conf.BatchFile)
+	}
+	results := make([]batchResult, len(jobs))
+	var problems []string
+	for i, job := range jobs {
+		jobConf, err := job.config(conf)
+		if err == nil {
+			if p := runProblems(jobConf); len(p) > 0 {
+				err = errors.New(strings.Join(p, ", "))
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid job at line %d of %s: %v", job.line, conf.BatchFile, err))
+		}
+		results[i] = batchResult{job: job, conf: jobConf, status: batchSkipped}
+	}
+	if len(problems) > 0 {
+		fatalProblems(failInvalidInput, problems)
+	}
+
+	var recs []Record
+	for i := range results {
+		res := &results[i]
+		if ctx.Err() != nil {
+			break
+		}
+		jobRecs, err := runBatchJob(ctx, res.conf, res.job.Paths)
+		res.status, res.err = batchOK, err
+		for _, r := range jobRecs {
+			res.files += len(r.Backups)
+			res.bytes += r.TotalBytes
+		}
+		label := fmt.Sprintf("%s %d/%s", res.conf.AID, res.conf.Year, res.job.monthsLabel())
+		if err != nil {
+			res.status = batchFailed
+			log.Printf("Batch job %d/%d (%s) failed: %v", i+1, len(results), label, err)
+			continue
+		}
+		recs = append(recs, jobRecs...)
+		log.Printf("Batch job %d/%d (%s) succeeded: %d files, %d bytes", i+1, len(results), label, res.files, res.bytes)
+	}
+
+	if err := printBatchSummary(os.Stderr, results); err != nil {
+		return err
+	}
+	if conf.MetadataSink == sinkStdout && len(recs) > 0 {
+		if err := writeRecords(os.Stdout, conf.MetadataDelimiter, recs); err != nil {
+			return fmt.Errorf("error writing metadata to stdout:%w", err)
+		}
+	}
+	var failed, skipped int
+	for _, res := range results {
+		switch res.status {
+		case batchFailed:
+			failed++
+		case batchSkipped:
+			skipped++
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("batch interrupted, %d of %d jobs not run:%w", skipped, len(results), err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d batch jobs failed", failed, len(results))
+	}
+	return nil
+}
+
+// runBatchJob runs a job of the batch as the stage runs its input, writing
+// its records to the file and postgres sinks, and queueing it for a retry
+// with RETRY_QUEUE if it fails.
+func runBatchJob(ctx context.Context, conf Config, patterns []string) ([]Record, error) {
+	paths, err := expandPaths(patterns, conf.InputExclude, conf.InputFollowSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	flagged, err := applyContentTypePolicy(conf, paths)
+	if err != nil {
+		return nil, err
+	}
+	if conf.DryRun {
+		recs, err := dryRun(ctx, conf, paths, flagged)
+		if err == nil {
+			err = writePlan(os.Stdout, recs)
+		}
+		return nil, err
+	}
+	recs, err := run(ctx, conf, paths, flagged, nil, nil)
+	notifyBackup(ctx, conf, paths, recs, err)
+	if err != nil {
+		if conf.RetryQueue && !errors.Is(err, errReadOnly) && !errors.Is(err, errStrict) && ctx.Err() == nil {
+			if qErr := enqueueRetry(ctx, conf, paths, flagged, err); qErr != nil {
+				warnings.warnf(warnRetryQueue, "%v", qErr)
+			}
+		}
+		return nil, err
+	}
+	return recs, storeRecords(ctx, conf, recs)
+}
+
+func (j batchJob) monthsLabel() string {
+	if len(j.Months) > 0 {
+		return monthsLabel(j.Months)
+	}
+	return fmt.Sprintf("%02d", j.Month)
+}
+
+// printBatchSummary prints a line per job of the batch, then how many
+// succeeded, failed and weren't run.
+func printBatchSummary(w io.Writer, results []batchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tAID\tYEAR\tMONTHS\tSTATUS\tFILES\tBYTES\tERROR")
+	counts := map[string]int{}
+	for _, res := range results {
+		counts[res.status]++
+		errMsg := ""
+		if res.err != nil {
+			errMsg = res.err.Error()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%d\t%d\t%s\n", res.job.line, res.conf.AID, res.conf.Year, res.job.monthsLabel(), res.status, res.files, res.bytes, errMsg)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d jobs: %d succeeded, %d failed, %d not run\n", len(results), counts[batchOK], counts[batchFailed], counts[batchSkipped])
+	return err
+}
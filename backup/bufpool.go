@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"context"
+	"io"
+)
+
+// bufferSize is the size of the buffers used to hash and upload files.
+const bufferSize = 1 << 20
+
+// bufferPool hands out a bounded number of fixed size buffers. Callers
+// block until a buffer is free, so raising concurrency never raises the
+// memory used for copying beyond the pool's limit.
+type bufferPool struct {
+	free chan []byte
+}
+
+// newBufferPool creates a pool using at most maxBytes, and at least one
+// buffer. Buffers are allocated on first use.
+func newBufferPool(maxBytes int64) *bufferPool {
+	n := int(maxBytes / bufferSize)
+	if n < 1 {
+		n = 1
+	}
+	p := &bufferPool{free: make(chan []byte, n)}
+	for i := 0; i < n; i++ {
+		p.free <- nil
+	}
+	return p
+}
+
+func (p *bufferPool) get(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-p.free:
+		if b == nil {
+			b = make([]byte, bufferSize)
+		}
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *bufferPool) put(b []byte) {
+	p.free <- b
+}
+
+// copy is io.Copy using a buffer of the pool.
+func (p *bufferPool) copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	b, err := p.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer p.put(b)
+	return io.CopyBuffer(dst, src, b)
+}
+
+// buffers is shared by everything hashing or uploading files. It is
+// replaced on startup by one sized from MAX_MEMORY_MB.
+var buffers = newBufferPool(64 << 20)
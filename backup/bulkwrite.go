@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	bulkWriteAttempts = 5
+	bulkWriteDelay    = time.Second
+)
+
+// recordBatch accumulates the records of the jobs of a batch run, writing
+// them in bulk operations of at most size records, one at a time, instead
+// of inserting them one by one. Each job's done func runs once its records
+// are stored.
+//
+// Only RECORD_POLICY=version records are queued, see batchedPolicy.
+type recordBatch struct {
+	coll     *mongo.Collection
+	chain    *mongo.Collection // nil without CHAIN_LOG
+	versions *mongo.Collection // nil without OBJECT_VERSIONING
+	size     int
+	recs     []Record
+	done     []func() error
+	// listed is how many of recs are listed in versions, a flush failing
+	// after listing some.
+	listed int
+}
+
+// batchedPolicy reports whether the records of a run with the RECORD_POLICY
+// policy are written by the batch. The other policies read and update the
+// record of the month, which is only safe while the run holds the month
+// leases: run writes them itself.
+func batchedPolicy(policy string) bool {
+	return policy == policyVersion
+}
+
+// add queues the records of a job, flushing the batch when it is full.
+func (b *recordBatch) add(ctx context.Context, recs []Record, done func() error) error {
+	b.recs = append(b.recs, recs...)
+	b.done = append(b.done, done)
+	if len(b.recs) >= b.size {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+// flush writes every queued record. On failure nothing is dequeued: the
+// records already written are recognized by their _id on the next flush.
+func (b *recordBatch) flush(ctx context.Context) error {
+	for start := 0; start < len(b.recs); start += b.size {
+		end := start + b.size
+		if end > len(b.recs) {
+			end = len(b.recs)
+		}
+		if err := insertBulk(ctx, b.coll, b.recs[start:end]); err != nil {
+			return err
+		}
+	}
+	for ; b.versions != nil && b.listed < len(b.recs); b.listed++ {
+		if err := addVersion(ctx, b.versions, b.recs[b.listed]); err != nil {
+			return err
+		}
+	}
+	if b.chain != nil {
+		for _, r := range b.recs {
+			if err := appendChain(ctx, b.chain, b.coll, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	finishJournals(b.recs)
+	done := b.done
+	b.recs, b.done, b.listed = nil, nil, 0
+	for _, f := range done {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertBulk inserts recs with an unordered bulk write, retrying the records
+// that failed. Duplicate key errors mean a record was written by a previous
+// attempt.
+func insertBulk(ctx context.Context, coll *mongo.Collection, recs []Record) error {
+	pending := make([]interface{}, len(recs))
+	for i, r := range recs {
+		pending[i] = r
+	}
+	delay := bulkWriteDelay
+	for attempt := 1; ; attempt++ {
+		_, err := coll.InsertMany(ctx, pending, options.InsertMany().SetOrdered(false))
+		if err == nil {
+			return nil
+		}
+		var bwe mongo.BulkWriteException
+		if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+			var failed []interface{}
+			for _, we := range bwe.WriteErrors {
+				if !mongo.IsDuplicateKeyError(we) {
+					failed = append(failed, pending[we.Index])
+				}
+			}
+			if len(failed) == 0 {
+				return nil
+			}
+			pending = failed
+		}
+		if attempt >= bulkWriteAttempts {
+			return fmt.Errorf("error writing %d backup records in bulk (after %d attempts):%w", len(pending), attempt, err)
+		}
+		wait := jittered(delay)
+		log.Printf("Warning: bulk write of %d backup records failed, retrying in %s: %v", len(pending), wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
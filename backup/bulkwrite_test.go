@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestProcessDueRetriesListsVersions(t *testing.T) {
+	conf := testConfig(t)
+	db := testMongo(t, &conf)
+	conf.ObjectVersioning = versionRun
+	conf.RecordPolicy = policyVersion
+	ctx := context.Background()
+
+	retries := db.Collection(conf.MongoRetryColl)
+	paths := writeTestFiles(t, "a.csv", "a,b\n1,2\n", "b.csv", "a,b\n3,4\n")
+	now := time.Now().UTC()
+	job := retryJob{AID: conf.AID, Year: int(conf.Year), Months: []int{int(conf.Month)}, Paths: paths, Attempts: 1, NextRetryAt: now.Add(-time.Minute), CreatedAt: now, UpdatedAt: now}
+	if _, err := retries.InsertOne(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	batch := &recordBatch{
+		coll:     db.Collection(conf.MongoBackupColl),
+		versions: db.Collection(conf.MongoVersionsColl),
+		size:     conf.BulkWriteSize,
+	}
+	ok, failed, err := processDueRetries(ctx, conf, retries, batch)
+	if err != nil || ok != 1 || failed != 0 {
+		t.Fatalf("processDueRetries = %d, %d, %v, want 1, 0, nil", ok, failed, err)
+	}
+
+	var rec Record
+	if err := batch.coll.FindOne(ctx, bson.M{"aid": conf.AID}).Decode(&rec); err != nil {
+		t.Fatal(err)
+	}
+	var versions monthVersions
+	key := leaseKey(conf.AID, int(conf.Year), int(conf.Month))
+	if err := batch.versions.FindOne(ctx, bson.M{"_id": key}).Decode(&versions); err != nil {
+		t.Fatalf("versions of %s: %v", key, err)
+	}
+	if versions.Latest != rec.ID || len(versions.Versions) != 1 || versions.Versions[0].RecordID != rec.ID {
+		t.Errorf("versions of %s = %+v, want only record %s, as the latest", key, versions, rec.ID.Hex())
+	}
+}
@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/ncw/swift/v2"
+)
+
+// canary round trips a tiny object before a run touches its inputs, so a
+// misconfigured deployment fails in seconds instead of after hashing and
+// uploading everything else.
+func (c *swiftClient) canary(ctx context.Context, runID string) error {
+	if err := swiftRoundTrip(ctx, c, ".canary/"+runID); err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseSwift(err, c.container))
+	}
+	return nil
+}
+
+// diagnoseSwift explains the likely cause of a swift error.
+func diagnoseSwift(err error, container string) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, swift.AuthorizationFailed):
+		return "authentication failed (check SWIFT_USERNAME, SWIFT_APIKEY, SWIFT_AUTHURL, SWIFT_AUTH_VERSION and SWIFT_DOMAIN)"
+	case errors.Is(err, swift.Forbidden):
+		return fmt.Sprintf("access denied (check the ACLs of container %s for SWIFT_USERNAME)", container)
+	case errors.Is(err, swift.ContainerNotFound), errors.Is(err, swift.ObjectNotFound):
+		return fmt.Sprintf("container %s not found (check SWIFT_CONTAINER, SWIFT_REGION and SWIFT_STORAGEURL)", container)
+	case errors.Is(err, swift.TooManyRequests), errors.Is(err, swift.RateLimit):
+		return "rate limited by swift"
+	case errors.Is(err, swift.TimeoutError), errors.As(err, &netErr):
+		return "network error (check connectivity to SWIFT_AUTHURL and the storage endpoint)"
+	}
+	return "unexpected error"
+}
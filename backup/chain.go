@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// chainEntry is one link of the tamper-evident log of backup records. Each
+// entry commits to a snapshot of a record and to the previous entry, so
+// changing a record, or any past entry, breaks the chain. Entries of
+// deleted records have no snapshot.
+type chainEntry struct {
+	Seq        int64              `bson:"_id"`
+	RecordID   primitive.ObjectID `bson:"record_id"`
+	Record     bson.Raw           `bson:"record,omitempty"`
+	RecordHash string             `bson:"record_hash"`
+	PrevHash   string             `bson:"prev_hash"`
+	Hash       string             `bson:"hash"`
+	Timestamp  time.Time          `bson:"timestamp"`
+}
+
+func rawHash(raw bson.Raw) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (e chainEntry) computeHash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s\n%s\n%s\n%s", e.Seq, e.PrevHash, e.RecordID.Hex(), e.RecordHash, e.Timestamp.UTC().Format(time.RFC3339Nano))))
+	return hex.EncodeToString(sum[:])
+}
+
+// appendChain links the current state of the record id to the log. The
+// record is read back from mongo so the hash covers exactly what is stored.
+func appendChain(ctx context.Context, chain, records *mongo.Collection, id primitive.ObjectID) error {
+	raw, err := records.FindOne(ctx, bson.M{"_id": id}).DecodeBytes()
+	if err != nil {
+		return fmt.Errorf("error reading record for the chain(%s):%w", id.Hex(), err)
+	}
+	return linkChain(ctx, chain, id, raw)
+}
+
+// appendChainDeletion links the deletion of the record id to the log, as an
+// entry without a snapshot.
+func appendChainDeletion(ctx context.Context, chain *mongo.Collection, id primitive.ObjectID) error {
+	return linkChain(ctx, chain, id, nil)
+}
+
+func linkChain(ctx context.Context, chain *mongo.Collection, id primitive.ObjectID, raw bson.Raw) error {
+	for {
+		var last chainEntry
+		err := chain.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&last)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("error reading chain head:%w", err)
+		}
+		e := chainEntry{
+			Seq:        last.Seq + 1,
+			RecordID:   id,
+			Record:     raw,
+			RecordHash: rawHash(raw),
+			PrevHash:   last.Hash,
+			Timestamp:  time.Now().UTC().Truncate(time.Millisecond),
+		}
+		e.Hash = e.computeHash()
+		_, err = chain.InsertOne(ctx, e)
+		if mongo.IsDuplicateKeyError(err) {
+			// Someone else appended first, link to the new head.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error appending to chain(%s):%w", id.Hex(), err)
+		}
+		return nil
+	}
+}
+
+// verifyChain walks the whole log checking its links and comparing the
+// latest snapshot of every record with what is currently stored. It returns
+// every problem found.
+func verifyChain(ctx context.Context, chain, records *mongo.Collection) ([]string, int, error) {
+	cur, err := chain.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading chain:%w", err)
+	}
+	defer cur.Close(ctx)
+
+	var problems []string
+	var prev chainEntry
+	var first time.Time
+	latest := make(map[primitive.ObjectID]string)
+	n := 0
+	for cur.Next(ctx) {
+		var e chainEntry
+		if err := cur.Decode(&e); err != nil {
+			return nil, n, fmt.Errorf("error decoding chain entry:%w", err)
+		}
+		if n == 0 {
+			first = e.Timestamp
+		}
+		n++
+		if e.Seq != prev.Seq+1 {
+			problems = append(problems, fmt.Sprintf("entry %d: expected sequence %d, entries are missing", e.Seq, prev.Seq+1))
+		}
+		if e.PrevHash != prev.Hash {
+			problems = append(problems, fmt.Sprintf("entry %d: previous hash does not match entry %d", e.Seq, prev.Seq))
+		}
+		if e.Hash != e.computeHash() {
+			problems = append(problems, fmt.Sprintf("entry %d: hash does not match its content", e.Seq))
+		}
+		if rawHash(e.Record) != e.RecordHash {
+			problems = append(problems, fmt.Sprintf("entry %d: record snapshot does not match its hash", e.Seq))
+		}
+		if len(e.Record) == 0 {
+			delete(latest, e.RecordID)
+		} else {
+			latest[e.RecordID] = e.RecordHash
+		}
+		prev = e
+	}
+	if err := cur.Err(); err != nil {
+		return nil, n, fmt.Errorf("error reading chain:%w", err)
+	}
+
+	for id, hash := range latest {
+		raw, err := records.FindOne(ctx, bson.M{"_id": id}).DecodeBytes()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			problems = append(problems, fmt.Sprintf("record %s: deleted outside of the chain", id.Hex()))
+			continue
+		}
+		if err != nil {
+			return nil, n, fmt.Errorf("error reading record(%s):%w", id.Hex(), err)
+		}
+		if rawHash(raw) != hash {
+			problems = append(problems, fmt.Sprintf("record %s: modified outside of the chain", id.Hex()))
+		}
+	}
+
+	if n > 0 {
+		cur, err := records.Find(ctx,
+			bson.M{"_id": bson.M{"$gte": primitive.NewObjectIDFromTimestamp(first)}},
+			options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, n, fmt.Errorf("error listing records:%w", err)
+		}
+		var ids []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.All(ctx, &ids); err != nil {
+			return nil, n, fmt.Errorf("error listing records:%w", err)
+		}
+		for _, r := range ids {
+			if _, ok := latest[r.ID]; !ok {
+				problems = append(problems, fmt.Sprintf("record %s: created after the chain started but missing from it", r.ID.Hex()))
+			}
+		}
+	}
+	return problems, n, nil
+}
+
+// chainCmd implements "chain verify".
+func chainCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("chain", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "verify" {
+		return fmt.Errorf("usage: chain verify")
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+
+	problems, n, err := verifyChain(ctx, mdb.Collection(conf.MongoChainColl), mdb.Collection(conf.MongoBackupColl))
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("chain verification found %d problems in %d entries", len(problems), n)
+	}
+	log.Printf("Chain verified: %d entries", n)
+	return nil
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/ncw/swift/v2"
+)
+
+// Content-defined chunking parameters. Boundaries depend only on the bytes
+// around them, so an archive that grew or changed in a few places keeps
+// most of its chunks from the previous month.
+const (
+	chunkMinSize = 1 << 20
+	chunkMaxSize = 16 << 20
+	// a boundary is found, on average, every 4MiB past the minimum size.
+	chunkMask = 1<<22 - 1
+)
+
+// gearTable maps bytes to the random values of the rolling hash. It is
+// generated from a fixed seed: changing it would change every boundary.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	r := rand.New(rand.NewSource(0x5a1ad02))
+	for i := range t {
+		t[i] = r.Uint64()
+	}
+	return t
+}()
+
+// chunk is a piece of a file, named in the chunk container by its SHA-256.
+type chunk struct {
+	offset, size int64
+	sha256, md5  string
+}
+
+// splitChunks finds the chunks of r, a gear hash picking each boundary.
+func splitChunks(r io.Reader) ([]chunk, error) {
+	var chunks []chunk
+	var h uint64
+	cur := chunk{}
+	sh, mh := sha256.New(), md5.New()
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		start := 0
+		for i, b := range buf[:n] {
+			cur.size++
+			h = h<<1 + gearTable[b]
+			if (cur.size < chunkMinSize || h&chunkMask != 0) && cur.size < chunkMaxSize {
+				continue
+			}
+			sh.Write(buf[start : i+1])
+			mh.Write(buf[start : i+1])
+			start = i + 1
+			cur.sha256, cur.md5 = hex.EncodeToString(sh.Sum(nil)), hex.EncodeToString(mh.Sum(nil))
+			chunks = append(chunks, cur)
+			cur = chunk{offset: cur.offset + cur.size}
+			sh.Reset()
+			mh.Reset()
+			h = 0
+		}
+		sh.Write(buf[start:n])
+		mh.Write(buf[start:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cur.size > 0 {
+		cur.sha256, cur.md5 = hex.EncodeToString(sh.Sum(nil)), hex.EncodeToString(mh.Sum(nil))
+		chunks = append(chunks, cur)
+	}
+	return chunks, nil
+}
+
+// sloSegment is an entry of a Static Large Object manifest.
+type sloSegment struct {
+	Path string `json:"path"`
+	Etag string `json:"etag"`
+	Size int64  `json:"size_bytes"`
+}
+
+// uploadChunked stores f as a Static Large Object manifest, name in
+// container, of its chunks in the chunk container. f is split as read from
+// r, which reads it from the start. Only chunks not already stored, by this
+// or any other backup, are uploaded. Downloading the
+// manifest returns the file, so restores don't need to know about chunks.
+func (c *swiftClient) uploadChunked(ctx context.Context, container, name string, r io.Reader, f *os.File, entry *FileEntry) (storage.Backup, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, err
+	}
+	chunks, err := splitChunks(r)
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error chunking file(%s):%w", f.Name(), err)
+	}
+	segments := make([]sloSegment, len(chunks))
+	for i, ch := range chunks {
+		segments[i] = sloSegment{Path: c.chunks + "/" + ch.sha256, Etag: ch.md5, Size: ch.size}
+		c.mu.Lock()
+		known := c.chunkStored[ch.sha256]
+		c.mu.Unlock()
+		if known {
+			continue
+		}
+		info, _, err := c.conn.Object(ctx, c.chunks, ch.sha256)
+		switch {
+		case err == nil && info.Hash == ch.md5:
+		case err == nil || errors.Is(err, swift.ObjectNotFound):
+			if _, err := c.uploadTo(ctx, c.chunks, ch.sha256, io.NewSectionReader(f, ch.offset, ch.size)); err != nil {
+				return storage.Backup{}, err
+			}
+			entry.NewChunks++
+		default:
+			return storage.Backup{}, fmt.Errorf("error reading chunk info(%s/%s):%w", c.chunks, ch.sha256, err)
+		}
+		c.mu.Lock()
+		c.chunkStored[ch.sha256] = true
+		c.mu.Unlock()
+	}
+	entry.Chunks = len(chunks)
+	return c.putManifest(ctx, container, name, segments)
+}
+
+// putManifest stores the Static Large Object manifest of segments as name in
+// container.
+func (c *swiftClient) putManifest(ctx context.Context, container, name string, segments []sloSegment) (storage.Backup, error) {
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error encoding manifest(%s/%s):%w", container, name, err)
+	}
+	_, headers, err := c.conn.Call(ctx, c.conn.StorageUrl, swift.RequestOpts{
+		Container:  container,
+		ObjectName: name,
+		Operation:  "PUT",
+		Parameters: url.Values{"multipart-manifest": {"put"}},
+		Body:       bytes.NewReader(manifest),
+		NoResponse: true,
+	})
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error uploading manifest(%s/%s):%w", container, name, err)
+	}
+	return storage.Backup{URL: fmt.Sprintf("%s/%s/%s", c.conn.StorageUrl, container, name), Hash: strings.Trim(headers["Etag"], `"`)}, nil
+}
@@ -0,0 +1,266 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What is done with the files clamd finds infected, set by CLAMD_POLICY.
+const (
+	// scanFail fails the run before anything is uploaded.
+	scanFail = "fail"
+	// scanSkip backs up the other files only.
+	scanSkip = "skip"
+	// scanQuarantine also moves the infected files to
+	// CLAMD_QUARANTINE_DIR.
+	scanQuarantine = "quarantine"
+)
+
+// clamdChunk is the size of the INSTREAM chunks, well under clamd's
+// StreamMaxLength.
+const clamdChunk = 64 << 10
+
+// scanReport is the outcome of scanning the files of a run with clamd.
+type scanReport struct {
+	// Engine is the clamd version and signature database it reported.
+	Engine    string         `bson:"engine" json:"engine"`
+	ScannedAt time.Time      `bson:"scanned_at" json:"scanned_at"`
+	Scanned   int            `bson:"scanned" json:"scanned"`
+	Infected  []infectedFile `bson:"infected,omitempty" json:"infected,omitempty"`
+}
+
+// infectedFile is a file clamd found a signature in, Action being the
+// CLAMD_POLICY applied to it.
+type infectedFile struct {
+	Path      string `bson:"path" json:"path"`
+	Signature string `bson:"signature" json:"signature"`
+	Action    string `bson:"action" json:"action"`
+}
+
+// infected tells whether p was left out of the backup by the scan of r.
+func (r *scanReport) infected(p string) bool {
+	if r == nil {
+		return false
+	}
+	for _, f := range r.Infected {
+		if f.Path == filepath.Clean(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkScanPolicy(conf Config) error {
+	switch conf.ClamdPolicy {
+	case scanFail, scanSkip:
+	case scanQuarantine:
+		if conf.ClamdQuarantineDir == "" {
+			return fmt.Errorf("%q needs CLAMD_QUARANTINE_DIR", scanQuarantine)
+		}
+	default:
+		return fmt.Errorf("%q must be %q, %q or %q", conf.ClamdPolicy, scanFail, scanSkip, scanQuarantine)
+	}
+	if conf.ClamdTimeout <= 0 {
+		return fmt.Errorf("CLAMD_TIMEOUT must be positive")
+	}
+	return nil
+}
+
+// dialClamd connects to addr: the path of a unix socket (optionally as a
+// unix:// URL) or a host:port.
+func dialClamd(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix://") || strings.HasPrefix(addr, "/") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to clamd(%s):%w", addr, err)
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// readClamdReply reads a NUL terminated reply.
+func readClamdReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("error reading clamd reply:%w", err)
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// clamdCommand sends cmd (PING, VERSION) and returns the reply.
+func clamdCommand(ctx context.Context, addr string, timeout time.Duration, cmd string) (string, error) {
+	conn, err := dialClamd(ctx, addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "z"+cmd+"\x00"); err != nil {
+		return "", fmt.Errorf("error sending clamd %s:%w", cmd, err)
+	}
+	return readClamdReply(conn)
+}
+
+// pingClamd checks clamd answers PING.
+func pingClamd(ctx context.Context, addr string, timeout time.Duration) error {
+	reply, err := clamdCommand(ctx, addr, timeout, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply to PING: %q", reply)
+	}
+	return nil
+}
+
+// clamdScan streams the file p to clamd, returning the signature found in
+// it, empty when it is clean.
+func clamdScan(ctx context.Context, addr string, timeout time.Duration, p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("error opening file(%s):%w", p, err)
+	}
+	defer f.Close()
+	conn, err := dialClamd(ctx, addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	w := bufio.NewWriterSize(conn, clamdChunk+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", fmt.Errorf("error scanning file(%s):%w", p, err)
+	}
+	buf := make([]byte, clamdChunk)
+	var size [4]byte
+	for {
+		n, rErr := f.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			if _, err := w.Write(buf[:n]); err != nil {
+				return "", fmt.Errorf("error scanning file(%s):%w", p, err)
+			}
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return "", fmt.Errorf("error reading file(%s):%w", p, rErr)
+		}
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("error scanning file(%s):%w", p, err)
+	}
+	reply, err := readClamdReply(conn)
+	if err != nil {
+		return "", fmt.Errorf("error scanning file(%s):%w", p, err)
+	}
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return "", nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return strings.TrimSuffix(verdict, " FOUND"), nil
+	}
+	// e.g. "INSTREAM size limit exceeded. ERROR", see StreamMaxLength.
+	return "", fmt.Errorf("error scanning file(%s): clamd replied %q", p, reply)
+}
+
+// scanFiles scans paths with the clamd at CLAMD_ADDR, applying
+// CLAMD_POLICY to the infected ones. It returns the paths to back up,
+// without those, and the report to store in the records.
+func scanFiles(ctx context.Context, conf Config, paths []string) ([]string, *scanReport, error) {
+	engine, err := clamdCommand(ctx, conf.ClamdAddr, conf.ClamdTimeout, "VERSION")
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &scanReport{Engine: engine, ScannedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	var clean []string
+	scanned := make(map[string]string)
+	for _, p := range paths {
+		sig, done := scanned[filepath.Clean(p)]
+		if !done {
+			if sig, err = clamdScan(ctx, conf.ClamdAddr, conf.ClamdTimeout, p); err != nil {
+				return nil, nil, err
+			}
+			scanned[filepath.Clean(p)] = sig
+			report.Scanned++
+		}
+		if sig == "" {
+			clean = append(clean, p)
+			continue
+		}
+		if done {
+			continue
+		}
+		if conf.ClamdPolicy == scanFail {
+			return nil, nil, withFailClass(failInvalidFile, fmt.Errorf("file %s is infected (%s)", p, sig))
+		}
+		report.Infected = append(report.Infected, infectedFile{Path: filepath.Clean(p), Signature: sig, Action: conf.ClamdPolicy})
+		if conf.ClamdPolicy == scanQuarantine {
+			if err := quarantineFile(conf.ClamdQuarantineDir, p); err != nil {
+				return nil, nil, err
+			}
+		}
+		warnings.warnf(warnInfected, "file %s is infected (%s), not backed up (CLAMD_POLICY=%s)", p, sig, conf.ClamdPolicy)
+	}
+	if len(clean) == 0 && len(paths) > 0 {
+		return nil, nil, withFailClass(failInvalidFile, fmt.Errorf("all %d file(s) are infected, nothing to back up", len(report.Infected)))
+	}
+	log.Printf("Scanned %d file(s) with %s, %d infected", report.Scanned, engine, len(report.Infected))
+	return clean, report, nil
+}
+
+// quarantineFile moves the infected file p to dir, under a name made
+// unique by the time it was found.
+func quarantineFile(dir, p string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating quarantine dir(%s):%w", dir, err)
+	}
+	dst := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000000000Z")+"-"+filepath.Base(p))
+	if err := os.Rename(p, dst); err != nil {
+		// across file systems the file is copied, then removed.
+		if err := copyFile(p, dst); err != nil {
+			return fmt.Errorf("error quarantining file(%s):%w", p, err)
+		}
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("error quarantining file(%s):%w", p, err)
+		}
+	}
+	log.Printf("Quarantined %s as %s", p, dst)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
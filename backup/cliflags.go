@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cliSource is the flag or config file each variable was set from, for
+// config dump.
+var cliSource = map[string]string{}
+
+// cliFlags are the flags the stage takes before its command, so ad-hoc runs
+// don't need a dozen exported variables. They are applied to the
+// environment before the config is read: the --config file under the
+// variables already set, which still take precedence as they do in the
+// pipeline, --aid, --year and --month over them.
+type cliFlags struct {
+	configFile string
+	vars       map[string]string
+	// paths, when set, are backed up instead of those read from stdin.
+	paths []string
+}
+
+// pathList is a repeatable flag of comma separated paths.
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*l = append(*l, p)
+		}
+	}
+	return nil
+}
+
+// parseCLIFlags parses the flags at the start of args, returning them and
+// the command line left, the command and its arguments.
+func parseCLIFlags(args []string) (cliFlags, []string, error) {
+	fs := flag.NewFlagSet("salvador-backups", flag.ContinueOnError)
+	configFile := fs.String("config", "", "YAML file of settings keyed by variable name (SWIFT_CONTAINER: x), under the variables set in the environment")
+	fs.String("aid", "", "agency to back up, over AID")
+	fs.String("year", "", "year of the files, over YEAR")
+	fs.String("month", "", "month of the files, over MONTH")
+	var paths pathList
+	fs.Var(&paths, "paths", "comma separated files to back up instead of reading them from stdin, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return cliFlags{}, nil, err
+	}
+	f := cliFlags{configFile: *configFile, vars: map[string]string{}, paths: paths}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "aid", "year", "month":
+			f.vars[strings.ToUpper(fl.Name)] = fl.Value.String()
+		}
+	})
+	return f, fs.Args(), nil
+}
+
+// readConfigFile parses a YAML file of settings: a mapping of variable
+// names, in any case, to scalars or lists of them, joined with commas as
+// list variables are.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file(%s):%w", path, err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing config file(%s):%w", path, err)
+	}
+	vars := make(map[string]string)
+	for k, v := range doc {
+		key := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		switch v := v.(type) {
+		case nil:
+			vars[key] = ""
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				if _, ok := item.(map[string]interface{}); ok {
+					return nil, fmt.Errorf("config file(%s): %s must be a scalar or a list of them", path, k)
+				}
+				items[i] = fmt.Sprint(item)
+			}
+			vars[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("config file(%s): %s must be a scalar or a list of them", path, k)
+		default:
+			vars[key] = fmt.Sprint(v)
+		}
+	}
+	return vars, nil
+}
+
+// apply sets the config file and the flags in the environment.
+func (f cliFlags) apply() error {
+	if f.configFile != "" {
+		vars, err := readConfigFile(f.configFile)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, ok := os.LookupEnv(k); ok {
+				continue
+			}
+			if err := os.Setenv(k, vars[k]); err != nil {
+				return fmt.Errorf("error setting %s from config file(%s):%w", k, f.configFile, err)
+			}
+			cliSource[k] = "config " + f.configFile
+		}
+	}
+	for k, v := range f.vars {
+		if err := os.Setenv(k, v); err != nil {
+			return fmt.Errorf("error setting %s from --%s:%w", k, strings.ToLower(k), err)
+		}
+		cliSource[k] = "flag --" + strings.ToLower(k)
+	}
+	return nil
+}
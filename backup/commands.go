@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// command is a subcommand entry point. args does not include the command
+// name. Running without a command acts as the backup pipeline stage.
+type command func(ctx context.Context, conf Config, args []string) error
+
+var commands = map[string]command{
+	"serve":          serveCmd,
+	"config":         configCmd,
+	"versions":       versionsCmd,
+	"restore":        restoreCmd,
+	"rehydrate":      rehydrateCmd,
+	"probe":          probeCmd,
+	"retry-due":      retryDueCmd,
+	"chain":          chainCmd,
+	"export":         exportCmd,
+	"tui":            tuiCmd,
+	"janitor":        janitorCmd,
+	"gc":             gcCmd,
+	"sync-metadata":  syncMetadataCmd,
+	"nats-worker":    natsWorkerCmd,
+	"job-worker":     jobWorkerCmd,
+	"tempurl":        tempURLCmd,
+	"sign":           signCmd,
+	"dev":            devCmd,
+	"annotate":       annotateCmd,
+	"audit-source":   auditSourceCmd,
+	"audit":          auditCmd,
+	"list":           listCmd,
+	"usage":          usageCmd,
+	"report":         reportCmd,
+	"gaps":           gapsCmd,
+	"smoke":          smokeCmd,
+	"advise":         adviseCmd,
+	"copy-container": copyContainerCmd,
+	"verify":         verifyCmd,
+	"purge":          purgeCmd,
+	"undelete":       undeleteCmd,
+	"rewrite-urls":   rewriteURLsCmd,
+	"publish-index":  publishIndexCmd,
+	"schema":         schemaCmd,
+}
+
+// monthSelector holds the --aid, --year and --month flags shared by commands
+// that work on one month of an agency. They default to the AID, YEAR and
+// MONTH environment variables.
+type monthSelector struct {
+	agency string
+	sep    string
+	year   int
+	month  int
+}
+
+func monthFlags(fs *flag.FlagSet, conf Config) *monthSelector {
+	m := &monthSelector{sep: conf.AIDSeparator}
+	fs.StringVar(&m.agency, "aid", conf.AID, "agency identifier")
+	fs.IntVar(&m.year, "year", int(conf.Year), "year")
+	fs.IntVar(&m.month, "month", int(conf.Month), "month")
+	return m
+}
+
+func (m *monthSelector) aid() agencyID {
+	return splitAID(strings.ToLower(m.agency), m.sep)
+}
+
+// healthzHandler reports the process is up and which build it runs.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string    `json:"status"`
+		Build  buildInfo `json:"build"`
+	}{"ok", currentBuild()})
+}
+
+// serveCmd runs in daemon mode, exposing the backup metrics of every agency
+// at /metrics.
+func serveCmd(ctx context.Context, conf Config, args []string) error {
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+
+	var runs *mongo.Collection
+	if conf.MongoRunsColl != "" {
+		runs = mdb.Collection(conf.MongoRunsColl)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(mdb.Collection(conf.MongoBackupColl), mdb.Collection(conf.MongoRetryColl), runs))
+	mux.HandleFunc("/healthz", healthzHandler)
+	srv := &http.Server{
+		Addr:              conf.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving metrics at %s/metrics", conf.MetricsAddr)
+	return srv.ListenAndServe()
+}
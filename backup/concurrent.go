@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dadosjusbr/storage"
+)
+
+// fileError is the error uploading the file stored as name.
+type fileError struct {
+	name string
+	err  error
+}
+
+// uploadErrors are the files of a concurrent upload that failed, in the
+// order they were given, unwrapping to the first one.
+type uploadErrors []fileError
+
+func (e uploadErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = fmt.Sprintf("%s: %v", f.name, f.err)
+	}
+	return fmt.Sprintf("%d file(s) failed to upload: %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e uploadErrors) Unwrap() error {
+	return e[0].err
+}
+
+// backupConcurrently is cloud.backup uploading concurrency files at a time.
+// Whichever upload finishes first, the backups keep the order of paths and
+// are, as with backup, those of the files before the first one that failed:
+// the files other workers uploaded after it are discarded. Once a file fails
+// no other upload is started, those in progress being waited for, and the
+// error lists every file that failed.
+func backupConcurrently(ctx context.Context, cloud backuper, paths, names []string, concurrency int) ([]storage.Backup, []FileEntry, error) {
+	if concurrency <= 1 || len(paths) <= 1 {
+		return cloud.backup(ctx, paths, names)
+	}
+	backups := make([]storage.Backup, len(paths))
+	files := make([]FileEntry, len(paths))
+	errs := make([]error, len(paths))
+	done := make([]bool, len(paths))
+	jobs := make(chan int)
+	failed := false
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				bs, fs, err := cloud.backup(ctx, paths[i:i+1], names[i:i+1])
+				mu.Lock()
+				if err != nil {
+					errs[i], failed = err, true
+				} else {
+					backups[i], files[i], done[i] = bs[0], fs[0], true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := range paths {
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	n := 0
+	for n < len(paths) && done[n] {
+		n++
+	}
+	for i := n + 1; i < len(paths); i++ {
+		if !done[i] {
+			continue
+		}
+		// the backups returned must be a prefix of paths.
+		if err := cloud.discard(context.Background(), backups[i], files[i]); err != nil {
+			warnings.warnf(warnPartialUpload, "error discarding %s, uploaded after %s failed:%v", names[i], names[n], err)
+		}
+	}
+	var failures uploadErrors
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fileError{name: names[i], err: err})
+		}
+	}
+	switch {
+	case len(failures) > 0:
+		return backups[:n], files[:n], failures
+	case n < len(paths):
+		// stopped feeding the workers.
+		return backups[:n], files[:n], ctx.Err()
+	}
+	return backups, files, nil
+}
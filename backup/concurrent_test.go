@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/ncw/swift/v2/swifttest"
+)
+
+// failingBackuper stores every file but those in fail, keeping what was
+// discarded. Calls of backup wait for each other on started, if set.
+type failingBackuper struct {
+	fail      map[string]error
+	started   *sync.WaitGroup
+	mu        sync.Mutex
+	discarded []string
+}
+
+func (b *failingBackuper) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	if b.started != nil {
+		b.started.Done()
+		b.started.Wait()
+	}
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for _, n := range names {
+		if err := b.fail[n]; err != nil {
+			return backups, files, err
+		}
+		backups = append(backups, storage.Backup{URL: "mem://" + n})
+		files = append(files, FileEntry{Name: n})
+	}
+	return backups, files, nil
+}
+
+func (b *failingBackuper) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	return storage.Backup{URL: "mem://" + name}, nil
+}
+
+func (b *failingBackuper) canary(ctx context.Context, runID string) error { return nil }
+
+func (b *failingBackuper) digest(ctx context.Context, bk storage.Backup) (string, int64, error) {
+	return "", 0, nil
+}
+
+func (b *failingBackuper) ping(ctx context.Context) error { return nil }
+
+func (b *failingBackuper) discard(ctx context.Context, bk storage.Backup, f FileEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.discarded = append(b.discarded, f.Name)
+	return nil
+}
+
+func testNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("trt1/f%02d.csv", i)
+	}
+	return names
+}
+
+func TestBackupConcurrentlyKeepsOrder(t *testing.T) {
+	names := testNames(20)
+	backups, files, err := backupConcurrently(context.Background(), &failingBackuper{}, names, names, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != len(names) || len(files) != len(names) {
+		t.Fatalf("got %d backups and %d files, want %d", len(backups), len(files), len(names))
+	}
+	for i, n := range names {
+		if backups[i].URL != "mem://"+n || files[i].Name != n {
+			t.Errorf("backup %d is %s (%s), want %s", i, backups[i].URL, files[i].Name, n)
+		}
+	}
+}
+
+func TestBackupConcurrentlyAggregatesErrors(t *testing.T) {
+	names := testNames(3)
+	first := errors.New("first")
+	// every upload starts before the first one fails.
+	var started sync.WaitGroup
+	started.Add(len(names))
+	b := &failingBackuper{fail: map[string]error{names[0]: first, names[2]: errors.New("second")}, started: &started}
+	backups, _, err := backupConcurrently(context.Background(), b, names, names, 3)
+	if len(backups) != 0 {
+		t.Errorf("got %d backups, want none: the first file failed", len(backups))
+	}
+	var errs uploadErrors
+	if !errors.As(err, &errs) || len(errs) != 2 || errs[0].name != names[0] || errs[1].name != names[2] {
+		t.Fatalf("error is %v, want both failures in order", err)
+	}
+	if !errors.Is(err, first) {
+		t.Errorf("error %v doesn't unwrap to the first failure", err)
+	}
+	if len(b.discarded) != 1 || b.discarded[0] != names[1] {
+		t.Errorf("discarded %v, want only %s, stored after the first failure", b.discarded, names[1])
+	}
+}
+
+// TestBackupConcurrentlySwift uploads to an in-process Swift server from
+// several workers, to be run with -race. SWIFT_STORAGE_URL makes every
+// worker's authentication wrap the connection.
+func TestBackupConcurrentlySwift(t *testing.T) {
+	srv, err := swifttest.NewSwiftServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conf := devConfig(testConfig(t), srv.AuthURL)
+	ctx := context.Background()
+	setup := newSwiftClient(conf)
+	if err := setup.authenticate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := setup.conn.ContainerCreate(ctx, conf.SwiftContainer, nil); err != nil {
+		t.Fatal(err)
+	}
+	conf.SwiftStorageURL = setup.conn.StorageUrl
+
+	var contents []string
+	for i := 0; i < 16; i++ {
+		contents = append(contents, fmt.Sprintf("f%02d.csv", i), fmt.Sprintf("a,b\n%d,%d\n", i, i))
+	}
+	paths := writeTestFiles(t, contents...)
+	names := testNames(len(paths))
+	backups, files, err := backupConcurrently(ctx, newSwiftClient(conf), paths, names, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range names {
+		if want := conf.SwiftStorageURL + "/" + conf.SwiftContainer + "/" + n; backups[i].URL != want || files[i].Name != n {
+			t.Errorf("backup %d is %s (%s), want %s", i, backups[i].URL, files[i].Name, want)
+		}
+	}
+}
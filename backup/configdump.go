@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+)
+
+const redacted = "REDACTED"
+
+// configEntry is one resolved configuration value and where it came from.
+type configEntry struct {
+	Name   string      `json:"name"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// configEntries lists every envconfig-managed field of conf, in declaration
+// order, with secrets redacted. Fields tagged secret:"true" are fully
+// hidden; secret:"uri" only shows the scheme, user and host of a URI, see
+// redactURI.
+func configEntries(conf Config) []configEntry {
+	v := reflect.ValueOf(conf)
+	t := v.Type()
+	var entries []configEntry
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := f.Tag.Lookup("envconfig")
+		if !ok {
+			continue
+		}
+		var value interface{} = v.Field(i).Interface()
+		if s, ok := value.(fmt.Stringer); ok {
+			value = s.String()
+		}
+		switch f.Tag.Get("secret") {
+		case "true":
+			if !v.Field(i).IsZero() {
+				value = redacted
+			}
+		case "uri":
+			value = redactURI(v.Field(i).String())
+		}
+		entries = append(entries, configEntry{Name: name, Value: value, Source: configSource(name, f)})
+	}
+	return entries
+}
+
+func configSource(name string, f reflect.StructField) string {
+	if path, ok := overlaySource[name]; ok {
+		return "overlay " + path
+	}
+	if source, ok := cliSource[name]; ok {
+		return source
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return "env"
+	}
+	if _, ok := f.Tag.Lookup("default"); ok {
+		return "default"
+	}
+	return "unset"
+}
+
+// redactURI hides the password, path, query and fragment of raw, any of
+// which may hold a credential (a webhook token, a signature). Values that
+// aren't URLs with a scheme and host, as the key/value DSNs of postgres, are
+// hidden whole.
+func redactURI(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if u.Path != "" && u.Path != "/" {
+		u.Path, u.RawPath = "/"+redacted, ""
+	}
+	u.RawQuery, u.Fragment, u.RawFragment = "", "", ""
+	return u.String()
+}
+
+// configCmd implements "config dump".
+func configCmd(ctx context.Context, conf Config, args []string) error {
+	if len(args) != 1 || args[0] != "dump" {
+		return fmt.Errorf("usage: config dump")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(configEntries(conf))
+}
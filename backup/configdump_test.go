@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactURI(t *testing.T) {
+	for raw, want := range map[string]string{
+		"":                                  "",
+		"mongodb://app:hunter2@db:27017":    "mongodb://app:REDACTED@db:27017",
+		"postgres://app:hunter2@db/backups": "postgres://app:REDACTED@db/REDACTED",
+		"host=db user=app password=hunter2": redacted,
+		"https://hooks.slack.com/services/T/B/sec": "https://hooks.slack.com/REDACTED",
+		"https://api.example.com/?token=sec":       "https://api.example.com/",
+		"https://acct.blob.core.windows.net?sig=x": "https://acct.blob.core.windows.net",
+		"db:27017": redacted,
+	} {
+		got := redactURI(raw)
+		if got != want {
+			t.Errorf("redactURI(%q) = %q, want %q", raw, got, want)
+		}
+		for _, secret := range []string{"hunter2", "sec", "sig=x"} {
+			if strings.Contains(raw, secret) && strings.Contains(got, secret) {
+				t.Errorf("redactURI(%q) = %q, showing %s", raw, got, secret)
+			}
+		}
+	}
+}
+
+func TestConfigEntriesHideWebhooks(t *testing.T) {
+	conf := testConfig(t)
+	conf.NotifyURL = "https://hooks.slack.com/services/T0/B0/token"
+	conf.EventsURL = "https://discord.com/api/webhooks/1/token"
+	conf.BackfillURL = "https://backfill.example.com/hook/token"
+	conf.MetricsEndpoint = "https://push.example.com/token"
+	for _, e := range configEntries(conf) {
+		switch e.Name {
+		case "NOTIFY_URL", "EVENTS_URL", "BACKFILL_URL", "METRICS_ENDPOINT":
+			if e.Value != redacted {
+				t.Errorf("%s shown as %v, want %s", e.Name, e.Value, redacted)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How uploaded files are named, set by OBJECT_LAYOUT.
+const (
+	// layoutName stores a file under <aid>/<name>, as it was read.
+	layoutName = "name"
+	// layoutContent stores a file under objects/sha256/<its SHA-256>, a
+	// manifest of the run mapping the original names to the objects.
+	layoutContent = "content"
+)
+
+const contentPrefix = "objects/sha256/"
+
+// contentIndex indexes the records by the names of their files, for the
+// content objects to be looked up.
+const contentIndex = "files_name"
+
+func checkObjectLayout(layout string) error {
+	if layout != layoutName && layout != layoutContent {
+		return fmt.Errorf("%q must be %q or %q", layout, layoutName, layoutContent)
+	}
+	return nil
+}
+
+// contentName is the name of the object with the content of SHA-256 digest.
+func contentName(digest string) string {
+	return contentPrefix + digest
+}
+
+// isContentObject tells whether name is a content addressed object, which
+// the records of any agency may share.
+func isContentObject(name string) bool {
+	return strings.HasPrefix(name, contentPrefix)
+}
+
+// dedupContent drops from upload, the indexes of the paths to upload, those
+// with the same content, by digests, as an earlier one: they would be the
+// same object. Each becomes a link to the first name with its content.
+func dedupContent(upload []int, names, digests []string) ([]int, []fileLink) {
+	var kept []int
+	var links []fileLink
+	first := make(map[string]int)
+	for _, i := range upload {
+		f, dup := first[digests[i]]
+		if !dup {
+			first[digests[i]] = i
+			kept = append(kept, i)
+			continue
+		}
+		links = append(links, fileLink{Name: names[i], Target: names[f]})
+	}
+	return kept, links
+}
+
+// storedObject is a content object a record already refers to.
+type storedObject struct {
+	backup storage.Backup
+	file   FileEntry
+}
+
+// findStoredContent looks up in the records of coll the content objects of
+// digests already stored in one of backends, by digest: objects are only
+// deleted once no record refers to them, so they needn't be uploaded
+// again.
+func findStoredContent(ctx context.Context, coll *mongo.Collection, digests, backends []string) (map[string]storedObject, error) {
+	byName := make(map[string]string)
+	var names []string
+	for _, d := range digests {
+		if _, ok := byName[contentName(d)]; !ok {
+			byName[contentName(d)] = d
+			names = append(names, contentName(d))
+		}
+	}
+	stored := make(map[string]storedObject)
+	if len(names) == 0 {
+		return stored, nil
+	}
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "files.name", Value: 1}},
+		Options: options.Index().SetName(contentIndex),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating index(%s) of the content objects:%w", contentIndex, err)
+	}
+	cur, err := coll.Find(ctx, bson.M{"files.name": bson.M{"$in": names}}, options.Find().SetProjection(bson.M{"backups": 1, "files": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error looking up stored content:%w", err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return nil, fmt.Errorf("error looking up stored content:%w", err)
+	}
+	configured := make(map[string]bool)
+	for _, b := range backends {
+		configured[b] = true
+	}
+	for _, rec := range recs {
+		for i, f := range rec.Files {
+			d, ok := byName[f.Name]
+			if !ok || i >= len(rec.Backups) || f.SHA256 != d || !configured[f.Backend] {
+				continue
+			}
+			if _, dup := stored[d]; !dup {
+				stored[d] = storedObject{backup: rec.Backups[i], file: f}
+			}
+		}
+	}
+	return stored, nil
+}
+
+// splitStored moves to the front of upload, the indexes of the paths to
+// upload, those whose content, by digests, is in stored, returning how
+// many they are.
+func splitStored(upload []int, digests []string, stored map[string]storedObject) ([]int, int) {
+	var found, rest []int
+	for _, i := range upload {
+		if _, ok := stored[digests[i]]; ok {
+			found = append(found, i)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+	return append(found, rest...), len(found)
+}
+
+// manifestEntry is an uploaded file as listed by the manifest of a run.
+type manifestEntry struct {
+	Name   string `json:"name"`
+	Object string `json:"object"`
+	SHA256 string `json:"sha256"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// contentManifest lists the original names of the objects of a run with
+// OBJECT_LAYOUT=content, and the links among them.
+type contentManifest struct {
+	Layout string          `json:"layout"`
+	Files  []manifestEntry `json:"files"`
+	Links  []fileLink      `json:"links,omitempty"`
+}
+
+func manifestName(aid string, year int, months []int, t time.Time) string {
+	return fmt.Sprintf("%s/manifests/manifest-%d-%s-%s.json", aid, year, monthsLabel(months), t.UTC().Format("20060102T150405Z"))
+}
+
+// buildManifest lists files, stored as content objects, by names, the
+// original name of each one.
+func buildManifest(files []FileEntry, names []string, links []fileLink) ([]byte, error) {
+	m := contentManifest{Layout: layoutContent, Links: links}
+	for k, f := range files {
+		m.Files = append(m.Files, manifestEntry{Name: names[k], Object: f.Name, SHA256: f.SHA256, Bytes: f.Bytes})
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding manifest:%w", err)
+	}
+	return b, nil
+}
+
+// readManifest downloads the manifest of a record, returning the original
+// name of every object it lists.
+func readManifest(ctx context.Context, cloud *swiftClient, b storage.Backup) (map[string]string, error) {
+	if err := cloud.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := cloud.download(ctx, b.URL, &buf); err != nil {
+		return nil, err
+	}
+	var m contentManifest
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest(%s):%w", b.URL, err)
+	}
+	names := make(map[string]string)
+	for _, f := range m.Files {
+		names[f.Object] = f.Name
+	}
+	return names, nil
+}
+
+// originalNames returns the name the object name of rec was backed up as,
+// read from the manifest of content addressed records and from the file
+// entries of those named with KEY_TEMPLATE, the object name being it
+// otherwise.
+func originalNames(ctx context.Context, cloud *swiftClient, rec Record) (func(name string) string, error) {
+	if rec.Manifest == nil && rec.KeyTemplate == "" {
+		return func(name string) string { return name }, nil
+	}
+	names := make(map[string]string)
+	if rec.Manifest != nil {
+		var err error
+		if names, err = readManifest(ctx, cloud, *rec.Manifest); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range rec.Files {
+		if f.Original != "" {
+			names[f.Name] = f.Original
+		}
+	}
+	return func(name string) string {
+		if n, ok := names[name]; ok {
+			return n
+		}
+		return name
+	}, nil
+}
@@ -0,0 +1,224 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/ncw/swift/v2"
+)
+
+// copyCheckpoint is kept in the --checkpoint file of copy-container, telling
+// where an interrupted copy resumes. Objects are listed in name order, so
+// every one up to Last was copied.
+type copyCheckpoint struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Prefix string `json:"prefix"`
+	Last   string `json:"last"`
+	Copied int    `json:"copied"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func readCheckpoint(path string, want copyCheckpoint) (copyCheckpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return want, nil
+	}
+	if err != nil {
+		return want, fmt.Errorf("error reading checkpoint(%s):%w", path, err)
+	}
+	var cp copyCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return want, fmt.Errorf("error decoding checkpoint(%s):%w", path, err)
+	}
+	if cp.From != want.From || cp.To != want.To || cp.Prefix != want.Prefix {
+		return want, fmt.Errorf("checkpoint %s is of a copy from %s to %s (prefix %q), remove it to start over", path, cp.From, cp.To, cp.Prefix)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint file, never leaving it half
+// written.
+func writeCheckpoint(path string, cp copyCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing checkpoint(%s):%w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing checkpoint(%s):%w", path, err)
+	}
+	return nil
+}
+
+// swiftAccount returns conf with the Swift account of the overlay file at
+// path (SWIFT_AUTHURL, SWIFT_USERNAME, SWIFT_APIKEY and so on), the rest of
+// the configuration being kept.
+func swiftAccount(conf Config, path string) (Config, error) {
+	vars, err := readOverlay(path)
+	if err != nil {
+		return conf, fmt.Errorf("error reading account(%s):%w", path, err)
+	}
+	fields := map[string]*string{
+		"SWIFT_AUTHURL":    &conf.SwiftAuthURL,
+		"SWIFT_USERNAME":   &conf.SwiftUsername,
+		"SWIFT_APIKEY":     &conf.SwiftAPIKey,
+		"SWIFT_DOMAIN":     &conf.SwiftDomain,
+		"SWIFT_REGION":     &conf.SwiftRegion,
+		"SWIFT_STORAGEURL": &conf.SwiftStorageURL,
+	}
+	for k, v := range vars {
+		if f, ok := fields[k]; ok {
+			*f = v
+			continue
+		}
+		if k != "SWIFT_AUTH_VERSION" {
+			return conf, fmt.Errorf("account %s sets %s, only the SWIFT_ account variables can be set", path, k)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 3 {
+			return conf, fmt.Errorf("account %s has invalid SWIFT_AUTH_VERSION %q: must be 0, 1, 2 or 3", path, v)
+		}
+		conf.SwiftAuthVersion = n
+	}
+	return conf, nil
+}
+
+// copyObject streams the object name of src.container into dst.container,
+// checking the MD5 of what was read against the source ETag, for regular
+// objects, and against the ETag of the copy.
+func copyObject(ctx context.Context, src, dst *swiftClient, o swift.Object) error {
+	pr, pw := io.Pipe()
+	url := fmt.Sprintf("%s/%s/%s", src.conn.StorageUrl, src.container, o.Name)
+	go func() {
+		pw.CloseWithError(src.download(ctx, url, pw))
+	}()
+	h := md5.New()
+	b, err := dst.uploadTo(ctx, dst.container, o.Name, io.TeeReader(pr, h))
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != o.Hash {
+		// large objects are copied whole, their ETag being of the manifest.
+		info, _, err := src.conn.Object(ctx, src.container, o.Name)
+		if err != nil {
+			return fmt.Errorf("error reading object info(%s/%s):%w", src.container, o.Name, err)
+		}
+		if info.ObjectType == swift.RegularObjectType {
+			return fmt.Errorf("object %s read with MD5 %s, the source ETag is %s", o.Name, sum, o.Hash)
+		}
+	}
+	if b.Hash != sum {
+		return fmt.Errorf("copy of %s has ETag %s, expected %s", o.Name, b.Hash, sum)
+	}
+	return nil
+}
+
+// copyContainerCmd duplicates a container, or the objects under a prefix of
+// it, into another container, possibly of another account, for provider
+// migrations. Backup records are left as they are.
+func copyContainerCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("copy-container", flag.ContinueOnError)
+	from := fs.String("from", conf.SwiftContainer, "container copied")
+	to := fs.String("to", "", "container the objects are copied into")
+	account := fs.String("to-account", "", "file with the SWIFT_ variables (KEY=VALUE lines) of the account of --to; the same account by default")
+	prefix := fs.String("prefix", "", "only copy the objects whose name starts with this, e.g. an agency")
+	checkpoint := fs.String("checkpoint", "", "file where progress is kept, an interrupted copy resuming from it")
+	maxRate := fs.String("max-rate", "0", "cap on the copy rate in bytes per second, e.g. 500K, 10M (0 is unlimited)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return fmt.Errorf("usage: copy-container --to <container> [--from container] [--to-account file] [--prefix p] [--checkpoint file] [--max-rate r]")
+	}
+	if err := checkWritable(conf.ReadOnly, "copy objects"); err != nil {
+		return err
+	}
+	bytesPerSec, err := parseByteRate(*maxRate)
+	if err != nil {
+		return err
+	}
+	dstConf := conf
+	if *account != "" {
+		if dstConf, err = swiftAccount(conf, *account); err != nil {
+			return err
+		}
+	} else if *to == *from {
+		return fmt.Errorf("--to must be another container or --to-account another account")
+	}
+	src := newSwiftClient(conf)
+	src.container = *from
+	src.downloads = newByteLimiter(bytesPerSec)
+	dst := newSwiftClient(dstConf)
+	dst.container = *to
+	if err := src.authenticate(ctx); err != nil {
+		return err
+	}
+	if err := dst.authenticate(ctx); err != nil {
+		return err
+	}
+	if err := dst.conn.ContainerCreate(ctx, *to, nil); err != nil {
+		return fmt.Errorf("error creating container(%s):%w", *to, err)
+	}
+
+	cp := copyCheckpoint{From: src.conn.StorageUrl + "/" + *from, To: dst.conn.StorageUrl + "/" + *to, Prefix: *prefix}
+	if *checkpoint != "" {
+		if cp, err = readCheckpoint(*checkpoint, cp); err != nil {
+			return err
+		}
+		if cp.Last != "" {
+			log.Printf("Resuming copy after %s (%d objects, %d bytes copied)", cp.Last, cp.Copied, cp.Bytes)
+		}
+	}
+	objs, err := src.conn.ObjectsAll(ctx, *from, &swift.ObjectsOpts{Prefix: *prefix, Marker: cp.Last})
+	if err != nil {
+		return fmt.Errorf("error listing objects(%s):%w", *from, err)
+	}
+	skipped := 0
+	for _, o := range objs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if o.Name <= cp.Last {
+			continue
+		}
+		// objects copied by a run that stopped before checkpointing them.
+		info, _, err := dst.conn.Object(ctx, *to, o.Name)
+		switch {
+		case err == nil && info.Bytes == o.Bytes && info.Hash == o.Hash:
+			skipped++
+		case err != nil && !errors.Is(err, swift.ObjectNotFound):
+			return fmt.Errorf("error reading object info(%s/%s):%w", *to, o.Name, err)
+		default:
+			if err := copyObject(ctx, src, dst, o); err != nil {
+				return err
+			}
+			cp.Copied++
+			cp.Bytes += o.Bytes
+			log.Printf("Copied %s (%d bytes)", o.Name, o.Bytes)
+		}
+		cp.Last = o.Name
+		if *checkpoint != "" {
+			if err := writeCheckpoint(*checkpoint, cp); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Copied %d objects (%d bytes) from %s to %s, %d already there", cp.Copied, cp.Bytes, cp.From, cp.To, skipped)
+	return nil
+}
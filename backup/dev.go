@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/ncw/swift/v2/swifttest"
+)
+
+const devContainer = "salvador-dev"
+
+// devConfig points conf to the in-process object store at authURL and turns
+// off everything that needs another service.
+func devConfig(conf Config, authURL string) Config {
+	conf.StorageBackend = []string{backendSwift}
+	conf.SwiftUsername = swifttest.TEST_ACCOUNT
+	conf.SwiftAPIKey = swifttest.TEST_ACCOUNT
+	conf.SwiftAuthURL = authURL
+	conf.SwiftAuthVersion = 1
+	conf.SwiftDomain = ""
+	conf.SwiftRegion = ""
+	conf.SwiftStorageURL = ""
+	conf.SwiftContainer = devContainer
+	conf.SizeTiers = nil
+	conf.MetadataSink = sinkStdout
+	conf.ChainLog = false
+	conf.RetryQueue = false
+	conf.ResultCache = false
+	conf.SkipUnchanged = false
+	conf.BackoffState = false
+	conf.EventsURL = ""
+	conf.NotifyURL = ""
+	conf.ReadOnly = false
+	if conf.AID == "" {
+		conf.AID = "dev"
+	}
+	if conf.Year == 0 && conf.Month == 0 && conf.Months == "" {
+		now := time.Now()
+		conf.Year, conf.Month = decInt(now.Year()), decInt(now.Month())
+	}
+	return conf
+}
+
+// devCmd exercises the whole backup and restore flow with no external
+// services: objects go to an ephemeral in-process Swift server and the
+// records are kept in memory. The files listed as arguments (or, without
+// arguments, in stdin) are backed up, then every record is restored into
+// --dir and each file checked against its stored ETag.
+//
+// With --serve it only runs the object store, printing the environment to
+// point other invocations to it, until interrupted.
+func devCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("dev", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:0", "address the object store listens on")
+	dir := fs.String("dir", "", "directory the files are restored into (a temporary one by default)")
+	serve := fs.Bool("serve", false, "only run the object store, until interrupted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	srv, err := swifttest.NewSwiftServer(*addr)
+	if err != nil {
+		return fmt.Errorf("error starting dev object store:%w", err)
+	}
+	defer srv.Close()
+	conf = devConfig(conf, srv.AuthURL)
+
+	cloud := newSwiftClient(conf)
+	if err := cloud.authenticate(ctx); err != nil {
+		return err
+	}
+	if err := cloud.conn.ContainerCreate(ctx, conf.SwiftContainer, nil); err != nil {
+		return fmt.Errorf("error creating container(%s):%w", conf.SwiftContainer, err)
+	}
+
+	if *serve {
+		fmt.Printf("SWIFT_AUTHURL=%s\nSWIFT_AUTH_VERSION=1\nSWIFT_USERNAME=%s\nSWIFT_APIKEY=%s\nSWIFT_CONTAINER=%s\nMETADATA_SINK=%s\n",
+			srv.AuthURL, swifttest.TEST_ACCOUNT, swifttest.TEST_ACCOUNT, conf.SwiftContainer, sinkStdout)
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		<-ctx.Done()
+		return nil
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		if paths, err = readPaths(os.Stdin); err != nil {
+			return fmt.Errorf("error reading from stdin:%w", err)
+		}
+	}
+	if paths, err = expandPaths(paths, conf.InputExclude, conf.InputFollowSymlinks); err != nil {
+		return err
+	}
+	flagged, err := applyContentTypePolicy(conf, paths)
+	if err != nil {
+		return err
+	}
+	recs, err := run(ctx, conf, paths, flagged, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := writeRecords(os.Stdout, conf.MetadataDelimiter, recs); err != nil {
+		return fmt.Errorf("error writing metadata to stdout:%w", err)
+	}
+
+	if *dir == "" {
+		if *dir, err = ioutil.TempDir("", "salvador-dev-"); err != nil {
+			return fmt.Errorf("error creating restore directory:%w", err)
+		}
+	}
+	for _, rec := range recs {
+		files := rec.Backups
+		if rec.SHA256Sums != nil {
+			files = append(files, *rec.SHA256Sums)
+		}
+		if rec.Provenance != nil {
+			files = append(files, *rec.Provenance)
+		}
+		files = append(files, rec.BagIt...)
+		original, err := originalNames(ctx, cloud, rec)
+		if err != nil {
+			return err
+		}
+		local := func(name string) (string, error) {
+			return filepath.Join(*dir, filepath.FromSlash(restorePath(rec.objectPrefix(), original(name)))), nil
+		}
+		if _, err := restoreFiles(ctx, cloud, files, recordFiles(rec), local, 1); err != nil {
+			return err
+		}
+		for _, l := range rec.Links {
+			dst, _ := local(l.Name)
+			src, _ := local(l.Target)
+			if err := restoreLink(src, dst); err != nil {
+				return err
+			}
+			fmt.Println(dst)
+		}
+	}
+	log.Printf("Backed up %d file(s) in %d record(s) and restored them into %s", len(paths), len(recs), *dir)
+	return nil
+}
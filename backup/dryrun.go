@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// dryRun checks what run would need, without uploading or writing anything:
+// every file is read, mongo or postgres (with METADATA_SINK=mongo or
+// postgres) and the storage backends are pinged. It returns the records run
+// would write, with the files that would be uploaded and no backups, their
+// URLs only being known once stored.
+func dryRun(ctx context.Context, conf Config, paths, flagged []string) ([]Record, error) {
+	months, err := runMonths(conf)
+	if err != nil {
+		return nil, err
+	}
+	agency := splitAID(conf.AID, conf.AIDSeparator)
+	digests, err := fileDigests(paths)
+	if err != nil {
+		return nil, fmt.Errorf("error computing checksums:%w", err)
+	}
+	sizes := make([]int64, len(paths))
+	var totalBytes int64
+	for i, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file info(%s):%w", p, err)
+		}
+		sizes[i] = fi.Size()
+		totalBytes += fi.Size()
+	}
+	var inHash string
+	if conf.ResultCache {
+		inHash = inputHash(paths, digests)
+	}
+
+	if conf.MetadataSink == sinkMongo {
+		db, err := connect(ctx, conf.MongoURI)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to mongo:%w", err)
+		}
+		defer disconnect(db)
+		if err := db.Ping(ctx, readpref.Primary()); err != nil {
+			return nil, fmt.Errorf("error pinging mongo:%w", err)
+		}
+	}
+	if conf.MetadataSink == sinkPostgres {
+		if err := pingPostgres(ctx, conf.PostgresURI); err != nil {
+			return nil, err
+		}
+	}
+	cloud, err := newBackuper(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := cloud.ping(ctx); err != nil {
+		return nil, err
+	}
+
+	names, err := objectNames(agency.prefix(), paths, conf.NameCollision)
+	if err != nil {
+		return nil, err
+	}
+	upload, links, err := dedupLinks(paths, names)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileEntry
+	var members []packageMember
+	for _, i := range upload {
+		if conf.PackageMode == packageTarGz {
+			members = append(members, packageMember{Name: restorePath(agency.prefix(), names[i]), Bytes: sizes[i], SHA256: digests[i]})
+			continue
+		}
+		files = append(files, plannedFile(conf, names[i], sizes[i], digests[i]))
+	}
+	if conf.PackageMode == packageTarGz {
+		for _, l := range links {
+			members = append(members, packageMember{Name: restorePath(agency.prefix(), l.Name), Link: restorePath(agency.prefix(), l.Target)})
+		}
+		links = nil
+		// the size and digest of the archive are only known once built.
+		files = []FileEntry{plannedFile(conf, packageName(agency.prefix(), int(conf.Year), months, time.Now()), 0, "")}
+	}
+	if conf.KeyTemplate != "" {
+		planned := make([]string, len(files))
+		for k, f := range files {
+			planned[k] = f.Name
+		}
+		keys, err := objectKeys(conf.KeyTemplate, agency, int(conf.Year), months, time.Now(), newRunID(), agency.prefix(), planned)
+		if err != nil {
+			return nil, err
+		}
+		for k := range files {
+			files[k].Original, files[k].Name = files[k].Name, keys[k]
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	var recs []Record
+	for _, m := range months {
+		rec := Record{
+			AID:            agency.AID,
+			SubAID:         agency.Sub,
+			IdempotencyKey: conf.IdempotencyKey,
+			InputHash:      inHash,
+			Year:           int(conf.Year),
+			Month:          m,
+			Backups:        []storage.Backup{},
+			Files:          files,
+			Build:          currentBuild(),
+			Links:          links,
+			Timestamp:      now,
+			TotalBytes:     totalBytes,
+			Flagged:        flagged,
+			Members:        members,
+			KeyTemplate:    conf.KeyTemplate,
+		}
+		if len(months) > 1 {
+			rec.Months = months
+		}
+		recs = append(recs, rec)
+	}
+	log.Printf("Dry run: %d file(s) of %d bytes would be uploaded, %d record(s) written", len(files), totalBytes, len(recs))
+	return recs, nil
+}
+
+// plannedFile is the entry a file would get, its container and backend
+// being left out when several backends share the files.
+func plannedFile(conf Config, name string, size int64, digest string) FileEntry {
+	f := FileEntry{Name: name, Bytes: size, SHA256: digest}
+	if len(conf.StorageBackend) > 1 {
+		return f
+	}
+	f.Backend = conf.StorageBackend[0]
+	f.Container = conf.S3Bucket
+	if f.Backend == backendSwift {
+		f.Container = conf.SizeTiers.container(size, conf.SwiftContainer)
+	}
+	return f
+}
+
+// writePlan prints the records of a dry run as indented JSON.
+func writePlan(w io.Writer, recs []Record) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(recs)
+}
@@ -0,0 +1,266 @@
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// encryptionAlgorithm is AES-256-GCM applied to segments of
+// encryptionSegment bytes, so files never have to fit in memory. Segment i
+// is sealed with the file nonce XORed with i and, as additional data, a
+// byte telling whether it is the last one, which makes truncated objects
+// fail to decrypt.
+const (
+	encryptionAlgorithm = "aes-256-gcm-segmented"
+	encryptionSegment   = 64 << 10
+)
+
+// fileEncryption is how a file was encrypted before upload.
+type fileEncryption struct {
+	Algorithm string `bson:"algorithm" json:"algorithm"`
+	// KeyID identifies the BACKUP_ENCRYPTION_KEY used, see encryptionKeyID.
+	KeyID        string `bson:"key_id" json:"key_id"`
+	Nonce        string `bson:"nonce" json:"nonce"`
+	SegmentBytes int    `bson:"segment_bytes" json:"segment_bytes"`
+	// SHA256 is the digest of the encrypted content, the one stored.
+	SHA256 string `bson:"sha256" json:"sha256"`
+}
+
+// parseEncryptionKey reads BACKUP_ENCRYPTION_KEY: 32 bytes, hex or base64
+// encoded.
+func parseEncryptionKey(v string) ([]byte, error) {
+	if key, err := hex.DecodeString(v); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(v); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("must be 32 bytes, hex or base64 encoded")
+}
+
+// encryptionKeyID is the first 8 bytes of the SHA-256 of key, hex encoded,
+// telling keys apart without revealing them.
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of segment i of a file.
+func segmentNonce(nonce []byte, i uint64) []byte {
+	n := make([]byte, len(nonce))
+	copy(n, nonce)
+	tail := n[len(n)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^i)
+	return n
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealWriter encrypts what is written to it into w, one segment at a time.
+// Close seals the last segment, which is empty for empty files.
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	seq   uint64
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// a full segment is only sealed once more data shows it isn't the
+		// last one.
+		if len(s.buf) == encryptionSegment {
+			if err := s.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := encryptionSegment - len(s.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		s.buf = append(s.buf, p[:k]...)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (s *sealWriter) seal(last bool) error {
+	out := s.aead.Seal(nil, segmentNonce(s.nonce, s.seq), s.buf, segmentAD(last))
+	s.seq++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(out)
+	return err
+}
+
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+// openWriter decrypts the segments written to it into w. Close opens the
+// last segment, failing if the content was truncated.
+type openWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	seq   uint64
+}
+
+func (o *openWriter) Write(p []byte) (int, error) {
+	size := encryptionSegment + o.aead.Overhead()
+	o.buf = append(o.buf, p...)
+	for len(o.buf) > size {
+		if err := o.open(o.buf[:size], false); err != nil {
+			return 0, err
+		}
+		o.buf = o.buf[size:]
+	}
+	return len(p), nil
+}
+
+func (o *openWriter) open(segment []byte, last bool) error {
+	plain, err := o.aead.Open(nil, segmentNonce(o.nonce, o.seq), segment, segmentAD(last))
+	if err != nil {
+		return fmt.Errorf("error decrypting segment %d:%w", o.seq, err)
+	}
+	o.seq++
+	_, err = o.w.Write(plain)
+	return err
+}
+
+func (o *openWriter) Close() error {
+	return o.open(o.buf, true)
+}
+
+// newDecrypter returns a writer decrypting into w the content encrypted as
+// enc says, refusing keys other than the one it was encrypted with.
+func newDecrypter(rawKey string, enc *fileEncryption, w io.Writer) (io.WriteCloser, error) {
+	if enc.Algorithm != encryptionAlgorithm || enc.SegmentBytes != encryptionSegment {
+		return nil, fmt.Errorf("unsupported encryption %s with %d bytes segments", enc.Algorithm, enc.SegmentBytes)
+	}
+	if rawKey == "" {
+		return nil, fmt.Errorf("file is encrypted with key %s but BACKUP_ENCRYPTION_KEY is not set", enc.KeyID)
+	}
+	key, err := parseEncryptionKey(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BACKUP_ENCRYPTION_KEY:%w", err)
+	}
+	if id := encryptionKeyID(key); id != enc.KeyID {
+		return nil, fmt.Errorf("file is encrypted with key %s, BACKUP_ENCRYPTION_KEY is %s", enc.KeyID, id)
+	}
+	nonce, err := hex.DecodeString(enc.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce %q:%w", enc.Nonce, err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce %q: must have %d bytes", enc.Nonce, aead.NonceSize())
+	}
+	return &openWriter{w: w, aead: aead, nonce: nonce}, nil
+}
+
+// plainSize returns the size of the file encrypted as enc into size bytes.
+func plainSize(enc *fileEncryption, size int64) int64 {
+	segment := int64(enc.SegmentBytes) + 16
+	segments := (size + segment - 1) / segment
+	return size - 16*segments
+}
+
+// encryptFile encrypts path with key into a work file, returning its path,
+// the SHA-256 of path, computed as it is read, and how it was encrypted.
+func encryptFile(key []byte, path string) (string, string, *fileEncryption, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", nil, fmt.Errorf("error generating nonce:%w", err)
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer in.Close()
+	out, err := createWorkFile("encrypted-*")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error creating encrypted file(%s):%w", path, err)
+	}
+	sum, plain := newDigestWriter(), newDigestWriter()
+	s := &sealWriter{w: io.MultiWriter(out, sum), aead: aead, nonce: nonce, buf: make([]byte, 0, encryptionSegment)}
+	_, err = io.Copy(s, io.TeeReader(in, plain))
+	if err == nil {
+		err = s.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeWorkFile(out.Name())
+		return "", "", nil, fmt.Errorf("error encrypting file(%s):%w", path, err)
+	}
+	return out.Name(), plain.sum(), &fileEncryption{
+		Algorithm:    encryptionAlgorithm,
+		KeyID:        encryptionKeyID(key),
+		Nonce:        hex.EncodeToString(nonce),
+		SegmentBytes: encryptionSegment,
+		SHA256:       sum.sum(),
+	}, nil
+}
+
+// decryptFile replaces the encrypted file at path with its content.
+func decryptFile(rawKey string, enc *fileEncryption, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer in.Close()
+	tmp := path + ".decrypting"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating file(%s):%w", tmp, err)
+	}
+	d, err := newDecrypter(rawKey, enc, out)
+	if err == nil {
+		if _, err = io.Copy(d, in); err == nil {
+			err = d.Close()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error decrypting file(%s):%w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error renaming file(%s):%w", tmp, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dadosjusbr/proto/pipeline"
+	"github.com/golang/protobuf/proto"
+)
+
+// Formats of the stage input.
+const (
+	// inputPaths is one path per line.
+	inputPaths = "paths"
+	// inputColeta is the ResultadoColeta JSON of dadosjusbr/proto, the
+	// files being the ones in coleta.arquivos.
+	inputColeta = "coleta-json"
+	// inputPipeline and inputPipelineText are the ResultadoExecucao
+	// protobuf the pipeline stages exchange, in the wire and text formats.
+	// The files are the ones of the collection plus the package.
+	inputPipeline     = "pipeline-proto"
+	inputPipelineText = "pipeline-prototext"
+)
+
+// coletaEnvelope is the part of a ResultadoColeta the stage reads.
+type coletaEnvelope struct {
+	Coleta struct {
+		Orgao    string   `json:"orgao"`
+		Mes      int      `json:"mes"`
+		Ano      int      `json:"ano"`
+		Arquivos []string `json:"arquivos"`
+	} `json:"coleta"`
+}
+
+func readEnvelope(r io.Reader) (coletaEnvelope, error) {
+	var env coletaEnvelope
+	if err := json.NewDecoder(r).Decode(&env); err != nil {
+		return coletaEnvelope{}, fmt.Errorf("error decoding %s input:%w", inputColeta, err)
+	}
+	// draining what follows the document, so all of it is passed through.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return coletaEnvelope{}, err
+	}
+	return env, nil
+}
+
+// readPipeline reads a ResultadoExecucao, in the text format if text is set,
+// returning its collection as an envelope along with the package path. The
+// input is read as a stream, only the fields the stage needs kept.
+func readPipeline(r io.Reader, text bool) (coletaEnvelope, string, error) {
+	var er pipeline.ResultadoExecucao
+	if text {
+		kept, err := filterPipelineText(r)
+		if err == nil {
+			err = proto.UnmarshalText(kept, &er)
+		}
+		if err != nil {
+			return coletaEnvelope{}, "", fmt.Errorf("error decoding pipeline input:%w", err)
+		}
+	} else {
+		kept, err := filterPipelineWire(r)
+		if err == nil {
+			err = proto.Unmarshal(kept, &er)
+		}
+		if err != nil {
+			return coletaEnvelope{}, "", fmt.Errorf("error decoding pipeline input:%w", err)
+		}
+	}
+	var env coletaEnvelope
+	if c := er.GetRc().GetColeta(); c != nil {
+		env.Coleta.Orgao = c.GetOrgao()
+		env.Coleta.Mes = int(c.GetMes())
+		env.Coleta.Ano = int(c.GetAno())
+		env.Coleta.Arquivos = c.GetArquivos()
+	}
+	return env, er.GetPr().GetPacote(), nil
+}
+
+// applyEnvelope takes AID, YEAR and MONTH from env when they are not set,
+// failing when they are and say otherwise. With MONTHS, the envelope month
+// must be one of them.
+func applyEnvelope(conf Config, env coletaEnvelope) (Config, error) {
+	c := env.Coleta
+	if aid := strings.ToLower(c.Orgao); aid != "" {
+		if conf.AID != "" && conf.AID != aid {
+			return conf, fmt.Errorf("input is from agency %q but AID is %q", aid, conf.AID)
+		}
+		conf.AID = aid
+	}
+	if c.Ano != 0 {
+		if conf.Year != 0 && int(conf.Year) != c.Ano {
+			return conf, fmt.Errorf("input is from year %d but YEAR is %d", c.Ano, conf.Year)
+		}
+		conf.Year = decInt(c.Ano)
+	}
+	if c.Mes != 0 {
+		if conf.Months != "" {
+			months, err := parseMonths(conf.Months)
+			if err != nil {
+				return conf, err
+			}
+			for _, m := range months {
+				if m == c.Mes {
+					return conf, nil
+				}
+			}
+			return conf, fmt.Errorf("input is from month %d, not one of MONTHS %s", c.Mes, conf.Months)
+		}
+		if conf.Month != 0 && int(conf.Month) != c.Mes {
+			return conf, fmt.Errorf("input is from month %d but MONTH is %d", c.Mes, conf.Month)
+		}
+		conf.Month = decInt(c.Mes)
+	}
+	return conf, nil
+}
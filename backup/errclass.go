@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/minio/minio-go/v7"
+	"github.com/ncw/swift/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// Classes of storage errors: retryable ones may go away by trying again,
+// permanent ones (bad credentials, missing containers, unreadable files)
+// won't, so uploads failing with them aren't retried.
+const (
+	errClassRetryable = "retryable"
+	errClassPermanent = "permanent"
+)
+
+// errCorrupted marks objects found stored with a checksum other than the one
+// of what was sent.
+var errCorrupted = errors.New("corrupted in transit")
+
+// classifiedError is a storage error with its class, which failed runs
+// carry to the retry queue and to their events.
+type classifiedError struct {
+	class, reason string
+	err           error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// errorClass returns the class of the storage error in the chain of err,
+// empty when there is none.
+func errorClass(err error) string {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	return ""
+}
+
+// classifyStorageError returns the class of a storage error and the
+// reason for it. Errors that can't be told apart are retryable, with an
+// empty reason.
+func classifyStorageError(err error) (string, string) {
+	var netErr net.Error
+	var swiftErr *swift.Error
+	var s3Err minio.ErrorResponse
+	var azErr azblob.StorageError
+	var gcsErr *googleapi.Error
+	var pathErr *os.PathError
+	switch {
+	case errors.Is(err, errReadOnly):
+		return errClassPermanent, "read-only mode"
+	case errors.Is(err, errUploadTimeout):
+		return errClassRetryable, "timeout"
+	case errors.Is(err, errAuthTimeout):
+		return errClassRetryable, "auth timeout"
+	case errors.Is(err, errCorrupted):
+		return errClassRetryable, "corrupted in transit"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return errClassPermanent, "canceled"
+	case errors.As(err, &pathErr):
+		return errClassPermanent, "local file error"
+	case errors.As(err, &swiftErr) && swiftErr.StatusCode != 0:
+		return classifyStatus(swiftErr.StatusCode)
+	case errors.As(err, &s3Err):
+		switch s3Err.Code {
+		case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+			return errClassPermanent, "authentication failed"
+		case "AccessDenied":
+			return errClassPermanent, "access denied"
+		case "NoSuchBucket", "InvalidBucketName":
+			return errClassPermanent, "bucket not found"
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+			return errClassRetryable, s3Err.Code
+		}
+		if s3Err.StatusCode != 0 {
+			return classifyStatus(s3Err.StatusCode)
+		}
+	case errors.As(err, &azErr):
+		switch azErr.ServiceCode() {
+		case azblob.ServiceCodeAuthenticationFailed:
+			return errClassPermanent, "authentication failed"
+		case azblob.ServiceCodeContainerNotFound:
+			return errClassPermanent, "container not found"
+		case azblob.ServiceCodeMd5Mismatch:
+			return errClassRetryable, "corrupted in transit"
+		}
+		if resp := azErr.Response(); resp != nil {
+			return classifyStatus(resp.StatusCode)
+		}
+	case errors.Is(err, gcs.ErrBucketNotExist):
+		return errClassPermanent, "bucket not found"
+	case errors.As(err, &gcsErr):
+		return classifyStatus(gcsErr.Code)
+	case errors.As(err, &netErr):
+		return errClassRetryable, "network error"
+	}
+	return errClassRetryable, ""
+}
+
+// classifyStatus classifies the HTTP status of a storage error: timeouts,
+// throttling (429, and 498 of swift rate limiting), corrupted uploads (422)
+// and server errors are retryable, other client errors permanent.
+func classifyStatus(code int) (string, string) {
+	switch {
+	case code == 401:
+		return errClassPermanent, "authentication failed"
+	case code == 403:
+		return errClassPermanent, "access denied"
+	case code == 404:
+		return errClassPermanent, "not found"
+	case code == 408:
+		return errClassRetryable, "timeout"
+	case code == 429 || code == 498:
+		return errClassRetryable, "throttled"
+	case code == 422:
+		return errClassRetryable, "corrupted in transit"
+	case code >= 500:
+		return errClassRetryable, "server error"
+	case code >= 400:
+		return errClassPermanent, "rejected by the server"
+	}
+	return errClassRetryable, ""
+}
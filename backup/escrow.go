@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// escrowName is the object name of the escrowed records of a run started at
+// t.
+func escrowName(aid string, year int, months []int, t time.Time, runID string) string {
+	return fmt.Sprintf("%s/%d-%s-%s-%s.json.age", aid, year, monthsLabel(months), t.UTC().Format("20060102T150405Z"), runID)
+}
+
+// escrowRecords uploads the records of a run, age encrypted to
+// ESCROW_RECIPIENTS, into ESCROW_CONTAINER of the ESCROW_ACCOUNT Swift
+// account, so which objects make up a backup can be recovered without the
+// metadata store.
+func escrowRecords(ctx context.Context, conf Config, name string, recs []Record) error {
+	var recipients []ageRecipient
+	for _, r := range conf.EscrowRecipients {
+		rec, err := parseAgeRecipient(r)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, rec)
+	}
+	content, err := json.Marshal(recs)
+	if err != nil {
+		return fmt.Errorf("error encoding escrowed records:%w", err)
+	}
+	sealed, err := ageEncrypt(content, recipients)
+	if err != nil {
+		return fmt.Errorf("error encrypting escrowed records:%w", err)
+	}
+	escrowConf := conf
+	if conf.EscrowAccount != "" {
+		if escrowConf, err = swiftAccount(conf, conf.EscrowAccount); err != nil {
+			return err
+		}
+	}
+	c := newSwiftClient(escrowConf)
+	if _, err := c.uploadTo(ctx, conf.EscrowContainer, name, bytes.NewReader(sealed)); err != nil {
+		return fmt.Errorf("error escrowing records:%w", err)
+	}
+	return nil
+}
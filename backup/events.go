@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	eventSource        = "https://github.com/dadosjusbr/salvador-backups"
+	eventTypeCompleted = "br.org.dadosjusbr.backup.completed"
+	eventTypeFailed    = "br.org.dadosjusbr.backup.failed"
+	eventTimeout       = 10 * time.Second
+)
+
+// cloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string       `json:"specversion"`
+	ID              string       `json:"id"`
+	Source          string       `json:"source"`
+	Type            string       `json:"type"`
+	Subject         string       `json:"subject"`
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            backupResult `json:"data"`
+}
+
+// backupResult summarizes a run for the consumers of its events.
+type backupResult struct {
+	AID        string   `json:"aid"`
+	SubAID     string   `json:"sub_aid,omitempty"`
+	Year       int      `json:"year"`
+	Months     []int    `json:"months"`
+	Files      int      `json:"files"`
+	TotalBytes int64    `json:"total_bytes"`
+	Records    []string `json:"records,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	// ErrorClass is retryable or permanent when the run failed storing
+	// its files.
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+func newBackupResult(conf Config, paths []string, recs []Record, runErr error) backupResult {
+	agency := splitAID(conf.AID, conf.AIDSeparator)
+	months, _ := runMonths(conf)
+	res := backupResult{AID: agency.AID, SubAID: agency.Sub, Year: int(conf.Year), Months: months, Files: len(paths)}
+	for _, r := range recs {
+		res.Records = append(res.Records, r.ID.Hex())
+		res.TotalBytes = r.TotalBytes
+	}
+	if runErr != nil {
+		res.Error = runErr.Error()
+		res.ErrorClass = errorClass(runErr)
+	}
+	return res
+}
+
+func newBackupEvent(res backupResult) cloudEvent {
+	typ := eventTypeCompleted
+	if res.Error != "" {
+		typ = eventTypeFailed
+	}
+	subject := fmt.Sprintf("%s/%d/%s", agencyID{AID: res.AID, Sub: res.SubAID}.prefix(), res.Year, monthsLabel(res.Months))
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              newRunID(),
+		Source:          eventSource,
+		Type:            typ,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            res,
+	}
+}
+
+// publishEvent sends ev to EVENTS_URL: POSTed to http(s) URLs, published on
+// EVENTS_NATS_SUBJECT for nats:// URLs.
+func publishEvent(ctx context.Context, conf Config, ev cloudEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("error encoding event:%w", err)
+	}
+	u, err := url.Parse(conf.EventsURL)
+	if err != nil {
+		return fmt.Errorf("error parsing EVENTS_URL:%w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.EventsURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("error creating event request:%w", err)
+		}
+		req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("error posting event(%s):%w", u.Host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("error posting event(%s): status %s", u.Host, resp.Status)
+		}
+		return nil
+	case "nats", "tls":
+		nc, err := nats.Connect(conf.EventsURL, nats.Timeout(eventTimeout))
+		if err != nil {
+			return fmt.Errorf("error connecting to nats(%s):%w", u.Host, err)
+		}
+		defer nc.Close()
+		msg := nats.NewMsg(conf.EventsNATSSubject)
+		msg.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+		msg.Data = body
+		if err := nc.PublishMsg(msg); err != nil {
+			return fmt.Errorf("error publishing event(%s):%w", conf.EventsNATSSubject, err)
+		}
+		if err := nc.FlushWithContext(ctx); err != nil {
+			return fmt.Errorf("error publishing event(%s):%w", conf.EventsNATSSubject, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported EVENTS_URL scheme %q: must be http, https or nats", u.Scheme)
+}
+
+// notifyBackup publishes the outcome of a run, if events are configured,
+// pushes its metrics, if METRICS_ENDPOINT is set, and posts it to NOTIFY_URL.
+// Failing to do any of them never fails the run.
+func notifyBackup(ctx context.Context, conf Config, paths []string, recs []Record, runErr error) {
+	if conf.MetricsEndpoint != "" {
+		if err := pushRunMetrics(ctx, conf, runErr); err != nil {
+			warnings.warnf(warnMetrics, "%v", err)
+		}
+	}
+	if conf.NotifyURL != "" {
+		if err := sendNotification(ctx, conf, newNotification(conf, paths, recs, runErr)); err != nil {
+			warnings.warnf(warnNotification, "%v", err)
+		}
+	}
+	if conf.EventsURL == "" {
+		return
+	}
+	if err := publishEvent(ctx, conf, newBackupEvent(newBackupResult(conf, paths, recs, runErr))); err != nil {
+		warnings.warnf(warnNotification, "%v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dadosjusbr/coletores/status"
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Classes of the errors the stage exits with, each one with the dadosjusbr
+// status code the orchestrator tells failures apart by.
+const (
+	failInvalidConfig = "invalid_config"
+	failInvalidInput  = "invalid_input"
+	failMissingFiles  = "missing_files"
+	failInvalidFile   = "invalid_file"
+	failStorage       = "storage"
+	failDatabase      = "database"
+	failOutput        = "output"
+	failInterrupted   = "interrupted"
+	failInProgress    = "in_progress"
+	failUnknown       = "unknown"
+)
+
+var failCodes = map[string]status.Code{
+	failInvalidConfig: status.InvalidParameters,
+	failInvalidInput:  status.InvalidInput,
+	failMissingFiles:  status.DataUnavailable,
+	failInvalidFile:   status.InvalidFile,
+	failStorage:       status.ConnectionError,
+	failDatabase:      status.ConnectionError,
+	failOutput:        status.OutputError,
+	failInterrupted:   status.SystemError,
+	failInProgress:    status.SystemError,
+	failUnknown:       status.Unknown,
+}
+
+// Prefixes of the preflight problems of services that can't be reached,
+// failing as such rather than as misconfigurations.
+const (
+	problemMongoUnreachable   = "Mongo unreachable: "
+	problemStorageUnreachable = "Storage unreachable: "
+)
+
+// stageError is an error with the class the stage exits with when it
+// can't be told from the error itself.
+type stageError struct {
+	class string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// withFailClass marks err as of class, nil staying nil.
+func withFailClass(class string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{class: class, err: err}
+}
+
+// failClass returns the class of err: the one it was marked with, storage
+// for classified storage errors, in progress for months another run holds
+// the lease of, database for mongo and postgres ones and missing files for
+// files that don't exist.
+func failClass(err error) string {
+	var se *stageError
+	var serverErr mongo.ServerError
+	var selectionErr topology.ServerSelectionError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &se):
+		return se.class
+	case errors.Is(err, errLeaseHeld):
+		return failInProgress
+	case errorClass(err) != "":
+		return failStorage
+	case errors.As(err, &serverErr), errors.As(err, &selectionErr), errors.As(err, &pqErr),
+		mongo.IsNetworkError(err), errors.Is(err, mongo.ErrClientDisconnected):
+		return failDatabase
+	case errors.Is(err, os.ErrNotExist):
+		return failMissingFiles
+	}
+	return failUnknown
+}
+
+// failure is the line written to stderr when the stage fails, for the
+// orchestrator to read why.
+type failure struct {
+	Error  string      `json:"error"`
+	Class  string      `json:"class"`
+	Code   status.Code `json:"code"`
+	Status string      `json:"status"`
+	// ErrorClass is retryable or permanent for storage errors.
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// exitWith logs err and exits with the status code of its class, after
+// writing it as a failure line to stderr.
+func exitWith(err error) {
+	log.Printf("Error: %v", err)
+	class := failClass(err)
+	os.Exit(int(writeFailure(class, err)))
+}
+
+// exitInterrupted logs the error of a run interrupted by sig and exits
+// with exitCode, after writing it as a failure line to stderr.
+func exitInterrupted(sig os.Signal, err error) {
+	removeWorkFiles()
+	err = fmt.Errorf("interrupted by %v: %w", sig, err)
+	log.Printf("Error: %v", err)
+	writeFailure(failInterrupted, err)
+	os.Exit(exitCode(sig))
+}
+
+func writeFailure(class string, err error) status.Code {
+	code := failCodes[class]
+	b, mErr := json.Marshal(failure{Error: err.Error(), Class: class, Code: code, Status: status.Text(code), ErrorClass: errorClass(err)})
+	if mErr == nil {
+		fmt.Fprintln(os.Stderr, string(b))
+	}
+	return code
+}
+
+// fatalProblems logs every problem and exits with the status code of
+// class, or of the service that can't be reached when every problem is
+// one.
+func fatalProblems(class string, problems []string) {
+	unreachable, misconfigured := "", false
+	for _, p := range problems {
+		log.Print(p)
+		switch {
+		case strings.HasPrefix(p, problemStorageUnreachable):
+			unreachable = failStorage
+		case strings.HasPrefix(p, problemMongoUnreachable):
+			if unreachable == "" {
+				unreachable = failDatabase
+			}
+		default:
+			misconfigured = true
+		}
+	}
+	if unreachable != "" && !misconfigured {
+		class = unreachable
+	}
+	err := fmt.Errorf("%d problem(s) found, nothing was done: %s", len(problems), strings.Join(problems, "; "))
+	log.Printf("Error: %d problem(s) found, nothing was done", len(problems))
+	os.Exit(int(writeFailure(class, err)))
+}
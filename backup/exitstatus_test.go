@@ -0,0 +1,23 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStageExitsOnNameCollision(t *testing.T) {
+	paths := writeTestFiles(t, "a/data.csv", "a,b\n1,2\n", "b/data.csv", "a,b\n3,4\n")
+	_, code := runStage(t, []string{"NAME_COLLISION=" + collisionError}, strings.Join(paths, "\n")+"\n")
+	if want := int(failCodes[failInvalidInput]); code != want {
+		t.Errorf("stage exited with status %d, want %d (%s)", code, want, failInvalidInput)
+	}
+}
+
+func TestStageExitsOnEmptyInput(t *testing.T) {
+	for _, stdin := range []string{"", "\n \n"} {
+		out, code := runStage(t, nil, stdin)
+		if want := int(failCodes[failInvalidInput]); code != want || out != "" {
+			t.Errorf("stage printed %q with status %d for input %q, want nothing with status %d (%s)", out, code, stdin, want, failInvalidInput)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandPaths replaces the directories among paths by the regular files
+// under them, walked recursively in lexical order, and the glob patterns
+// (out/*.csv, in filepath.Match syntax) by what they match, expanded the
+// same way. Files whose base name or path matches one of exclude are left
+// out, and excluded directories aren't walked. Symbolic links found while
+// walking are followed with followLinks and skipped otherwise; paths given
+// as links always stand for their targets.
+func expandPaths(paths, exclude []string, followLinks bool) ([]string, error) {
+	for _, pat := range exclude {
+		if _, err := filepath.Match(pat, ""); err != nil {
+			return nil, withFailClass(failInvalidConfig, fmt.Errorf("invalid exclude pattern %q:%w", pat, err))
+		}
+	}
+	e := &expander{exclude: exclude, followLinks: followLinks, walked: make(map[string]bool)}
+	var out []string
+	for _, p := range paths {
+		matches := []string{p}
+		if _, err := os.Lstat(p); os.IsNotExist(err) && strings.ContainsAny(p, "*?[") {
+			if matches, err = filepath.Glob(p); err != nil {
+				return nil, withFailClass(failInvalidInput, fmt.Errorf("invalid glob pattern %q:%w", p, err))
+			}
+			if len(matches) == 0 {
+				return nil, withFailClass(failMissingFiles, fmt.Errorf("glob pattern %q matches no file", p))
+			}
+		}
+		for _, m := range matches {
+			if e.excluded(m) {
+				continue
+			}
+			files, err := e.expand(m)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, files...)
+		}
+	}
+	return out, nil
+}
+
+type expander struct {
+	exclude     []string
+	followLinks bool
+	// walked are the real paths of the directories walked, so links back
+	// to a parent don't loop.
+	walked map[string]bool
+}
+
+func (e *expander) excluded(p string) bool {
+	for _, pat := range e.exclude {
+		if ok, _ := filepath.Match(pat, filepath.Base(p)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pat, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the file p, or the files under it if it is a directory.
+func (e *expander) expand(p string) ([]string, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file info(%s):%w", p, err)
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		return []string{p}, nil
+	case fi.IsDir():
+		return e.walk(p)
+	}
+	return nil, fmt.Errorf("%s is not a regular file or directory", p)
+}
+
+func (e *expander) walk(dir string) ([]string, error) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path(%s):%w", dir, err)
+	}
+	if e.walked[real] {
+		return nil, nil
+	}
+	e.walked[real] = true
+	// WalkDir doesn't follow a root that is a link unless it ends in a
+	// separator.
+	root := dir
+	if fi, err := os.Lstat(dir); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		root = dir + string(filepath.Separator)
+	}
+	var files []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error walking directory(%s):%w", p, err)
+		}
+		if p == root {
+			return nil
+		}
+		if e.excluded(p) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case d.Type().IsRegular():
+			files = append(files, p)
+		case d.Type()&fs.ModeSymlink != 0 && e.followLinks:
+			fi, err := os.Stat(p)
+			if err != nil {
+				return fmt.Errorf("error following link(%s):%w", p, err)
+			}
+			if fi.IsDir() {
+				sub, err := e.walk(p)
+				if err != nil {
+					return err
+				}
+				files = append(files, sub...)
+			} else if fi.Mode().IsRegular() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
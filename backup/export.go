@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordRow is the flattened representation of a backup record used by
+// analytics exports.
+type recordRow struct {
+	ID         string `parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AID        string `parquet:"name=aid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SubAID     string `parquet:"name=sub_aid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Year       int32  `parquet:"name=year, type=INT32"`
+	Month      int32  `parquet:"name=month, type=INT32"`
+	Timestamp  int64  `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Files      int32  `parquet:"name=files, type=INT32"`
+	TotalBytes int64  `parquet:"name=total_bytes, type=INT64"`
+}
+
+func newRecordRow(r Record) recordRow {
+	return recordRow{
+		ID:         r.ID.Hex(),
+		AID:        r.AID,
+		SubAID:     r.SubAID,
+		Year:       int32(r.Year),
+		Month:      int32(r.Month),
+		Timestamp:  r.createdAt().UnixNano() / int64(1e6),
+		Files:      int32(len(r.Backups)),
+		TotalBytes: r.TotalBytes,
+	}
+}
+
+// partitionWriter writes the rows of one aid/year partition.
+type partitionWriter struct {
+	f  *os.File
+	pw *writer.ParquetWriter
+}
+
+// exportCmd writes the backup collection as parquet files partitioned in
+// hive style (aid=<aid>/year=<year>/records.parquet) under --out.
+func exportCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "parquet", "export format (parquet)")
+	out := fs.String("out", "export", "output directory")
+	aid := fs.String("aid", "", "only export this agency")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "parquet" {
+		return fmt.Errorf("unsupported export format %q", *format)
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+
+	filter := bson.M{}
+	if *aid != "" {
+		filter["aid"] = *aid
+	}
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "aid", Value: 1}, {Key: "year", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("error querying backup records:%w", err)
+	}
+	defer cur.Close(ctx)
+
+	partitions := make(map[string]*partitionWriter)
+	closeAll := func() error {
+		var firstErr error
+		for dir, p := range partitions {
+			if err := p.pw.WriteStop(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("error finishing parquet file(%s):%w", dir, err)
+			}
+			if err := p.f.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("error closing parquet file(%s):%w", dir, err)
+			}
+		}
+		return firstErr
+	}
+	n := 0
+	for cur.Next(ctx) {
+		var r Record
+		if err := cur.Decode(&r); err != nil {
+			closeAll()
+			return fmt.Errorf("error decoding backup record:%w", err)
+		}
+		dir := filepath.Join(*out, "aid="+url.PathEscape(r.AID), fmt.Sprintf("year=%d", r.Year))
+		p, ok := partitions[dir]
+		if !ok {
+			if p, err = newPartitionWriter(dir); err != nil {
+				closeAll()
+				return err
+			}
+			partitions[dir] = p
+		}
+		if err := p.pw.Write(newRecordRow(r)); err != nil {
+			closeAll()
+			return fmt.Errorf("error writing parquet row(%s):%w", dir, err)
+		}
+		n++
+	}
+	if err := cur.Err(); err != nil {
+		closeAll()
+		return fmt.Errorf("error reading backup records:%w", err)
+	}
+	if err := closeAll(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d records into %d partitions under %s", n, len(partitions), *out)
+	return nil
+}
+
+func newPartitionWriter(dir string) (*partitionWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating partition directory(%s):%w", dir, err)
+	}
+	path := filepath.Join(dir, "records.parquet")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating parquet file(%s):%w", path, err)
+	}
+	pw, err := writer.NewParquetWriterFromWriter(f, new(recordRow), 1)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error creating parquet writer(%s):%w", path, err)
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &partitionWriter{f: f, pw: pw}, nil
+}
@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// backfillTimeout bounds every BACKFILL_COMMAND run and BACKFILL_URL
+// request.
+const backfillTimeout = time.Minute
+
+// coverageGap is a month of an agency with no backup record.
+type coverageGap struct {
+	AID    string `json:"aid"`
+	SubAID string `json:"sub_aid,omitempty"`
+	Year   int    `json:"year"`
+	Month  int    `json:"month"`
+	// Backfill is triggered or why triggering it failed, with --enqueue.
+	Backfill string `json:"backfill,omitempty"`
+}
+
+// findGaps returns the months from year from to to that no record of recs
+// (all of agency) covers, up to the last month for the current year.
+func findGaps(recs []Record, agency agencyID, from, to int, now time.Time) []coverageGap {
+	covered := make(map[int]map[int]bool)
+	for _, r := range recs {
+		if covered[r.Year] == nil {
+			covered[r.Year] = make(map[int]bool)
+		}
+		covered[r.Year][r.Month] = true
+	}
+	var gaps []coverageGap
+	for y := from; y <= to; y++ {
+		for _, m := range missingMonths(covered[y], y, now) {
+			gaps = append(gaps, coverageGap{AID: agency.AID, SubAID: agency.Sub, Year: y, Month: m})
+		}
+	}
+	return gaps
+}
+
+// checkBackfill validates BACKFILL_URL.
+func checkBackfill(conf Config) error {
+	if conf.BackfillURL == "" {
+		return nil
+	}
+	u, err := url.Parse(conf.BackfillURL)
+	if err != nil {
+		return err
+	}
+	if s := strings.ToLower(u.Scheme); s != "http" && s != "https" {
+		return fmt.Errorf("unsupported scheme %q: must be http or https", u.Scheme)
+	}
+	return nil
+}
+
+// triggerBackfill asks for the month of g to be collected and backed up
+// again: running BACKFILL_COMMAND, with AID, SUB_AID, YEAR and MONTH set,
+// and POSTing g to BACKFILL_URL, whichever are set.
+func triggerBackfill(ctx context.Context, conf Config, g coverageGap) error {
+	ctx, cancel := context.WithTimeout(ctx, backfillTimeout)
+	defer cancel()
+	if conf.BackfillCommand != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", conf.BackfillCommand)
+		cmd.Env = append(os.Environ(), "AID="+g.AID, "SUB_AID="+g.SubAID, "YEAR="+strconv.Itoa(g.Year), "MONTH="+strconv.Itoa(g.Month))
+		// stdout is the list of gaps.
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error running BACKFILL_COMMAND:%w", err)
+		}
+	}
+	if conf.BackfillURL != "" {
+		body, err := json.Marshal(g)
+		if err != nil {
+			return fmt.Errorf("error encoding backfill request:%w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.BackfillURL, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("error creating backfill request:%w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("error posting backfill request(%s):%w", req.URL.Host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("error posting backfill request(%s): status %s", req.URL.Host, resp.Status)
+		}
+	}
+	return nil
+}
+
+// gapsCmd lists the months from --from to --to of an agency with no backup
+// record, one JSON object per line by default. With --enqueue a backfill of
+// every one is triggered through BACKFILL_COMMAND or BACKFILL_URL.
+func gapsCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("gaps", flag.ContinueOnError)
+	agency := fs.String("aid", conf.AID, "agency identifier")
+	from := fs.Int("from", 0, "first year to look for gaps in")
+	to := fs.Int("to", time.Now().Year(), "last year to look for gaps in")
+	asOfFlag := fs.String("as-of", "", "look at the archive as it was at this date (2006-01-02, at midnight UTC) or RFC 3339 time; now by default")
+	format := fs.String("format", "json", "output format: json (a gap per line) or table")
+	enqueue := fs.Bool("enqueue", false, "trigger a backfill of every gap through BACKFILL_COMMAND or BACKFILL_URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *agency == "" || *from == 0 || *to < *from || (*format != "json" && *format != "table") {
+		return fmt.Errorf("usage: gaps --aid aid --from year [--to year] [--as-of t] [--format json|table] [--enqueue]")
+	}
+	if *enqueue && conf.BackfillCommand == "" && conf.BackfillURL == "" {
+		return fmt.Errorf("--enqueue needs BACKFILL_COMMAND or BACKFILL_URL")
+	}
+	asOf, err := parseAsOf(*asOfFlag)
+	if err != nil {
+		return err
+	}
+	aid := splitAID(strings.ToLower(*agency), conf.AIDSeparator)
+	filter := aid.filter()
+	filter["year"] = bson.M{"$gte": *from, "$lte": *to}
+	recs, err := storedRecords(ctx, conf, aid, 0, filter, asOf)
+	if err != nil {
+		return err
+	}
+
+	gaps := findGaps(recs, aid, *from, *to, asOf)
+	failed := 0
+	if *enqueue {
+		for i, g := range gaps {
+			gaps[i].Backfill = "triggered"
+			if err := triggerBackfill(ctx, conf, g); err != nil {
+				log.Printf("Error triggering backfill of %s %d/%02d: %v", aid, g.Year, g.Month, err)
+				gaps[i].Backfill = err.Error()
+				failed++
+			}
+		}
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, g := range gaps {
+			if err := enc.Encode(g); err != nil {
+				return fmt.Errorf("error encoding gaps:%w", err)
+			}
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "AID\tYEAR\tMONTH\tBACKFILL")
+		for _, g := range gaps {
+			backfill := g.Backfill
+			if backfill == "" {
+				backfill = "-"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%02d\t%s\n", aid, g.Year, g.Month, backfill)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d month(s) without a backup from %d to %d", len(gaps), *from, *to)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backfill(s) failed to trigger", failed, len(gaps))
+	}
+	return nil
+}
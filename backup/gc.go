@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// orphanObject is an object under an agency's prefix no record refers to.
+type orphanObject struct {
+	container, name string
+	bytes           int64
+	modified        time.Time
+}
+
+// referencedObjects returns the container/name of every swift object recs
+// refer to. Files stored in other backends are left out, as are mirror
+// replicas outside the swift account; a swift object that can't be told
+// apart (its URL rewritten to another storage, say) is an error, lest it
+// be taken for an orphan.
+func referencedObjects(ctx context.Context, cloud *swiftClient, recs []Record) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	for _, rec := range recs {
+		for i, b := range rec.objects() {
+			if i < len(rec.Files) && rec.Files[i].Backend != "" && rec.Files[i].Backend != backendSwift {
+				continue
+			}
+			container, name, err := cloud.objectPath(ctx, b.URL)
+			if err != nil {
+				return nil, fmt.Errorf("error resolving objects of record(%s):%w", rec.ID.Hex(), err)
+			}
+			referenced[container+"/"+name] = true
+		}
+		for _, r := range rec.Replicas {
+			if container, name, err := cloud.objectPath(ctx, r.URL); err == nil {
+				referenced[container+"/"+name] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// findOrphans lists the objects under prefix in containers no record
+// refers to, last modified before cutoff so the uploads of a run still
+// writing its record are left alone. It also returns how many objects
+// were listed.
+func findOrphans(ctx context.Context, cloud *swiftClient, containers []string, prefix string, referenced map[string]bool, cutoff time.Time) ([]orphanObject, int, error) {
+	if err := cloud.authenticate(ctx); err != nil {
+		return nil, 0, err
+	}
+	var orphans []orphanObject
+	listed := 0
+	for _, container := range containers {
+		objs, err := cloud.conn.ObjectsAll(ctx, container, &swift.ObjectsOpts{Prefix: prefix})
+		if errors.Is(err, swift.ContainerNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("error listing objects(%s/%s):%w", container, prefix, err)
+		}
+		listed += len(objs)
+		for _, o := range objs {
+			if referenced[container+"/"+o.Name] || !o.LastModified.Before(cutoff) {
+				continue
+			}
+			orphans = append(orphans, orphanObject{container: container, name: o.Name, bytes: o.Bytes, modified: o.LastModified})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].container != orphans[j].container {
+			return orphans[i].container < orphans[j].container
+		}
+		return orphans[i].name < orphans[j].name
+	})
+	return orphans, listed, nil
+}
+
+// gcContainers are where the files of an agency may be: SWIFT_CONTAINER
+// and the SIZE_TIERS containers.
+func gcContainers(conf Config) []string {
+	containers := []string{conf.SwiftContainer}
+	seen := map[string]bool{conf.SwiftContainer: true}
+	for _, t := range conf.SizeTiers {
+		if !seen[t.container] {
+			seen[t.container] = true
+			containers = append(containers, t.container)
+		}
+	}
+	return containers
+}
+
+// gcCmd deletes the swift objects under an agency's prefix that no backup
+// record refers to, left behind by failed runs and manual interventions.
+// Content objects, shared by agencies, and large object segments (see
+// janitor) aren't under it. As a mistaken MONGODB_BCOLL would make every
+// object an orphan, nothing is deleted when there are more than
+// --max-delete orphans or they are more than --max-ratio of the objects
+// listed.
+func gcCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	aid := fs.String("aid", conf.AID, "collect the objects of this agency, its sub-agencies included")
+	olderThan := fs.Duration("older-than", 24*time.Hour, "only delete orphans last modified longer than this ago")
+	dryRun := fs.Bool("dry-run", false, "only list the orphans")
+	maxDelete := fs.Int("max-delete", 100, "delete nothing when there are more orphans than this")
+	maxRatio := fs.Float64("max-ratio", 0.5, "delete nothing when orphans are more than this fraction of the objects listed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *aid == "" || *olderThan < 0 || *maxDelete < 0 || *maxRatio < 0 || *maxRatio > 1 {
+		return fmt.Errorf("usage: gc --aid aid [--older-than d] [--dry-run] [--max-delete n] [--max-ratio r], with r between 0 and 1")
+	}
+	if !*dryRun {
+		if err := checkWritable(conf.ReadOnly, "delete orphaned objects"); err != nil {
+			return err
+		}
+	}
+	agency := splitAID(strings.ToLower(*aid), conf.AIDSeparator)
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+
+	// a parent agency's prefix has the objects of its sub-agencies too.
+	filter := agency.filter()
+	if agency.Sub == "" {
+		filter = bson.M{"aid": agency.AID}
+	}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("error querying backup records:%w", err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return fmt.Errorf("error decoding backup records:%w", err)
+	}
+	cloud := newSwiftClient(conf)
+	referenced, err := referencedObjects(ctx, cloud, recs)
+	if err != nil {
+		return err
+	}
+	orphans, listed, err := findOrphans(ctx, cloud, gcContainers(conf), agency.prefix()+"/", referenced, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tOBJECT\tBYTES\tMODIFIED")
+	var size int64
+	for _, o := range orphans {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", o.container, o.name, o.bytes, o.modified.UTC().Format(time.RFC3339))
+		size += o.bytes
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d orphan(s), %d bytes, among %d objects of %d record(s)\n", len(orphans), size, listed, len(recs))
+	if *dryRun || len(orphans) == 0 {
+		return nil
+	}
+	if len(orphans) > *maxDelete {
+		return fmt.Errorf("%d orphans, more than --max-delete %d: nothing deleted", len(orphans), *maxDelete)
+	}
+	if ratio := float64(len(orphans)) / float64(listed); ratio > *maxRatio {
+		return fmt.Errorf("orphans are %.0f%% of the objects listed, more than --max-ratio %g: nothing deleted", 100*ratio, *maxRatio)
+	}
+	for _, o := range orphans {
+		if err := cloud.removeFrom(ctx, o.container, o.name); err != nil {
+			return err
+		}
+		log.Printf("Deleted %s/%s (%d bytes, last modified %s)", o.container, o.name, o.bytes, o.modified.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
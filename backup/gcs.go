@@ -0,0 +1,242 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/dadosjusbr/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// castagnoli is the CRC32C table GCS checksums objects with.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// gcsClient stores the files of the stage in a bucket of Google Cloud
+// Storage.
+type gcsClient struct {
+	bucket *gcs.BucketHandle
+	// base is the URL the object URLs are under.
+	base       string
+	name       string
+	readOnly   bool
+	attempts   int
+	retryDelay time.Duration
+	timeout    time.Duration
+}
+
+// newGCSClient connects to GCS with the application default credentials:
+// the service account key at GOOGLE_APPLICATION_CREDENTIALS, those of
+// gcloud auth application-default login or of the metadata server, or to
+// the emulator at STORAGE_EMULATOR_HOST.
+func newGCSClient(ctx context.Context, conf Config) (*gcsClient, error) {
+	base := "https://storage.googleapis.com"
+	var opts []option.ClientOption
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		base = strings.TrimRight(host, "/")
+		if !strings.Contains(base, "://") {
+			base = "http://" + base
+		}
+	} else {
+		t, err := htransport.NewTransport(ctx, countingTransport(), option.WithScopes(gcs.ScopeReadWrite))
+		if err != nil {
+			return nil, fmt.Errorf("error creating gcs client:%w", err)
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: t}))
+	}
+	client, err := gcs.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcs client:%w", err)
+	}
+	return &gcsClient{
+		bucket:     client.Bucket(conf.GCSBucket),
+		base:       base + "/" + conf.GCSBucket,
+		name:       conf.GCSBucket,
+		readOnly:   conf.ReadOnly,
+		attempts:   conf.UploadAttempts,
+		retryDelay: conf.UploadRetryDelay,
+		timeout:    conf.UploadTimeout,
+	}, nil
+}
+
+func (c *gcsClient) objectURL(name string) string {
+	return c.base + "/" + name
+}
+
+func (c *gcsClient) put(ctx context.Context, name string, r io.Reader, sum io.Writer) (storage.Backup, int64, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, 0, err
+	}
+	// canceling wctx aborts the upload, leaving no object behind.
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	obj := c.bucket.Object(name)
+	w := obj.NewWriter(wctx)
+	crc := crc32.New(castagnoli)
+	var dst io.Writer = io.MultiWriter(w, crc)
+	if sum != nil {
+		dst = io.MultiWriter(w, crc, sum)
+	}
+	n, err := buffers.copy(ctx, dst, throttledUpload(ctx, r))
+	if err != nil {
+		cancel()
+		w.Close()
+		return storage.Backup{}, 0, fmt.Errorf("error uploading object(%s/%s):%w", c.name, name, err)
+	}
+	if err := w.Close(); err != nil {
+		return storage.Backup{}, 0, fmt.Errorf("error uploading object(%s/%s):%w", c.name, name, err)
+	}
+	// the CRC32C GCS computed of what it received, checked against the
+	// one of what was sent: an object corrupted in transit is deleted,
+	// for the upload to be retried.
+	attrs := w.Attrs()
+	if attrs.CRC32C != crc.Sum32() {
+		err := fmt.Errorf("object %s/%s was stored with crc32c %08x, %08x was sent: %w", c.name, name, attrs.CRC32C, crc.Sum32(), errCorrupted)
+		if dErr := obj.Delete(ctx); dErr != nil {
+			err = fmt.Errorf("%v (error deleting it: %v)", err, dErr)
+		}
+		return storage.Backup{}, 0, err
+	}
+	return storage.Backup{URL: c.objectURL(name), Hash: hex.EncodeToString(attrs.MD5)}, n, nil
+}
+
+func (c *gcsClient) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	b, _, err := c.put(ctx, name, r, nil)
+	return b, err
+}
+
+func (c *gcsClient) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for i, p := range paths {
+		b, f, err := retryUpload(ctx, c.attempts, c.retryDelay, c.timeout, names[i], func(ctx context.Context) (storage.Backup, FileEntry, error) {
+			return c.uploadFile(ctx, p, names[i])
+		})
+		if err != nil {
+			return backups, files, err
+		}
+		backups = append(backups, b)
+		files = append(files, f)
+	}
+	return backups, files, nil
+}
+
+func (c *gcsClient) uploadFile(ctx context.Context, path, name string) (storage.Backup, FileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	entry := FileEntry{Name: name, Container: c.name, Bytes: fi.Size(), Backend: backendGCS}
+	sum := newDigestWriter()
+	b, _, err := c.put(ctx, name, f, sum)
+	if err == nil {
+		entry.SHA256, err = sum.check(path, entry.Bytes)
+	}
+	return b, entry, err
+}
+
+// discard deletes the object f was stored as.
+func (c *gcsClient) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	if err := checkWritable(c.readOnly, "delete "+f.Name); err != nil {
+		return err
+	}
+	if err := c.bucket.Object(f.Name).Delete(ctx); err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+		return fmt.Errorf("error deleting object(%s/%s):%w", c.name, f.Name, err)
+	}
+	return nil
+}
+
+// digest returns the SHA-256 and size of the object of b. The reader
+// checks the content against the CRC32C GCS stored with it.
+func (c *gcsClient) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	name := strings.TrimPrefix(b.URL, c.objectURL(""))
+	r, err := c.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("error downloading object(%s/%s):%w", c.name, name, err)
+	}
+	defer r.Close()
+	w := newDigestWriter()
+	if _, err := buffers.copy(ctx, w, r); err != nil {
+		return "", 0, fmt.Errorf("error downloading object(%s/%s):%w", c.name, name, err)
+	}
+	return w.sum(), w.n, nil
+}
+
+// ping checks the bucket exists.
+func (c *gcsClient) ping(ctx context.Context) error {
+	if _, err := c.bucket.Attrs(ctx); err != nil {
+		if errors.Is(err, gcs.ErrBucketNotExist) {
+			return fmt.Errorf("bucket %s does not exist", c.name)
+		}
+		return fmt.Errorf("error reading bucket info(%s):%w (likely cause: %s)", c.name, err, diagnoseGCS(err, c.name))
+	}
+	return nil
+}
+
+// canary writes, reads back and deletes a tiny object.
+func (c *gcsClient) canary(ctx context.Context, runID string) error {
+	name := ".canary/" + runID
+	content := []byte("salvador-backups canary " + time.Now().UTC().Format(time.RFC3339Nano))
+	if _, err := c.upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseGCS(err, c.name))
+	}
+	obj := c.bucket.Object(name)
+	var got []byte
+	r, err := obj.NewReader(ctx)
+	if err == nil {
+		got, err = io.ReadAll(r)
+		r.Close()
+	}
+	if rmErr := obj.Delete(ctx); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	if err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseGCS(err, c.name))
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("error running canary: object %s read back with different content", name)
+	}
+	return nil
+}
+
+// diagnoseGCS explains the likely cause of a GCS error.
+func diagnoseGCS(err error, bucket string) string {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusUnauthorized:
+			return "authentication failed (check GOOGLE_APPLICATION_CREDENTIALS)"
+		case http.StatusForbidden:
+			return fmt.Sprintf("access denied (check the IAM policy of bucket %s)", bucket)
+		case http.StatusNotFound:
+			return fmt.Sprintf("bucket %s not found (check GCS_BUCKET)", bucket)
+		case http.StatusTooManyRequests:
+			return "rate limited by gcs"
+		}
+	}
+	if errors.Is(err, gcs.ErrBucketNotExist) {
+		return fmt.Sprintf("bucket %s not found (check GCS_BUCKET)", bucket)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network error (check connectivity to storage.googleapis.com)"
+	}
+	return "unexpected error"
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+)
+
+// fileSHA256 returns the hex encoded SHA-256 digest of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := buffers.copy(context.Background(), h, f); err != nil {
+		return "", fmt.Errorf("error hashing file(%s):%w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestWriter computes the SHA-256 and size of what is written to it.
+type digestWriter struct {
+	h hash.Hash
+	n int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{h: sha256.New()}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return w.h.Write(p)
+}
+
+// sum returns the hex encoded digest of what was written so far.
+func (w *digestWriter) sum() string {
+	return hex.EncodeToString(w.h.Sum(nil))
+}
+
+// check returns the digest of the file at path, hashed while it was read,
+// making sure all of its size bytes were.
+func (w *digestWriter) check(path string, size int64) (string, error) {
+	if w.n != size {
+		return "", fmt.Errorf("file %s changed while read: %d bytes read, %d expected", path, w.n, size)
+	}
+	return w.sum(), nil
+}
+
+// sha256Sums builds a checksum list in the format read by "sha256sum -c",
+// naming files by their object names as they are laid out on restore.
+func sha256Sums(aid string, names, digests []string) []byte {
+	var b bytes.Buffer
+	for i, n := range names {
+		fmt.Fprintf(&b, "%s  %s\n", digests[i], restorePath(aid, n))
+	}
+	return b.Bytes()
+}
+
+// fileDigests returns the SHA-256 digest of every path.
+func fileDigests(paths []string) ([]string, error) {
+	digests := make([]string, len(paths))
+	for i, p := range paths {
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return nil, err
+		}
+		digests[i] = sum
+	}
+	return digests, nil
+}
+
+// inputHash identifies a run's input: the SHA-256 of its path list, in
+// order, along with the digest of every file.
+func inputHash(paths, digests []string) string {
+	h := sha256.New()
+	for i, p := range paths {
+		fmt.Fprintf(h, "%s  %s\n", digests[i], p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sha256SumsName is the object name of a month's checksum list.
+func sha256SumsName(aid string, year int, months []int) string {
+	return fmt.Sprintf("%s/SHA256SUMS-%d-%s", aid, year, monthsLabel(months))
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// testConfig returns the default configuration, storing objects in a
+// temporary LOCAL_DIR and records in a temporary METADATA_FILE.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	conf, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	conf.AID, conf.Year, conf.Month, conf.Months = "trt1", 2022, 3, ""
+	conf.StorageBackend = []string{backendLocal}
+	conf.LocalDir = filepath.Join(dir, "store")
+	conf.MetadataSink = sinkFile
+	conf.MetadataFile = filepath.Join(dir, "records.jsonl")
+	conf.WorkDir = filepath.Join(dir, "work")
+	if err := Setup(conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// writeTestFiles creates files with the given names and contents in a
+// temporary directory, returning their paths in the order of names.
+func writeTestFiles(t *testing.T, files ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i+1 < len(files); i += 2 {
+		p := filepath.Join(dir, files[i])
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(files[i+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// testMongo points conf at a new database of the server of
+// MONGODB_TEST_URI, dropped once the test is over, skipping the test
+// without the variable.
+func testMongo(t *testing.T, conf *Config) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI not set")
+	}
+	ctx := context.Background()
+	client, err := connect(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("salvador_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		disconnect(client)
+	})
+	conf.MongoURI, conf.MongoDBName, conf.MongoBackupColl = uri, db.Name(), "backups"
+	conf.MetadataSink = sinkMongo
+	return db
+}
+
+// TestStageProcess is not a test: it is the stage run by runStage in a
+// subprocess, so its exit status can be checked.
+func TestStageProcess(t *testing.T) {
+	if os.Getenv("SALVADOR_TEST_STAGE") != "1" {
+		return
+	}
+	os.Args = []string{"salvador-backups"}
+	Main()
+	os.Exit(0)
+}
+
+// runStage runs the stage with the variables of env set, besides those of
+// a local backend and a metadata file in temporary directories, feeding it
+// stdin. A name without a value in env unsets the variable. It returns what
+// the stage printed and its exit status.
+func runStage(t *testing.T, env []string, stdin string) (string, int) {
+	t.Helper()
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStageProcess$")
+	cmd.Env = append(os.Environ(),
+		"SALVADOR_TEST_STAGE=1",
+		"AID=trt1", "YEAR=2022", "MONTH=3",
+		"STORAGE_BACKEND="+backendLocal,
+		"LOCAL_DIR="+filepath.Join(dir, "store"),
+		"METADATA_SINK="+sinkFile,
+		"METADATA_FILE="+filepath.Join(dir, "records.jsonl"),
+		"WORK_DIR="+filepath.Join(dir, "work"),
+	)
+	for _, e := range env {
+		if strings.Contains(e, "=") {
+			cmd.Env = append(cmd.Env, e)
+			continue
+		}
+		kept := cmd.Env[:0]
+		for _, set := range cmd.Env {
+			if !strings.HasPrefix(set, e+"=") {
+				kept = append(kept, set)
+			}
+		}
+		cmd.Env = kept
+	}
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		t.Logf("stage stderr:\n%s", stderr.String())
+		return stdout.String(), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), 0
+}
@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// staleObject is a leftover of an interrupted run.
+type staleObject struct {
+	container, name string
+	modified        time.Time
+}
+
+// findStale lists the leftovers older than cutoff: ".part" objects and
+// probe objects in the container, and large object segments in
+// <container>_segments that no manifest of the container points to.
+func findStale(ctx context.Context, c *swiftClient, cutoff time.Time) ([]staleObject, error) {
+	if err := c.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	objs, err := c.conn.ObjectsAll(ctx, c.container, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects(%s):%w", c.container, err)
+	}
+	var stale []staleObject
+	for _, o := range objs {
+		if (strings.HasSuffix(o.Name, ".part") || strings.HasPrefix(o.Name, ".probe/")) && o.LastModified.Before(cutoff) {
+			stale = append(stale, staleObject{container: c.container, name: o.Name, modified: o.LastModified})
+		}
+	}
+
+	segContainer := c.container + "_segments"
+	segs, err := c.conn.ObjectsAll(ctx, segContainer, nil)
+	if errors.Is(err, swift.ContainerNotFound) {
+		return stale, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects(%s):%w", segContainer, err)
+	}
+	var candidates []swift.Object
+	for _, s := range segs {
+		if s.LastModified.Before(cutoff) {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return stale, nil
+	}
+	// Only looking up the manifests when there is something to clean up, as
+	// it takes one request per object.
+	referenced := make(map[string]bool)
+	for _, o := range objs {
+		_, parts, err := c.conn.LargeObjectGetSegments(ctx, c.container, o.Name)
+		if errors.Is(err, swift.NotLargeObject) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading segments of object(%s/%s):%w", c.container, o.Name, err)
+		}
+		for _, p := range parts {
+			referenced[path.Dir(p.Name)] = true
+		}
+	}
+	for _, s := range candidates {
+		if !referenced[path.Dir(s.Name)] {
+			stale = append(stale, staleObject{container: segContainer, name: s.Name, modified: s.LastModified})
+		}
+	}
+	return stale, nil
+}
+
+// janitorCmd deletes partial uploads left behind by interrupted runs, which
+// otherwise keep being billed.
+func janitorCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("janitor", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", 24*time.Hour, "only delete leftovers last modified longer than this ago")
+	dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+	every := fs.Duration("every", 0, "keep running, cleaning up at this interval")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := checkWritable(conf.ReadOnly, "delete partial uploads"); err != nil {
+			return err
+		}
+	}
+	cloud := newSwiftClient(conf)
+	for {
+		stale, err := findStale(ctx, cloud, time.Now().Add(-*olderThan))
+		if err != nil {
+			return err
+		}
+		for _, s := range stale {
+			if *dryRun {
+				fmt.Printf("%s/%s\t%s\n", s.container, s.name, s.modified.UTC().Format(time.RFC3339))
+				continue
+			}
+			if err := cloud.removeFrom(ctx, s.container, s.name); err != nil {
+				return err
+			}
+			log.Printf("Deleted %s/%s (last modified %s)", s.container, s.name, s.modified.UTC().Format(time.RFC3339))
+		}
+		if *every == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*every):
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// States of a backup job. The orchestrator inserts jobs pending, workers
+// claim them and leave them done or failed.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// backupJob is a backup inserted in MONGODB_JOBSCOLL by the orchestrator.
+// Only the agency, year, month(s), paths and, optionally, the idempotency
+// key and priority are needed, a missing status meaning pending.
+type backupJob struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	AID            string             `bson:"aid"`
+	Year           int                `bson:"year"`
+	Month          int                `bson:"month"`
+	Months         []int              `bson:"months,omitempty"`
+	Paths          []string           `bson:"paths"`
+	IdempotencyKey string             `bson:"idempotency_key,omitempty"`
+	// Priority is the lane of the job, urgent or, when missing, scheduled.
+	Priority string `bson:"priority,omitempty"`
+	Status   string `bson:"status,omitempty"`
+	// Owner is the worker that claimed the job, its lease on it running
+	// until LeaseUntil. A job whose lease expired, its worker having died,
+	// can be claimed again.
+	Owner      string    `bson:"owner,omitempty"`
+	LeaseUntil time.Time `bson:"lease_until,omitempty"`
+	Attempts   int       `bson:"attempts"`
+	LastError  string    `bson:"last_error,omitempty"`
+	ErrorClass string    `bson:"error_class,omitempty"`
+	// Records are the _ids of the records written by the job.
+	Records    []primitive.ObjectID `bson:"records,omitempty"`
+	FinishedAt time.Time            `bson:"finished_at,omitempty"`
+}
+
+// config returns conf pointed at the job.
+func (j backupJob) config(conf Config) (Config, error) {
+	months := j.Months
+	if len(months) == 0 {
+		months = []int{j.Month}
+	}
+	if j.AID == "" || j.Year == 0 || months[0] == 0 || len(j.Paths) == 0 {
+		return conf, fmt.Errorf("job must have aid, year, month(s) and paths")
+	}
+	if err := checkLane(j.Priority); err != nil {
+		return conf, err
+	}
+	conf = jobConfig(conf, strings.ToLower(j.AID), j.Year, months)
+	conf.IdempotencyKey = j.IdempotencyKey
+	if _, err := runMonths(conf); err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+// claimJob leases to owner the oldest pending job, or one whose lease
+// expired, of the first lane that has one and isn't at its limit, returning
+// mongo.ErrNoDocuments when there is none.
+func claimJob(ctx context.Context, conf Config, coll *mongo.Collection, owner string, ttl time.Duration) (backupJob, error) {
+	for _, lane := range jobLanes {
+		full, err := laneFull(ctx, coll, lane, laneLimit(conf, lane))
+		if err != nil {
+			return backupJob{}, err
+		}
+		if full {
+			continue
+		}
+		job, err := claimLaneJob(ctx, coll, lane, owner, ttl)
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return job, err
+		}
+	}
+	return backupJob{}, mongo.ErrNoDocuments
+}
+
+func claimLaneJob(ctx context.Context, coll *mongo.Collection, lane, owner string, ttl time.Duration) (backupJob, error) {
+	now := time.Now().UTC()
+	filter := laneFilter(lane)
+	filter["$or"] = bson.A{
+		bson.M{"status": bson.M{"$in": bson.A{jobPending, nil}}},
+		bson.M{"status": jobRunning, "lease_until": bson.M{"$lt": now}},
+	}
+	var job backupJob
+	err := coll.FindOneAndUpdate(ctx, filter,
+		bson.M{
+			"$set": bson.M{"status": jobRunning, "owner": owner, "lease_until": now.Add(ttl)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"_id": 1}).SetReturnDocument(options.After)).Decode(&job)
+	return job, err
+}
+
+// finishJob leaves the job claimed by owner done, with the records it
+// wrote, or failed with runErr.
+func finishJob(ctx context.Context, coll *mongo.Collection, job backupJob, owner string, recs []Record, runErr error) error {
+	set := bson.M{"status": jobDone, "finished_at": time.Now().UTC()}
+	if runErr != nil {
+		set["status"] = jobFailed
+		set["last_error"] = runErr.Error()
+		set["error_class"] = errorClass(runErr)
+	}
+	ids := []primitive.ObjectID{}
+	for _, r := range recs {
+		ids = append(ids, r.ID)
+	}
+	set["records"] = ids
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": job.ID, "owner": owner}, bson.M{
+		"$set":   set,
+		"$unset": bson.M{"lease_until": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("error updating job(%s):%w", job.ID.Hex(), err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("error updating job(%s): claimed by another worker after its lease expired", job.ID.Hex())
+	}
+	return nil
+}
+
+// lane returns the lane of the job.
+func (j backupJob) lane() string {
+	if j.Priority == laneUrgent {
+		return laneUrgent
+	}
+	return laneScheduled
+}
+
+// processJob runs a claimed job, extending its lease while the upload is in
+// progress so long uploads aren't claimed by another worker.
+func processJob(ctx context.Context, conf Config, coll *mongo.Collection, job backupJob, owner string) error {
+	jobConf, err := job.config(conf)
+	if err != nil {
+		log.Printf("Warning: invalid job %s: %v", job.ID.Hex(), err)
+		return finishJob(ctx, coll, job, owner, nil, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(conf.JobLease / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				_, err := coll.UpdateOne(ctx, bson.M{"_id": job.ID, "owner": owner}, bson.M{"$set": bson.M{"lease_until": time.Now().UTC().Add(conf.JobLease)}})
+				if err != nil {
+					warnings.warnf(warnLease, "error extending lease of job %s:%v", job.ID.Hex(), err)
+				}
+			}
+		}
+	}()
+	var recs []Record
+	flagged, runErr := applyContentTypePolicy(jobConf, job.Paths)
+	if runErr == nil {
+		recs, runErr = run(ctx, jobConf, job.Paths, flagged, nil, nil)
+	}
+	close(done)
+	notifyBackup(ctx, jobConf, job.Paths, recs, runErr)
+	if runErr != nil {
+		log.Printf("Job %s (%s %d/%s, %s) failed: %v", job.ID.Hex(), jobConf.AID, jobConf.Year, jobConf.Months, job.lane(), runErr)
+	} else {
+		log.Printf("Job %s (%s %d/%s, %s) succeeded", job.ID.Hex(), jobConf.AID, jobConf.Year, jobConf.Months, job.lane())
+	}
+	return finishJob(ctx, coll, job, owner, recs, runErr)
+}
+
+// jobWorkerCmd keeps running, claiming the backup jobs the orchestrator
+// inserts in MONGODB_JOBSCOLL and processing them one at a time, urgent
+// ones first, polling every JOB_POLL_INTERVAL when there are none. A warm
+// worker spares every pipeline run the start of a container. It stops
+// between jobs once ctx is done, on SIGINT or SIGTERM.
+func jobWorkerCmd(ctx context.Context, conf Config, args []string) error {
+	if conf.JobLease <= 0 || conf.JobPollInterval <= 0 {
+		return fmt.Errorf("JOB_LEASE and JOB_POLL_INTERVAL must be positive")
+	}
+	if conf.JobUrgentConcurrency < 0 || conf.JobScheduledConcurrency < 0 {
+		return fmt.Errorf("JOB_URGENT_CONCURRENCY and JOB_SCHEDULED_CONCURRENCY must not be negative")
+	}
+	if err := checkWritable(conf.ReadOnly, "process backup jobs"); err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoJobsColl)
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "lease_until", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating job index(%s):%w", conf.MongoJobsColl, err)
+	}
+
+	owner := newRunID()
+	log.Printf("Processing backup jobs from %s as %s", conf.MongoJobsColl, owner)
+	for ctx.Err() == nil {
+		job, err := claimJob(ctx, conf, coll, owner, conf.JobLease)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(conf.JobPollInterval):
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error claiming job:%w", err)
+		}
+		if err := processJob(ctx, conf, coll, job, owner); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	log.Printf("Stopped processing backup jobs from %s (%v)", conf.MongoJobsColl, ctx.Err())
+	return nil
+}
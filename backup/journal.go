@@ -0,0 +1,256 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// journalEntry is written to JOURNAL_DIR before a run uploads its files and
+// removed once their records are stored, so the objects of a run killed in
+// between can be told apart from those of the archive and rolled back.
+type journalEntry struct {
+	RunID     string    `json:"run_id"`
+	AID       string    `json:"aid"`
+	SubAID    string    `json:"sub_aid,omitempty"`
+	Year      int       `json:"year"`
+	Months    []int     `json:"months"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+	// Backends are the STORAGE_BACKEND and MIRROR_BACKENDS the files were
+	// uploaded to, entries of others being left alone.
+	Backends []string `json:"backends"`
+	// Objects are the names being uploaded, Backups and Files what was
+	// uploaded once the upload returned.
+	Objects []string         `json:"objects"`
+	Backups []storage.Backup `json:"backups,omitempty"`
+	Files   []FileEntry      `json:"files,omitempty"`
+
+	path string
+}
+
+// journals maps the records of this process not stored yet to their
+// entries, finished by the sink writing them.
+var journals = struct {
+	sync.Mutex
+	byRecord map[primitive.ObjectID]*journalEntry
+}{byRecord: map[primitive.ObjectID]*journalEntry{}}
+
+// journalRecovery reconciles the entries of crashed runs on the first run of
+// the process.
+var journalRecovery sync.Once
+
+// openJournal writes the entry of a run about to upload names. It returns
+// nil, as all the methods of a nil entry do nothing, without JOURNAL_DIR.
+func openJournal(conf Config, runID string, agency agencyID, months []int, started time.Time, names []string) (*journalEntry, error) {
+	if conf.JournalDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(conf.JournalDir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating journal dir(%s):%w", conf.JournalDir, err)
+	}
+	host, _ := os.Hostname()
+	j := &journalEntry{
+		RunID:     runID,
+		AID:       agency.AID,
+		SubAID:    agency.Sub,
+		Year:      int(conf.Year),
+		Months:    months,
+		Host:      host,
+		PID:       os.Getpid(),
+		StartedAt: started.UTC(),
+		Backends:  append(append([]string{}, conf.StorageBackend...), conf.MirrorBackends...),
+		Objects:   names,
+		path:      filepath.Join(conf.JournalDir, runID+".json"),
+	}
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// save writes the entry atomically: a crash leaves the previous one.
+func (j *journalEntry) save() error {
+	if j == nil {
+		return nil
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("error encoding journal entry(%s):%w", j.path, err)
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("error writing journal entry(%s):%w", j.path, err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing journal entry(%s):%w", j.path, err)
+	}
+	return nil
+}
+
+// uploaded records what the upload stored. Failing to is a warning: the
+// names are already journaled.
+func (j *journalEntry) uploaded(backups []storage.Backup, files []FileEntry) {
+	if j == nil {
+		return
+	}
+	j.Backups, j.Files = backups, files
+	if err := j.save(); err != nil {
+		warnings.warnf(warnJournal, "%v", err)
+	}
+}
+
+// pending leaves the entry open until the sink stores recs.
+func (j *journalEntry) pending(recs []Record) {
+	if j == nil {
+		return
+	}
+	journals.Lock()
+	defer journals.Unlock()
+	for _, r := range recs {
+		journals.byRecord[r.ID] = j
+	}
+}
+
+// finish removes the entry, the run being over.
+func (j *journalEntry) finish() {
+	if j == nil {
+		return
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		warnings.warnf(warnJournal, "error removing journal entry(%s): %v", j.path, err)
+	}
+}
+
+// finishJournals finishes the entries of recs, once they are stored.
+func finishJournals(recs []Record) {
+	journals.Lock()
+	defer journals.Unlock()
+	for _, r := range recs {
+		j, ok := journals.byRecord[r.ID]
+		if !ok {
+			continue
+		}
+		for id, other := range journals.byRecord {
+			if other == j {
+				delete(journals.byRecord, id)
+			}
+		}
+		j.finish()
+	}
+}
+
+// open reports whether j is an entry of this process.
+func (j *journalEntry) open() bool {
+	journals.Lock()
+	defer journals.Unlock()
+	for _, other := range journals.byRecord {
+		if other.RunID == j.RunID {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverJournals reconciles the entries left in JOURNAL_DIR by runs that
+// died before storing their records: the objects they uploaded, but those a
+// record refers to, are deleted. The runs of other hosts can't be told dead
+// and are left alone, as are those still running on this one.
+func recoverJournals(ctx context.Context, conf Config, cloud backuper, coll *mongo.Collection) {
+	if conf.JournalDir == "" {
+		return
+	}
+	paths, err := filepath.Glob(filepath.Join(conf.JournalDir, "*.json"))
+	if err != nil {
+		warnings.warnf(warnJournal, "error reading journal dir(%s): %v", conf.JournalDir, err)
+		return
+	}
+	host, _ := os.Hostname()
+	backends := strings.Join(append(append([]string{}, conf.StorageBackend...), conf.MirrorBackends...), ",")
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			warnings.warnf(warnJournal, "error reading journal entry(%s): %v", p, err)
+			continue
+		}
+		var j journalEntry
+		if err := json.Unmarshal(b, &j); err != nil {
+			warnings.warnf(warnJournal, "error decoding journal entry(%s): %v", p, err)
+			continue
+		}
+		j.path = p
+		label := fmt.Sprintf("run %s of %s %d/%s", j.RunID, agencyID{j.AID, j.SubAID}, j.Year, monthsLabel(j.Months))
+		switch {
+		case j.open():
+			continue
+		case j.Host != host:
+			log.Printf("Leaving the journal entry of %s alone, written on host %s", label, j.Host)
+			continue
+		case j.PID != os.Getpid() && processAlive(j.PID):
+			continue
+		case strings.Join(j.Backends, ",") != backends:
+			warnings.warnf(warnJournal, "%s uploaded to %s, not reconciling it with %s", label, strings.Join(j.Backends, ","), backends)
+			continue
+		}
+		if len(j.Backups) == 0 {
+			if len(j.Objects) > 0 {
+				// partially uploaded objects may share their names with
+				// those of a previous version.
+				warnings.warnf(warnJournal, "%s died uploading %v, run gc to remove what it left", label, j.Objects)
+			}
+		} else if err := rollbackJournaled(ctx, conf, cloud, coll, j); err != nil {
+			warnings.warnf(warnJournal, "error reconciling %s: %v", label, err)
+			continue
+		}
+		log.Printf("Reconciled the journal entry of %s, started at %s", label, j.StartedAt.Format(time.RFC3339))
+		j.finish()
+	}
+}
+
+// rollbackJournaled deletes the objects of j no record refers to. Only mongo
+// and file records can be checked: with the other sinks they are kept.
+func rollbackJournaled(ctx context.Context, conf Config, cloud backuper, coll *mongo.Collection, j journalEntry) error {
+	switch conf.MetadataSink {
+	case sinkMongo:
+		rollbackUploads(ctx, cloud, coll, j.Backups, j.Files)
+		return nil
+	case sinkFile:
+		recs, err := readRecordsFile(conf.MetadataFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		referenced := make(map[string]bool)
+		for _, r := range recs {
+			for _, b := range r.Backups {
+				referenced[b.URL] = true
+			}
+		}
+		var backups []storage.Backup
+		var files []FileEntry
+		for i, b := range j.Backups {
+			if referenced[b.URL] {
+				log.Printf("Keeping %s, referenced by a backup record", b.URL)
+				continue
+			}
+			backups, files = append(backups, b), append(files, j.Files[i])
+		}
+		rollbackUploads(ctx, cloud, nil, backups, files)
+		return nil
+	}
+	warnings.warnf(warnJournal, "can't tell which of %d object(s) the records of METADATA_SINK=%s refer to, run gc to remove those untracked", len(j.Backups), conf.MetadataSink)
+	return nil
+}
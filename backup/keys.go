@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// keyData is what KEY_TEMPLATE is executed with for every file.
+type keyData struct {
+	AID    string
+	SubAID string
+	// Agency is the agency folder, AID/SUB_AID.
+	Agency string
+	Year   int
+	// Month is the first month of the run, zero padded, Months the label of
+	// all of them (01-03).
+	Month  string
+	Months string
+	// Filename is the name the file would otherwise get under Prefix, its
+	// directories included, Base and Ext those of its last element.
+	Filename string
+	Base     string
+	Ext      string
+	// Timestamp is when the run started, as 20060102T150405Z.
+	Timestamp string
+	RunID     string
+	// Prefix is the agency folder, or the version folder with
+	// OBJECT_VERSIONING.
+	Prefix string
+}
+
+func parseKeyTemplate(s string) (*template.Template, error) {
+	return template.New("KEY_TEMPLATE").Option("missingkey=error").Parse(s)
+}
+
+// checkKeyTemplate validates KEY_TEMPLATE, executing it on a sample file.
+func checkKeyTemplate(s string) error {
+	if s == "" {
+		return nil
+	}
+	t, err := parseKeyTemplate(s)
+	if err != nil {
+		return err
+	}
+	_, err = executeKey(t, keyData{AID: "aid", Agency: "aid", Year: 2020, Month: "01", Months: "01", Filename: "file.csv", Base: "file", Ext: ".csv", Timestamp: "20200101T000000Z", RunID: "run", Prefix: "aid"})
+	return err
+}
+
+func executeKey(t *template.Template, d keyData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, d); err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(b.String())
+	switch {
+	case key == "":
+		return "", fmt.Errorf("empty key for %s", d.Filename)
+	case strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/"):
+		return "", fmt.Errorf("key %q of %s can't start or end with /", key, d.Filename)
+	case path.Clean(key) != key:
+		return "", fmt.Errorf("key %q of %s isn't a clean path", key, d.Filename)
+	}
+	return key, nil
+}
+
+// objectKeys returns the object key of every name of a run, given by
+// KEY_TEMPLATE, every name getting a different one.
+func objectKeys(tmpl string, agency agencyID, year int, months []int, started time.Time, runID, prefix string, names []string) ([]string, error) {
+	t, err := parseKeyTemplate(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KEY_TEMPLATE:%w", err)
+	}
+	keys := make([]string, len(names))
+	seen := make(map[string]string)
+	for i, n := range names {
+		filename := restorePath(prefix, n)
+		ext := path.Ext(filename)
+		key, err := executeKey(t, keyData{
+			AID:       agency.AID,
+			SubAID:    agency.Sub,
+			Agency:    agency.prefix(),
+			Year:      year,
+			Month:     fmt.Sprintf("%02d", months[0]),
+			Months:    monthsLabel(months),
+			Filename:  filename,
+			Base:      strings.TrimSuffix(path.Base(filename), ext),
+			Ext:       ext,
+			Timestamp: started.UTC().Format("20060102T150405Z"),
+			RunID:     runID,
+			Prefix:    prefix,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error building object key with KEY_TEMPLATE:%w", err)
+		}
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("KEY_TEMPLATE gives %s and %s the same key %s", other, n, key)
+		}
+		seen[key] = n
+		keys[i] = key
+	}
+	return keys, nil
+}
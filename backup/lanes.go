@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Priority lanes of the queued backups. Urgent ones, triggered by an
+// operator, are taken before the scheduled backfill, each lane having its
+// own concurrency limit across the workers.
+const (
+	laneUrgent    = "urgent"
+	laneScheduled = "scheduled"
+)
+
+// jobLanes are the lanes in the order their jobs are taken.
+var jobLanes = []string{laneUrgent, laneScheduled}
+
+func checkLane(lane string) error {
+	if lane != "" && lane != laneUrgent && lane != laneScheduled {
+		return fmt.Errorf("priority %q must be empty, %q or %q", lane, laneScheduled, laneUrgent)
+	}
+	return nil
+}
+
+// laneLimit is how many jobs of lane may run at once, 0 being no limit.
+func laneLimit(conf Config, lane string) int {
+	if lane == laneUrgent {
+		return conf.JobUrgentConcurrency
+	}
+	return conf.JobScheduledConcurrency
+}
+
+// laneFilter matches the jobs of lane, those without a priority being
+// scheduled.
+func laneFilter(lane string) bson.M {
+	if lane == laneUrgent {
+		return bson.M{"priority": laneUrgent}
+	}
+	return bson.M{"priority": bson.M{"$ne": laneUrgent}}
+}
+
+// laneFull tells whether lane runs as many jobs as its limit, counting those
+// whose lease is alive. Workers claiming at the same instant may briefly go
+// past it.
+func laneFull(ctx context.Context, coll *mongo.Collection, lane string, limit int) (bool, error) {
+	if limit <= 0 {
+		return false, nil
+	}
+	filter := laneFilter(lane)
+	filter["status"] = jobRunning
+	filter["lease_until"] = bson.M{"$gte": time.Now().UTC()}
+	n, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("error counting running %s jobs:%w", lane, err)
+	}
+	return n >= int64(limit), nil
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+)
+
+// fileLink records that the object Name was not uploaded because its input
+// file is a hard link to the one stored as Target.
+type fileLink struct {
+	Name   string `bson:"name" json:"name"`
+	Target string `bson:"target" json:"target"`
+}
+
+// fileID identifies a file's content on disk.
+type fileID struct {
+	dev, ino uint64
+}
+
+// dedupLinks separates paths that share an inode, which crawlers produce
+// when deduplicating downloads locally with hard links. It returns the
+// indexes of the paths to upload and, for every other path, the link to the
+// object holding its content. The same path given twice is dropped.
+func dedupLinks(paths, names []string) ([]int, []fileLink, error) {
+	var upload []int
+	var links []fileLink
+	seen := make(map[fileID]int)
+	for i, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading file info(%s):%w", p, err)
+		}
+		id, ok := fileIdentity(fi)
+		if !ok {
+			upload = append(upload, i)
+			continue
+		}
+		first, dup := seen[id]
+		switch {
+		case !dup:
+			seen[id] = i
+			upload = append(upload, i)
+		case names[first] != names[i]:
+			links = append(links, fileLink{Name: names[i], Target: names[first]})
+		}
+	}
+	return upload, links, nil
+}
@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// parseAsOf reads the --as-of flag: a date, meaning its midnight in UTC, or
+// an RFC 3339 time. Empty is now.
+func parseAsOf(v string) (time.Time, error) {
+	if v == "" {
+		return time.Now().UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --as-of %q: must be a date (2006-01-02) or an RFC 3339 time", v)
+	}
+	return t.UTC(), nil
+}
+
+// recordsAsOf returns the records in filter written up to asOf, as they
+// were then. Records are rewritten in place by every RECORD_POLICY but
+// version, so their state at asOf is only known from the chain log.
+func recordsAsOf(ctx context.Context, coll *mongo.Collection, filter bson.M, asOf time.Time) ([]Record, error) {
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error querying backup records:%w", err)
+	}
+	var all []Record
+	if err := cur.All(ctx, &all); err != nil {
+		return nil, fmt.Errorf("error decoding backup records:%w", err)
+	}
+	var recs []Record
+	for _, r := range all {
+		if !r.createdAt().After(asOf) {
+			recs = append(recs, r)
+		}
+	}
+	return recs, nil
+}
+
+// chainRecordsAsOf rebuilds the records in filter from the latest snapshot
+// of each one linked to the chain up to asOf, seeing records that were
+// changed or deleted since.
+func chainRecordsAsOf(ctx context.Context, chain *mongo.Collection, filter bson.M, asOf time.Time) ([]Record, error) {
+	q := bson.M{"timestamp": bson.M{"$lte": asOf}}
+	for k, v := range filter {
+		q["record."+k] = v
+	}
+	cur, err := chain.Find(ctx, q, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error querying chain:%w", err)
+	}
+	defer cur.Close(ctx)
+	latest := make(map[primitive.ObjectID]Record)
+	for cur.Next(ctx) {
+		var e chainEntry
+		if err := cur.Decode(&e); err != nil {
+			return nil, fmt.Errorf("error decoding chain entry:%w", err)
+		}
+		var r Record
+		if err := bson.Unmarshal(e.Record, &r); err != nil {
+			return nil, fmt.Errorf("error decoding record of chain entry %d:%w", e.Seq, err)
+		}
+		latest[e.RecordID] = r
+	}
+	if err := cur.Err(); err != nil {
+		return nil, fmt.Errorf("error reading chain:%w", err)
+	}
+	recs := make([]Record, 0, len(latest))
+	for _, r := range latest {
+		recs = append(recs, r)
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ID.Hex() < recs[j].ID.Hex() })
+	return recs, nil
+}
+
+// listCmd shows the latest version of every month of the archive at a point
+// in time (--as-of), to reproduce the inputs of past analyses, as a table or
+// as JSON lines (--format json) of the records. Records are read from mongo,
+// or from METADATA_FILE with METADATA_SINK=file.
+func listCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	agency := fs.String("aid", conf.AID, "agency identifier, empty lists every agency")
+	year := fs.Int("year", 0, "only list this year")
+	monthFlag := fs.Int("month", 0, "only list this month")
+	sinceFlag := fs.String("since", "", "only list the months whose latest version was written from this date (2006-01-02, at midnight UTC) or RFC 3339 time on")
+	asOfFlag := fs.String("as-of", "", "list the archive as it was at this date (2006-01-02, at midnight UTC) or RFC 3339 time; now by default")
+	fromChain := fs.Bool("from-chain", conf.ChainLog, "rebuild records from the chain log, seeing the ones changed or deleted since --as-of")
+	previews := fs.Bool("previews", false, "show the previews of the files of the latest versions, if recorded")
+	format := fs.String("format", "table", "output format: table or json, a record per line")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("invalid --format %q: must be table or json", *format)
+	}
+	if *monthFlag < 0 || *monthFlag > 12 {
+		return fmt.Errorf("invalid --month %d", *monthFlag)
+	}
+	asOf, err := parseAsOf(*asOfFlag)
+	if err != nil {
+		return err
+	}
+	var since time.Time
+	if *sinceFlag != "" {
+		if since, err = parseAsOf(*sinceFlag); err != nil {
+			return fmt.Errorf("invalid --since %q: must be a date (2006-01-02) or an RFC 3339 time", *sinceFlag)
+		}
+	}
+
+	var aid agencyID
+	filter := bson.M{}
+	if *agency != "" {
+		aid = splitAID(strings.ToLower(*agency), conf.AIDSeparator)
+		filter = aid.filter()
+	}
+	if *year != 0 {
+		filter["year"] = *year
+	}
+	if *monthFlag != 0 {
+		filter["month"] = *monthFlag
+	}
+	var recs []Record
+	switch {
+	case conf.MetadataSink == sinkFile:
+		if *fromChain {
+			return fmt.Errorf("--from-chain needs METADATA_SINK=%s", sinkMongo)
+		}
+		if recs, err = readRecordsFile(conf.MetadataFile); err != nil {
+			return err
+		}
+		recs = filterRecords(recs, aid, *year, *monthFlag, asOf)
+	case conf.MetadataSink != sinkMongo:
+		return fmt.Errorf("can't list the records of METADATA_SINK=%s", conf.MetadataSink)
+	default:
+		db, err := connect(ctx, conf.MongoURI)
+		if err != nil {
+			return fmt.Errorf("error connecting to mongo:%w", err)
+		}
+		defer disconnect(db)
+		if *fromChain {
+			recs, err = chainRecordsAsOf(ctx, db.Database(conf.MongoDBName).Collection(conf.MongoChainColl), filter, asOf)
+		} else {
+			recs, err = recordsAsOf(ctx, db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl), filter, asOf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// recs are oldest first: the last one of a month is its latest version.
+	type month struct {
+		rec      Record
+		versions int
+	}
+	months := make(map[string]*month)
+	var keys []string
+	for _, r := range recs {
+		k := fmt.Sprintf("%s\t%04d\t%02d", r.agency(), r.Year, r.Month)
+		m, ok := months[k]
+		if !ok {
+			m = &month{}
+			months[k] = m
+			keys = append(keys, k)
+		}
+		m.rec = r
+		m.versions++
+	}
+	sort.Strings(keys)
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, k := range keys {
+			if r := months[k].rec; !r.createdAt().Before(since) {
+				if err := enc.Encode(r); err != nil {
+					return fmt.Errorf("error encoding record(%s):%w", r.ID.Hex(), err)
+				}
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AID\tYEAR\tMONTH\tVERSION\tCREATED\tFILES\tBYTES\tID")
+	for _, k := range keys {
+		m := months[k]
+		if m.rec.createdAt().Before(since) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", k, versionLabel(m.versions-1), m.rec.createdAt().Format("2006-01-02T15:04:05Z"), len(m.rec.Backups), m.rec.TotalBytes, m.rec.ID.Hex())
+		if *previews {
+			for _, p := range m.rec.Previews {
+				fmt.Fprintf(w, "    %s  %s\n", p.Name, p.summary())
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// filterRecords is recordsAsOf for records read from a file, keeping those
+// of agency, year and month, each one unless zero.
+func filterRecords(recs []Record, agency agencyID, year, month int, asOf time.Time) []Record {
+	var out []Record
+	for _, r := range recs {
+		if (agency.AID != "" && r.agency() != agency) || (year != 0 && r.Year != year) || (month != 0 && r.Month != month) {
+			continue
+		}
+		if !r.createdAt().After(asOf) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+)
+
+// localClient stores the files of the stage under a local directory, laid
+// out as <dir>/<container>/<object name> like the Swift container would be,
+// so the pipeline runs with no object store at all. URLs are file:// ones.
+type localClient struct {
+	dir       string
+	container string
+	readOnly  bool
+}
+
+func newLocalClient(conf Config) (*localClient, error) {
+	dir, err := filepath.Abs(conf.LocalDir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving LOCAL_DIR(%s):%w", conf.LocalDir, err)
+	}
+	return &localClient{dir: dir, container: conf.SwiftContainer, readOnly: conf.ReadOnly}, nil
+}
+
+func (c *localClient) objectPath(name string) string {
+	return filepath.Join(c.dir, c.container, filepath.FromSlash(name))
+}
+
+func (c *localClient) objectURL(name string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(c.objectPath(name))}).String()
+}
+
+// pathOf returns the file of the object at the file:// url u.
+func (c *localClient) pathOf(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "file" {
+		return "", fmt.Errorf("%s is not a file url", u)
+	}
+	p := filepath.FromSlash(parsed.Path)
+	if !strings.HasPrefix(p, c.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under LOCAL_DIR %s", u, c.dir)
+	}
+	return p, nil
+}
+
+// put writes r to the object name, through a temporary file renamed into
+// place so a failed write leaves no partial object. The hash of the
+// returned backup is the MD5 of the content, as Swift's ETag is.
+func (c *localClient) put(ctx context.Context, name string, r io.Reader, sum io.Writer) (storage.Backup, int64, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, 0, err
+	}
+	dst := c.objectPath(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return storage.Backup{}, 0, fmt.Errorf("error creating object directory(%s):%w", filepath.Dir(dst), err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return storage.Backup{}, 0, fmt.Errorf("error creating object(%s/%s):%w", c.container, name, err)
+	}
+	defer os.Remove(f.Name())
+	h := md5.New()
+	w := io.MultiWriter(f, h)
+	if sum != nil {
+		w = io.MultiWriter(f, h, sum)
+	}
+	n, err := buffers.copy(ctx, w, r)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return storage.Backup{}, 0, fmt.Errorf("error writing object(%s/%s):%w", c.container, name, err)
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return storage.Backup{}, 0, fmt.Errorf("error writing object(%s/%s):%w", c.container, name, err)
+	}
+	return storage.Backup{URL: c.objectURL(name), Hash: hex.EncodeToString(h.Sum(nil))}, n, nil
+}
+
+func (c *localClient) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	b, _, err := c.put(ctx, name, r, nil)
+	return b, err
+}
+
+func (c *localClient) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for i, p := range paths {
+		b, f, err := c.copyFile(ctx, p, names[i])
+		if err != nil {
+			return backups, files, err
+		}
+		backups = append(backups, b)
+		files = append(files, f)
+	}
+	return backups, files, nil
+}
+
+func (c *localClient) copyFile(ctx context.Context, path, name string) (storage.Backup, FileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	entry := FileEntry{Name: name, Container: c.container, Bytes: fi.Size(), Backend: backendLocal, Attempts: 1}
+	sum := newDigestWriter()
+	b, _, err := c.put(ctx, name, f, sum)
+	if err == nil {
+		entry.SHA256, err = sum.check(path, entry.Bytes)
+	}
+	return b, entry, err
+}
+
+// digest returns the SHA-256 and size of the object of b.
+func (c *localClient) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	p, err := c.pathOf(b.URL)
+	if err != nil {
+		return "", 0, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening object(%s):%w", p, err)
+	}
+	defer f.Close()
+	w := newDigestWriter()
+	if _, err := buffers.copy(ctx, w, f); err != nil {
+		return "", 0, fmt.Errorf("error reading object(%s):%w", p, err)
+	}
+	return w.sum(), w.n, nil
+}
+
+// ping checks the container directory can be created.
+func (c *localClient) ping(ctx context.Context) error {
+	dir := filepath.Join(c.dir, c.container)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating container directory(%s):%w", dir, err)
+	}
+	return nil
+}
+
+// canary writes, reads back and deletes a tiny object.
+func (c *localClient) canary(ctx context.Context, runID string) error {
+	name := ".canary/" + runID
+	content := []byte("salvador-backups canary " + time.Now().UTC().Format(time.RFC3339Nano))
+	if _, err := c.upload(ctx, name, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("error running canary:%w", err)
+	}
+	got, err := os.ReadFile(c.objectPath(name))
+	if rmErr := os.Remove(c.objectPath(name)); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	if err != nil {
+		return fmt.Errorf("error running canary:%w", err)
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("error running canary: object %s read back with different content", name)
+	}
+	return nil
+}
+
+// discard deletes the object f was stored as.
+func (c *localClient) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	if err := checkWritable(c.readOnly, "delete "+f.Name); err != nil {
+		return err
+	}
+	p, err := c.pathOf(b.URL)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting object(%s):%w", p, err)
+	}
+	return nil
+}
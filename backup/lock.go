@@ -0,0 +1,144 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const leasePollInterval = 5 * time.Second
+
+// errLeaseHeld is returned when another run holds the lease for the same
+// (aid, year, month).
+var errLeaseHeld = errors.New("backup already in progress")
+
+// What the stage does when another run holds the lease of a month once
+// LOCK_WAIT is over.
+const (
+	// lockHeldFail exits with the in_progress failure class.
+	lockHeldFail = "fail"
+	// lockHeldExit exits with status 0, the other run doing the backup.
+	lockHeldExit = "exit"
+)
+
+func checkLockHeldPolicy(policy string) error {
+	if policy != lockHeldFail && policy != lockHeldExit {
+		return fmt.Errorf("%q must be %q or %q", policy, lockHeldFail, lockHeldExit)
+	}
+	return nil
+}
+
+// lease is a mongo-based lock document. The owner keeps it alive by renewing
+// its expiration while the run is in progress, so a crashed run only blocks
+// others until the TTL elapses.
+type lease struct {
+	coll  *mongo.Collection
+	key   string
+	owner string
+	ttl   time.Duration
+	done  chan struct{}
+}
+
+type leaseDoc struct {
+	Key        string    `bson:"_id"`
+	Owner      string    `bson:"owner"`
+	AcquiredAt time.Time `bson:"acquired_at"`
+	ExpiresAt  time.Time `bson:"expires_at"`
+}
+
+func leaseKey(aid string, year, month int) string {
+	return fmt.Sprintf("%s/%d/%02d", aid, year, month)
+}
+
+// newRunID returns a random identifier for this execution.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// acquireLease takes the lease identified by key. If it is held by someone
+// else, it polls until wait has elapsed and then fails with errLeaseHeld. A
+// zero wait fails fast.
+func acquireLease(ctx context.Context, coll *mongo.Collection, key, owner string, ttl, wait time.Duration) (*lease, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		now := time.Now()
+		_, err := coll.UpdateOne(ctx,
+			bson.M{"_id": key, "$or": bson.A{
+				bson.M{"expires_at": bson.M{"$lt": now}},
+				bson.M{"owner": owner},
+			}},
+			bson.M{"$set": bson.M{"owner": owner, "acquired_at": now, "expires_at": now.Add(ttl)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			l := &lease{coll: coll, key: key, owner: owner, ttl: ttl, done: make(chan struct{})}
+			go l.keepAlive()
+			return l, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("error acquiring lease(%s):%w", key, err)
+		}
+		if time.Now().Add(leasePollInterval).After(deadline) {
+			var holder leaseDoc
+			if err := coll.FindOne(ctx, bson.M{"_id": key}).Decode(&holder); err != nil {
+				return nil, fmt.Errorf("%w: lease %s is held by another run", errLeaseHeld, key)
+			}
+			return nil, fmt.Errorf("%w: lease %s held by %s since %s (expires %s)", errLeaseHeld, key, holder.Owner, holder.AcquiredAt.Format(time.RFC3339), holder.ExpiresAt.Format(time.RFC3339))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+}
+
+func (l *lease) keepAlive() {
+	// a ttl of a few nanoseconds still renews.
+	every := l.ttl / 3
+	if every <= 0 {
+		every = l.ttl
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), mgoConnTimeout)
+			res, err := l.coll.UpdateOne(ctx,
+				bson.M{"_id": l.key, "owner": l.owner},
+				bson.M{"$set": bson.M{"expires_at": time.Now().Add(l.ttl)}})
+			cancel()
+			switch {
+			case err != nil:
+				warnings.warnf(warnLease, "error renewing lease %s: %v", l.key, err)
+			case res.MatchedCount == 0:
+				warnings.warnf(warnLease, "lease %s was lost to another run", l.key)
+			}
+		}
+	}
+}
+
+// release stops renewing the lease and removes it if still owned by us.
+func (l *lease) release() error {
+	close(l.done)
+	ctx, cancel := context.WithTimeout(context.Background(), mgoConnTimeout)
+	defer cancel()
+	if _, err := l.coll.DeleteOne(ctx, bson.M{"_id": l.key, "owner": l.owner}); err != nil {
+		return fmt.Errorf("error releasing lease(%s):%w", l.key, err)
+	}
+	return nil
+}
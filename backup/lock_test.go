@@ -0,0 +1,41 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStageExitsOnHeldLease(t *testing.T) {
+	conf := testConfig(t)
+	db := testMongo(t, &conf)
+	now := time.Now()
+	held := leaseDoc{Key: leaseKey(conf.AID, int(conf.Year), int(conf.Month)), Owner: "other", AcquiredAt: now, ExpiresAt: now.Add(time.Hour)}
+	if _, err := db.Collection(conf.MongoLockColl).InsertOne(context.Background(), held); err != nil {
+		t.Fatal(err)
+	}
+	paths := writeTestFiles(t, "a.csv", "a,b\n1,2\n")
+	env := []string{
+		"MONGODB_URI=" + conf.MongoURI,
+		"MONGODB_DBNAME=" + conf.MongoDBName,
+		"MONGODB_BCOLL=" + conf.MongoBackupColl,
+		"METADATA_SINK=" + sinkMongo,
+		"LOCK_HELD_POLICY=" + lockHeldExit,
+	}
+	stdin := paths[0] + "\n"
+
+	out, code := runStage(t, env, stdin)
+	if code != 0 || out != stdin {
+		t.Errorf("stage printed %q with status %d, want the input %q with status 0", out, code, stdin)
+	}
+
+	out, code = runStage(t, append(env, "OUTPUT_FORMAT="+outputJSON), stdin)
+	var res Result
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("stage printed %q with status %d: %v", out, code, err)
+	}
+	if code != 0 || !res.InProgress || len(res.Paths) != 1 || len(res.Records) != 0 {
+		t.Errorf("stage printed %+v with status %d, want the path in progress with status 0", res, code)
+	}
+}
@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LOG_FORMAT values.
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// Log levels, LOG_LEVEL dropping the lines below it.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLevel(s string) (int, error) {
+	for l, name := range levelNames {
+		if s == name {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("%q must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// logLine is how log lines are written to stderr with LOG_FORMAT=json, one
+// per line. The run fields are of the run in progress, if any.
+type logLine struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	Message  string    `json:"message"`
+	RunID    string    `json:"run_id,omitempty"`
+	AID      string    `json:"aid,omitempty"`
+	Year     int       `json:"year,omitempty"`
+	Month    int       `json:"month,omitempty"`
+	Months   []int     `json:"months,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+}
+
+// runLogger is where the standard logger writes. Its level is told by the
+// prefix of the message ("Warning: ", "Error: " and "Invalid " being what
+// the code uses), debug lines being written with debugf.
+type runLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  int
+	run    logLine
+}
+
+// logs is set up from the config in main.
+var logs = &runLogger{w: os.Stderr, format: logText, level: levelInfo}
+
+// setupLogging points the standard logger at logs, with the LOG_FORMAT and
+// LOG_LEVEL of conf.
+func setupLogging(conf Config) error {
+	if conf.LogFormat != logText && conf.LogFormat != logJSON {
+		return fmt.Errorf("LOG_FORMAT %q must be %q or %q", conf.LogFormat, logText, logJSON)
+	}
+	level, err := parseLevel(conf.LogLevel)
+	if err != nil {
+		return fmt.Errorf("LOG_LEVEL %w", err)
+	}
+	logs.mu.Lock()
+	logs.format, logs.level = conf.LogFormat, level
+	logs.mu.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(logs)
+	return nil
+}
+
+// setRun adds the fields of a run to the lines written until clearRun.
+func (l *runLogger) setRun(runID string, aid agencyID, year int, months []int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.run = logLine{RunID: runID, AID: aid.String(), Year: year, Month: months[0]}
+	if len(months) > 1 {
+		l.run.Months = months
+	}
+}
+
+func (l *runLogger) clearRun() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.run = logLine{}
+}
+
+// debugf writes a debug line about file, which took d.
+func (l *runLogger) debugf(file string, d time.Duration, format string, args ...interface{}) {
+	l.write(levelDebug, fmt.Sprintf(format, args...), file, d)
+}
+
+// infof writes an info line about what took d.
+func (l *runLogger) infof(d time.Duration, format string, args ...interface{}) {
+	l.write(levelInfo, fmt.Sprintf(format, args...), "", d)
+}
+
+// Write takes the lines of the standard logger.
+func (l *runLogger) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := levelInfo
+	switch {
+	case strings.HasPrefix(msg, "Warning: "):
+		level = levelWarn
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Invalid "):
+		level = levelError
+	}
+	if err := l.write(level, msg, "", 0); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (l *runLogger) write(level int, msg, file string, d time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return nil
+	}
+	now := time.Now()
+	if l.format != logJSON {
+		_, err := fmt.Fprintf(l.w, "%s %s\n", now.Format("2006/01/02 15:04:05"), msg)
+		return err
+	}
+	line := l.run
+	line.Time = now.UTC()
+	line.Level = levelNames[level]
+	line.Message = msg
+	if level == levelWarn {
+		line.Message = strings.TrimPrefix(msg, "Warning: ")
+	}
+	if level == levelError {
+		line.Message = strings.TrimPrefix(msg, "Error: ")
+	}
+	line.File = file
+	line.Duration = d.Seconds()
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
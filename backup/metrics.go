@@ -0,0 +1,224 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// agencyStats aggregates the backup records of one agency.
+type agencyStats struct {
+	AID         agencyID  `bson:"_id"`
+	LastSuccess time.Time `bson:"last_success"`
+	Records     int64     `bson:"records"`
+	Files       int64     `bson:"files"`
+	Bytes       int64     `bson:"bytes"`
+	// LastUsage is the usage of the latest run, nil for records written
+	// before it was measured.
+	LastUsage *runUsage `bson:"last_usage"`
+}
+
+// loadAgencyStats aggregates the backup collection per agency. Records
+// written before the timestamp field existed fall back to the creation time
+// embedded in their ObjectID, and the records of runs that failed uploading
+// some of their files don't count as successes.
+func loadAgencyStats(ctx context.Context, coll *mongo.Collection) ([]agencyStats, error) {
+	success := bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{"$incomplete", true}},
+		nil,
+		bson.M{"$ifNull": bson.A{"$timestamp", bson.M{"$toDate": "$_id"}}},
+	}}
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          bson.M{"aid": "$aid", "sub_aid": "$sub_aid"},
+			"last_success": bson.M{"$max": success},
+			"records":      bson.M{"$sum": 1},
+			"files":        bson.M{"$sum": bson.M{"$size": bson.M{"$ifNull": bson.A{"$backups", bson.A{}}}}},
+			"bytes":        bson.M{"$sum": bson.M{"$ifNull": bson.A{"$total_bytes", 0}}},
+			"last_usage":   bson.M{"$last": "$usage"},
+		}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating backup records:%w", err)
+	}
+	var stats []agencyStats
+	if err := cur.All(ctx, &stats); err != nil {
+		return nil, fmt.Errorf("error decoding backup aggregation:%w", err)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].AID.AID != stats[j].AID.AID {
+			return stats[i].AID.AID < stats[j].AID.AID
+		}
+		return stats[i].AID.Sub < stats[j].AID.Sub
+	})
+	return stats, nil
+}
+
+// writeAgencyMetrics writes stats in the Prometheus text exposition format.
+func writeAgencyMetrics(w io.Writer, stats []agencyStats) {
+	hasUsage := func(s agencyStats) bool { return s.LastUsage != nil }
+	hasSuccess := func(s agencyStats) bool { return !s.LastSuccess.IsZero() }
+	gauges := []struct {
+		name, help string
+		value      func(s agencyStats) float64
+		// has tells whether the agency has a value, nil if all have.
+		has func(s agencyStats) bool
+	}{
+		{"salvador_backup_last_success_timestamp_seconds", "Unix time of the last successful backup of the agency.",
+			func(s agencyStats) float64 { return float64(s.LastSuccess.Unix()) }, hasSuccess},
+		{"salvador_backup_records", "Number of backup records stored for the agency.",
+			func(s agencyStats) float64 { return float64(s.Records) }, nil},
+		{"salvador_backup_files", "Number of files backed up for the agency.",
+			func(s agencyStats) float64 { return float64(s.Files) }, nil},
+		{"salvador_backup_bytes", "Bytes stored for the agency.",
+			func(s agencyStats) float64 { return float64(s.Bytes) }, nil},
+		{"salvador_backup_last_run_cpu_seconds", "CPU time used by the latest backup run of the agency.",
+			func(s agencyStats) float64 { return s.LastUsage.CPUSeconds }, hasUsage},
+		{"salvador_backup_last_run_peak_rss_bytes", "Peak resident set size of the process of the latest backup run of the agency.",
+			func(s agencyStats) float64 { return float64(s.LastUsage.PeakRSSBytes) }, hasUsage},
+		{"salvador_backup_last_run_sent_bytes", "Bytes sent over the network by the latest backup run of the agency.",
+			func(s agencyStats) float64 { return float64(s.LastUsage.SentBytes) }, hasUsage},
+		{"salvador_backup_last_run_received_bytes", "Bytes received over the network by the latest backup run of the agency.",
+			func(s agencyStats) float64 { return float64(s.LastUsage.ReceivedBytes) }, hasUsage},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, s := range stats {
+			if g.has != nil && !g.has(s) {
+				continue
+			}
+			fmt.Fprintf(w, "%s{%s} %g\n", g.name, agencyLabels(s.AID), g.value(s))
+		}
+	}
+}
+
+func agencyLabels(a agencyID) string {
+	labels := fmt.Sprintf("aid=\"%s\"", escapeLabel(a.AID))
+	if a.Sub != "" {
+		labels += fmt.Sprintf(",sub_aid=\"%s\"", escapeLabel(a.Sub))
+	}
+	return labels
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// retryStats counts the jobs of the retry queue of an agency that failed
+// with the same class of storage error.
+type retryStats struct {
+	Key struct {
+		AID   string `bson:"aid"`
+		Class string `bson:"error_class"`
+	} `bson:"_id"`
+	Jobs int64 `bson:"jobs"`
+}
+
+func loadRetryStats(ctx context.Context, coll *mongo.Collection) ([]retryStats, error) {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":  bson.M{"aid": "$aid", "error_class": bson.M{"$ifNull": bson.A{"$error_class", ""}}},
+			"jobs": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.aid", Value: 1}, {Key: "_id.error_class", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating retry jobs:%w", err)
+	}
+	var stats []retryStats
+	if err := cur.All(ctx, &stats); err != nil {
+		return nil, fmt.Errorf("error decoding retry job aggregation:%w", err)
+	}
+	return stats, nil
+}
+
+// writeRetryMetrics writes the retry queue gauge, jobs whose last attempt
+// didn't fail storing files being of class "other".
+func writeRetryMetrics(w io.Writer, stats []retryStats) {
+	const name = "salvador_backup_retry_jobs"
+	fmt.Fprintf(w, "# HELP %s Failed runs waiting in the retry queue, by the class of the storage error of their last attempt.\n# TYPE %s gauge\n", name, name)
+	for _, s := range stats {
+		class := s.Key.Class
+		if class == "" {
+			class = "other"
+		}
+		fmt.Fprintf(w, "%s{aid=\"%s\",class=\"%s\"} %d\n", name, escapeLabel(s.Key.AID), class, s.Jobs)
+	}
+}
+
+// failureStats counts the failed runs of an agency.
+type failureStats struct {
+	AID  agencyID `bson:"_id"`
+	Runs int64    `bson:"runs"`
+}
+
+func loadFailureStats(ctx context.Context, coll *mongo.Collection) ([]failureStats, error) {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": runFailed}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  bson.M{"aid": "$aid", "sub_aid": "$sub_aid"},
+			"runs": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.aid", Value: 1}, {Key: "_id.sub_aid", Value: 1}}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating failed runs:%w", err)
+	}
+	var stats []failureStats
+	if err := cur.All(ctx, &stats); err != nil {
+		return nil, fmt.Errorf("error decoding failed run aggregation:%w", err)
+	}
+	return stats, nil
+}
+
+// writeFailureMetrics writes the counter of failed runs, as kept in
+// MONGODB_RUNS_COLL.
+func writeFailureMetrics(w io.Writer, stats []failureStats) {
+	const name = "salvador_backup_failures_total"
+	fmt.Fprintf(w, "# HELP %s Failed backup runs of the agency.\n# TYPE %s counter\n", name, name)
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, agencyLabels(s.AID), s.Runs)
+	}
+}
+
+// metricsHandler serves per-agency metrics, querying mongo on every scrape,
+// runs nil when MONGODB_RUNS_COLL isn't set.
+func metricsHandler(coll, retries, runs *mongo.Collection) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), mgoConnTimeout)
+		defer cancel()
+		stats, err := loadAgencyStats(ctx, coll)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		queued, err := loadRetryStats(ctx, retries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var failed []failureStats
+		if runs != nil {
+			if failed, err = loadFailureStats(ctx, runs); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeAgencyMetrics(w, stats)
+		writeRetryMetrics(w, queued)
+		if runs != nil {
+			writeFailureMetrics(w, failed)
+		}
+	})
+}
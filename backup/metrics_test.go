@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWriteAgencyMetricsWithoutSuccess(t *testing.T) {
+	var b bytes.Buffer
+	writeAgencyMetrics(&b, []agencyStats{
+		{AID: agencyID{AID: "trt1"}, LastSuccess: time.Unix(1650000000, 0), Records: 1},
+		{AID: agencyID{AID: "trt2"}, Records: 1},
+	})
+	out := b.String()
+	if !strings.Contains(out, `salvador_backup_last_success_timestamp_seconds{aid="trt1"} 1.65e+09`) {
+		t.Errorf("last success of trt1 missing from:\n%s", out)
+	}
+	if strings.Contains(out, `salvador_backup_last_success_timestamp_seconds{aid="trt2"}`) {
+		t.Errorf("last success written for trt2, which has none:\n%s", out)
+	}
+}
+
+func TestWriteFailureMetrics(t *testing.T) {
+	var b bytes.Buffer
+	writeFailureMetrics(&b, []failureStats{
+		{AID: agencyID{AID: "trt1"}, Runs: 2},
+		{AID: agencyID{AID: "mppb", Sub: "pgj"}, Runs: 1},
+	})
+	want := "# HELP salvador_backup_failures_total Failed backup runs of the agency.\n" +
+		"# TYPE salvador_backup_failures_total counter\n" +
+		"salvador_backup_failures_total{aid=\"trt1\"} 2\n" +
+		"salvador_backup_failures_total{aid=\"mppb\",sub_aid=\"pgj\"} 1\n"
+	if b.String() != want {
+		t.Errorf("got:\n%swant:\n%s", b.String(), want)
+	}
+}
+
+func TestLoadAgencyStatsSkipsIncomplete(t *testing.T) {
+	conf := testConfig(t)
+	db := testMongo(t, &conf)
+	ctx := context.Background()
+	coll := db.Collection(conf.MongoBackupColl)
+	done, failed := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	_, err := coll.InsertMany(ctx, []interface{}{
+		bson.M{"_id": primitive.NewObjectID(), "aid": "trt1", "timestamp": done},
+		bson.M{"_id": primitive.NewObjectID(), "aid": "trt1", "timestamp": failed, "incomplete": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := loadAgencyStats(ctx, coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || !stats[0].LastSuccess.Equal(done) {
+		t.Errorf("got stats %+v, want the last success at %s", stats, done)
+	}
+}
+
+func TestLoadFailureStats(t *testing.T) {
+	conf := testConfig(t)
+	db := testMongo(t, &conf)
+	ctx := context.Background()
+	coll := db.Collection(conf.MongoRunsColl)
+	_, err := coll.InsertMany(ctx, []interface{}{
+		bson.M{"_id": "a", "aid": "trt1", "status": runFailed},
+		bson.M{"_id": "b", "aid": "trt1", "status": runFailed},
+		bson.M{"_id": "c", "aid": "trt1", "status": runSucceeded},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := loadFailureStats(ctx, coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].AID.AID != "trt1" || stats[0].Runs != 2 {
+		t.Errorf("got %+v, want 2 failed runs of trt1", stats)
+	}
+}
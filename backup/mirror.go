@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/dadosjusbr/storage"
+)
+
+// What a run does when storing a copy in a MIRROR_BACKENDS backend fails.
+const (
+	// mirrorFail fails the run, as when the upload itself fails.
+	mirrorFail = "fail"
+	// mirrorWarn warns, the object being left without that copy.
+	mirrorWarn = "warn"
+)
+
+// objectReplica is a copy of an object of a record, stored in a mirror
+// backend.
+type objectReplica struct {
+	// Object is the URL of the object the replica is a copy of.
+	Object  string `bson:"object" json:"object"`
+	Backend string `bson:"backend" json:"backend"`
+	URL     string `bson:"url" json:"url"`
+}
+
+// storedCopy is a replica with what its backend needs to discard it.
+type storedCopy struct {
+	replica objectReplica
+	backend backuper
+	backup  storage.Backup
+	entry   FileEntry
+}
+
+// mirror stores every object in the primary backend, then a copy of it in
+// each of the replica ones, so losing a provider doesn't lose backups.
+type mirror struct {
+	primary  backuper
+	names    []string
+	replicas []backuper
+	policy   string
+	// copies maps the URL of every object stored by the primary to its
+	// replicas, guarded by mu as files are stored concurrently with
+	// BACKUP_CONCURRENCY.
+	copies map[string][]storedCopy
+	mu     sync.Mutex
+}
+
+func newMirror(primary backuper, names []string, replicas []backuper, policy string) *mirror {
+	return &mirror{
+		primary:  primary,
+		names:    names,
+		replicas: replicas,
+		policy:   policy,
+		copies:   make(map[string][]storedCopy),
+	}
+}
+
+// failed handles a replica failing to store a copy, returning the error the
+// run fails with, if any.
+func (m *mirror) failed(i int, err error) error {
+	if m.policy == mirrorWarn {
+		warnings.warnf(warnMirror, "error mirroring to backend %s, continuing without the copy:%v", m.names[i], err)
+		return nil
+	}
+	return fmt.Errorf("error mirroring to backend %s:%w", m.names[i], err)
+}
+
+// backup stores the files in the primary and then in every replica. With
+// MIRROR_FAILURE_POLICY=fail, the files a replica failed to store are
+// discarded from the other backends and reported as not uploaded.
+func (m *mirror) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups, files, err := m.primary.backup(ctx, paths, names)
+	n := len(backups)
+	var mirrorErr error
+	for i, r := range m.replicas {
+		rb, rf, rerr := r.backup(ctx, paths[:n], names[:n])
+		m.mu.Lock()
+		for k, b := range rb {
+			m.copies[backups[k].URL] = append(m.copies[backups[k].URL], storedCopy{
+				replica: objectReplica{Object: backups[k].URL, Backend: m.names[i], URL: b.URL},
+				backend: r,
+				backup:  b,
+				entry:   rf[k],
+			})
+		}
+		m.mu.Unlock()
+		if rerr == nil {
+			continue
+		}
+		if rerr = m.failed(i, rerr); rerr != nil {
+			mirrorErr = rerr
+			n = len(rb)
+			break
+		}
+	}
+	if mirrorErr == nil {
+		return backups, files, err
+	}
+	for k := n; k < len(backups); k++ {
+		if derr := m.discard(ctx, backups[k], files[k]); derr != nil {
+			warnings.warnf(warnMirror, "error discarding %s, not stored in every backend:%v", files[k].Name, derr)
+		}
+	}
+	if err == nil {
+		err = mirrorErr
+	}
+	return backups[:n], files[:n], err
+}
+
+// upload keeps the content of r in memory, to be sent to every backend. It
+// is only used for small generated files.
+func (m *mirror) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error reading content(%s):%w", name, err)
+	}
+	b, err := m.primary.upload(ctx, name, bytes.NewReader(content))
+	if err != nil {
+		return b, err
+	}
+	for i, r := range m.replicas {
+		rb, err := r.upload(ctx, name, bytes.NewReader(content))
+		if err != nil {
+			if err := m.failed(i, err); err != nil {
+				return b, err
+			}
+			continue
+		}
+		m.mu.Lock()
+		m.copies[b.URL] = append(m.copies[b.URL], storedCopy{
+			replica: objectReplica{Object: b.URL, Backend: m.names[i], URL: rb.URL},
+			backend: r,
+			backup:  rb,
+		})
+		m.mu.Unlock()
+	}
+	return b, nil
+}
+
+// canary round trips an object through every backend.
+func (m *mirror) canary(ctx context.Context, runID string) error {
+	if err := m.primary.canary(ctx, runID); err != nil {
+		return err
+	}
+	for i, r := range m.replicas {
+		if err := r.canary(ctx, runID); err != nil {
+			return fmt.Errorf("error running canary in mirror backend %s:%w", m.names[i], err)
+		}
+	}
+	return nil
+}
+
+// digest checks the primary copy.
+func (m *mirror) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	return m.primary.digest(ctx, b)
+}
+
+func (m *mirror) ping(ctx context.Context) error {
+	if err := m.primary.ping(ctx); err != nil {
+		return err
+	}
+	for i, r := range m.replicas {
+		if err := r.ping(ctx); err != nil {
+			return fmt.Errorf("error pinging mirror backend %s:%w", m.names[i], err)
+		}
+	}
+	return nil
+}
+
+// discard deletes the object of b and its replicas.
+func (m *mirror) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	if err := m.primary.discard(ctx, b, f); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	copies := m.copies[b.URL]
+	m.mu.Unlock()
+	for _, c := range copies {
+		if err := c.backend.discard(ctx, c.backup, c.entry); err != nil {
+			return fmt.Errorf("error discarding replica in backend %s:%w", c.replica.Backend, err)
+		}
+		log.Printf("Discarded replica %s", c.replica.URL)
+	}
+	m.mu.Lock()
+	delete(m.copies, b.URL)
+	m.mu.Unlock()
+	return nil
+}
+
+// checkQuotas checks the quotas of the primary, the one files are recorded
+// in.
+func (m *mirror) checkQuotas(ctx context.Context, files []FileEntry, ratio float64) error {
+	if q, ok := m.primary.(quotaChecker); ok {
+		return q.checkQuotas(ctx, files, ratio)
+	}
+	return nil
+}
+
+// replicasOf returns the replicas of objects, in their order.
+func (m *mirror) replicasOf(objects []storage.Backup) []objectReplica {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var replicas []objectReplica
+	for _, b := range objects {
+		for _, c := range m.copies[b.URL] {
+			replicas = append(replicas, c.replica)
+		}
+	}
+	return replicas
+}
+
+// checkMirrorBackends validates MIRROR_BACKENDS, which must be other than
+// the STORAGE_BACKEND ones to be independent copies.
+func checkMirrorBackends(conf Config) error {
+	if conf.MirrorFailurePolicy != mirrorFail && conf.MirrorFailurePolicy != mirrorWarn {
+		return fmt.Errorf("MIRROR_FAILURE_POLICY %q must be %q or %q", conf.MirrorFailurePolicy, mirrorFail, mirrorWarn)
+	}
+	primary := make(map[string]bool)
+	for _, name := range conf.StorageBackend {
+		primary[name] = true
+	}
+	for _, name := range conf.MirrorBackends {
+		if primary[name] {
+			return fmt.Errorf("%q is a STORAGE_BACKEND already", name)
+		}
+	}
+	return checkBackendNames(conf, conf.MirrorBackends)
+}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseMonths parses a month list such as "1-12", "1,2,3" or "1-3,7" into a
+// sorted list of distinct months.
+func parseMonths(spec string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid month %q in %q", part, spec)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("invalid month range %q in %q", part, spec)
+			}
+		}
+		if from < 1 || to > 12 || from > to {
+			return nil, fmt.Errorf("invalid month range %q in %q: months go from 1 to 12", part, spec)
+		}
+		for m := from; m <= to; m++ {
+			seen[m] = true
+		}
+	}
+	months := make([]int, 0, len(seen))
+	for m := range seen {
+		months = append(months, m)
+	}
+	sort.Ints(months)
+	return months, nil
+}
+
+// runMonths returns the months covered by the run: MONTHS when set, MONTH
+// otherwise.
+func runMonths(conf Config) ([]int, error) {
+	if conf.Months == "" {
+		return []int{int(conf.Month)}, nil
+	}
+	return parseMonths(conf.Months)
+}
+
+// monthsLabel names a list of months in object names, e.g. "08" or "01-12".
+func monthsLabel(months []int) string {
+	first, last := months[0], months[len(months)-1]
+	if first == last {
+		return fmt.Sprintf("%02d", first)
+	}
+	if last-first == len(months)-1 {
+		return fmt.Sprintf("%02d-%02d", first, last)
+	}
+	labels := make([]string, len(months))
+	for i, m := range months {
+		labels[i] = fmt.Sprintf("%02d", m)
+	}
+	return strings.Join(labels, "_")
+}
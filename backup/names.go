@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	collisionError = "error"
+	collisionHash  = "hash"
+	collisionPath  = "path"
+)
+
+// objectNames returns the object name of every path. Files are named after
+// their base name under the agency folder; when several paths share a base
+// name, strategy decides what happens: fail as invalid input (error),
+// suffix the name with a short content hash (hash) or keep the path
+// relative to the inputs' common directory (path).
+func objectNames(aid string, paths []string, strategy string) ([]string, error) {
+	// the same file listed twice is not a collision.
+	first := make(map[string]int)
+	dups := make(map[int]int)
+	byBase := make(map[string][]int)
+	for i, p := range paths {
+		key := filepath.Clean(p)
+		if j, ok := first[key]; ok {
+			dups[i] = j
+			continue
+		}
+		first[key] = i
+		b := filepath.Base(p)
+		byBase[b] = append(byBase[b], i)
+	}
+	names := make([]string, len(paths))
+	root := commonDir(paths)
+	for base, idx := range byBase {
+		if len(idx) == 1 {
+			names[idx[0]] = aid + "/" + base
+			continue
+		}
+		switch strategy {
+		case collisionError:
+			var colliding []string
+			for _, i := range idx {
+				colliding = append(colliding, paths[i])
+			}
+			return nil, withFailClass(failInvalidInput, fmt.Errorf("files %v would be stored with the same name %s/%s", colliding, aid, base))
+		case collisionHash:
+			for _, i := range idx {
+				sum, err := fileSHA256(paths[i])
+				if err != nil {
+					return nil, err
+				}
+				ext := path.Ext(base)
+				names[i] = fmt.Sprintf("%s/%s-%s%s", aid, strings.TrimSuffix(base, ext), sum[:8], ext)
+			}
+		case collisionPath:
+			for _, i := range idx {
+				rel, err := filepath.Rel(root, paths[i])
+				if err != nil {
+					return nil, fmt.Errorf("error computing relative path(%s):%w", paths[i], err)
+				}
+				names[i] = aid + "/" + filepath.ToSlash(rel)
+			}
+		default:
+			return nil, fmt.Errorf("invalid name collision strategy %q", strategy)
+		}
+	}
+	for i, j := range dups {
+		names[i] = names[j]
+	}
+	seen := make(map[string]string)
+	for i, n := range names {
+		if _, ok := dups[i]; ok {
+			continue
+		}
+		if other, ok := seen[n]; ok {
+			return nil, fmt.Errorf("files %s and %s would still be stored with the same name %s", other, paths[i], n)
+		}
+		seen[n] = paths[i]
+	}
+	return names, nil
+}
+
+// commonDir returns the deepest directory containing every path.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return "."
+	}
+	abs := func(p string) string {
+		if a, err := filepath.Abs(p); err == nil {
+			return a
+		}
+		return filepath.Clean(p)
+	}
+	dir := filepath.Dir(abs(paths[0]))
+	for _, p := range paths[1:] {
+		d := filepath.Dir(abs(p))
+		for dir != d && !strings.HasPrefix(d, dir+string(filepath.Separator)) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dir
+}
@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsFetchWait is how long a fetch waits for a job before trying again,
+// natsLaneWait that of every lane when the urgent one is consumed too, so
+// an urgent job waits at most for the fetch of the scheduled lane.
+const (
+	natsFetchWait = 30 * time.Second
+	natsLaneWait  = 2 * time.Second
+)
+
+// natsLane is the consumer of the jobs of a lane.
+type natsLane struct {
+	subject string
+	sub     *nats.Subscription
+}
+
+// natsJob is a backup job consumed from NATS_JOBS_SUBJECT.
+type natsJob struct {
+	AID            string   `json:"aid"`
+	Year           int      `json:"year"`
+	Month          int      `json:"month"`
+	Months         []int    `json:"months,omitempty"`
+	Paths          []string `json:"paths"`
+	IdempotencyKey string   `json:"idempotency_key,omitempty"`
+}
+
+// config returns conf pointed at the job.
+func (j natsJob) config(conf Config) (Config, error) {
+	months := j.Months
+	if len(months) == 0 {
+		months = []int{j.Month}
+	}
+	if j.AID == "" || j.Year == 0 || months[0] == 0 || len(j.Paths) == 0 {
+		return conf, fmt.Errorf("job must have aid, year, month(s) and paths")
+	}
+	conf = jobConfig(conf, strings.ToLower(j.AID), j.Year, months)
+	conf.IdempotencyKey = j.IdempotencyKey
+	if _, err := runMonths(conf); err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+// natsAcker acknowledges the message of a job, a *nats.Msg outside tests.
+type natsAcker interface {
+	Ack(opts ...nats.AckOpt) error
+	Nak(opts ...nats.AckOpt) error
+	Term(opts ...nats.AckOpt) error
+	InProgress(opts ...nats.AckOpt) error
+}
+
+// processNATSJob runs the job carried by data and publishes its result. While
+// the upload is in progress the message is periodically marked as such, so
+// long uploads don't exceed the consumer's ack wait and get redelivered. A
+// job interrupted by ctx is given back, without a result, for another worker
+// to run it.
+func processNATSJob(ctx context.Context, conf Config, js nats.JetStreamContext, data []byte, msg natsAcker) error {
+	var job natsJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		log.Printf("Warning: discarding malformed job: %v", err)
+		return msg.Term()
+	}
+	jobConf, err := job.config(conf)
+	if err != nil {
+		log.Printf("Warning: discarding invalid job: %v", err)
+		return msg.Term()
+	}
+	if err := ctx.Err(); err != nil {
+		log.Printf("Job %s %d/%s not started, giving it back: %v", jobConf.AID, jobConf.Year, jobConf.Months, err)
+		return msg.Nak()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(conf.NATSAckWait / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := msg.InProgress(); err != nil {
+					log.Printf("Warning: error extending job ack wait: %v", err)
+				}
+			}
+		}
+	}()
+	var recs []Record
+	flagged, runErr := applyContentTypePolicy(jobConf, job.Paths)
+	if runErr == nil {
+		recs, runErr = run(ctx, jobConf, job.Paths, flagged, nil, nil)
+	}
+	close(done)
+	if runErr != nil && ctx.Err() != nil {
+		log.Printf("Job %s %d/%s interrupted, giving it back: %v", jobConf.AID, jobConf.Year, jobConf.Months, runErr)
+		return msg.Nak()
+	}
+	notifyBackup(ctx, jobConf, job.Paths, recs, runErr)
+
+	res, err := json.Marshal(newBackupResult(jobConf, job.Paths, recs, runErr))
+	if err != nil {
+		return fmt.Errorf("error encoding job result:%w", err)
+	}
+	if _, err := js.Publish(conf.NATSResultsSubject, res); err != nil {
+		return fmt.Errorf("error publishing job result(%s):%w", conf.NATSResultsSubject, err)
+	}
+	if runErr != nil {
+		log.Printf("Job %s %d/%s failed: %v", jobConf.AID, jobConf.Year, jobConf.Months, runErr)
+		// a run refused by configuration won't succeed when redelivered.
+		if errors.Is(runErr, errReadOnly) {
+			return msg.Term()
+		}
+		return msg.Nak()
+	}
+	log.Printf("Job %s %d/%s succeeded", jobConf.AID, jobConf.Year, jobConf.Months)
+	return msg.Ack()
+}
+
+// natsWorkerCmd consumes backup jobs from a JetStream durable pull consumer,
+// one at a time, publishing every result to NATS_RESULTS_SUBJECT. With
+// NATS_URGENT_JOBS_SUBJECT the jobs there are consumed first, by a consumer
+// of their own. The lanes' concurrency limits are the most jobs their
+// consumers leave unacknowledged, across the workers. It stops once ctx is
+// done, on SIGINT or SIGTERM, the job in progress given back.
+func natsWorkerCmd(ctx context.Context, conf Config, args []string) error {
+	if conf.NATSURL == "" {
+		return fmt.Errorf("NATS_URL must be set")
+	}
+	if conf.NATSAckWait <= 0 {
+		return fmt.Errorf("NATS_ACK_WAIT must be positive")
+	}
+	if conf.JobUrgentConcurrency < 0 || conf.JobScheduledConcurrency < 0 {
+		return fmt.Errorf("JOB_URGENT_CONCURRENCY and JOB_SCHEDULED_CONCURRENCY must not be negative")
+	}
+	if err := checkWritable(conf.ReadOnly, "process backup jobs"); err != nil {
+		return err
+	}
+	nc, err := nats.Connect(conf.NATSURL, nats.Name("salvador-backups"))
+	if err != nil {
+		return fmt.Errorf("error connecting to nats:%w", err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("error creating jetstream context:%w", err)
+	}
+	subscribe := func(lane, subject, durable string) (natsLane, error) {
+		opts := []nats.SubOpt{
+			nats.ManualAck(),
+			nats.AckWait(conf.NATSAckWait),
+			nats.MaxDeliver(conf.NATSMaxDeliver),
+		}
+		if limit := laneLimit(conf, lane); limit > 0 {
+			opts = append(opts, nats.MaxAckPending(limit))
+		}
+		if conf.NATSStream != "" {
+			opts = append(opts, nats.BindStream(conf.NATSStream))
+		}
+		sub, err := js.PullSubscribe(subject, durable, opts...)
+		if err != nil {
+			return natsLane{}, fmt.Errorf("error subscribing to jobs(%s):%w", subject, err)
+		}
+		log.Printf("Consuming %s backup jobs from %s as %s", lane, subject, durable)
+		return natsLane{subject: subject, sub: sub}, nil
+	}
+	var lanes []natsLane
+	wait := natsFetchWait
+	if conf.NATSUrgentJobsSubject != "" {
+		l, err := subscribe(laneUrgent, conf.NATSUrgentJobsSubject, conf.NATSDurable+"-"+laneUrgent)
+		if err != nil {
+			return err
+		}
+		lanes = append(lanes, l)
+		wait = natsLaneWait
+	}
+	l, err := subscribe(laneScheduled, conf.NATSJobsSubject, conf.NATSDurable)
+	if err != nil {
+		return err
+	}
+	lanes = append(lanes, l)
+	for ctx.Err() == nil {
+		// back to the urgent lane after every job.
+		for _, l := range lanes {
+			msgs, err := fetchNATSJobs(ctx, l.sub, wait)
+			if ctx.Err() != nil {
+				// a job fetched as ctx was done is given back too.
+				for _, msg := range msgs {
+					if err := msg.Nak(); err != nil {
+						log.Printf("Warning: error giving back job: %v", err)
+					}
+				}
+				break
+			}
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("error fetching jobs(%s):%w", l.subject, err)
+			}
+			for _, msg := range msgs {
+				if err := processNATSJob(ctx, conf, js, msg.Data, msg); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}
+			break
+		}
+	}
+	log.Printf("Stopped consuming backup jobs (%v)", ctx.Err())
+	return nil
+}
+
+// fetchNATSJobs fetches a job from sub, waiting for one at most wait or
+// until ctx is done.
+func fetchNATSJobs(ctx context.Context, sub *nats.Subscription, wait time.Duration) ([]*nats.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	return sub.Fetch(1, nats.Context(ctx))
+}
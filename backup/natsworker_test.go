@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeAcker records how a job's message was acknowledged.
+type fakeAcker struct{ acks []string }
+
+func (a *fakeAcker) Ack(...nats.AckOpt) error        { a.acks = append(a.acks, "ack"); return nil }
+func (a *fakeAcker) Nak(...nats.AckOpt) error        { a.acks = append(a.acks, "nak"); return nil }
+func (a *fakeAcker) Term(...nats.AckOpt) error       { a.acks = append(a.acks, "term"); return nil }
+func (a *fakeAcker) InProgress(...nats.AckOpt) error { return nil }
+
+// fakeJetStream records the results published.
+type fakeJetStream struct {
+	nats.JetStreamContext
+	published []string
+}
+
+func (js *fakeJetStream) Publish(subj string, data []byte, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	js.published = append(js.published, subj)
+	return &nats.PubAck{}, nil
+}
+
+func natsTestJob(t *testing.T, conf Config) []byte {
+	t.Helper()
+	b, err := json.Marshal(natsJob{AID: conf.AID, Year: int(conf.Year), Month: int(conf.Month), Paths: writeTestFiles(t, "a.csv", "a,b\n1,2\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNATSJobAcked(t *testing.T) {
+	conf := testConfig(t)
+	js, msg := &fakeJetStream{}, &fakeAcker{}
+	if err := processNATSJob(context.Background(), conf, js, natsTestJob(t, conf), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.acks) != 1 || msg.acks[0] != "ack" || len(js.published) != 1 {
+		t.Errorf("job acknowledged with %v, %d results published; want ack and 1", msg.acks, len(js.published))
+	}
+}
+
+func TestNATSJobInterrupted(t *testing.T) {
+	conf := testConfig(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	js, msg := &fakeJetStream{}, &fakeAcker{}
+	if err := processNATSJob(ctx, conf, js, natsTestJob(t, conf), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.acks) != 1 || msg.acks[0] != "nak" || len(js.published) != 0 {
+		t.Errorf("interrupted job acknowledged with %v, %d results published; want nak and none", msg.acks, len(js.published))
+	}
+}
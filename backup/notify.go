@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	notifyJSON    = "json"
+	notifySlack   = "slack"
+	notifyDiscord = "discord"
+
+	// notifyRetryDelay is the delay before the first retry of a
+	// notification, doubled on every other one.
+	notifyRetryDelay = time.Second
+)
+
+// notification is what NOTIFY_URL receives when a run ends.
+type notification struct {
+	// Status is succeeded or failed.
+	Status string `json:"status"`
+	backupResult
+	Objects         []notifiedObject `json:"objects"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Time            time.Time        `json:"time"`
+}
+
+// notifiedObject is a file backed up by the run.
+type notifiedObject struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Bytes int64  `json:"bytes"`
+}
+
+func newNotification(conf Config, paths []string, recs []Record, runErr error) notification {
+	n := notification{
+		Status:          runSucceeded,
+		backupResult:    newBackupResult(conf, paths, recs, runErr),
+		Objects:         []notifiedObject{},
+		DurationSeconds: uploadStats.elapsed().Seconds(),
+		Time:            time.Now().UTC(),
+	}
+	if runErr != nil {
+		n.Status = runFailed
+	}
+	for _, r := range recs {
+		for i, f := range r.Files {
+			o := notifiedObject{Name: f.Name, Bytes: f.Bytes}
+			if i < len(r.Backups) {
+				o.URL = r.Backups[i].URL
+			}
+			n.Objects = append(n.Objects, o)
+		}
+	}
+	return n
+}
+
+// text is the one line chat message of n.
+func (n notification) text() string {
+	agency := agencyID{AID: n.AID, Sub: n.SubAID}
+	what := fmt.Sprintf("Backup of %s %d/%s", agency, n.Year, monthsLabel(n.Months))
+	took := time.Duration(n.DurationSeconds * float64(time.Second)).Round(time.Millisecond)
+	if n.Error != "" {
+		return fmt.Sprintf("%s failed after %s: %s", what, took, n.Error)
+	}
+	return fmt.Sprintf("%s succeeded: %d files, %d bytes in %s", what, n.Files, n.TotalBytes, took)
+}
+
+// notificationBody encodes n as NOTIFY_FORMAT expects: the notification
+// itself, or a message for Slack or Discord incoming webhooks.
+func notificationBody(format string, n notification) ([]byte, error) {
+	switch format {
+	case notifySlack:
+		return json.Marshal(map[string]string{"text": n.text()})
+	case notifyDiscord:
+		return json.Marshal(map[string]string{"content": n.text()})
+	}
+	return json.Marshal(n)
+}
+
+// signNotification returns the X-Salvador-Signature of body sent at ts:
+// the hex HMAC-SHA256, keyed with secret, of the unix time, a dot and the
+// body, so receivers can also reject replayed notifications.
+func signNotification(secret string, ts time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts.Unix())
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// errNotifyRejected marks the responses a retry won't change.
+var errNotifyRejected = errors.New("notification rejected")
+
+// sendNotification POSTs n to NOTIFY_URL, retrying NOTIFY_RETRIES times
+// on network errors, 429 and 5xx responses.
+func sendNotification(ctx context.Context, conf Config, n notification) error {
+	body, err := notificationBody(conf.NotifyFormat, n)
+	if err != nil {
+		return fmt.Errorf("error encoding notification:%w", err)
+	}
+	u, err := url.Parse(conf.NotifyURL)
+	if err != nil {
+		return fmt.Errorf("error parsing NOTIFY_URL:%w", err)
+	}
+	for attempt := 1; ; attempt++ {
+		err = postNotification(ctx, conf, u.Host, body)
+		if err == nil || errors.Is(err, errNotifyRejected) || attempt > conf.NotifyRetries {
+			break
+		}
+		t := time.NewTimer(jittered(retryBackoff(notifyRetryDelay, attempt)))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%v (giving up: %w)", err, ctx.Err())
+		case <-t.C:
+		}
+	}
+	return err
+}
+
+func postNotification(ctx context.Context, conf Config, host string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating notification request:%w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if conf.NotifySecret != "" {
+		now := time.Now()
+		req.Header.Set("X-Salvador-Timestamp", strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set("X-Salvador-Signature", signNotification(conf.NotifySecret, now, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting notification(%s):%w", host, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return fmt.Errorf("error posting notification(%s): status %s", host, resp.Status)
+	}
+	return fmt.Errorf("error posting notification(%s): status %s: %w", host, resp.Status, errNotifyRejected)
+}
+
+// checkNotify validates the NOTIFY_* settings.
+func checkNotify(conf Config) error {
+	if conf.NotifyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(conf.NotifyURL)
+	if err != nil {
+		return err
+	}
+	if s := strings.ToLower(u.Scheme); s != "http" && s != "https" {
+		return fmt.Errorf("unsupported scheme %q: must be http or https", u.Scheme)
+	}
+	switch conf.NotifyFormat {
+	case notifyJSON, notifySlack, notifyDiscord:
+	default:
+		return fmt.Errorf("NOTIFY_FORMAT %q must be %q, %q or %q", conf.NotifyFormat, notifyJSON, notifySlack, notifyDiscord)
+	}
+	if conf.NotifyRetries < 0 {
+		return fmt.Errorf("NOTIFY_RETRIES %d must not be negative", conf.NotifyRetries)
+	}
+	return nil
+}
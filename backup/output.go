@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// Formats of the stage output.
+const (
+	// outputPassthrough echoes the input, as a proxy stage.
+	outputPassthrough = "passthrough"
+	// outputJSON prints an Result.
+	outputJSON = "json"
+)
+
+// Result tells downstream stages where every input file was backed
+// up.
+type Result struct {
+	Paths   []string     `json:"paths"`
+	Files   []resultFile `json:"files"`
+	Records []Record     `json:"records"`
+	// InProgress is set when the stage exited because another run holds
+	// the lease of the month, see LOCK_HELD_POLICY.
+	InProgress bool `json:"in_progress,omitempty"`
+}
+
+// resultFile is an input file and the object it is stored in. Files that
+// were hard links to another input point to its object. Packaged files
+// point to the archive, Member being their name in it.
+type resultFile struct {
+	Path      string    `json:"path"`
+	URL       string    `json:"url"`
+	Member    string    `json:"member,omitempty"`
+	Hash      string    `json:"hash"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// buildResult matches paths to the objects of recs, named as run names them.
+func buildResult(conf Config, paths []string, recs []Record) (Result, error) {
+	res := Result{Paths: paths, Files: []resultFile{}, Records: recs}
+	if len(recs) == 0 {
+		return res, nil
+	}
+	rec := recs[0]
+	names, err := objectNames(rec.objectPrefix(), paths, conf.NameCollision)
+	if err != nil {
+		return Result{}, err
+	}
+	byName := make(map[string]resultFile)
+	for i, b := range rec.Backups {
+		f := resultFile{URL: b.URL, Hash: b.Hash, Timestamp: rec.Timestamp}
+		if i < len(rec.Files) {
+			f.SHA256, f.Bytes = rec.Files[i].SHA256, rec.Files[i].Bytes
+			byName[rec.Files[i].originalName()] = f
+		}
+	}
+	for _, l := range rec.Links {
+		if f, ok := byName[l.Target]; ok {
+			byName[l.Name] = f
+		}
+	}
+	if len(rec.Members) > 0 && len(rec.Backups) == 1 {
+		archive := resultFile{URL: rec.Backups[0].URL, Hash: rec.Backups[0].Hash, Timestamp: rec.Timestamp}
+		members := make(map[string]packageMember)
+		for _, m := range rec.Members {
+			members[m.Name] = m
+		}
+		byName = make(map[string]resultFile)
+		for _, n := range names {
+			m := members[restorePath(rec.objectPrefix(), n)]
+			f := archive
+			f.Member, f.SHA256, f.Bytes = m.Name, m.SHA256, m.Bytes
+			if m.Link != "" {
+				t := members[m.Link]
+				f.SHA256, f.Bytes = t.SHA256, t.Bytes
+			}
+			byName[n] = f
+		}
+	}
+	for i, n := range names {
+		if rec.Scan.infected(paths[i]) {
+			continue
+		}
+		f, ok := byName[n]
+		if !ok {
+			return Result{}, fmt.Errorf("no backup of %s (object %s) in record %s", paths[i], n, rec.ID.Hex())
+		}
+		f.Path = filepath.Clean(paths[i])
+		res.Files = append(res.Files, f)
+	}
+	return res, nil
+}
+
+func writeResult(w io.Writer, res Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return fmt.Errorf("error encoding execution result:%w", err)
+	}
+	return nil
+}
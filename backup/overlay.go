@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlaySource is the overlay file each variable was set from, for config
+// dump.
+var overlaySource = map[string]string{}
+
+// readOverlay parses an overlay file: KEY=VALUE lines, blank lines and lines
+// starting with # being ignored. Values may be quoted.
+func readOverlay(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vars := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if key == "AID" || key == "CONFIG_OVERLAY_DIR" {
+			return nil, fmt.Errorf("%s:%d: %s can't be set by an overlay", path, n, key)
+		}
+		vars[key] = value
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("error reading overlay(%s):%w", path, err)
+	}
+	return vars, nil
+}
+
+// applyOverlay sets the variables of the overlay file of aid, <dir>/<aid>.env,
+// over the environment. It reports whether there was one. Sub-agencies use
+// the file of their agency.
+func applyOverlay(dir string, aid agencyID) (bool, error) {
+	if aid.AID == "" {
+		return false, nil
+	}
+	path := filepath.Join(dir, aid.AID+".env")
+	vars, err := readOverlay(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			return false, fmt.Errorf("error setting %s from overlay(%s):%w", k, path, err)
+		}
+		overlaySource[k] = path
+	}
+	log.Printf("Applied config overlay %s (%d variables)", path, len(vars))
+	return true, nil
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// packageTarGz bundles the files of a run into one archive before upload,
+// sparing a request and an object per small file.
+const packageTarGz = "targz"
+
+// packageMember is a file stored in the archive of a run, named by its path
+// in it. Links are hard link entries to the Link member.
+type packageMember struct {
+	Name   string `bson:"name" json:"name"`
+	Bytes  int64  `bson:"bytes" json:"bytes"`
+	SHA256 string `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	Link   string `bson:"link,omitempty" json:"link,omitempty"`
+}
+
+// packageName is the object name of the archive of a run started at t, e.g.
+// trt13/trt13-2021-01-20210205T101500Z.tar.gz.
+func packageName(aid string, year int, months []int, t time.Time) string {
+	return fmt.Sprintf("%s/%s-%d-%s-%s.tar.gz", aid, strings.ReplaceAll(aid, "/", "-"), year, monthsLabel(months), t.UTC().Format("20060102T150405Z"))
+}
+
+// createPackage writes paths into a tar.gz work file, each one named by the
+// restore path of the object name of the same index, and links as hard link
+// entries. It returns the archive path, its SHA-256 and the members, with
+// the SHA-256 of the files computed as they are packaged.
+//
+// Entries are POSIX (PAX) ones: members over 8GiB and names over 100 bytes,
+// or not ASCII, get extended headers instead of being refused or cut, and
+// the number of entries has no limit. Modification times are kept to the
+// second, so entries that don't need one get no extended header.
+func createPackage(aid string, paths, names []string, links []fileLink) (string, string, []packageMember, error) {
+	f, err := createWorkFile("package-*.tar.gz")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error creating package:%w", err)
+	}
+	fail := func(err error) (string, string, []packageMember, error) {
+		f.Close()
+		removeWorkFile(f.Name())
+		return "", "", nil, err
+	}
+	sum := newDigestWriter()
+	gz := gzip.NewWriter(io.MultiWriter(f, sum))
+	tw := tar.NewWriter(gz)
+	var members []packageMember
+	for i, p := range paths {
+		m, err := addPackageFile(tw, p, restorePath(aid, names[i]))
+		if err != nil {
+			return fail(err)
+		}
+		members = append(members, m)
+	}
+	for _, l := range links {
+		name, target := restorePath(aid, l.Name), restorePath(aid, l.Target)
+		hdr := &tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target, Mode: 0644, Format: tar.FormatPAX}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fail(fmt.Errorf("error writing package entry(%s):%w", name, err))
+		}
+		members = append(members, packageMember{Name: name, Link: target})
+	}
+	if err := tw.Close(); err != nil {
+		return fail(fmt.Errorf("error finishing package:%w", err))
+	}
+	if err := gz.Close(); err != nil {
+		return fail(fmt.Errorf("error compressing package:%w", err))
+	}
+	if err := f.Close(); err != nil {
+		removeWorkFile(f.Name())
+		return "", "", nil, fmt.Errorf("error closing package(%s):%w", f.Name(), err)
+	}
+	return f.Name(), sum.sum(), members, nil
+}
+
+func addPackageFile(tw *tar.Writer, path, name string) (packageMember, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return packageMember{}, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return packageMember{}, fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime().Truncate(time.Second), Format: tar.FormatPAX}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return packageMember{}, fmt.Errorf("error writing package entry(%s):%w", name, err)
+	}
+	sum := newDigestWriter()
+	if _, err := buffers.copy(context.Background(), io.MultiWriter(tw, sum), in); err != nil {
+		return packageMember{}, fmt.Errorf("error packaging file(%s):%w", path, err)
+	}
+	digest, err := sum.check(path, fi.Size())
+	if err != nil {
+		return packageMember{}, err
+	}
+	return packageMember{Name: name, Bytes: fi.Size(), SHA256: digest}, nil
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What a run does with the files it uploaded when uploading another one
+// fails.
+const (
+	// partialRollback deletes them.
+	partialRollback = "rollback"
+	// partialRecord writes the records of the run with them, flagged
+	// incomplete, before failing.
+	partialRecord = "record"
+)
+
+// rollbackUploads deletes the objects a failed run uploaded, but those a
+// record refers to: object names are kept across runs, so a previous
+// version of the month may have its files under the same names. Failing to
+// delete one is a warning, the run failing anyway.
+func rollbackUploads(ctx context.Context, cloud backuper, coll *mongo.Collection, backups []storage.Backup, files []FileEntry) {
+	for i, b := range backups {
+		if coll != nil {
+			n, err := coll.CountDocuments(ctx, bson.M{"backups.url": b.URL}, options.Count().SetLimit(1))
+			if err != nil {
+				warnings.warnf(warnPartialUpload, "error checking whether %s is referenced, keeping it:%v", b.URL, err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Keeping %s, referenced by a backup record", b.URL)
+				continue
+			}
+		} else if isContentObject(files[i].Name) {
+			// with no records to tell, the object may well be another
+			// backup's file.
+			log.Printf("Keeping %s, content objects being shared", b.URL)
+			continue
+		}
+		if err := cloud.discard(ctx, b, files[i]); err != nil {
+			warnings.warnf(warnPartialUpload, "error rolling back upload of %s:%v", files[i].Name, err)
+			continue
+		}
+		log.Printf("Rolled back upload of %s", files[i].Name)
+	}
+}
+
+func checkPartialFailurePolicy(policy string) error {
+	if policy != partialRollback && policy != partialRecord {
+		return fmt.Errorf("%q must be %q or %q", policy, partialRollback, partialRecord)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// partsCheck is how a restored large object, reassembled from its segments
+// or chunks, compared to them and to the record. Restores keep them in
+// their access log entry.
+type partsCheck struct {
+	Object string `bson:"object" json:"object"`
+	Parts  int    `bson:"parts" json:"parts"`
+	// BadParts are the indexes of the parts whose bytes in the restored
+	// file don't have their MD5.
+	BadParts []int  `bson:"bad_parts,omitempty" json:"bad_parts,omitempty"`
+	Bytes    int64  `bson:"bytes" json:"bytes"`
+	SHA256   string `bson:"sha256" json:"sha256"`
+	// Expected is the SHA-256 of the record, if it has one.
+	Expected string `bson:"expected,omitempty" json:"expected,omitempty"`
+	OK       bool   `bson:"ok" json:"ok"`
+	Error    string `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+func (c partsCheck) err() error {
+	if c.OK {
+		return nil
+	}
+	return errors.New(c.Error)
+}
+
+// checkParts reads the file restored at dst from the large object name in
+// container, checking every part of it against the MD5 of its segment and
+// the whole against want, the SHA-256 of the record, unless empty. A
+// truncated or corrupted segment fails the check even when the sizes add
+// up.
+func checkParts(ctx context.Context, cloud *swiftClient, container, name, dst, want string) partsCheck {
+	check := partsCheck{Object: container + "/" + name, Expected: want}
+	fail := func(format string, args ...interface{}) partsCheck {
+		check.Error = fmt.Sprintf(format, args...)
+		return check
+	}
+	_, segments, err := cloud.conn.LargeObjectGetSegments(ctx, container, name)
+	if err != nil {
+		return fail("error listing segments(%s/%s): %v", container, name, err)
+	}
+	check.Parts = len(segments)
+	f, err := os.Open(dst)
+	if err != nil {
+		return fail("error opening file(%s): %v", dst, err)
+	}
+	defer f.Close()
+	whole := newDigestWriter()
+	for i, s := range segments {
+		h := md5.New()
+		n, err := io.CopyN(io.MultiWriter(h, whole), f, s.Bytes)
+		if err != nil && err != io.EOF {
+			return fail("error reading file(%s): %v", dst, err)
+		}
+		if n != s.Bytes || !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), s.Hash) {
+			check.BadParts = append(check.BadParts, i)
+		}
+	}
+	// bytes past the last part.
+	extra, err := io.Copy(whole, f)
+	if err != nil {
+		return fail("error reading file(%s): %v", dst, err)
+	}
+	check.Bytes, check.SHA256 = whole.n, whole.sum()
+	switch {
+	case len(check.BadParts) > 0:
+		return fail("restored %s doesn't match parts %v of its %d", dst, check.BadParts, check.Parts)
+	case extra > 0:
+		return fail("restored %s has %d bytes past its %d parts", dst, extra, check.Parts)
+	case want != "" && check.SHA256 != want:
+		return fail("restored %s has sha256 %s after reassembly, the record has %s", dst, check.SHA256, want)
+	}
+	check.OK = true
+	return check
+}
+
+// isLargeObject tells whether info is the manifest of a large object, made
+// of parts.
+func isLargeObject(info swift.Object) bool {
+	return info.ObjectType == swift.StaticLargeObjectType || info.ObjectType == swift.DynamicLargeObjectType
+}
+
+// recordPartsChecks adds checks to the access log entry id of a restore.
+func recordPartsChecks(ctx context.Context, coll *mongo.Collection, id primitive.ObjectID, checks []partsCheck) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"parts_checks": checks}}); err != nil {
+		return fmt.Errorf("error recording restore checks(%s):%w", id.Hex(), err)
+	}
+	return nil
+}
+
+func failedChecks(checks []partsCheck) int {
+	n := 0
+	for _, c := range checks {
+		if !c.OK {
+			n++
+		}
+	}
+	return n
+}
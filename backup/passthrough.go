@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// spool keeps a copy of the stage input so it can be replayed to stdout once
+// the backup finishes. Up to memLimit bytes are kept in memory; larger
+// payloads are moved to a temporary file so they don't sit in memory for the
+// duration of all uploads.
+type spool struct {
+	memLimit int64
+	buf      bytes.Buffer
+	file     *os.File
+}
+
+func newSpool(memLimit int64) *spool {
+	return &spool{memLimit: memLimit}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.memLimit {
+		f, err := createWorkFile("stdin-*")
+		if err != nil {
+			return 0, fmt.Errorf("error creating stdin spool file:%w", err)
+		}
+		if _, err := s.buf.WriteTo(f); err != nil {
+			f.Close()
+			removeWorkFile(f.Name())
+			return 0, fmt.Errorf("error writing stdin spool file(%s):%w", f.Name(), err)
+		}
+		s.file = f
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// WriteTo replays the spooled content into w.
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return s.buf.WriteTo(w)
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error rewinding stdin spool file(%s):%w", s.file.Name(), err)
+	}
+	return io.Copy(w, s.file)
+}
+
+// reader reads the spooled content from the start, without consuming it.
+func (s *spool) reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error rewinding stdin spool file(%s):%w", s.file.Name(), err)
+	}
+	return s.file, nil
+}
+
+// inputName is the name the input of a run is stored as, with STORE_INPUT.
+func inputName(aid string, year int, months []int, t time.Time) string {
+	return fmt.Sprintf("%s/inputs/input-%d-%s-%s", aid, year, monthsLabel(months), t.UTC().Format("20060102T150405Z"))
+}
+
+// Close releases the spool, removing its temporary file if any.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return removeWorkFile(s.file.Name())
+}
+
+// errNoPaths is returned for an input without a single path, nothing to
+// back up being a mistake of the stage before.
+var errNoPaths = errors.New("no file paths in the input")
+
+// readPaths reads newline separated paths from r, skipping blank lines. It
+// fails with errNoPaths when there are none.
+func readPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if p := strings.TrimRight(line, "\r\n"); strings.TrimSpace(p) != "" {
+			paths = append(paths, p)
+		}
+		if err == io.EOF {
+			if len(paths) == 0 {
+				return nil, errNoPaths
+			}
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pipelineField is a field of a ResultadoExecucao the stage reads, by its
+// name in the text format and its number in the wire format. A field with
+// no fields of its own is kept whole.
+type pipelineField struct {
+	name   string
+	num    uint64
+	fields []pipelineField
+}
+
+// pipelineFields are rc.coleta and pr.pacote, everything else in the input,
+// such as the payroll, being skipped as it is read so it never has to fit in
+// memory.
+var pipelineFields = []pipelineField{
+	{name: "pr", num: 1, fields: []pipelineField{{name: "pacote", num: 1}}},
+	{name: "rc", num: 2, fields: []pipelineField{{name: "coleta", num: 1}}},
+}
+
+func findPipelineField(fields []pipelineField, name string, num uint64) *pipelineField {
+	for i, f := range fields {
+		if (name != "" && f.name == name) || (name == "" && f.num == num) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// Protocol buffers wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// wireReader reads a message in the protocol buffers wire format, counting
+// the bytes read.
+type wireReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (w *wireReader) ReadByte() (byte, error) {
+	b, err := w.r.ReadByte()
+	if err == nil {
+		w.n++
+	}
+	return b, err
+}
+
+func (w *wireReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(w)
+	if err == io.EOF {
+		// a value cut short.
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (w *wireReader) skip(n int64) error {
+	skipped, err := io.CopyN(io.Discard, w.r, n)
+	w.n += skipped
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// filter reads the fields of a message up to byte end, or to the end of the
+// input if end is negative, returning the encoding of those in fields.
+func (w *wireReader) filter(fields []pipelineField, end int64) ([]byte, error) {
+	var out []byte
+	for end < 0 || w.n < end {
+		tag, err := binary.ReadUvarint(w)
+		if end < 0 && err == io.EOF {
+			break
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		num, typ := tag>>3, tag&7
+		if num == 0 {
+			return nil, fmt.Errorf("invalid field number 0")
+		}
+		f := findPipelineField(fields, "", num)
+		switch typ {
+		case wireVarint:
+			_, err = w.uvarint()
+		case wireFixed64:
+			err = w.skip(8)
+		case wireFixed32:
+			err = w.skip(4)
+		case wireBytes:
+			var n uint64
+			if n, err = w.uvarint(); err != nil {
+				break
+			}
+			if end >= 0 && w.n+int64(n) > end {
+				return nil, fmt.Errorf("field %d overflows its message", num)
+			}
+			var b []byte
+			switch {
+			case f == nil:
+				err = w.skip(int64(n))
+			case f.fields == nil:
+				b = make([]byte, n)
+				_, err = io.ReadFull(w.r, b)
+				w.n += int64(len(b))
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+			default:
+				b, err = w.filter(f.fields, w.n+int64(n))
+			}
+			if err == nil && f != nil {
+				out = appendUvarint(out, tag)
+				out = appendUvarint(out, uint64(len(b)))
+				out = append(out, b...)
+			}
+		default:
+			// groups are long deprecated, and not in the pipeline messages.
+			return nil, fmt.Errorf("unsupported wire type %d of field %d", typ, num)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if end >= 0 && w.n != end {
+		return nil, fmt.Errorf("message overflows its length")
+	}
+	return out, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// filterPipelineWire reads a ResultadoExecucao in the wire format, returning
+// the encoding of its pipelineFields.
+func filterPipelineWire(r io.Reader) ([]byte, error) {
+	w := &wireReader{r: bufio.NewReader(r)}
+	return w.filter(pipelineFields, -1)
+}
+
+// textScanner splits a message in the protocol buffers text format into
+// tokens: names and scalars, quoted strings and punctuation.
+type textScanner struct {
+	r    *bufio.Reader
+	peek string
+}
+
+func (s *textScanner) next() (string, error) {
+	if s.peek != "" {
+		tok := s.peek
+		s.peek = ""
+		return tok, nil
+	}
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+		case c == '#':
+			if _, err := s.r.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case c == '"' || c == '\'':
+			return s.quoted(c)
+		case strings.IndexByte("{}<>[]:,;/", c) >= 0:
+			return string(c), nil
+		default:
+			tok := []byte{c}
+			for {
+				c, err := s.r.ReadByte()
+				if err == io.EOF {
+					return string(tok), nil
+				}
+				if err != nil {
+					return "", err
+				}
+				if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '#' || c == '"' || c == '\'' || strings.IndexByte("{}<>[]:,;/", c) >= 0 {
+					s.r.UnreadByte()
+					return string(tok), nil
+				}
+				tok = append(tok, c)
+			}
+		}
+	}
+}
+
+func (s *textScanner) quoted(q byte) (string, error) {
+	tok := []byte{q}
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF || c == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if err != nil {
+			return "", err
+		}
+		tok = append(tok, c)
+		switch c {
+		case '\\':
+			c, err := s.r.ReadByte()
+			if err != nil {
+				return "", fmt.Errorf("unterminated string")
+			}
+			tok = append(tok, c)
+		case q:
+			return string(tok), nil
+		}
+	}
+}
+
+func (s *textScanner) peekToken() (string, error) {
+	if s.peek == "" {
+		tok, err := s.next()
+		if err != nil {
+			return "", err
+		}
+		s.peek = tok
+	}
+	return s.peek, nil
+}
+
+// closers are the tokens closing the ones that open a message or a list.
+var closers = map[string]string{"{": "}", "<": ">", "[": "]"}
+
+// balanced reads up to the token closing open, writing every token to out.
+func (s *textScanner) balanced(open string, out *bytes.Buffer) error {
+	stack := []string{closers[open]}
+	for len(stack) > 0 {
+		tok, err := s.next()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if out != nil {
+			out.WriteString(tok + " ")
+		}
+		if c, ok := closers[tok]; ok {
+			stack = append(stack, c)
+		} else if tok == stack[len(stack)-1] {
+			stack = stack[:len(stack)-1]
+		} else if tok == "}" || tok == ">" || tok == "]" {
+			return fmt.Errorf("unexpected %q", tok)
+		}
+	}
+	return nil
+}
+
+// filter reads the fields of a message up to the token end, or to the end
+// of the input if end is empty, writing those in fields to out.
+func (s *textScanner) filter(fields []pipelineField, end string, out *bytes.Buffer) error {
+	for {
+		name, err := s.next()
+		if err == io.EOF && end == "" {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if name == end {
+			return nil
+		}
+		var f *pipelineField
+		if name == "[" {
+			// an extension or Any type URL, never kept.
+			if err := s.balanced(name, nil); err != nil {
+				return err
+			}
+		} else if _, ok := closers[name]; ok || strings.IndexByte("}>]:,;/", name[0]) >= 0 || name[0] == '"' || name[0] == '\'' {
+			return fmt.Errorf("unexpected %q, want a field name", name)
+		} else {
+			f = findPipelineField(fields, name, 0)
+		}
+		tok, err := s.peekToken()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		colon := tok == ":"
+		if colon {
+			s.next()
+			if tok, err = s.peekToken(); err == io.EOF {
+				return io.ErrUnexpectedEOF
+			} else if err != nil {
+				return err
+			}
+		}
+		var kept *bytes.Buffer
+		if f != nil {
+			kept = out
+			out.WriteString(name + " ")
+		}
+		switch {
+		case tok == "{" || tok == "<":
+			s.next()
+			if kept != nil {
+				out.WriteString(tok + " ")
+			}
+			if f != nil && f.fields != nil {
+				err = s.filter(f.fields, closers[tok], out)
+				out.WriteString(closers[tok] + " ")
+			} else {
+				err = s.balanced(tok, kept)
+			}
+		case tok == "[":
+			s.next()
+			if kept != nil {
+				out.WriteString(": [ ")
+			}
+			err = s.balanced(tok, kept)
+		case !colon:
+			return fmt.Errorf("missing ':' after field %s", name)
+		default:
+			err = s.scalar(kept)
+		}
+		if err != nil {
+			return err
+		}
+		if tok, err := s.peekToken(); err == nil && (tok == "," || tok == ";") {
+			s.next()
+		}
+	}
+}
+
+// scalar reads a scalar value, adjacent strings being concatenated.
+func (s *textScanner) scalar(out *bytes.Buffer) error {
+	if out != nil {
+		out.WriteString(": ")
+	}
+	tok, err := s.next()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := closers[tok]; ok || strings.IndexByte("}>]:,;/", tok[0]) >= 0 {
+		return fmt.Errorf("unexpected %q, want a value", tok)
+	}
+	if tok == "-" {
+		// a sign apart from its number.
+		num, err := s.next()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		tok += num
+	}
+	for {
+		if out != nil {
+			out.WriteString(tok + " ")
+		}
+		if tok[0] != '"' && tok[0] != '\'' {
+			return nil
+		}
+		next, err := s.peekToken()
+		if errors.Is(err, io.EOF) || (err == nil && next[0] != '"' && next[0] != '\'') {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tok, _ = s.next()
+	}
+}
+
+// filterPipelineText reads a ResultadoExecucao in the text format, returning
+// the text of its pipelineFields.
+func filterPipelineText(r io.Reader) (string, error) {
+	s := &textScanner{r: bufio.NewReader(r)}
+	var out bytes.Buffer
+	if err := s.filter(pipelineFields, "", &out); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dadosjusbr/proto/coleta"
+	"github.com/dadosjusbr/proto/pipeline"
+	"github.com/golang/protobuf/proto"
+)
+
+func testPipeline() *pipeline.ResultadoExecucao {
+	return &pipeline.ResultadoExecucao{
+		Pr: &pipeline.ResultadoEmpacotamento{Pacote: "/out/trt1-2022-3.zip", Procinfo: &coleta.ProcInfo{Stdout: "packed"}},
+		Rc: &coleta.ResultadoColeta{
+			Coleta: &coleta.Coleta{Orgao: "TRT1", Ano: 2022, Mes: 3, Arquivos: []string{"/out/a.csv", "/out/b \"quoted\".csv"}},
+			Folha: &coleta.FolhaDePagamento{ContraCheque: []*coleta.ContraCheque{
+				{Nome: "Fulana # de 'Tal'", Matricula: "1", Ativo: true, Tipo: coleta.ContraCheque_MEMBRO},
+				{Nome: "Beltrano {x}", Matricula: "2"},
+			}},
+			Metadados: &coleta.Metadados{NaoRequerLogin: true},
+		},
+	}
+}
+
+func checkPipelineEnvelope(t *testing.T, env coletaEnvelope, pkg string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := env.Coleta
+	if c.Orgao != "TRT1" || c.Ano != 2022 || c.Mes != 3 || len(c.Arquivos) != 2 || c.Arquivos[1] != `/out/b "quoted".csv` || pkg != "/out/trt1-2022-3.zip" {
+		t.Errorf("read %+v and package %q", c, pkg)
+	}
+}
+
+func TestReadPipeline(t *testing.T) {
+	b, err := proto.Marshal(testPipeline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, pkg, err := readPipeline(bytes.NewReader(b), false)
+	checkPipelineEnvelope(t, env, pkg, err)
+
+	text := "# the pipeline result\n" + proto.MarshalTextString(testPipeline())
+	env, pkg, err = readPipeline(strings.NewReader(text), true)
+	checkPipelineEnvelope(t, env, pkg, err)
+}
+
+func TestReadPipelineInvalid(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		text bool
+	}{
+		{"\x12\x10\x0a", false},
+		{"\x0f", false},
+		{"/out/a.csv\n", false},
+		{`rc { coleta { orgao: "trt1" }`, true},
+		{`rc { coleta { orgao: "trt1 } }`, true},
+		{`rc } {`, true},
+	} {
+		if _, _, err := readPipeline(strings.NewReader(c.in), c.text); err == nil {
+			t.Errorf("readPipeline(%q, %v) accepted", c.in, c.text)
+		}
+	}
+}
+
+// repeated reads chunk n times, none of it kept in memory but chunk.
+type repeated struct {
+	chunk []byte
+	n     int
+	off   int
+}
+
+func (r *repeated) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	c := copy(p, r.chunk[r.off:])
+	if r.off += c; r.off == len(r.chunk) {
+		r.off, r.n = 0, r.n-1
+	}
+	return c, nil
+}
+
+// peakHeap runs f, returning how much the heap in use grew at most.
+func peakHeap(f func()) uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	base, peak := m.HeapInuse, m.HeapInuse
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak {
+				peak = m.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	f()
+	close(done)
+	<-sampled
+	if peak < base {
+		return 0
+	}
+	return peak - base
+}
+
+// TestReadPipelineLarge reads a payroll of 256 MiB, in both formats,
+// without holding it in memory, and all of it is passed through.
+func TestReadPipelineLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large input")
+	}
+	const size, limit = 256 << 20, 64 << 20
+	head, err := proto.Marshal(testPipeline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := proto.Marshal(&coleta.FolhaDePagamento{ContraCheque: []*coleta.ContraCheque{{Nome: strings.Repeat("x", 4000), Matricula: "1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := size / len(cc)
+	folha := appendUvarint([]byte{0x12}, uint64(n*len(cc)))
+	rc := append(appendUvarint([]byte{0x12}, uint64(len(folha)+n*len(cc))), folha...)
+	wire := io.MultiReader(bytes.NewReader(head), bytes.NewReader(rc), &repeated{chunk: cc, n: n})
+
+	text := `pr { pacote: "/out/trt1-2022-3.zip" }
+rc {
+  coleta { orgao: "TRT1" ano: 2022 mes: 3 arquivos: "/out/a.csv" arquivos: "/out/b \"quoted\".csv" }
+  folha {
+`
+	chunk := `    contra_cheque { nome: "` + strings.Repeat("x", 4000) + `" matricula: "1" ativo: true tipo: MEMBRO }` + "\n"
+	textIn := io.MultiReader(strings.NewReader(text), &repeated{chunk: []byte(chunk), n: size / len(chunk)}, strings.NewReader("  }\n}\n"))
+
+	for _, c := range []struct {
+		in         io.Reader
+		text       bool
+		inputBytes int64
+	}{
+		{wire, false, int64(len(head) + len(rc) + n*len(cc))},
+		{textIn, true, int64(len(text) + size/len(chunk)*len(chunk) + len("  }\n}\n"))},
+	} {
+		var passed countingWriter
+		var env coletaEnvelope
+		var pkg string
+		grew := peakHeap(func() {
+			env, pkg, err = readPipeline(io.TeeReader(c.in, &passed), c.text)
+		})
+		checkPipelineEnvelope(t, env, pkg, err)
+		if passed.n != c.inputBytes {
+			t.Errorf("text %v: passed %d bytes through, want %d", c.text, passed.n, c.inputBytes)
+		}
+		if grew > limit {
+			t.Errorf("text %v: heap grew %d bytes reading %d", c.text, grew, c.inputBytes)
+		}
+	}
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
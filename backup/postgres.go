@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	// registers the postgres driver of database/sql.
+	_ "github.com/lib/pq"
+)
+
+// postgresTable matches the POSTGRES_TABLE names used unquoted in
+// statements, optionally schema qualified.
+var postgresTable = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+func pingPostgres(ctx context.Context, uri string) error {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return fmt.Errorf("error connecting to postgres:%w", err)
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("error pinging postgres:%w", err)
+	}
+	return nil
+}
+
+// insertPostgres stores the records of a run in the table of the postgres
+// database at uri, as one row per backed up file. The table is created if
+// needed, and the records of a run are written in a single transaction.
+func insertPostgres(ctx context.Context, uri, table string, recs []Record) error {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return fmt.Errorf("error connecting to postgres:%w", err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+		aid TEXT NOT NULL,
+		year INTEGER NOT NULL,
+		month INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		size BIGINT,
+		created_at TIMESTAMPTZ NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("error creating postgres table(%s):%w", table, err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting postgres transaction:%w", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO `+table+` (aid, year, month, url, hash, size, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	if err != nil {
+		return fmt.Errorf("error preparing postgres insert(%s):%w", table, err)
+	}
+	defer stmt.Close()
+	for _, r := range recs {
+		for i, b := range r.Backups {
+			// sizes are only known for the files of the run.
+			var size sql.NullInt64
+			if len(r.Files) == len(r.Backups) {
+				size = sql.NullInt64{Int64: r.Files[i].Bytes, Valid: true}
+			}
+			if _, err := stmt.ExecContext(ctx, r.agency().String(), r.Year, r.Month, b.URL, b.Hash, size, r.Timestamp); err != nil {
+				return fmt.Errorf("error inserting record(%s, %d, %d):%w", r.agency(), r.Year, r.Month, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing postgres transaction:%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfigMetadataBackend(t *testing.T) {
+	setEnv(t, "METADATA_SINK", "")
+	setEnv(t, "METADATA_BACKEND", sinkPostgres)
+	conf, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.MetadataSink != sinkPostgres {
+		t.Errorf("METADATA_SINK is %q with METADATA_BACKEND=%s, want %q", conf.MetadataSink, sinkPostgres, sinkPostgres)
+	}
+
+	setEnv(t, "METADATA_SINK", sinkMongo)
+	if conf, err = readConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !hasProblem(configProblems(conf), "METADATA_BACKEND") {
+		t.Errorf("METADATA_BACKEND=%s accepted with METADATA_SINK=%s", sinkPostgres, sinkMongo)
+	}
+}
+
+// TestStagePostgres backs up a file with METADATA_BACKEND=postgres into a
+// new table of the database at POSTGRES_URL, skipping without it.
+func TestStagePostgres(t *testing.T) {
+	uri := os.Getenv("POSTGRES_URL")
+	if uri == "" {
+		t.Skip("POSTGRES_URL not set")
+	}
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	table := fmt.Sprintf("backups_test_%d", time.Now().UnixNano())
+	defer db.Exec("DROP TABLE IF EXISTS " + table)
+
+	paths := writeTestFiles(t, "a.csv", "a,b\n1,2\n")
+	stdin := strings.Join(paths, "\n") + "\n"
+	out, code := runStage(t, []string{"METADATA_SINK", "METADATA_BACKEND=" + sinkPostgres, "POSTGRES_URI=" + uri, "POSTGRES_TABLE=" + table}, stdin)
+	if code != 0 || out != stdin {
+		t.Fatalf("stage printed %q with status %d, want the input %q with status 0", out, code, stdin)
+	}
+
+	var aid, url string
+	var year, month int
+	var size int64
+	row := db.QueryRowContext(context.Background(), "SELECT aid, year, month, url, size FROM "+table)
+	if err := row.Scan(&aid, &year, &month, &url, &size); err != nil {
+		t.Fatal(err)
+	}
+	if aid != "trt1" || year != 2022 || month != 3 || !strings.HasSuffix(url, "/trt1/a.csv") || size != 8 {
+		t.Errorf("row is (%s, %d, %d, %s, %d), want (trt1, 2022, 3, .../trt1/a.csv, 8)", aid, year, month, url, size)
+	}
+}
@@ -0,0 +1,291 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// minYear is the earliest YEAR accepted, earlier ones being typos: the
+// collections started well after it.
+const minYear = 2000
+
+// configProblems lists everything wrong with conf on its own, whatever the
+// command.
+func configProblems(conf Config) []string {
+	var problems []string
+	if conf.ContentTypePolicy != policyReject && conf.ContentTypePolicy != policyFlag {
+		problems = append(problems, fmt.Sprintf("Invalid CONTENT_TYPE_POLICY %q: must be %q or %q", conf.ContentTypePolicy, policyReject, policyFlag))
+	}
+	if conf.ValidationPolicy != policyReject && conf.ValidationPolicy != policyFlag {
+		problems = append(problems, fmt.Sprintf("Invalid VALIDATION_POLICY %q: must be %q or %q", conf.ValidationPolicy, policyReject, policyFlag))
+	}
+	switch conf.NameCollision {
+	case collisionError, collisionHash, collisionPath:
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid NAME_COLLISION %q: must be %q, %q or %q", conf.NameCollision, collisionError, collisionHash, collisionPath))
+	}
+	if conf.SwiftAuthVersion < 0 || conf.SwiftAuthVersion > 3 {
+		problems = append(problems, fmt.Sprintf("Invalid SWIFT_AUTH_VERSION %d: must be 1, 2, 3 or 0 to detect it from SWIFT_AUTHURL", conf.SwiftAuthVersion))
+	}
+	if conf.Preview && conf.PreviewRows < 1 {
+		problems = append(problems, fmt.Sprintf("Invalid PREVIEW_ROWS %d: must be at least 1", conf.PreviewRows))
+	}
+	if conf.BackupConcurrency < 1 {
+		problems = append(problems, fmt.Sprintf("Invalid BACKUP_CONCURRENCY %d: must be at least 1", conf.BackupConcurrency))
+	}
+	if conf.BackupTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid BACKUP_TIMEOUT %s: must not be negative", conf.BackupTimeout))
+	}
+	if conf.ShutdownGrace < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid SHUTDOWN_GRACE %s: must not be negative", conf.ShutdownGrace))
+	}
+	if conf.SignTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid SIGN_TTL %s: must be positive", conf.SignTTL))
+	}
+	if conf.UploadTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid UPLOAD_TIMEOUT %s: must not be negative", conf.UploadTimeout))
+	}
+	if conf.SwiftAuthTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid SWIFT_AUTH_TIMEOUT %s: must be positive", conf.SwiftAuthTimeout))
+	}
+	if conf.SwiftFirstByteTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid SWIFT_FIRST_BYTE_TIMEOUT %s: must be positive", conf.SwiftFirstByteTimeout))
+	}
+	if conf.SwiftStallTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid SWIFT_STALL_TIMEOUT %s: must be positive", conf.SwiftStallTimeout))
+	}
+	if conf.S3PartSize < s3PartMinSize {
+		problems = append(problems, fmt.Sprintf("Invalid S3_PART_SIZE %d: must be at least %d bytes", conf.S3PartSize, s3PartMinSize))
+	}
+	if err := checkS3SSE(conf.S3SSE, conf.S3SSEKMSKeyID); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid S3_SSE: %v", err))
+	}
+	// every big upload would be warned about.
+	if conf.MaxUploadRate > 0 && conf.SlowUploadRate > conf.MaxUploadRate {
+		problems = append(problems, fmt.Sprintf("Invalid SLOW_UPLOAD_RATE %.0f: must not be above MAX_UPLOAD_RATE %.0f", float64(conf.SlowUploadRate), float64(conf.MaxUploadRate)))
+	}
+	if conf.SegmentContainer != "" {
+		if conf.SegmentSize < segmentMinSize {
+			problems = append(problems, fmt.Sprintf("Invalid SEGMENT_SIZE %d: must be at least %d bytes", conf.SegmentSize, segmentMinSize))
+		}
+		if conf.ChunkContainer != "" {
+			problems = append(problems, fmt.Sprintf("Invalid SEGMENT_CONTAINER: can't be used with CHUNK_CONTAINER"))
+		}
+	}
+	if conf.PackageMode != "" && conf.PackageMode != packageTarGz {
+		problems = append(problems, fmt.Sprintf("Invalid PACKAGE_MODE %q: must be empty or %q", conf.PackageMode, packageTarGz))
+	}
+	if conf.EncryptionKey != "" {
+		if _, err := parseEncryptionKey(conf.EncryptionKey); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid BACKUP_ENCRYPTION_KEY: %v", err))
+		}
+	}
+	if err := checkObjectLayout(conf.ObjectLayout); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid OBJECT_LAYOUT: %v", err))
+	}
+	if conf.ObjectLayout == layoutContent {
+		switch {
+		case conf.PackageMode != "":
+			problems = append(problems, fmt.Sprintf("Invalid OBJECT_LAYOUT: %q can't be used with PACKAGE_MODE", layoutContent))
+		case conf.EncryptionKey != "":
+			// the object would be named by what it hides.
+			problems = append(problems, fmt.Sprintf("Invalid OBJECT_LAYOUT: %q can't be used with BACKUP_ENCRYPTION_KEY", layoutContent))
+		case conf.SkipUnchanged:
+			problems = append(problems, fmt.Sprintf("Invalid OBJECT_LAYOUT: %q can't be used with SKIP_UNCHANGED", layoutContent))
+		}
+	}
+	if err := checkKeyTemplate(conf.KeyTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid KEY_TEMPLATE: %v", err))
+	} else if conf.KeyTemplate != "" && conf.ObjectLayout == layoutContent {
+		problems = append(problems, fmt.Sprintf("Invalid KEY_TEMPLATE: can't be used with OBJECT_LAYOUT %q", layoutContent))
+	}
+	if len(conf.EscrowRecipients) > 0 {
+		for _, r := range conf.EscrowRecipients {
+			if _, err := parseAgeRecipient(r); err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid ESCROW_RECIPIENTS: %v", err))
+			}
+		}
+		if conf.EscrowContainer == "" {
+			problems = append(problems, fmt.Sprintf("Invalid ESCROW_CONTAINER: must be set with ESCROW_RECIPIENTS"))
+		}
+	}
+	if conf.OutputFormat != outputPassthrough && conf.OutputFormat != outputJSON {
+		problems = append(problems, fmt.Sprintf("Invalid OUTPUT_FORMAT %q: must be %q or %q", conf.OutputFormat, outputPassthrough, outputJSON))
+	}
+	switch conf.InputFormat {
+	case inputPaths, inputColeta, inputPipeline, inputPipelineText:
+	default:
+		problems = append(problems, fmt.Sprintf("Invalid INPUT_FORMAT %q: must be %q, %q, %q or %q", conf.InputFormat, inputPaths, inputColeta, inputPipeline, inputPipelineText))
+	}
+	if conf.BatchFile != "" {
+		switch {
+		case conf.InputFormat != inputPaths:
+			problems = append(problems, fmt.Sprintf("Invalid BATCH_FILE: can't be used with INPUT_FORMAT %q", conf.InputFormat))
+		case conf.OutputFormat != outputPassthrough:
+			problems = append(problems, fmt.Sprintf("Invalid BATCH_FILE: can't be used with OUTPUT_FORMAT %q", conf.OutputFormat))
+		case conf.StoreInput:
+			problems = append(problems, "Invalid BATCH_FILE: can't be used with STORE_INPUT")
+		}
+	}
+	if _, err := runMonths(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid MONTHS: %v", err))
+	}
+	if err := checkMetadataSink(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid METADATA_SINK: %v", err))
+	}
+	if conf.MetadataBackend != "" && conf.MetadataBackend != conf.MetadataSink {
+		problems = append(problems, fmt.Sprintf("Invalid METADATA_BACKEND %q: METADATA_SINK is %q", conf.MetadataBackend, conf.MetadataSink))
+	}
+	if conf.MetadataStore != "" && conf.MetadataStore != conf.MetadataSink {
+		problems = append(problems, fmt.Sprintf("Invalid METADATA_STORE %q: METADATA_SINK is %q", conf.MetadataStore, conf.MetadataSink))
+	}
+	if err := checkRecordPolicy(conf.RecordPolicy); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid RECORD_POLICY: %v", err))
+	}
+	// a record holds a single archive or manifest, those of later runs
+	// couldn't be added to it.
+	if conf.RecordPolicy == policyAppend || conf.RecordPolicy == policyMerge {
+		if conf.PackageMode != "" {
+			problems = append(problems, fmt.Sprintf("Invalid RECORD_POLICY: %q can't be used with PACKAGE_MODE", conf.RecordPolicy))
+		}
+		if conf.ObjectLayout == layoutContent {
+			problems = append(problems, fmt.Sprintf("Invalid RECORD_POLICY: %q can't be used with OBJECT_LAYOUT %q", conf.RecordPolicy, layoutContent))
+		}
+	}
+	if err := checkObjectVersioning(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid OBJECT_VERSIONING: %v", err))
+	}
+	if conf.LockTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid LOCK_TTL %s: must be positive", conf.LockTTL))
+	}
+	if err := checkLockHeldPolicy(conf.LockHeldPolicy); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid LOCK_HELD_POLICY: %v", err))
+	}
+	if err := checkPartialFailurePolicy(conf.PartialFailurePolicy); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid PARTIAL_FAILURE_POLICY: %v", err))
+	}
+	if conf.PartialFailurePolicy == partialRecord && (conf.MetadataSink != sinkMongo || conf.RecordPolicy != policyVersion) {
+		problems = append(problems, fmt.Sprintf("Invalid PARTIAL_FAILURE_POLICY: %q needs METADATA_SINK=%s and RECORD_POLICY=%s", partialRecord, sinkMongo, policyVersion))
+	}
+	if err := checkStorageBackend(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid STORAGE_BACKEND: %v", err))
+	}
+	if err := checkMirrorBackends(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid MIRROR_BACKENDS: %v", err))
+	}
+	if conf.WarningsFormat != warningsText && conf.WarningsFormat != warningsJSON {
+		problems = append(problems, fmt.Sprintf("Invalid WARNINGS_FORMAT %q: must be %q or %q", conf.WarningsFormat, warningsText, warningsJSON))
+	}
+	if conf.PreflightTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("Invalid PREFLIGHT_TIMEOUT %s: must be positive", conf.PreflightTimeout))
+	}
+	if conf.ClamdAddr != "" {
+		if err := checkScanPolicy(conf); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid CLAMD_POLICY: %v", err))
+		}
+	}
+	if err := checkNotify(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid NOTIFY_URL: %v", err))
+	}
+	if err := checkBackfill(conf); err != nil {
+		problems = append(problems, fmt.Sprintf("Invalid BACKFILL_URL: %v", err))
+	}
+	if conf.TrashRetention < 0 {
+		problems = append(problems, fmt.Sprintf("Invalid TRASH_RETENTION %s: must not be negative", conf.TrashRetention))
+	}
+	if conf.RetryJitter < 0 || conf.RetryJitter > 1 {
+		problems = append(problems, fmt.Sprintf("Invalid RETRY_JITTER %v: must be between 0 and 1", conf.RetryJitter))
+	}
+	return problems
+}
+
+// runProblems lists what a run of the stage is missing to know the month it
+// backs up, with the envelope applied for the envelope formats.
+func runProblems(conf Config) []string {
+	var problems []string
+	if conf.AID == "" {
+		problems = append(problems, "Missing AID")
+	}
+	if y := int(conf.Year); y < minYear || y > time.Now().Year() {
+		problems = append(problems, fmt.Sprintf("Invalid YEAR %d: must be between %d and %d", y, minYear, time.Now().Year()))
+	}
+	if conf.Months == "" && (conf.Month < 1 || conf.Month > 12) {
+		problems = append(problems, fmt.Sprintf("Invalid MONTH %d: must be between 1 and 12", conf.Month))
+	}
+	return problems
+}
+
+// preflight checks, before the stage reads its input, that every variable
+// the run needs is set and that mongo and the storage backends answer,
+// listing every problem found. Backends missing variables aren't pinged.
+func preflight(ctx context.Context, conf Config) []string {
+	var problems []string
+	if conf.InputFormat == inputPaths && conf.BatchFile == "" {
+		problems = append(problems, runProblems(conf)...)
+	}
+	mongoOK := true
+	if conf.MetadataSink == sinkMongo {
+		for _, v := range []struct{ name, value string }{
+			{"MONGODB_URI", conf.MongoURI},
+			{"MONGODB_DBNAME", conf.MongoDBName},
+			{"MONGODB_BCOLL", conf.MongoBackupColl},
+		} {
+			if v.value == "" {
+				problems = append(problems, "Missing "+v.name)
+				mongoOK = false
+			}
+		}
+	}
+	backendsOK := true
+	for _, name := range append(append([]string{}, conf.StorageBackend...), conf.MirrorBackends...) {
+		if name != backendSwift {
+			continue
+		}
+		for _, v := range []struct{ name, value string }{
+			{"SWIFT_USERNAME", conf.SwiftUsername},
+			{"SWIFT_APIKEY", conf.SwiftAPIKey},
+			{"SWIFT_AUTHURL", conf.SwiftAuthURL},
+			{"SWIFT_CONTAINER", conf.SwiftContainer},
+		} {
+			if v.value == "" {
+				problems = append(problems, "Missing "+v.name)
+				backendsOK = false
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.PreflightTimeout)
+	defer cancel()
+	if conf.MetadataSink == sinkMongo && mongoOK {
+		if err := pingMongo(ctx, conf); err != nil {
+			problems = append(problems, problemMongoUnreachable+err.Error())
+		}
+	}
+	if conf.ClamdAddr != "" {
+		if err := pingClamd(ctx, conf.ClamdAddr, conf.PreflightTimeout); err != nil {
+			problems = append(problems, fmt.Sprintf("Clamd unreachable: %v", err))
+		}
+	}
+	if backendsOK {
+		cloud, err := newBackuper(conf)
+		if err == nil {
+			err = cloud.ping(ctx)
+		}
+		if err != nil {
+			problems = append(problems, problemStorageUnreachable+err.Error())
+		}
+	}
+	return problems
+}
+
+func pingMongo(ctx context.Context, conf Config) error {
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return err
+	}
+	defer disconnect(db)
+	return db.Ping(ctx, readpref.Primary())
+}
@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// hasProblem tells whether problems has one about the variable name.
+func hasProblem(problems []string, name string) bool {
+	for _, p := range problems {
+		if strings.HasPrefix(p, "Invalid "+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConfigProblemsS3SSE(t *testing.T) {
+	for _, tc := range []struct {
+		mode, keyID string
+		invalid     bool
+	}{
+		{"", "", false},
+		{sseS3, "", false},
+		{sseKMS, "", false},
+		{sseKMS, "arn:aws:kms:us-east-1:111122223333:key/1234", false},
+		{"aes", "", true},
+		{sseS3, "arn:aws:kms:us-east-1:111122223333:key/1234", true},
+	} {
+		conf := testConfig(t)
+		conf.S3SSE, conf.S3SSEKMSKeyID = tc.mode, tc.keyID
+		if got := hasProblem(configProblems(conf), "S3_SSE"); got != tc.invalid {
+			t.Errorf("S3_SSE=%q S3_SSE_KMS_KEY_ID=%q invalid: %v, want %v", tc.mode, tc.keyID, got, tc.invalid)
+		}
+	}
+}
+
+func TestConfigProblemsAppendPolicy(t *testing.T) {
+	for _, policy := range []string{policyAppend, policyMerge} {
+		conf := testConfig(t)
+		conf.RecordPolicy = policy
+		if hasProblem(configProblems(conf), "RECORD_POLICY") {
+			t.Fatalf("RECORD_POLICY=%s rejected on its own", policy)
+		}
+		packaged := conf
+		packaged.PackageMode = packageTarGz
+		content := conf
+		content.ObjectLayout = layoutContent
+		for name, c := range map[string]Config{"PACKAGE_MODE": packaged, "OBJECT_LAYOUT": content} {
+			if !hasProblem(configProblems(c), "RECORD_POLICY") {
+				t.Errorf("RECORD_POLICY=%s accepted with %s", policy, name)
+			}
+		}
+	}
+}
+
+func TestConfigProblemsLockTTL(t *testing.T) {
+	conf := testConfig(t)
+	if hasProblem(configProblems(conf), "LOCK_TTL") {
+		t.Fatalf("default LOCK_TTL %s rejected", conf.LockTTL)
+	}
+	for _, ttl := range []time.Duration{0, -time.Minute} {
+		conf.LockTTL = ttl
+		if !hasProblem(configProblems(conf), "LOCK_TTL") {
+			t.Errorf("LOCK_TTL=%s accepted", ttl)
+		}
+	}
+}
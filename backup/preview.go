@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// previewMaxEntries caps the archive members listed in a preview.
+	previewMaxEntries = 50
+	// previewMaxPDF is the biggest PDF whose pages are counted, the whole
+	// file being scanned.
+	previewMaxPDF = 64 << 20
+)
+
+// filePreview is a glimpse of a backed up file, kept in the record so what
+// a backup has can be told without downloading it.
+type filePreview struct {
+	Name string `bson:"name" json:"name"`
+	Kind string `bson:"kind" json:"kind"`
+	// Rows are the first PREVIEW_ROWS rows of a csv.
+	Rows [][]string `bson:"rows,omitempty" json:"rows,omitempty"`
+	// Pages is the page count of a pdf.
+	Pages int `bson:"pages,omitempty" json:"pages,omitempty"`
+	// Entries lists the first members of an archive, of Members in total.
+	Entries []string `bson:"entries,omitempty" json:"entries,omitempty"`
+	Members int      `bson:"members,omitempty" json:"members,omitempty"`
+}
+
+// previewFile extracts the preview of the file at path, stored as name.
+func previewFile(path, name string, rows int) (filePreview, error) {
+	kind, err := sniffContentType(path)
+	if err != nil {
+		return filePreview{}, err
+	}
+	lower := strings.ToLower(path)
+	if kind == "unknown" && (strings.HasSuffix(lower, ".tar") || strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")) {
+		kind = "tar"
+	}
+	p := filePreview{Name: name, Kind: kind}
+	switch kind {
+	case "csv":
+		p.Rows, err = previewCSV(path, rows)
+	case "pdf":
+		p.Pages, err = countPDFPages(path)
+	case "zip":
+		p.Entries, p.Members, err = listZip(path)
+	case "tar":
+		p.Entries, p.Members, err = listTar(path)
+	}
+	if err != nil {
+		return filePreview{}, fmt.Errorf("error previewing file(%s):%w", path, err)
+	}
+	return p, nil
+}
+
+func previewCSV(path string, rows int) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	// the BOM of spreadsheet exports isn't part of the first field.
+	if b, err := br.Peek(3); err == nil && string(b) == "\xEF\xBB\xBF" {
+		br.Discard(3)
+	}
+	r := csv.NewReader(br)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	if head, err := br.Peek(sniffLen); err == nil || err == io.EOF {
+		r.Comma = csvDelimiter(head)
+	}
+	var out [][]string
+	for len(out) < rows {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// csvDelimiter picks the most frequent of the common delimiters in the first
+// line of head.
+func csvDelimiter(head []byte) rune {
+	line := string(head)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	best, n := ',', 0
+	for _, d := range []rune{',', ';', '\t', '|'} {
+		if c := strings.Count(line, string(d)); c > n {
+			best, n = d, c
+		}
+	}
+	return best
+}
+
+var (
+	pdfPage  = regexp.MustCompile(`/Type\s*/Page[^s]`)
+	pdfCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+)
+
+// countPDFPages counts the page objects of a pdf, falling back to the count
+// of its page tree when they are in compressed object streams. Zero means
+// it couldn't be told.
+func countPDFPages(path string) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() > previewMaxPDF {
+		return 0, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if n := len(pdfPage.FindAllIndex(b, -1)); n > 0 {
+		return n, nil
+	}
+	pages := 0
+	for _, m := range pdfCount.FindAllSubmatch(b, -1) {
+		v := m[1]
+		if v == nil {
+			v = m[2]
+		}
+		if n, err := strconv.Atoi(string(v)); err == nil && n > pages {
+			pages = n
+		}
+	}
+	return pages, nil
+}
+
+func listZip(path string) ([]string, int, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	var entries []string
+	for _, f := range r.File {
+		if len(entries) < previewMaxEntries {
+			entries = append(entries, f.Name)
+		}
+	}
+	return entries, len(r.File), nil
+}
+
+func listTar(path string) ([]string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if lower := strings.ToLower(path); strings.HasSuffix(lower, "gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	var entries []string
+	n := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		n++
+		if len(entries) < previewMaxEntries {
+			entries = append(entries, h.Name)
+		}
+	}
+	return entries, n, nil
+}
+
+// summary describes p in a line.
+func (p filePreview) summary() string {
+	switch {
+	case len(p.Rows) > 0:
+		return fmt.Sprintf("%s: %s", p.Kind, strings.Join(p.Rows[0], ", "))
+	case p.Pages > 0:
+		return fmt.Sprintf("%s: %d pages", p.Kind, p.Pages)
+	case p.Members > 0:
+		more := ""
+		if p.Members > len(p.Entries) {
+			more = ", ..."
+		}
+		return fmt.Sprintf("%s: %d members (%s%s)", p.Kind, p.Members, strings.Join(p.Entries, ", "), more)
+	}
+	return p.Kind
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// probeResult is the outcome of checking one backend.
+type probeResult struct {
+	Target    string  `json:"target"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func newProbeResult(target string, start time.Time, err error) probeResult {
+	r := probeResult{Target: target, OK: err == nil, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// probeSwift writes, reads back and deletes a tiny object. In read-only mode
+// it only reads the container metadata.
+func probeSwift(ctx context.Context, c *swiftClient) probeResult {
+	start := time.Now()
+	if c.readOnly {
+		_, err := c.containerInfo(ctx)
+		return newProbeResult("swift", start, err)
+	}
+	return newProbeResult("swift", start, swiftRoundTrip(ctx, c, ".probe/"+newRunID()))
+}
+
+func swiftRoundTrip(ctx context.Context, c *swiftClient, name string) error {
+	content := []byte("salvador-backups probe " + time.Now().UTC().Format(time.RFC3339Nano))
+	b, err := c.upload(ctx, name, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	var got bytes.Buffer
+	dlErr := c.download(ctx, b.URL, &got)
+	if err := c.remove(ctx, name); err != nil {
+		return err
+	}
+	if dlErr != nil {
+		return dlErr
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		return fmt.Errorf("object %s read back with different content", name)
+	}
+	return nil
+}
+
+// probeMongo pings the metadata store.
+func probeMongo(ctx context.Context, conf Config) probeResult {
+	start := time.Now()
+	return newProbeResult("mongo", start, pingMongo(ctx, conf))
+}
+
+// probeCmd checks every configured backend, failing if any of them is not
+// healthy.
+func probeCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	results := []probeResult{
+		probeSwift(ctx, newSwiftClient(conf)),
+		probeMongo(ctx, conf),
+	}
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tOK\tLATENCY\tERROR")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%t\t%.1fms\t%s\n", r.Target, r.OK, r.LatencyMS, r.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, r := range results {
+		if !r.OK {
+			return fmt.Errorf("probe of %s failed", r.Target)
+		}
+	}
+	return nil
+}
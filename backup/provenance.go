@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v0.2"
+	backupBuildType     = "https://github.com/dadosjusbr/salvador-backups/backup@v1"
+)
+
+type digestSet map[string]string
+
+type provenanceSubject struct {
+	Name   string    `json:"name"`
+	Digest digestSet `json:"digest"`
+}
+
+type provenanceMaterial struct {
+	URI    string    `json:"uri"`
+	Digest digestSet `json:"digest"`
+}
+
+// provenanceStatement is an in-toto statement carrying a SLSA provenance
+// predicate: the stored objects are the subjects and the input files the
+// materials they were produced from.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	PredicateType string              `json:"predicateType"`
+	Subject       []provenanceSubject `json:"subject"`
+	Predicate     struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		BuildType  string `json:"buildType"`
+		Invocation struct {
+			Parameters  map[string]interface{} `json:"parameters"`
+			Environment map[string]interface{} `json:"environment"`
+		} `json:"invocation"`
+		Metadata struct {
+			BuildInvocationID string    `json:"buildInvocationId"`
+			BuildStartedOn    time.Time `json:"buildStartedOn"`
+			BuildFinishedOn   time.Time `json:"buildFinishedOn"`
+		} `json:"metadata"`
+		Materials []provenanceMaterial `json:"materials"`
+	} `json:"predicate"`
+}
+
+// buildProvenance describes a run that stored paths as names. The
+// invocation environment is the resolved configuration, secrets redacted.
+func buildProvenance(conf Config, runID string, months []int, paths, names, digests []string, started time.Time) ([]byte, error) {
+	var st provenanceStatement
+	st.Type = inTotoStatementType
+	st.PredicateType = slsaProvenanceType
+	st.Predicate.Builder.ID = conf.ProvenanceBuilderID
+	st.Predicate.BuildType = backupBuildType
+	agency := splitAID(conf.AID, conf.AIDSeparator)
+	st.Predicate.Invocation.Parameters = map[string]interface{}{
+		"aid":    agency.AID,
+		"year":   int(conf.Year),
+		"months": months,
+	}
+	if agency.Sub != "" {
+		st.Predicate.Invocation.Parameters["sub_aid"] = agency.Sub
+	}
+	env := make(map[string]interface{})
+	for _, e := range configEntries(conf) {
+		if e.Source != "unset" {
+			env[e.Name] = e.Value
+		}
+	}
+	if host, err := os.Hostname(); err == nil {
+		env["HOSTNAME"] = host
+	}
+	st.Predicate.Invocation.Environment = env
+	st.Predicate.Metadata.BuildInvocationID = runID
+	st.Predicate.Metadata.BuildStartedOn = started.UTC()
+	st.Predicate.Metadata.BuildFinishedOn = time.Now().UTC()
+	for i, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			abs = p
+		}
+		st.Subject = append(st.Subject, provenanceSubject{Name: names[i], Digest: digestSet{"sha256": digests[i]}})
+		st.Predicate.Materials = append(st.Predicate.Materials, provenanceMaterial{URI: "file://" + filepath.ToSlash(abs), Digest: digestSet{"sha256": digests[i]}})
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding provenance:%w", err)
+	}
+	return b, nil
+}
+
+// provenanceName is the object name of a run's provenance statement.
+func provenanceName(aid string, year int, months []int) string {
+	return fmt.Sprintf("%s/provenance-%d-%s.intoto.json", aid, year, monthsLabel(months))
+}
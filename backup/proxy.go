@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksDialer dials the connections of countingDialer through the SOCKS5
+// proxy of ALL_PROXY, when set.
+var socksDialer proxy.ContextDialer
+
+// setupProxy makes the connections to the backends and mongo go through the
+// SOCKS5 proxy at conf.AllProxy, but those to the hosts of conf.NoProxy.
+func setupProxy(conf Config) error {
+	if conf.AllProxy == "" {
+		return nil
+	}
+	u, err := url.Parse(conf.AllProxy)
+	if err != nil {
+		// the url.Error would show the credentials of the url.
+		return fmt.Errorf("error parsing proxy url:%w", err.(*url.Error).Err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("scheme %q must be socks5 or socks5h", u.Scheme)
+	}
+	// the proxy itself is dialed directly, countingDialer counting what
+	// goes through it.
+	direct := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	d, err := proxy.FromURL(u, direct)
+	if err != nil {
+		return fmt.Errorf("error creating proxy dialer(%s):%w", u.Host, err)
+	}
+	perHost := proxy.NewPerHost(d, direct)
+	perHost.AddFromString(conf.NoProxy)
+	socksDialer = perHost
+	return nil
+}
+
+// dial opens a connection to address, through the SOCKS5 proxy if any.
+func (d *countingDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if socksDialer != nil {
+		c, err := socksDialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting through proxy(%s):%w", address, err)
+		}
+		return c, nil
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexFile is a backed up file as listed by the public index, named
+// relative to its agency.
+type indexFile struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	URL    string `json:"url"`
+}
+
+// indexMonth is the latest backup of a month of an agency.
+type indexMonth struct {
+	Year       int         `json:"year"`
+	Month      int         `json:"month"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Files      []indexFile `json:"files"`
+	SHA256Sums string      `json:"sha256sums,omitempty"`
+	Incomplete bool        `json:"incomplete,omitempty"`
+}
+
+// agencyIndex is the index of the public backups of an agency.
+type agencyIndex struct {
+	AID       string       `json:"aid"`
+	SubAID    string       `json:"sub_aid,omitempty"`
+	Generated time.Time    `json:"generated"`
+	Months    []indexMonth `json:"months"`
+}
+
+func (a agencyIndex) agency() agencyID {
+	return agencyID{AID: a.AID, Sub: a.SubAID}
+}
+
+// bytes is the size of the files of every month of a.
+func (a agencyIndex) bytes() int64 {
+	var n int64
+	for _, m := range a.Months {
+		for _, f := range m.Files {
+			n += f.Bytes
+		}
+	}
+	return n
+}
+
+// publicFilter matches the records of the agencies in aids, an aid without
+// a sub-agency matching those of its sub-agencies too.
+func publicFilter(aids []string, sep string) (bson.M, error) {
+	var or []bson.M
+	for _, s := range aids {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		a := splitAID(s, sep)
+		if a.Sub == "" {
+			or = append(or, bson.M{"aid": a.AID})
+			continue
+		}
+		or = append(or, a.filter())
+	}
+	if len(or) == 0 {
+		return nil, fmt.Errorf("PUBLIC_AIDS is empty, no agency would be published")
+	}
+	return bson.M{"$or": or}, nil
+}
+
+// buildIndexes groups recs, oldest first, by agency, keeping the latest
+// version of every month. Encrypted files are left out, their content not
+// being readable by the public anyway.
+func buildIndexes(recs []Record, generated time.Time) []agencyIndex {
+	latest := make(map[string]Record)
+	for _, r := range recs {
+		latest[fmt.Sprintf("%s\t%04d\t%02d", r.agency(), r.Year, r.Month)] = r
+	}
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var indexes []agencyIndex
+	for _, k := range keys {
+		r := latest[k]
+		if n := len(indexes); n == 0 || indexes[n-1].agency() != r.agency() {
+			indexes = append(indexes, agencyIndex{AID: r.AID, SubAID: r.SubAID, Generated: generated})
+		}
+		m := indexMonth{Year: r.Year, Month: r.Month, Timestamp: r.createdAt(), Incomplete: r.Incomplete}
+		for i, b := range r.Backups {
+			f := indexFile{Name: path.Base(b.URL), URL: b.URL}
+			// records of old runs don't say how their files were stored.
+			if len(r.Files) == len(r.Backups) {
+				if r.Files[i].Encryption != nil {
+					continue
+				}
+				f.Name = strings.TrimPrefix(r.Files[i].Name, r.objectPrefix()+"/")
+				f.Bytes, f.SHA256 = r.Files[i].Bytes, r.Files[i].SHA256
+			}
+			m.Files = append(m.Files, f)
+		}
+		if r.SHA256Sums != nil {
+			m.SHA256Sums = r.SHA256Sums.URL
+		}
+		idx := &indexes[len(indexes)-1]
+		idx.Months = append(idx.Months, m)
+	}
+	return indexes
+}
+
+var indexFuncs = template.FuncMap{
+	"prefix": func(a agencyIndex) string { return a.agency().prefix() },
+	"bytes":  func(a agencyIndex) int64 { return a.bytes() },
+	// root is the relative path from the page of a to the root index.
+	"root": func(a agencyIndex) string { return strings.Repeat("../", strings.Count(a.agency().prefix(), "/")+1) },
+}
+
+var agencyIndexPage = template.Must(template.New("agency").Funcs(indexFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{prefix .}} - backups</title></head>
+<body>
+<h1>{{prefix .}}</h1>
+<p><a href="{{root .}}index.html">All agencies</a> · <a href="index.json">index.json</a> · generated {{.Generated.Format "2006-01-02 15:04:05Z"}}</p>
+{{range .Months}}<h2>{{printf "%04d-%02d" .Year .Month}}{{if .Incomplete}} (incomplete){{end}}</h2>
+<p>Backed up {{.Timestamp.Format "2006-01-02 15:04:05Z"}}{{if .SHA256Sums}} · <a href="{{.SHA256Sums}}">SHA256SUMS</a>{{end}}</p>
+<table>
+<tr><th>File</th><th>Bytes</th><th>SHA-256</th></tr>
+{{range .Files}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>{{if .Bytes}}{{.Bytes}}{{end}}</td><td><code>{{.SHA256}}</code></td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+var rootIndexPage = template.Must(template.New("root").Funcs(indexFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Backups</title></head>
+<body>
+<h1>Backups</h1>
+<p><a href="index.json">index.json</a> · generated {{.Generated.Format "2006-01-02 15:04:05Z"}}</p>
+<table>
+<tr><th>Agency</th><th>Months</th><th>Bytes</th></tr>
+{{range .Agencies}}<tr><td><a href="{{prefix .}}/index.html">{{prefix .}}</a></td><td>{{len .Months}}</td><td>{{bytes .}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// rootIndexAgency is an agency as listed by the root index.json.
+type rootIndexAgency struct {
+	AID    string `json:"aid"`
+	SubAID string `json:"sub_aid,omitempty"`
+	Months int    `json:"months"`
+	Bytes  int64  `json:"bytes"`
+	Index  string `json:"index"`
+}
+
+// renderIndexes returns the content of the index objects, by name relative
+// to the index prefix.
+func renderIndexes(indexes []agencyIndex, generated time.Time) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	root := struct {
+		Generated time.Time         `json:"generated"`
+		Agencies  []rootIndexAgency `json:"agencies"`
+	}{Generated: generated, Agencies: []rootIndexAgency{}}
+	for _, a := range indexes {
+		dir := a.agency().prefix()
+		b, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("error encoding index(%s):%w", dir, err)
+		}
+		out[dir+"/index.json"] = b
+		var page bytes.Buffer
+		if err := agencyIndexPage.Execute(&page, a); err != nil {
+			return nil, fmt.Errorf("error rendering index(%s):%w", dir, err)
+		}
+		out[dir+"/index.html"] = page.Bytes()
+		root.Agencies = append(root.Agencies, rootIndexAgency{AID: a.AID, SubAID: a.SubAID, Months: len(a.Months), Bytes: a.bytes(), Index: dir + "/index.json"})
+	}
+	b, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding root index:%w", err)
+	}
+	out["index.json"] = b
+	var page bytes.Buffer
+	if err := rootIndexPage.Execute(&page, struct {
+		Generated time.Time
+		Agencies  []agencyIndex
+	}{generated, indexes}); err != nil {
+		return nil, fmt.Errorf("error rendering root index:%w", err)
+	}
+	out["index.html"] = page.Bytes()
+	return out, nil
+}
+
+// publishIndexCmd generates a static HTML and JSON index of the latest
+// backups of the agencies in PUBLIC_AIDS (names, sizes, hashes and links of
+// their files) and uploads it under PUBLIC_INDEX_PREFIX, so the archive can
+// be browsed with no service running. Index objects of agencies no longer
+// public are deleted. The links only work if SWIFT_CONTAINER is publicly
+// readable. With --out the index is written to a directory instead.
+func publishIndexCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("publish-index", flag.ContinueOnError)
+	out := fs.String("out", "", "write the index to this directory instead of uploading it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filter, err := publicFilter(conf.PublicAIDs, conf.AIDSeparator)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		if err := checkWritable(conf.ReadOnly, "publish the index"); err != nil {
+			return err
+		}
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	cur, err := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl).Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("error querying backup records:%w", err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return fmt.Errorf("error decoding backup records:%w", err)
+	}
+	generated := time.Now().UTC().Truncate(time.Second)
+	indexes := buildIndexes(recs, generated)
+	objects, err := renderIndexes(indexes, generated)
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		for name, content := range objects {
+			p := filepath.Join(*out, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return fmt.Errorf("error creating index directory(%s):%w", filepath.Dir(p), err)
+			}
+			if err := os.WriteFile(p, content, 0644); err != nil {
+				return fmt.Errorf("error writing index(%s):%w", p, err)
+			}
+		}
+		log.Printf("Wrote the index of %d agencies to %s", len(indexes), *out)
+		return nil
+	}
+	return uploadIndex(ctx, newSwiftClient(conf), strings.Trim(conf.PublicIndexPrefix, "/"), objects, len(indexes))
+}
+
+// uploadIndex uploads objects under prefix, then deletes the other index
+// objects there, left by agencies no longer public.
+func uploadIndex(ctx context.Context, c *swiftClient, prefix string, objects map[string][]byte, agencies int) error {
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the root index last, once what it links to is there.
+	sort.SliceStable(names, func(i, j int) bool {
+		return strings.Contains(names[i], "/") && !strings.Contains(names[j], "/")
+	})
+	for _, name := range names {
+		if _, err := c.upload(ctx, prefix+"/"+name, bytes.NewReader(objects[name])); err != nil {
+			return err
+		}
+	}
+	if err := c.authenticate(ctx); err != nil {
+		return err
+	}
+	existing, err := c.conn.ObjectNamesAll(ctx, c.container, &swift.ObjectsOpts{Prefix: prefix + "/"})
+	if err != nil {
+		return fmt.Errorf("error listing index objects(%s/%s):%w", c.container, prefix, err)
+	}
+	removed := 0
+	for _, name := range existing {
+		rel := strings.TrimPrefix(name, prefix+"/")
+		if _, ok := objects[rel]; ok || (path.Base(rel) != "index.html" && path.Base(rel) != "index.json") {
+			continue
+		}
+		if err := c.removeFrom(ctx, c.container, name); err != nil {
+			return err
+		}
+		log.Printf("Removed %s, no longer public", name)
+		removed++
+	}
+	log.Printf("Published the index of %d agencies to %s/%s/index.html, %d stale objects removed", agencies, c.container, prefix, removed)
+	return nil
+}
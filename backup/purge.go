@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// purgeVersions returns the indexes of the versions of a month, oldest
+// first, that the retention policy drops: those created before cutoff
+// (unless zero) and not among the keep latest (unless zero). The latest
+// version is always kept.
+func purgeVersions(versions []Record, keep int, cutoff time.Time) []int {
+	var purged []int
+	for i, rec := range versions[:len(versions)-1] {
+		if keep > 0 && i >= len(versions)-keep {
+			continue
+		}
+		if !cutoff.IsZero() && !rec.createdAt().Before(cutoff) {
+			continue
+		}
+		purged = append(purged, i)
+	}
+	return purged
+}
+
+func swiftOnly(rec Record) bool {
+	if len(rec.Replicas) > 0 {
+		return false
+	}
+	for _, f := range rec.Files {
+		if f.Backend != "" && f.Backend != backendSwift {
+			return false
+		}
+	}
+	return true
+}
+
+// purgeCmd applies a retention policy to the backups: versions of a month
+// older than --older-than-months, or beyond the --keep latest, are moved to
+// the trash with their objects, undelete bringing them back. Objects a kept
+// record refers to (object names are reused across versions, and runs
+// covering several months share them) are left in place. Every purge then
+// deletes for good what was trashed more than TRASH_RETENTION ago, which
+// is all it does with --empty-trash.
+func purgeCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	olderThan := fs.Int("older-than-months", 0, "purge the versions created more than this many months ago")
+	keep := fs.Int("keep", 0, "keep only this many latest versions of every month")
+	agency := fs.String("aid", "", "only purge this agency")
+	dryRun := fs.Bool("dry-run", false, "only list what would be purged and the bytes it would reclaim")
+	trashOnly := fs.Bool("empty-trash", false, "only delete for good what was trashed more than TRASH_RETENTION ago")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *olderThan < 0 || *keep < 0 || (*olderThan == 0 && *keep == 0 && !*trashOnly) {
+		return fmt.Errorf("usage: purge [--older-than-months n] [--keep k] [--aid aid] [--dry-run], with n or k positive, or purge --empty-trash [--aid aid] [--dry-run]")
+	}
+	if !*dryRun {
+		if err := checkWritable(conf.ReadOnly, "purge backups"); err != nil {
+			return err
+		}
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+	coll := mdb.Collection(conf.MongoBackupColl)
+
+	filter := bson.M{}
+	if *agency != "" {
+		filter = splitAID(strings.ToLower(*agency), conf.AIDSeparator).filter()
+	}
+	cloud := newSwiftClient(conf)
+	if *trashOnly {
+		return emptyTrashLogged(ctx, conf, mdb, cloud, filter, *dryRun)
+	}
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("error querying backup records:%w", err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return fmt.Errorf("error decoding backup records:%w", err)
+	}
+	type monthKey struct {
+		aid         string
+		year, month int
+	}
+	months := make(map[monthKey][]Record)
+	var order []monthKey
+	for _, rec := range recs {
+		k := monthKey{rec.agency().String(), rec.Year, rec.Month}
+		if _, ok := months[k]; !ok {
+			order = append(order, k)
+		}
+		months[k] = append(months[k], rec)
+	}
+	var cutoff time.Time
+	if *olderThan > 0 {
+		cutoff = time.Now().AddDate(0, -*olderThan, 0)
+	}
+	type purgedVersion struct {
+		rec     Record
+		version string
+	}
+	var purged []purgedVersion
+	skipped := 0
+	isPurged := make(map[string]bool)
+	var purgedIDs []primitive.ObjectID
+	for _, k := range order {
+		versions := months[k]
+		for _, i := range purgeVersions(versions, *keep, cutoff) {
+			// only swift objects can be deleted for now, records of other
+			// backends, or mirrored to them, are kept.
+			if !swiftOnly(versions[i]) {
+				log.Printf("Skipping record %s, stored in another backend", versions[i].ID.Hex())
+				skipped++
+				continue
+			}
+			purged = append(purged, purgedVersion{versions[i], versionLabel(i)})
+			isPurged[versions[i].ID.Hex()] = true
+			purgedIDs = append(purgedIDs, versions[i].ID)
+		}
+	}
+	referenced := make(map[string]bool)
+	for _, rec := range recs {
+		if isPurged[rec.ID.Hex()] {
+			continue
+		}
+		for _, b := range rec.objects() {
+			referenced[b.URL] = true
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECORD\tAID\tYEAR\tMONTH\tVERSION\tCREATED\tOBJECTS\tBYTES")
+	var records, objects int
+	var reclaimed int64
+	deleted := make(map[string]bool)
+	for _, p := range purged {
+		rec := p.rec
+		n, size := 0, int64(0)
+		var objs []trashedObject
+		segmented := make(map[string]bool)
+		for i, f := range rec.Files {
+			if f.Segments > 0 && i < len(rec.Backups) {
+				segmented[rec.Backups[i].URL] = true
+			}
+		}
+		for _, b := range rec.objects() {
+			if referenced[b.URL] || deleted[b.URL] {
+				continue
+			}
+			// content objects are shared by agencies --aid leaves out too.
+			if *agency != "" && strings.Contains(b.URL, "/"+contentPrefix) {
+				n, err := coll.CountDocuments(ctx, bson.M{"backups.url": b.URL, "_id": bson.M{"$nin": purgedIDs}}, options.Count().SetLimit(1))
+				if err != nil {
+					return fmt.Errorf("error checking whether %s is referenced:%w", b.URL, err)
+				}
+				if n > 0 {
+					referenced[b.URL] = true
+					continue
+				}
+			}
+			deleted[b.URL] = true
+			info, err := cloud.stat(ctx, b.URL)
+			if errors.Is(err, swift.ObjectNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			container, name, err := cloud.objectPath(ctx, b.URL)
+			if err != nil {
+				return err
+			}
+			objs = append(objs, trashedObject{URL: b.URL, Container: container, Name: name, Trash: trashName(rec.ID, name), Segmented: segmented[b.URL]})
+			n++
+			size += info.Bytes
+		}
+		if !*dryRun {
+			if err := trashRecord(ctx, conf, mdb, cloud, rec, objs); err != nil {
+				return err
+			}
+		}
+		records++
+		objects += n
+		reclaimed += size
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%d\t%d\n", rec.ID.Hex(), rec.agency(), rec.Year, rec.Month, p.version, rec.createdAt().Format(time.RFC3339), n, size)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	verb := "Moved"
+	if *dryRun {
+		verb = "Would move"
+	}
+	log.Printf("%s %d records and %d objects, of %d bytes, to the trash (%d records skipped)", verb, records, objects, reclaimed, skipped)
+	return emptyTrashLogged(ctx, conf, mdb, cloud, filter, *dryRun)
+}
+
+func emptyTrashLogged(ctx context.Context, conf Config, mdb *mongo.Database, cloud *swiftClient, filter bson.M, dryRun bool) error {
+	records, objects, err := emptyTrash(ctx, conf, mdb, cloud, filter, dryRun)
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	log.Printf("%s for good %d records and %d objects trashed more than %s ago", verb, records, objects, conf.TrashRetention)
+	return err
+}
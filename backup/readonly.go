@@ -0,0 +1,17 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errReadOnly is returned by mutating operations when READ_ONLY is set.
+var errReadOnly = errors.New("read-only mode")
+
+// checkWritable refuses op when running in read-only mode.
+func checkWritable(readOnly bool, op string) error {
+	if readOnly {
+		return fmt.Errorf("%w: refusing to %s", errReadOnly, op)
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// What a run does when (aid, year, month) already has a record.
+const (
+	// policyVersion writes a new record, the month keeping every version.
+	policyVersion = "version"
+	// policyReplace overwrites the record with the one of the run.
+	policyReplace = "replace"
+	// policyAppend adds the files of the run to the record.
+	policyAppend = "append"
+	// policyFail refuses to write the record.
+	policyFail = "fail"
+	// policyMerge adds the files of the run not in the record yet, for
+	// crawlers delivering a month in several waves.
+	policyMerge = "merge"
+)
+
+// recordIndex is the unique index on the month of an agency kept by every
+// policy but version.
+const recordIndex = "aid_sub_aid_year_month"
+
+var errRecordExists = errors.New("record already exists")
+
+func checkRecordPolicy(policy string) error {
+	switch policy {
+	case policyVersion, policyReplace, policyAppend, policyFail, policyMerge:
+		return nil
+	}
+	return fmt.Errorf("%q must be %q, %q, %q, %q or %q", policy, policyVersion, policyReplace, policyAppend, policyFail, policyMerge)
+}
+
+// ensureRecordIndex creates the unique index on (aid, sub_aid, year,
+// month), a no-op when it already exists. It fails while the collection has
+// several versions of a month, which must be cleaned up first.
+func ensureRecordIndex(ctx context.Context, coll *mongo.Collection, policy string) error {
+	if policy == policyVersion {
+		return nil
+	}
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "aid", Value: 1}, {Key: "sub_aid", Value: 1}, {Key: "year", Value: 1}, {Key: "month", Value: 1}},
+		Options: options.Index().SetName(recordIndex).SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating unique index(%s) for RECORD_POLICY %s (are there months with several versions?):%w", recordIndex, policy, err)
+	}
+	return nil
+}
+
+// writeRecord stores rec according to policy, returning the _id of the
+// record it ended up in.
+func writeRecord(ctx context.Context, coll *mongo.Collection, rec Record, policy string) (primitive.ObjectID, error) {
+	filter := monthFilter(rec)
+	switch policy {
+	case policyReplace:
+		// the existing record keeps its _id.
+		rec.ID = primitive.NilObjectID
+		var stored Record
+		err := coll.FindOneAndReplace(ctx, filter, rec, options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)).Decode(&stored)
+		if err != nil {
+			return primitive.NilObjectID, fmt.Errorf("error replacing backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+		}
+		return stored.ID, nil
+	case policyAppend:
+		update, err := appendUpdate(rec)
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		var stored Record
+		err = coll.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&stored)
+		if err != nil {
+			return primitive.NilObjectID, fmt.Errorf("error appending to backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+		}
+		return stored.ID, nil
+	case policyMerge:
+		var cur Record
+		err := coll.FindOne(ctx, filter).Decode(&cur)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			return primitive.NilObjectID, fmt.Errorf("error reading backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+		}
+		if _, err := coll.UpdateByID(ctx, cur.ID, bson.M{"$set": mergeRecords(cur, rec)}); err != nil {
+			return primitive.NilObjectID, fmt.Errorf("error merging backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+		}
+		return cur.ID, nil
+	}
+	if rec.ID.IsZero() {
+		rec.ID = primitive.NewObjectID()
+	}
+	_, err := coll.InsertOne(ctx, rec)
+	if policy == policyFail && mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, fmt.Errorf("error writing backup record(%s, %d, %d):%w (RECORD_POLICY is %s)", rec.agency(), rec.Year, rec.Month, errRecordExists, policy)
+	}
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("error writing backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+	}
+	return rec.ID, nil
+}
+
+// monthFilter matches the records of the month of rec.
+func monthFilter(rec Record) bson.M {
+	filter := rec.agency().filter()
+	filter["year"] = rec.Year
+	filter["month"] = rec.Month
+	return filter
+}
+
+// appendKey identifies the run appending rec: its idempotency key, the hash
+// of its input without one, and the _id given upfront to rec otherwise, ""
+// if it has none.
+func appendKey(rec Record) string {
+	switch {
+	case rec.IdempotencyKey != "":
+		return "key:" + rec.IdempotencyKey
+	case rec.InputHash != "":
+		return "input:" + rec.InputHash
+	case !rec.ID.IsZero():
+		return "id:" + rec.ID.Hex()
+	}
+	return ""
+}
+
+// appended looks for the record of the month rec was already appended to,
+// by an attempt whose reply was lost, returning its _id. Earlier runs
+// appending the same files don't count.
+func appended(ctx context.Context, coll *mongo.Collection, rec Record) (primitive.ObjectID, bool, error) {
+	key := appendKey(rec)
+	if key == "" {
+		return primitive.NilObjectID, false, nil
+	}
+	filter := monthFilter(rec)
+	filter["appends"] = key
+	var stored Record
+	err := coll.FindOne(ctx, filter, options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, false, nil
+	}
+	if err != nil {
+		return primitive.NilObjectID, false, fmt.Errorf("error reading backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+	}
+	return stored.ID, true, nil
+}
+
+// How appendUpdate carries the fields of a record: the arrays of
+// appendFields get the entries of every run, the fields of latestFields
+// become those of the latest one and the others are kept from the run that
+// created the record. The month is set from the filter.
+var (
+	appendFields = map[string]bool{"backups": true, "files": true, "links": true, "flagged": true, "previews": true, "replicas": true, "missing": true, "notes": true, "appends": true}
+	latestFields = map[string]bool{"timestamp": true, "build": true, "usage": true, "scan": true}
+	monthFields  = map[string]bool{"_id": true, "aid": true, "sub_aid": true, "year": true, "month": true}
+)
+
+// appendUpdate adds the files of rec, and every other array of
+// appendFields, to the month's record, which takes the rest of rec when it
+// doesn't exist yet. total_bytes adds up.
+func appendUpdate(rec Record) (bson.M, error) {
+	rec.Appends = nil
+	if key := appendKey(rec); key != "" {
+		rec.Appends = []string{key}
+	}
+	raw, err := bson.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("error encoding backup record(%s, %d, %d):%w", rec.agency(), rec.Year, rec.Month, err)
+	}
+	push, set, onInsert := bson.M{}, bson.M{}, bson.M{}
+	for k, v := range fields {
+		switch {
+		case monthFields[k], k == "total_bytes":
+		case appendFields[k]:
+			// $each needs an array, nil slices are encoded as null.
+			if a, ok := v.(bson.A); ok {
+				push[k] = bson.M{"$each": a}
+			}
+		case latestFields[k]:
+			set[k] = v
+		default:
+			onInsert[k] = v
+		}
+	}
+	if _, ok := push["backups"]; !ok {
+		push["backups"] = bson.M{"$each": bson.A{}}
+	}
+	update := bson.M{
+		"$push": push,
+		"$inc":  bson.M{"total_bytes": rec.TotalBytes},
+		"$set":  set,
+	}
+	if len(onInsert) > 0 {
+		update["$setOnInsert"] = onInsert
+	}
+	return update, nil
+}
+
+// mergeRecords returns the fields of cur updated with the files of rec whose
+// hash it doesn't have yet. A file stored at a URL cur already has replaces
+// the entry, as its object was overwritten. total_bytes only grows by the
+// files added. The members, previews and replicas of rec are added, those of
+// a name or object cur has replacing its own, and the usage and scan become
+// those of rec. Reading the record first is only safe while the run holds
+// the leases of its months, which is why run writes merged records itself,
+// even for retry-due's batch.
+func mergeRecords(cur, rec Record) bson.M {
+	// files are only kept when both records have one entry per backup,
+	// records older than them having none.
+	recFiles := len(rec.Files) == len(rec.Backups)
+	withFiles := len(cur.Files) == len(cur.Backups) && recFiles
+	byURL := make(map[string]int)
+	hashes := make(map[string]bool)
+	for i, b := range cur.Backups {
+		byURL[b.URL] = i
+		hashes[b.Hash] = true
+	}
+	total := cur.TotalBytes
+	backups, files := cur.Backups, cur.Files
+	added := make(map[string]bool)
+	for i, b := range rec.Backups {
+		if b.Hash != "" && hashes[b.Hash] {
+			continue
+		}
+		hashes[b.Hash] = true
+		added[b.URL] = true
+		j, ok := byURL[b.URL]
+		if !ok {
+			byURL[b.URL] = len(backups)
+			backups = append(backups, b)
+			if withFiles {
+				files = append(files, rec.Files[i])
+			}
+			if recFiles {
+				total += rec.Files[i].Bytes
+			}
+			continue
+		}
+		backups[j] = b
+		if withFiles {
+			total += rec.Files[i].Bytes - files[j].Bytes
+			files[j] = rec.Files[i]
+		}
+	}
+	if !withFiles {
+		files = nil
+	}
+	// without file entries only a record added whole is known to weigh
+	// its total.
+	if !recFiles && len(added) == len(rec.Backups) {
+		total += rec.TotalBytes
+	}
+
+	links := cur.Links
+	linked := make(map[string]bool)
+	for _, l := range links {
+		linked[l.Name] = true
+	}
+	for _, l := range rec.Links {
+		if !linked[l.Name] {
+			linked[l.Name] = true
+			links = append(links, l)
+		}
+	}
+	flagged := cur.Flagged
+	seen := make(map[string]bool)
+	for _, f := range flagged {
+		seen[f] = true
+	}
+	for _, f := range rec.Flagged {
+		if !seen[f] {
+			seen[f] = true
+			flagged = append(flagged, f)
+		}
+	}
+	members := cur.Members
+	memberAt := make(map[string]int)
+	for i, m := range members {
+		memberAt[m.Name] = i
+	}
+	for _, m := range rec.Members {
+		if i, ok := memberAt[m.Name]; ok {
+			members[i] = m
+			continue
+		}
+		memberAt[m.Name] = len(members)
+		members = append(members, m)
+	}
+	previews := cur.Previews
+	previewAt := make(map[string]int)
+	for i, p := range previews {
+		previewAt[p.Name] = i
+	}
+	for _, p := range rec.Previews {
+		if i, ok := previewAt[p.Name]; ok {
+			previews[i] = p
+			continue
+		}
+		previewAt[p.Name] = len(previews)
+		previews = append(previews, p)
+	}
+	// the replicas of the objects rec stored again are those of rec.
+	var replicas []objectReplica
+	for _, r := range cur.Replicas {
+		if !added[r.Object] {
+			replicas = append(replicas, r)
+		}
+	}
+	for _, r := range rec.Replicas {
+		if added[r.Object] {
+			replicas = append(replicas, r)
+		}
+	}
+	merged := bson.M{
+		"backups":     backups,
+		"files":       files,
+		"links":       links,
+		"flagged":     flagged,
+		"total_bytes": total,
+		"timestamp":   rec.Timestamp,
+		"build":       rec.Build,
+	}
+	if len(members) > 0 {
+		merged["members"] = members
+	}
+	if len(previews) > 0 {
+		merged["previews"] = previews
+	}
+	if len(cur.Replicas) > 0 || len(replicas) > 0 {
+		merged["replicas"] = replicas
+	}
+	if cur.Manifest == nil && rec.Manifest != nil {
+		merged["manifest"] = rec.Manifest
+	}
+	if rec.Usage != nil {
+		merged["usage"] = rec.Usage
+	}
+	if rec.Scan != nil {
+		merged["scan"] = rec.Scan
+	}
+	return merged
+}
@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fullRecord returns a record of agency trt1 and month 2022/3 where every
+// field is set, times at millisecond precision as mongo keeps them.
+func fullRecord(t *testing.T, name string) Record {
+	t.Helper()
+	now := time.Date(2022, 3, 31, 12, 30, 0, 5e6, time.UTC)
+	url := "mem://trt1/" + name
+	b := func(kind string) *storage.Backup { return &storage.Backup{URL: url + "." + kind, Hash: kind} }
+	rec := Record{
+		ID: primitive.NewObjectID(), AID: "trt1", SubAID: "sub", Year: 2022, Month: 3,
+		Backups:        []storage.Backup{{URL: url, Hash: "h-" + name}},
+		Files:          []FileEntry{{Name: "trt1/" + name, Container: "c", Bytes: 8, SHA256: "s", Backend: backendLocal, ModTime: &now, Encryption: &fileEncryption{Algorithm: "a", KeyID: "k", Nonce: "n", SegmentBytes: 1, SHA256: "e"}}},
+		Timestamp:      now,
+		TotalBytes:     8,
+		Flagged:        []string{name},
+		Months:         []int{3, 4},
+		SHA256Sums:     b("sums"),
+		Provenance:     b("provenance"),
+		IdempotencyKey: "key-" + name,
+		BagIt:          []storage.Backup{*b("bagit")},
+		InputHash:      "input-" + name,
+		Build:          buildInfo{Version: "v", Commit: "c", BuildDate: "d", GoVersion: "g"},
+		Links:          []fileLink{{Name: "trt1/link-" + name, Target: "trt1/" + name}},
+		Members:        []packageMember{{Name: name, Bytes: 8, SHA256: "s"}},
+		Usage:          &runUsage{WallSeconds: 1, CPUSeconds: 1, PeakRSSBytes: 1, SentBytes: 1, ReceivedBytes: 1},
+		Incomplete:     true,
+		Missing:        []string{"trt1/missing-" + name},
+		Manifest:       b("manifest"),
+		ObjectPrefix:   "trt1",
+		KeyTemplate:    "{{.Name}}",
+		Input:          b("input"),
+		Previews:       []filePreview{{Name: name, Kind: "csv", Rows: [][]string{{"a", "b"}}}},
+		Replicas:       []objectReplica{{Object: url, Backend: backendS3, URL: "s3://" + name}},
+		Scan:           &scanReport{Engine: "clamav", ScannedAt: now, Scanned: 1},
+		Notes:          []recordNote{{Time: now, Author: "ops", Text: name}},
+		Appends:        []string{"key:key-" + name},
+	}
+	v := reflect.ValueOf(rec)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Fatalf("fullRecord doesn't set %s", v.Type().Field(i).Name)
+		}
+	}
+	return rec
+}
+
+func TestAppendUpdateCarriesEveryField(t *testing.T) {
+	update, err := appendUpdate(fullRecord(t, "a.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	carried := map[string]bool{"total_bytes": true}
+	for k := range monthFields {
+		carried[k] = true
+	}
+	for _, op := range []string{"$push", "$set", "$setOnInsert"} {
+		fields, _ := update[op].(bson.M)
+		for k := range fields {
+			carried[k] = true
+		}
+	}
+	typ := reflect.TypeOf(Record{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("bson"), ",")[0]
+		if !carried[name] {
+			t.Errorf("appendUpdate drops %s (%s)", typ.Field(i).Name, name)
+		}
+	}
+}
+
+// TestAppendRoundTrip appends a full record to an empty month, reading it
+// back as it was, and then another one, whose arrays add up.
+func TestAppendRoundTrip(t *testing.T) {
+	conf := testConfig(t)
+	db := testMongo(t, &conf)
+	coll := db.Collection(conf.MongoBackupColl)
+	ctx := context.Background()
+
+	first := fullRecord(t, "a.csv")
+	id, err := writeRecord(ctx, coll, first, policyAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Record
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := first
+	want.ID = id
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("appended record reads back as\n%+v\nwant\n%+v", got, want)
+	}
+
+	second := fullRecord(t, "b.csv")
+	if _, err := writeRecord(ctx, coll, second, policyAppend); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Backups) != 2 || len(got.Files) != 2 || len(got.Previews) != 2 || len(got.Replicas) != 2 || got.TotalBytes != 16 {
+		t.Errorf("record after two appends has %d backups, %d files, %d previews, %d replicas and %d bytes, want 2, 2, 2, 2 and 16", len(got.Backups), len(got.Files), len(got.Previews), len(got.Replicas), got.TotalBytes)
+	}
+	if got.IdempotencyKey != first.IdempotencyKey || got.Members[0].Name != "a.csv" {
+		t.Errorf("record after two appends has the key %s and members %v, want those of the first run", got.IdempotencyKey, got.Members)
+	}
+}
+
+func TestAppendedRecognizesLostAppend(t *testing.T) {
+	conf := testConfig(t)
+	db := testMongo(t, &conf)
+	coll := db.Collection(conf.MongoBackupColl)
+	ctx := context.Background()
+	first := Record{ID: primitive.NewObjectID(), AID: conf.AID, Year: int(conf.Year), Month: int(conf.Month), Timestamp: time.Now().UTC(), Backups: []storage.Backup{{URL: "mem://trt1/a.csv"}}}
+	// a later run appending the same file again.
+	second := first
+	second.ID = primitive.NewObjectID()
+
+	id, err := writeRecord(ctx, coll, first, policyAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := appended(ctx, coll, second); err != nil || ok {
+		t.Fatalf("appended before the append = %v, %v, want false", ok, err)
+	}
+	if _, err := writeRecord(ctx, coll, second, policyAppend); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := appended(ctx, coll, second)
+	if err != nil || !ok || got != id {
+		t.Fatalf("appended after the append = %s, %v, %v, want %s", got.Hex(), ok, err, id.Hex())
+	}
+}
+
+func TestAppendKey(t *testing.T) {
+	id := primitive.NewObjectID()
+	for _, c := range []struct {
+		rec  Record
+		want string
+	}{
+		{Record{ID: id, IdempotencyKey: "k", InputHash: "h"}, "key:k"},
+		{Record{ID: id, InputHash: "h"}, "input:h"},
+		{Record{ID: id}, "id:" + id.Hex()},
+		{Record{}, ""},
+	} {
+		if got := appendKey(c.rec); got != c.want {
+			t.Errorf("appendKey(%+v) = %q, want %q", c.rec, got, c.want)
+		}
+	}
+}
+
+func TestMergeRecordsAddsOnlyNewFiles(t *testing.T) {
+	file := func(name string, bytes int64) (storage.Backup, FileEntry) {
+		return storage.Backup{URL: "mem://trt1/" + name, Hash: "h-" + name}, FileEntry{Name: "trt1/" + name, Bytes: bytes}
+	}
+	a, fa := file("a.csv", 10)
+	b, fb := file("b.csv", 20)
+	c, fc := file("c.csv", 40)
+	cur := Record{
+		Backups: []storage.Backup{a, b}, Files: []FileEntry{fa, fb}, TotalBytes: 30,
+		Members:  []packageMember{{Name: "a.csv"}},
+		Replicas: []objectReplica{{Object: a.URL, URL: "s3://a"}},
+	}
+	rec := Record{
+		Backups: []storage.Backup{b, c}, Files: []FileEntry{fb, fc}, TotalBytes: 60,
+		Members:  []packageMember{{Name: "c.csv"}},
+		Previews: []filePreview{{Name: "c.csv", Kind: "csv"}},
+		Replicas: []objectReplica{{Object: b.URL, URL: "s3://b"}, {Object: c.URL, URL: "s3://c"}},
+		Usage:    &runUsage{WallSeconds: 1},
+		Scan:     &scanReport{Scanned: 2},
+	}
+	merged := mergeRecords(cur, rec)
+	if got := merged["total_bytes"]; got != int64(70) {
+		t.Errorf("total_bytes = %v, want 70: b.csv was already there", got)
+	}
+	if got := merged["backups"].([]storage.Backup); len(got) != 3 {
+		t.Errorf("backups = %v, want a, b and c", got)
+	}
+	if got, _ := merged["members"].([]packageMember); len(got) != 2 {
+		t.Errorf("members = %v, want those of both records", got)
+	}
+	if got, _ := merged["previews"].([]filePreview); len(got) != 1 {
+		t.Errorf("previews = %v, want the one of c.csv", got)
+	}
+	if got, _ := merged["replicas"].([]objectReplica); len(got) != 2 || got[0].URL != "s3://a" || got[1].URL != "s3://c" {
+		t.Errorf("replicas = %v, want those of a and c", got)
+	}
+	if merged["usage"] != rec.Usage || merged["scan"] != rec.Scan {
+		t.Errorf("usage and scan are %v and %v, want those of the merged record", merged["usage"], merged["scan"])
+	}
+
+	// records without file entries only add the bytes of the files.
+	cur = Record{Backups: []storage.Backup{a, b}, TotalBytes: 30}
+	if got := mergeRecords(cur, rec)["total_bytes"]; got != int64(70) {
+		t.Errorf("total_bytes without file entries = %v, want 70", got)
+	}
+	if got := mergeRecords(cur, Record{Backups: []storage.Backup{b}, TotalBytes: 20})["total_bytes"]; got != int64(30) {
+		t.Errorf("total_bytes merging a file already there = %v, want 30", got)
+	}
+}
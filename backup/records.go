@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Record is the document stored in the backup collection for every
+// run of the stage.
+type Record struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AID     string             `bson:"aid" json:"aid"`
+	SubAID  string             `bson:"sub_aid,omitempty" json:"sub_aid,omitempty"`
+	Year    int                `bson:"year" json:"year"`
+	Month   int                `bson:"month" json:"month"`
+	Backups []storage.Backup   `bson:"backups" json:"backups"`
+	// Files has how each of the Backups was stored, in the same order.
+	Files      []FileEntry `bson:"files,omitempty" json:"files,omitempty"`
+	Timestamp  time.Time   `bson:"timestamp" json:"timestamp"`
+	TotalBytes int64       `bson:"total_bytes" json:"total_bytes"`
+	Flagged    []string    `bson:"flagged,omitempty" json:"flagged,omitempty"`
+	// Months lists every month covered by the same backup when a run
+	// spans several of them, each one getting its own record.
+	Months         []int           `bson:"months,omitempty" json:"months,omitempty"`
+	SHA256Sums     *storage.Backup `bson:"sha256sums,omitempty" json:"sha256sums,omitempty"`
+	Provenance     *storage.Backup `bson:"provenance,omitempty" json:"provenance,omitempty"`
+	IdempotencyKey string          `bson:"idempotency_key,omitempty" json:"idempotency_key,omitempty"`
+	// BagIt are the tag files of the BagIt bag of the backup.
+	BagIt []storage.Backup `bson:"bagit,omitempty" json:"bagit,omitempty"`
+	// InputHash identifies the run's input, see inputHash.
+	InputHash string `bson:"input_hash,omitempty" json:"input_hash,omitempty"`
+	// Build is the binary that wrote the record.
+	Build buildInfo `bson:"build" json:"build"`
+	// Links lists the input files that were hard links to an uploaded one.
+	Links []fileLink `bson:"links,omitempty" json:"links,omitempty"`
+	// Members lists the files in the archive, the only backup, of a run
+	// with PACKAGE_MODE=targz.
+	Members []packageMember `bson:"members,omitempty" json:"members,omitempty"`
+	// Usage is what the run that wrote the record used.
+	Usage *runUsage `bson:"usage,omitempty" json:"usage,omitempty"`
+	// Incomplete is set on the records of a run that failed uploading its
+	// files with PARTIAL_FAILURE_POLICY=record, Missing listing the object
+	// names it didn't store.
+	Incomplete bool     `bson:"incomplete,omitempty" json:"incomplete,omitempty"`
+	Missing    []string `bson:"missing,omitempty" json:"missing,omitempty"`
+	// Manifest maps the original names of the files to their objects, for
+	// runs with OBJECT_LAYOUT=content.
+	Manifest *storage.Backup `bson:"manifest,omitempty" json:"manifest,omitempty"`
+	// ObjectPrefix is what the objects of a run with OBJECT_VERSIONING are
+	// named under, instead of the agency folder.
+	ObjectPrefix string `bson:"object_prefix,omitempty" json:"object_prefix,omitempty"`
+	// KeyTemplate is the KEY_TEMPLATE the objects of the files were named
+	// with, their entries keeping their original names.
+	KeyTemplate string `bson:"key_template,omitempty" json:"key_template,omitempty"`
+	// Input is the stdin of the run, with STORE_INPUT.
+	Input *storage.Backup `bson:"input,omitempty" json:"input,omitempty"`
+	// Previews glimpse at the content of the files, with PREVIEW=true.
+	Previews []filePreview `bson:"previews,omitempty" json:"previews,omitempty"`
+	// Replicas are the copies of its objects in MIRROR_BACKENDS.
+	Replicas []objectReplica `bson:"replicas,omitempty" json:"replicas,omitempty"`
+	// Scan is how the files were scanned with CLAMD_ADDR, listing the
+	// infected ones left out.
+	Scan *scanReport `bson:"scan,omitempty" json:"scan,omitempty"`
+	// Notes are appended by operators with the annotate command.
+	Notes []recordNote `bson:"notes,omitempty" json:"notes,omitempty"`
+	// Appends has the appendKey of every run appended to the record with
+	// RECORD_POLICY=append.
+	Appends []string `bson:"appends,omitempty" json:"appends,omitempty"`
+}
+
+// FileEntry describes how one backed up file was stored.
+type FileEntry struct {
+	Name      string `bson:"name" json:"name"`
+	Container string `bson:"container" json:"container"`
+	Bytes     int64  `bson:"bytes" json:"bytes"`
+	// SHA256 is the digest of the file, computed while uploading it.
+	SHA256 string `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	// Backend is the storage backend the file went to.
+	Backend string `bson:"backend,omitempty" json:"backend,omitempty"`
+	// Attempts is how many uploads it took, LastError the error of the last
+	// failed one, if any.
+	Attempts  int    `bson:"attempts" json:"attempts"`
+	LastError string `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	// Deduplicated is set on the content objects, with
+	// OBJECT_LAYOUT=content, another record had already stored.
+	Deduplicated bool `bson:"deduplicated,omitempty" json:"deduplicated,omitempty"`
+	// Chunks is how many chunks a file stored as a chunk manifest has,
+	// NewChunks how many of them weren't stored yet.
+	Chunks    int `bson:"chunks,omitempty" json:"chunks,omitempty"`
+	NewChunks int `bson:"new_chunks,omitempty" json:"new_chunks,omitempty"`
+	// Segments is how many segments, in SEGMENT_CONTAINER, a file stored as
+	// a segmented manifest has.
+	Segments int `bson:"segments,omitempty" json:"segments,omitempty"`
+	// Parts is how many parts a file uploaded to S3 in parts has.
+	Parts int `bson:"parts,omitempty" json:"parts,omitempty"`
+	// SSE is how S3 encrypts the object at rest, see S3_SSE, SSEKeyID the
+	// KMS key of SSE-KMS.
+	SSE      string `bson:"sse,omitempty" json:"sse,omitempty"`
+	SSEKeyID string `bson:"sse_key_id,omitempty" json:"sse_key_id,omitempty"`
+	// ContentType, ModTime and Path describe the input file: its detected
+	// MIME type, modification time and path relative to the common
+	// directory of the inputs. A package only has its content type.
+	ContentType string     `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	ModTime     *time.Time `bson:"mod_time,omitempty" json:"mod_time,omitempty"`
+	Path        string     `bson:"path,omitempty" json:"path,omitempty"`
+	// Encryption is set when the file was encrypted with
+	// BACKUP_ENCRYPTION_KEY, Bytes being the size of the encrypted content.
+	Encryption *fileEncryption `bson:"encryption,omitempty" json:"encryption,omitempty"`
+	// Original is the name the file would have been stored as, when
+	// KEY_TEMPLATE gave its object another one.
+	Original string `bson:"original,omitempty" json:"original,omitempty"`
+}
+
+// originalName returns the name f was backed up as.
+func (f FileEntry) originalName() string {
+	if f.Original != "" {
+		return f.Original
+	}
+	return f.Name
+}
+
+// describeSources records in every entry of files what describes the input
+// of the same index of sources, root being the common directory of the
+// inputs.
+func describeSources(files []FileEntry, sources []string, root string) error {
+	for k := range files {
+		p := sources[k]
+		fi, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("error reading file info(%s):%w", p, err)
+		}
+		if files[k].ContentType, err = mimeType(p); err != nil {
+			return err
+		}
+		// mongo keeps milliseconds.
+		mtime := fi.ModTime().UTC().Truncate(time.Millisecond)
+		files[k].ModTime = &mtime
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return fmt.Errorf("error computing absolute path(%s):%w", p, err)
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return fmt.Errorf("error computing relative path(%s):%w", p, err)
+		}
+		files[k].Path = filepath.ToSlash(rel)
+	}
+	return nil
+}
+
+// agency returns the agency the record belongs to.
+func (r Record) agency() agencyID {
+	return agencyID{AID: r.AID, Sub: r.SubAID}
+}
+
+// objectPrefix returns what the objects of the record are named under, and
+// restored relative to.
+func (r Record) objectPrefix() string {
+	if r.ObjectPrefix != "" {
+		return r.ObjectPrefix
+	}
+	return r.agency().prefix()
+}
+
+// objects returns every object of the record: its backups, then the
+// checksums, provenance, manifest, input and BagIt tag files, if any.
+func (r Record) objects() []storage.Backup {
+	objects := append([]storage.Backup{}, r.Backups...)
+	if r.SHA256Sums != nil {
+		objects = append(objects, *r.SHA256Sums)
+	}
+	if r.Provenance != nil {
+		objects = append(objects, *r.Provenance)
+	}
+	if r.Manifest != nil {
+		objects = append(objects, *r.Manifest)
+	}
+	if r.Input != nil {
+		objects = append(objects, *r.Input)
+	}
+	return append(objects, r.BagIt...)
+}
+
+// createdAt returns when the record was written. Records written before the
+// timestamp field existed fall back to the time embedded in their ObjectID.
+func (r Record) createdAt() time.Time {
+	if !r.Timestamp.IsZero() {
+		return r.Timestamp
+	}
+	return r.ID.Timestamp().UTC()
+}
+
+// findVersions returns every record of (aid, year, month), oldest first. Each
+// run of the stage writes a new record, so those are the stored versions of
+// the month's backup.
+func findVersions(ctx context.Context, coll *mongo.Collection, aid agencyID, year, month int) ([]Record, error) {
+	filter := aid.filter()
+	filter["year"] = year
+	filter["month"] = month
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error querying backup records(%s, %d, %d):%w", aid, year, month, err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return nil, fmt.Errorf("error decoding backup records(%s, %d, %d):%w", aid, year, month, err)
+	}
+	return recs, nil
+}
+
+// findByIdempotencyKey returns the records written by the run that had key.
+func findByIdempotencyKey(ctx context.Context, coll *mongo.Collection, key string) ([]Record, error) {
+	cur, err := coll.Find(ctx, bson.M{"idempotency_key": key}, options.Find().SetSort(bson.M{"month": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error querying backup records(idempotency key %s):%w", key, err)
+	}
+	var recs []Record
+	if err := cur.All(ctx, &recs); err != nil {
+		return nil, fmt.Errorf("error decoding backup records(idempotency key %s):%w", key, err)
+	}
+	return recs, nil
+}
+
+// findCached returns the latest record of every month if all of them were
+// written from the input with hash, nil otherwise.
+func findCached(ctx context.Context, coll *mongo.Collection, aid agencyID, year int, months []int, hash string) ([]Record, error) {
+	var recs []Record
+	for _, m := range months {
+		versions, err := findVersions(ctx, coll, aid, year, m)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 || versions[len(versions)-1].InputHash != hash {
+			return nil, nil
+		}
+		recs = append(recs, versions[len(versions)-1])
+	}
+	return recs, nil
+}
+
+// versionLabel names the i-th (zero based) version.
+func versionLabel(i int) string {
+	return fmt.Sprintf("v%d", i+1)
+}
+
+// pickVersion selects a version by its label (v1, v2, ...) or "latest".
+func pickVersion(recs []Record, label string) (Record, error) {
+	if len(recs) == 0 {
+		return Record{}, fmt.Errorf("no backup records found")
+	}
+	if label == "latest" {
+		return recs[len(recs)-1], nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(label, "v"))
+	if err != nil || !strings.HasPrefix(label, "v") || n < 1 || n > len(recs) {
+		return Record{}, fmt.Errorf("invalid version %q: must be latest or one of v1..v%d", label, len(recs))
+	}
+	return recs[n-1], nil
+}
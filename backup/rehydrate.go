@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rehydrateCmd downloads a stored backup of a month into a work directory
+// and prints the path of every file on stdout, a line each, as the stage
+// reads them: its output feeds the files back into the pipeline, e.g. to
+// parse historical data again. Package archives are unpacked, their members
+// being printed instead.
+func rehydrateCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("rehydrate", flag.ContinueOnError)
+	m := monthFlags(fs, conf)
+	version := fs.String("version", "latest", "version to rehydrate: latest or v1, v2, ...")
+	dir := fs.String("dir", "", "directory the files are placed in (a new one in WORK_DIR by default)")
+	concurrency := fs.Int("concurrency", 1, "number of files downloaded at the same time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+	recs, err := findVersions(ctx, coll, m.aid(), m.year, m.month)
+	if err != nil {
+		return err
+	}
+	rec, err := pickVersion(recs, *version)
+	if err != nil {
+		return fmt.Errorf("error picking version(%s, %d, %d):%w", m.aid(), m.year, m.month, err)
+	}
+	if rec.Incomplete {
+		log.Printf("Record %s is incomplete, its run failed before storing %v", rec.ID.Hex(), rec.Missing)
+	}
+
+	if *dir == "" {
+		if conf.WorkDir != "" {
+			if err := os.MkdirAll(conf.WorkDir, 0700); err != nil {
+				return fmt.Errorf("error creating work dir(%s):%w", conf.WorkDir, err)
+			}
+		}
+		if *dir, err = os.MkdirTemp(conf.WorkDir, workFilePrefix+"rehydrate-"+strings.ReplaceAll(m.aid().prefix(), "/", "-")+"-*"); err != nil {
+			return fmt.Errorf("error creating rehydrate dir:%w", err)
+		}
+	}
+	// the next stage may run elsewhere.
+	if *dir, err = filepath.Abs(*dir); err != nil {
+		return fmt.Errorf("error resolving rehydrate dir:%w", err)
+	}
+	cloud := newSwiftClient(conf)
+	access := db.Database(conf.MongoDBName).Collection(conf.MongoAccessColl)
+	if _, err := logRestore(ctx, conf, access, rec, rec.Backups, *dir); err != nil {
+		return err
+	}
+	if len(rec.Members) > 0 && len(rec.Backups) == 1 {
+		if err := rehydratePackage(ctx, cloud, rec, *dir); err != nil {
+			return err
+		}
+		log.Printf("Rehydrated %d file(s) of %s into %s", len(rec.Members), rec.ID.Hex(), *dir)
+		return nil
+	}
+
+	original, err := originalNames(ctx, cloud, rec)
+	if err != nil {
+		return err
+	}
+	local := func(name string) (string, error) {
+		return filepath.Join(*dir, filepath.FromSlash(restorePath(rec.objectPrefix(), original(name)))), nil
+	}
+	if _, err := restoreFiles(ctx, cloud, rec.Backups, recordFiles(rec), local, *concurrency); err != nil {
+		return err
+	}
+	for _, l := range rec.Links {
+		dst, _ := local(l.Name)
+		src, _ := local(l.Target)
+		if err := restoreLink(src, dst); err != nil {
+			return err
+		}
+		fmt.Println(dst)
+	}
+	log.Printf("Rehydrated %d file(s) of %s into %s", len(rec.Backups)+len(rec.Links), rec.ID.Hex(), *dir)
+	return nil
+}
+
+// rehydratePackage downloads the archive of rec and unpacks it into dir,
+// printing the path of every member and checking them against the SHA-256
+// of the record.
+func rehydratePackage(ctx context.Context, cloud *swiftClient, rec Record, dir string) error {
+	if err := cloud.authenticate(ctx); err != nil {
+		return err
+	}
+	archive, err := createWorkFile("rehydrate-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("error creating work file:%w", err)
+	}
+	archive.Close()
+	defer removeWorkFile(archive.Name())
+	f := FileEntry{Bytes: -1}
+	if len(rec.Files) == 1 {
+		f = rec.Files[0]
+	}
+	if _, err := restoreFile(ctx, cloud, rec.Backups[0], f, archive.Name()); err != nil {
+		return err
+	}
+
+	digests := make(map[string]string)
+	for _, m := range rec.Members {
+		digests[m.Name] = m.SHA256
+	}
+	in, err := os.Open(archive.Name())
+	if err != nil {
+		return fmt.Errorf("error opening package(%s):%w", archive.Name(), err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("error reading package(%s):%w", rec.Backups[0].URL, err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading package(%s):%w", rec.Backups[0].URL, err)
+		}
+		dst, err := memberPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			sum, err := writeMember(dst, tr)
+			if err != nil {
+				return err
+			}
+			if want := digests[hdr.Name]; want != "" && sum != want {
+				return fmt.Errorf("member %s of %s has SHA-256 %s, the record has %s", hdr.Name, rec.Backups[0].URL, sum, want)
+			}
+		case tar.TypeLink:
+			src, err := memberPath(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := restoreLink(src, dst); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		fmt.Println(dst)
+	}
+}
+
+// memberPath returns where the member name is unpacked in dir, refusing
+// names that would land outside of it.
+func memberPath(dir, name string) (string, error) {
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+		return "", fmt.Errorf("package member %s is outside of the package", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// writeMember writes the content of r to dst, returning its SHA-256.
+func writeMember(dst string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", fmt.Errorf("error creating directory(%s):%w", filepath.Dir(dst), err)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", fmt.Errorf("error creating file(%s):%w", dst, err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), r); err != nil {
+		out.Close()
+		return "", fmt.Errorf("error writing file(%s):%w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("error closing file(%s):%w", dst, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
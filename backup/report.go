@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// yearReport sums up the backups of a year of an agency.
+type yearReport struct {
+	AID    string `json:"aid"`
+	SubAID string `json:"sub_aid,omitempty"`
+	Year   int    `json:"year"`
+	// Months are those with a backup, Missing those without one: up to
+	// the last month for the current year, which isn't over.
+	Months  []int `json:"months"`
+	Missing []int `json:"missing"`
+	// Versions counts the records, Files and Bytes the distinct objects
+	// of all of them: what the year takes in storage.
+	Versions int   `json:"versions"`
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	// LatestBackup is nil for years without any.
+	LatestBackup *time.Time `json:"latest_backup"`
+}
+
+// buildReport groups recs by agency and year, every year from an agency's
+// first to its last backed up one having a row, missing months included.
+func buildReport(recs []Record, now time.Time) []yearReport {
+	type key struct {
+		agency agencyID
+		year   int
+	}
+	rows := make(map[key]*yearReport)
+	months := make(map[key]map[int]bool)
+	objects := make(map[key]map[string]bool)
+	first := make(map[agencyID]int)
+	last := make(map[agencyID]int)
+	for _, r := range recs {
+		k := key{r.agency(), r.Year}
+		row, ok := rows[k]
+		if !ok {
+			row = &yearReport{AID: r.AID, SubAID: r.SubAID, Year: r.Year}
+			rows[k] = row
+			months[k] = make(map[int]bool)
+			objects[k] = make(map[string]bool)
+		}
+		row.Versions++
+		months[k][r.Month] = true
+		if t := r.createdAt(); row.LatestBackup == nil || t.After(*row.LatestBackup) {
+			row.LatestBackup = &t
+		}
+		// objects are shared by versions and by the months of a run.
+		if len(r.Files) == 0 && len(r.Backups) > 0 && !objects[k][r.Backups[0].URL] {
+			objects[k][r.Backups[0].URL] = true
+			row.Files += len(r.Backups)
+			row.Bytes += r.TotalBytes
+		}
+		for i, f := range r.Files {
+			if i >= len(r.Backups) || objects[k][r.Backups[i].URL] {
+				continue
+			}
+			objects[k][r.Backups[i].URL] = true
+			row.Files++
+			row.Bytes += f.Bytes
+		}
+		if y, ok := first[r.agency()]; !ok || r.Year < y {
+			first[r.agency()] = r.Year
+		}
+		if r.Year > last[r.agency()] {
+			last[r.agency()] = r.Year
+		}
+	}
+	var out []yearReport
+	for agency, from := range first {
+		for y := from; y <= last[agency]; y++ {
+			k := key{agency, y}
+			row, ok := rows[k]
+			if !ok {
+				row = &yearReport{AID: agency.AID, SubAID: agency.Sub, Year: y}
+			}
+			row.Months = []int{}
+			for m := 1; m <= 12; m++ {
+				if months[k][m] {
+					row.Months = append(row.Months, m)
+				}
+			}
+			row.Missing = missingMonths(months[k], y, now)
+			out = append(out, *row)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := agencyID{out[i].AID, out[i].SubAID}.prefix(), agencyID{out[j].AID, out[j].SubAID}.prefix()
+		if a != b {
+			return a < b
+		}
+		return out[i].Year < out[j].Year
+	})
+	return out
+}
+
+// missingMonths returns the months of year not in covered, up to the last
+// month for the year of now, which isn't over.
+func missingMonths(covered map[int]bool, year int, now time.Time) []int {
+	missing := []int{}
+	for m := 1; m <= 12; m++ {
+		if !covered[m] && (year < now.Year() || (year == now.Year() && m < int(now.Month()))) {
+			missing = append(missing, m)
+		}
+	}
+	return missing
+}
+
+func joinMonths(months []int, sep string) string {
+	s := make([]string, len(months))
+	for i, m := range months {
+		s[i] = strconv.Itoa(m)
+	}
+	return strings.Join(s, sep)
+}
+
+func writeReportCSV(w io.Writer, rows []yearReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"aid", "sub_aid", "year", "months", "missing", "versions", "files", "bytes", "latest_backup"})
+	for _, r := range rows {
+		latest := ""
+		if r.LatestBackup != nil {
+			latest = r.LatestBackup.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{r.AID, r.SubAID, strconv.Itoa(r.Year), joinMonths(r.Months, ";"), joinMonths(r.Missing, ";"),
+			strconv.Itoa(r.Versions), strconv.Itoa(r.Files), strconv.FormatInt(r.Bytes, 10), latest})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// storedRecords reads the records of the file or mongo metadata sink as they
+// were at asOf: those of agency and year, unless empty and zero, from the
+// file, those filter matches from mongo.
+func storedRecords(ctx context.Context, conf Config, agency agencyID, year int, filter bson.M, asOf time.Time) ([]Record, error) {
+	switch conf.MetadataSink {
+	case sinkFile:
+		recs, err := readRecordsFile(conf.MetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		return filterRecords(recs, agency, year, 0, asOf), nil
+	case sinkMongo:
+		db, err := connect(ctx, conf.MongoURI)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to mongo:%w", err)
+		}
+		defer disconnect(db)
+		return recordsAsOf(ctx, db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl), filter, asOf)
+	}
+	return nil, fmt.Errorf("can't read the records of METADATA_SINK=%s", conf.MetadataSink)
+}
+
+// reportCmd sums up the backup records by agency and year: storage used,
+// files, latest backup and the months without one.
+func reportCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	agency := fs.String("aid", conf.AID, "agency identifier, empty reports every agency")
+	year := fs.Int("year", 0, "only report this year")
+	asOfFlag := fs.String("as-of", "", "report the archive as it was at this date (2006-01-02, at midnight UTC) or RFC 3339 time; now by default")
+	format := fs.String("format", "table", "output format: table, json (a row per line) or csv")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" && *format != "csv" {
+		return fmt.Errorf("invalid --format %q: must be table, json or csv", *format)
+	}
+	asOf, err := parseAsOf(*asOfFlag)
+	if err != nil {
+		return err
+	}
+
+	var aid agencyID
+	filter := bson.M{}
+	if *agency != "" {
+		aid = splitAID(strings.ToLower(*agency), conf.AIDSeparator)
+		filter = aid.filter()
+	}
+	if *year != 0 {
+		filter["year"] = *year
+	}
+	recs, err := storedRecords(ctx, conf, aid, *year, filter, asOf)
+	if err != nil {
+		return err
+	}
+
+	rows := buildReport(recs, asOf)
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range rows {
+			if err := enc.Encode(r); err != nil {
+				return fmt.Errorf("error encoding report:%w", err)
+			}
+		}
+		return nil
+	case "csv":
+		return writeReportCSV(os.Stdout, rows)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AID\tYEAR\tMONTHS\tMISSING\tVERSIONS\tFILES\tBYTES\tLATEST")
+	for _, r := range rows {
+		latest := "-"
+		if r.LatestBackup != nil {
+			latest = r.LatestBackup.UTC().Format(time.RFC3339)
+		}
+		missing := "-"
+		if len(r.Missing) > 0 {
+			missing = joinMonths(r.Missing, ",")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%d\t%d\t%s\n", agencyID{r.AID, r.SubAID}, r.Year, len(r.Months), missing, r.Versions, r.Files, r.Bytes, latest)
+	}
+	return w.Flush()
+}
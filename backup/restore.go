@@ -0,0 +1,735 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/ncw/swift/v2"
+)
+
+// versionsCmd lists every stored version of a month's backup.
+func versionsCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ContinueOnError)
+	m := monthFlags(fs, conf)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+
+	recs, err := findVersions(ctx, coll, m.aid(), m.year, m.month)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tCREATED\tFILES\tBYTES\tID\tLAST NOTE")
+	for i, r := range recs {
+		var note string
+		if len(r.Notes) > 0 {
+			note = r.Notes[len(r.Notes)-1].Text
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", versionLabel(i), r.createdAt().Format("2006-01-02T15:04:05Z"), len(r.Backups), r.TotalBytes, r.ID.Hex(), note)
+	}
+	return w.Flush()
+}
+
+// restoreCmd downloads the files of one version of a month's backup into a
+// local directory.
+func restoreCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	m := monthFlags(fs, conf)
+	version := fs.String("version", "latest", "version to restore: latest or v1, v2, ...")
+	dir := fs.String("dir", ".", "directory the files are restored into")
+	manifestOnly := fs.Bool("manifest-only", false, "only list the path, size and hash of the files that would be restored, without downloading them")
+	asTar := fs.Bool("tar", false, "stream the files as a tar archive to stdout instead of writing them to --dir (e.g. to pipe into kubectl exec -i ... tar x or docker cp -)")
+	concurrency := fs.Int("concurrency", 1, "number of files downloaded at the same time")
+	attempts := fs.Int("attempts", 3, "times a download is tried, each attempt resuming from where the previous one stopped")
+	maxRate := fs.String("max-rate", "0", "cap on the combined download rate in bytes per second, e.g. 500K, 10M (0 is unlimited)")
+	bagit := fs.Bool("bagit", false, "lay the files out as the BagIt bag of the backup (payload under data/), for records written with EMIT_BAGIT")
+	var maps pathMaps
+	var only globs
+	fs.Var(&only, "only", "only restore files matching this glob (e.g. '*.csv'), matched against the restored path or, for patterns without a /, the file name; can be repeated")
+	fs.Var(&maps, "map", "remap restored paths, as <from prefix>=<to prefix> (e.g. 'output/=data/raw/'); can be repeated, the first matching rule wins")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	bytesPerSec, err := parseByteRate(*maxRate)
+	if err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+
+	recs, err := findVersions(ctx, coll, m.aid(), m.year, m.month)
+	if err != nil {
+		return err
+	}
+	rec, err := pickVersion(recs, *version)
+	if err != nil {
+		return fmt.Errorf("error picking version(%s, %d, %d):%w", m.aid(), m.year, m.month, err)
+	}
+
+	if rec.Incomplete {
+		log.Printf("Record %s is incomplete, its run failed before storing %v", rec.ID.Hex(), rec.Missing)
+	}
+	cloud := newSwiftClient(conf)
+	cloud.downloads = newByteLimiter(bytesPerSec)
+	cloud.attempts = *attempts
+	files := rec.Backups
+	var bagTags string
+	if *bagit {
+		// the bag payload is only what its manifest lists.
+		if err := checkBagRestore(rec, len(maps) > 0 || len(only) > 0); err != nil {
+			return err
+		}
+		_, name, err := cloud.objectPath(ctx, rec.BagIt[0].URL)
+		if err != nil {
+			return err
+		}
+		bagTags = path.Dir(name)
+		files = append(files, rec.BagIt...)
+	} else {
+		if rec.SHA256Sums != nil {
+			files = append(files, *rec.SHA256Sums)
+		}
+		if rec.Provenance != nil {
+			files = append(files, *rec.Provenance)
+		}
+		if rec.Input != nil {
+			files = append(files, *rec.Input)
+		}
+		files = append(files, rec.BagIt...)
+	}
+	original, err := originalNames(ctx, cloud, rec)
+	if err != nil {
+		return err
+	}
+	restored := func(name string) string {
+		return restorePath(rec.objectPrefix(), original(name))
+	}
+	links := rec.Links
+	if len(only) > 0 {
+		if files, links, err = selectFiles(ctx, cloud, restored, files, links, only); err != nil {
+			return err
+		}
+	}
+	layout := func(name string) (string, error) {
+		rel, err := maps.apply(restored(name))
+		if err != nil || !*bagit {
+			return rel, err
+		}
+		return bagLayout(bagTags, original(name), rel), nil
+	}
+	if *manifestOnly {
+		return writeManifest(ctx, cloud, rec, layout, files, links, os.Stdout)
+	}
+	dest := *dir
+	if *asTar {
+		dest = "tar stream"
+	}
+	access := db.Database(conf.MongoDBName).Collection(conf.MongoAccessColl)
+	entry, err := logRestore(ctx, conf, access, rec, files, dest)
+	if err != nil {
+		return err
+	}
+	if *asTar {
+		return restoreTar(ctx, cloud, layout, files, recordFiles(rec), links, os.Stdout)
+	}
+	local := func(name string) (string, error) {
+		rel, err := layout(name)
+		return filepath.Join(*dir, filepath.FromSlash(rel)), err
+	}
+	checks, err := restoreFiles(ctx, cloud, files, recordFiles(rec), local, *concurrency)
+	// failed checks are recorded too, they are what explains the failure.
+	if rErr := recordPartsChecks(ctx, access, entry, checks); rErr != nil {
+		log.Printf("%v", rErr)
+	}
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		dst, err := local(l.Name)
+		if err != nil {
+			return err
+		}
+		src, err := local(l.Target)
+		if err != nil {
+			return err
+		}
+		if err := restoreLink(src, dst); err != nil {
+			return err
+		}
+		fmt.Println(dst)
+	}
+	return nil
+}
+
+// writeManifest lists where files and links would be restored, with their
+// size and hash, reading only metadata. Sizes come from the record, objects
+// of records written before it listed them are looked up in Swift. Encrypted
+// files are listed with the size they have once decrypted.
+func writeManifest(ctx context.Context, cloud *swiftClient, rec Record, layout func(name string) (string, error), files []storage.Backup, links []fileLink, w io.Writer) error {
+	recorded := recordFiles(rec)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tBYTES\tHASH")
+	for _, b := range files {
+		container, name, err := cloud.objectPath(ctx, b.URL)
+		if err != nil {
+			return err
+		}
+		f, ok := recorded[container+"/"+name]
+		size := f.Bytes
+		if !ok {
+			info, err := cloud.stat(ctx, b.URL)
+			if err != nil {
+				return err
+			}
+			size = info.Bytes
+		}
+		if f.Encryption != nil {
+			size = plainSize(f.Encryption, size)
+		}
+		p, err := layout(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", p, size, b.Hash)
+	}
+	for _, l := range links {
+		p, err := layout(l.Name)
+		if err != nil {
+			return err
+		}
+		target, err := layout(l.Target)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t-\tlink to %s\n", p, target)
+	}
+	return tw.Flush()
+}
+
+// checkBagRestore tells whether rec can be restored as a bag: it must have
+// tag files and its objects must be the payload listed in the manifest, which
+// remapped or partial restores and package archives aren't.
+func checkBagRestore(rec Record, selective bool) error {
+	switch {
+	case len(rec.BagIt) == 0:
+		return fmt.Errorf("record %s has no BagIt tag files, it was not backed up with EMIT_BAGIT", rec.ID.Hex())
+	case len(rec.Members) > 0:
+		return fmt.Errorf("record %s is a package archive, its bag payload being the archive members", rec.ID.Hex())
+	case selective:
+		return fmt.Errorf("--bagit can't be used with --map or --only, the bag manifest listing every file as backed up")
+	}
+	return nil
+}
+
+// globs implements the repeatable --only flag of restore.
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globs) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("invalid glob %q:%w", v, err)
+	}
+	*g = append(*g, v)
+	return nil
+}
+
+// match tells whether the restored path rel matches any of the globs.
+func (g globs) match(rel string) bool {
+	for _, p := range g {
+		target := rel
+		if !strings.Contains(p, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectFiles keeps the files and links whose restored path, given by
+// restored, matches only. A selected link brings the file it points to
+// along, as that is where its content is stored.
+func selectFiles(ctx context.Context, cloud *swiftClient, restored func(name string) string, files []storage.Backup, links []fileLink, only globs) ([]storage.Backup, []fileLink, error) {
+	byName := make(map[string]storage.Backup)
+	var names []string
+	for _, b := range files {
+		_, name, err := cloud.objectPath(ctx, b.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		byName[name] = b
+		names = append(names, name)
+	}
+	keep := make(map[string]bool)
+	// links name their target as restored, not as stored.
+	stored := make(map[string]string)
+	for _, n := range names {
+		keep[n] = only.match(restored(n))
+		stored[restored(n)] = n
+	}
+	var selLinks []fileLink
+	for _, l := range links {
+		if only.match(restored(l.Name)) {
+			selLinks = append(selLinks, l)
+			keep[stored[restored(l.Target)]] = true
+		}
+	}
+	var sel []storage.Backup
+	for _, n := range names {
+		if keep[n] {
+			sel = append(sel, byName[n])
+		}
+	}
+	return sel, selLinks, nil
+}
+
+// recordFiles maps the <container>/<name> of the objects of rec to how they
+// were stored. Records written before files were listed have none.
+func recordFiles(rec Record) map[string]FileEntry {
+	files := make(map[string]FileEntry)
+	for _, f := range rec.Files {
+		files[f.Container+"/"+f.Name] = f
+	}
+	return files
+}
+
+// restoreFiles downloads files to the paths given by local, concurrency of
+// them at a time, checking them against the recorded sizes (see
+// recordFiles) and hashes and decrypting encrypted ones. It stops at the
+// first error, returning the checks of the large objects restored so far
+// either way.
+func restoreFiles(ctx context.Context, cloud *swiftClient, files []storage.Backup, recorded map[string]FileEntry, local func(name string) (string, error), concurrency int) ([]partsCheck, error) {
+	// authenticating upfront, not concurrently from every worker.
+	if err := cloud.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan storage.Backup)
+	errs := make(chan error, concurrency)
+	var checks []partsCheck
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				dst, check, err := restoreObject(ctx, cloud, b, recorded, local)
+				mu.Lock()
+				if check != nil {
+					checks = append(checks, *check)
+				}
+				if err == nil {
+					fmt.Println(dst)
+				}
+				mu.Unlock()
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for _, b := range files {
+		select {
+		case jobs <- b:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return checks, err
+	}
+	return checks, ctx.Err()
+}
+
+func restoreObject(ctx context.Context, cloud *swiftClient, b storage.Backup, recorded map[string]FileEntry, local func(name string) (string, error)) (string, *partsCheck, error) {
+	container, name, err := cloud.objectPath(ctx, b.URL)
+	if err != nil {
+		return "", nil, err
+	}
+	dst, err := local(name)
+	if err != nil {
+		return "", nil, err
+	}
+	f, ok := recorded[container+"/"+name]
+	if !ok {
+		f.Bytes = -1
+	}
+	check, err := restoreFile(ctx, cloud, b, f, dst)
+	return dst, check, err
+}
+
+// pathMap replaces the from prefix of a restored path with to.
+type pathMap struct {
+	from, to string
+}
+
+// pathMaps implements the repeatable --map flag of restore.
+type pathMaps []pathMap
+
+func (p *pathMaps) String() string {
+	var rules []string
+	for _, m := range *p {
+		rules = append(rules, m.from+"="+m.to)
+	}
+	return strings.Join(rules, ",")
+}
+
+func (p *pathMaps) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid map %q: must be <from prefix>=<to prefix>", v)
+	}
+	*p = append(*p, pathMap{from: v[:i], to: v[i+1:]})
+	return nil
+}
+
+// apply rewrites rel with the first rule whose prefix matches, refusing
+// results that would land outside the restore directory.
+func (p pathMaps) apply(rel string) (string, error) {
+	mapped := rel
+	for _, m := range p {
+		if strings.HasPrefix(rel, m.from) {
+			mapped = path.Clean(m.to + strings.TrimPrefix(rel, m.from))
+			break
+		}
+	}
+	if mapped == ".." || strings.HasPrefix(mapped, "../") || path.IsAbs(mapped) {
+		return "", fmt.Errorf("path %s is mapped to %s, outside of the restore directory", rel, mapped)
+	}
+	return mapped, nil
+}
+
+// restoreLink recreates dst as a hard link to src, copying the content when
+// the filesystem doesn't support links.
+func restoreLink(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("error creating directory(%s):%w", filepath.Dir(dst), err)
+	}
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening file(%s):%w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating file(%s):%w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying file(%s) to (%s):%w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing file(%s):%w", dst, err)
+	}
+	return nil
+}
+
+// restorePath returns where an object is placed relative to the restore
+// directory: its name without the agency prefix.
+func restorePath(prefix, name string) string {
+	if rel := strings.TrimPrefix(name, prefix+"/"); rel != name {
+		return rel
+	}
+	return path.Base(name)
+}
+
+// restoreFile downloads the object of b to dst, f being how it was stored
+// (Bytes -1 when unknown). An object that no longer matches the record is
+// refused before anything is downloaded, and the restored file must have
+// the size of the object. Large objects are then checked part by part and
+// as a whole, the check being returned. The file is decrypted last when
+// it was encrypted.
+func restoreFile(ctx context.Context, cloud *swiftClient, b storage.Backup, f FileEntry, dst string) (*partsCheck, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory(%s):%w", filepath.Dir(dst), err)
+	}
+	info, err := cloud.stat(ctx, b.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRecorded(info, b, f.Bytes); err != nil {
+		return nil, err
+	}
+	// what was stored, before decryption.
+	want := f.SHA256
+	if f.Encryption != nil {
+		want = f.Encryption.SHA256
+	}
+	var check *partsCheck
+	delay := cloud.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := resumeDownload(ctx, cloud, b.URL, info, dst)
+		if err == nil {
+			err = checkRestoredSize(dst, info.Bytes)
+		}
+		if err == nil && isLargeObject(info) {
+			container, name, _ := cloud.objectPath(ctx, b.URL)
+			c := checkParts(ctx, cloud, container, name, dst, want)
+			check = &c
+			if err = c.err(); err != nil {
+				os.Remove(dst)
+			}
+		}
+		if err == nil && f.Encryption != nil {
+			// not leaving the encrypted content where the file is expected.
+			if err := decryptFile(cloud.encryptionKey, f.Encryption, dst); err != nil {
+				os.Remove(dst)
+				return check, err
+			}
+			return check, nil
+		}
+		if err == nil || attempt >= cloud.attempts || ctx.Err() != nil {
+			return check, err
+		}
+		wait := jittered(delay)
+		log.Printf("Warning: download attempt %d/%d of %s failed, resuming in %s: %v", attempt, cloud.attempts, dst, wait, err)
+		select {
+		case <-ctx.Done():
+			return check, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// checkRecorded tells whether the object described by info is still the one
+// backed up: same size and, for regular objects, same ETag. Large objects
+// are checked by size only, their ETag being that of the manifest.
+func checkRecorded(info swift.Object, b storage.Backup, size int64) error {
+	if size >= 0 && info.Bytes != size {
+		return fmt.Errorf("object %s has %d bytes, the record has %d", info.Name, info.Bytes, size)
+	}
+	if b.Hash != "" && info.ObjectType == swift.RegularObjectType && info.Hash != b.Hash {
+		return fmt.Errorf("object %s has hash %s, the record has %s", info.Name, info.Hash, b.Hash)
+	}
+	return nil
+}
+
+// checkRestoredSize checks the file restored at dst has size bytes, removing
+// it otherwise so the next attempt downloads it again.
+func checkRestoredSize(dst string, size int64) error {
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return fmt.Errorf("error reading file info(%s):%w", dst, err)
+	}
+	if fi.Size() != size {
+		os.Remove(dst)
+		return fmt.Errorf("restored file %s has %d bytes, expected %d", dst, fi.Size(), size)
+	}
+	return nil
+}
+
+// downloadProgress is kept next to a partial download (<dst>.part.json),
+// telling which object version the <dst>.part bytes belong to.
+type downloadProgress struct {
+	URL  string `json:"url"`
+	Etag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+// resumeDownload downloads the object described by info into dst through
+// dst.part, continuing from the bytes already in it when they belong to the
+// same version of the object. The part file is renamed to dst once
+// complete and verified.
+func resumeDownload(ctx context.Context, cloud *swiftClient, url string, info swift.Object, dst string) error {
+	part, progFile := dst+".part", dst+".part.json"
+	want := downloadProgress{URL: url, Etag: info.Hash, Size: info.Bytes}
+
+	var offset int64
+	var prog downloadProgress
+	if b, err := ioutil.ReadFile(progFile); err == nil && json.Unmarshal(b, &prog) == nil && prog == want {
+		if fi, err := os.Stat(part); err == nil && fi.Size() <= info.Bytes {
+			offset = fi.Size()
+		}
+	}
+	if offset == 0 {
+		b, _ := json.Marshal(want)
+		if err := ioutil.WriteFile(progFile, b, 0644); err != nil {
+			return fmt.Errorf("error writing download progress(%s):%w", progFile, err)
+		}
+	}
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating file(%s):%w", part, err)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return fmt.Errorf("error truncating file(%s):%w", part, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("error seeking file(%s):%w", part, err)
+	}
+	if offset > 0 {
+		log.Printf("Resuming %s from byte %d of %d", dst, offset, info.Bytes)
+	}
+	if offset < info.Bytes || info.Bytes == 0 {
+		if err := cloud.downloadFrom(ctx, url, offset, f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing file(%s):%w", part, err)
+	}
+	if offset > 0 {
+		if err := verifyResumed(part, info); err != nil {
+			os.Remove(part)
+			os.Remove(progFile)
+			return err
+		}
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return fmt.Errorf("error renaming file(%s):%w", part, err)
+	}
+	os.Remove(progFile)
+	return nil
+}
+
+// verifyResumed checks a download assembled from several requests against the
+// object's ETag, which is the MD5 of its content for regular objects.
+func verifyResumed(path string, info swift.Object) error {
+	if len(info.Hash) != 32 || info.ObjectType != swift.RegularObjectType {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("error hashing file(%s):%w", path, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != info.Hash {
+		return fmt.Errorf("resumed download of %s has MD5 %s, expected %s", info.Name, got, info.Hash)
+	}
+	return nil
+}
+
+// restoreTar streams files as a tar archive laid out as a directory restore
+// would be, with links as hard link entries, in the PAX format as packages
+// (see createPackage). layout gives the path of an object in the archive.
+// Encrypted files are decrypted on the fly.
+func restoreTar(ctx context.Context, cloud *swiftClient, layout func(name string) (string, error), files []storage.Backup, recorded map[string]FileEntry, links []fileLink, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, b := range files {
+		info, err := cloud.stat(ctx, b.URL)
+		if err != nil {
+			return err
+		}
+		container, _, err := cloud.objectPath(ctx, b.URL)
+		if err != nil {
+			return err
+		}
+		f, ok := recorded[container+"/"+info.Name]
+		if !ok {
+			f.Bytes = -1
+		}
+		if err := checkRecorded(info, b, f.Bytes); err != nil {
+			return err
+		}
+		name, err := layout(info.Name)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    info.Bytes,
+			ModTime: info.LastModified.Truncate(time.Second),
+			Format:  tar.FormatPAX,
+		}
+		var out io.Writer = tw
+		var dec io.WriteCloser
+		if f.Encryption != nil {
+			hdr.Size = plainSize(f.Encryption, info.Bytes)
+			if dec, err = newDecrypter(cloud.encryptionKey, f.Encryption, tw); err != nil {
+				return fmt.Errorf("error decrypting object(%s):%w", info.Name, err)
+			}
+			out = dec
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("error writing tar header(%s):%w", hdr.Name, err)
+		}
+		if err := cloud.download(ctx, b.URL, out); err != nil {
+			return err
+		}
+		if dec != nil {
+			if err := dec.Close(); err != nil {
+				return fmt.Errorf("error decrypting object(%s):%w", info.Name, err)
+			}
+		}
+		log.Printf("Restored %s", hdr.Name)
+	}
+	for _, l := range links {
+		name, err := layout(l.Name)
+		if err != nil {
+			return err
+		}
+		target, err := layout(l.Target)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     name,
+			Linkname: target,
+			Mode:     0644,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("error writing tar header(%s):%w", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error finishing tar archive:%w", err)
+	}
+	return nil
+}
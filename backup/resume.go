@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/ncw/swift/v2"
+)
+
+// segmentMinSize is the smallest SEGMENT_SIZE, Swift refusing smaller
+// segments but the last one of a Static Large Object.
+const segmentMinSize = 1 << 20
+
+// byteSize is a size in bytes configured as 512, 500K, 10M or 1G.
+type byteSize int64
+
+func (s *byteSize) Decode(value string) error {
+	n, err := parseByteSize(value)
+	*s = byteSize(n)
+	return err
+}
+
+// uploadCheckpoint is how far the segmented upload of a file got: the
+// segments stored, up to offset, and the state of the SHA-256 of the bytes
+// before it. A failed or timed out attempt resumes from there.
+type uploadCheckpoint struct {
+	// prefix names the segments of the upload, unique to it so runs
+	// uploading the same name don't share them.
+	prefix    string
+	offset    int64
+	hashState []byte
+	segments  []sloSegment
+}
+
+// uploadSegmented stores f as a Static Large Object manifest, name in
+// container, of segments of the client's segment size in the segment
+// container, returning the SHA-256 of f along with the backup. The upload
+// is checkpointed after every segment, a new attempt only uploading and
+// hashing what is past the last checkpoint.
+func (c *swiftClient) uploadSegmented(ctx context.Context, container, name string, f *os.File, entry *FileEntry) (storage.Backup, string, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, "", err
+	}
+	c.mu.Lock()
+	cp := c.checkpoints[name]
+	c.mu.Unlock()
+	if cp == nil {
+		cp = &uploadCheckpoint{prefix: fmt.Sprintf("%s/%s", name, newRunID())}
+		c.mu.Lock()
+		c.checkpoints[name] = cp
+		c.mu.Unlock()
+	}
+	sum := &digestWriter{h: sha256.New(), n: cp.offset}
+	if cp.hashState != nil {
+		if err := sum.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.hashState); err != nil {
+			return storage.Backup{}, "", fmt.Errorf("error restoring hash checkpoint(%s):%w", name, err)
+		}
+		log.Printf("Resuming upload of %s at byte %d of %d (segment %d)", name, cp.offset, entry.Bytes, len(cp.segments)+1)
+	}
+	for cp.offset < entry.Bytes {
+		size := int64(c.segmentSize)
+		if rest := entry.Bytes - cp.offset; rest < size {
+			size = rest
+		}
+		seg := fmt.Sprintf("%s/%08d", cp.prefix, len(cp.segments))
+		b, err := c.uploadTo(ctx, c.segments, seg, io.TeeReader(io.NewSectionReader(f, cp.offset, size), sum))
+		if err != nil {
+			return storage.Backup{}, "", err
+		}
+		if sum.n != cp.offset+size {
+			return storage.Backup{}, "", fmt.Errorf("file %s changed while read: %d bytes read, %d expected", f.Name(), sum.n, entry.Bytes)
+		}
+		state, err := sum.h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return storage.Backup{}, "", fmt.Errorf("error checkpointing hash(%s):%w", name, err)
+		}
+		cp.segments = append(cp.segments, sloSegment{Path: c.segments + "/" + seg, Etag: b.Hash, Size: size})
+		cp.offset += size
+		cp.hashState = state
+	}
+	b, err := c.putManifest(ctx, container, name, cp.segments)
+	if err != nil {
+		return storage.Backup{}, "", err
+	}
+	digest, err := sum.check(f.Name(), entry.Bytes)
+	if err != nil {
+		return storage.Backup{}, "", err
+	}
+	entry.Segments = len(cp.segments)
+	c.mu.Lock()
+	delete(c.checkpoints, name)
+	c.mu.Unlock()
+	return b, digest, nil
+}
+
+// dropCheckpoint deletes the segments of the unfinished upload of name, if
+// any, once it is given up.
+func (c *swiftClient) dropCheckpoint(ctx context.Context, name string) {
+	c.mu.Lock()
+	cp := c.checkpoints[name]
+	delete(c.checkpoints, name)
+	c.mu.Unlock()
+	if cp == nil {
+		return
+	}
+	for i := range cp.segments {
+		seg := fmt.Sprintf("%s/%08d", cp.prefix, i)
+		if err := c.removeFrom(ctx, c.segments, seg); err != nil {
+			warnings.warnf(warnPartialUpload, "error deleting segment %s of failed upload:%v", seg, err)
+		}
+	}
+}
+
+// removeSegmented deletes the Static Large Object name from container along
+// with its segments.
+func (c *swiftClient) removeSegmented(ctx context.Context, container, name string) error {
+	if err := checkWritable(c.readOnly, "delete "+name); err != nil {
+		return err
+	}
+	if err := c.authenticate(ctx); err != nil {
+		return err
+	}
+	_, _, err := c.conn.Call(ctx, c.conn.StorageUrl, swift.RequestOpts{
+		Container:  container,
+		ObjectName: name,
+		Operation:  "DELETE",
+		Parameters: url.Values{"multipart-manifest": {"delete"}},
+		NoResponse: true,
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting object and segments(%s/%s):%w", container, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// retryJitter is the RETRY_JITTER set up in main.
+var retryJitter float64
+
+// jittered spreads d by up to retryJitter of it either way, so stages that
+// failed together don't retry in lockstep.
+func jittered(d time.Duration) time.Duration {
+	if retryJitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + retryJitter*(2*rand.Float64()-1)))
+}
+
+// writeRecordRetrying is writeRecord retried on network errors and timeouts
+// up to attempts times, waiting delay (doubled every time) in between. The
+// _id is set upfront so a retried insert recognizes a record written by an
+// attempt whose reply was lost, as a retried append recognizes the run
+// already appended.
+func writeRecordRetrying(ctx context.Context, coll *mongo.Collection, rec Record, policy string, attempts int, delay time.Duration) (primitive.ObjectID, error) {
+	if rec.ID.IsZero() {
+		rec.ID = primitive.NewObjectID()
+	}
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && policy == policyAppend {
+			if id, ok, err := appended(ctx, coll, rec); err == nil && ok {
+				return id, nil
+			}
+		}
+		id, err := writeRecord(ctx, coll, rec, policy)
+		if err == nil {
+			return id, nil
+		}
+		// RECORD_POLICY=fail turns the duplicate key into errRecordExists.
+		if attempt > 1 && (mongo.IsDuplicateKeyError(err) || errors.Is(err, errRecordExists)) {
+			if n, cErr := coll.CountDocuments(ctx, bson.M{"_id": rec.ID}); cErr == nil && n > 0 {
+				return rec.ID, nil
+			}
+		}
+		if !mongo.IsNetworkError(err) && !mongo.IsTimeout(err) {
+			return primitive.NilObjectID, err
+		}
+		if attempt >= attempts {
+			return primitive.NilObjectID, fmt.Errorf("%w (after %d attempts)", err, attempt)
+		}
+		wait := jittered(delay)
+		warnings.warnf(warnMongoRetry, "writing backup record attempt %d/%d failed, retrying in %s: %v", attempt, attempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return primitive.NilObjectID, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
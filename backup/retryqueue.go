@@ -0,0 +1,218 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// retryClaimTTL is how long a claimed job is hidden from other retry-due
+// runs. A job whose processing crashes becomes due again afterwards.
+const retryClaimTTL = time.Hour
+
+// retryJob is a failed backup waiting to be retried.
+type retryJob struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	AID     string             `bson:"aid"`
+	Year    int                `bson:"year"`
+	Months  []int              `bson:"months"`
+	Paths   []string           `bson:"paths"`
+	Flagged []string           `bson:"flagged,omitempty"`
+	// IdempotencyKey is the key of the failed run, kept for its retries.
+	IdempotencyKey string    `bson:"idempotency_key,omitempty"`
+	Attempts       int       `bson:"attempts"`
+	NextRetryAt    time.Time `bson:"next_retry_at"`
+	LastError      string    `bson:"last_error"`
+	CreatedAt      time.Time `bson:"created_at"`
+	UpdatedAt      time.Time `bson:"updated_at"`
+	// ErrorClass is the class of the storage error of the last attempt, if
+	// it failed with one (see classifyStorageError).
+	ErrorClass string `bson:"error_class,omitempty"`
+}
+
+// retryBackoff returns the delay before the next attempt, doubling the base
+// delay on every failed attempt.
+func retryBackoff(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < 24*time.Hour; i++ {
+		d *= 2
+	}
+	return d
+}
+
+// enqueueRetry persists a failed run so retry-due can process it later. A
+// pending job of the same agency and months is replaced.
+func enqueueRetry(ctx context.Context, conf Config, paths, flagged []string, runErr error) error {
+	if err := checkWritable(conf.ReadOnly, "persist retry jobs"); err != nil {
+		return err
+	}
+	months, err := runMonths(conf)
+	if err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoRetryColl)
+
+	now := time.Now().UTC()
+	_, err = coll.UpdateOne(ctx,
+		bson.M{"aid": conf.AID, "year": int(conf.Year), "months": months},
+		bson.M{
+			"$set": bson.M{
+				"paths":           paths,
+				"flagged":         flagged,
+				"idempotency_key": conf.IdempotencyKey,
+				"last_error":      runErr.Error(),
+				"error_class":     errorClass(runErr),
+				"next_retry_at":   now.Add(retryBackoff(conf.RetryQueueBackoff, 1)),
+				"updated_at":      now,
+			},
+			"$inc":         bson.M{"attempts": 1},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error persisting retry job(%s, %d, %v):%w", conf.AID, conf.Year, months, err)
+	}
+	return nil
+}
+
+// claimDueRetry hides one due job from concurrent retry-due runs and returns
+// it, or returns mongo.ErrNoDocuments when nothing is due.
+func claimDueRetry(ctx context.Context, coll *mongo.Collection, maxAttempts int) (retryJob, error) {
+	now := time.Now().UTC()
+	var job retryJob
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{"next_retry_at": bson.M{"$lte": now}, "attempts": bson.M{"$lt": maxAttempts}},
+		bson.M{"$set": bson.M{"next_retry_at": now.Add(retryClaimTTL)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"next_retry_at": 1})).Decode(&job)
+	return job, err
+}
+
+// jobConfig returns conf pointed at the job's agency and months.
+func jobConfig(conf Config, aid string, year int, months []int) Config {
+	conf.AID = aid
+	conf.Year = decInt(year)
+	conf.Month = decInt(months[0])
+	labels := make([]string, len(months))
+	for i, m := range months {
+		labels[i] = strconv.Itoa(m)
+	}
+	conf.Months = strings.Join(labels, ",")
+	return conf
+}
+
+// processDueRetries runs every due job once, returning how many succeeded
+// and failed. Successful jobs are removed, and their success notified, once
+// their records are written: by batch with RECORD_POLICY=version, by run
+// with the other policies (see batchedPolicy).
+func processDueRetries(ctx context.Context, conf Config, coll *mongo.Collection, batch *recordBatch) (int, int, error) {
+	var ok, failed int
+	for {
+		job, err := claimDueRetry(ctx, coll, conf.RetryQueueMaxAttempts)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ok, failed, batch.flush(ctx)
+		}
+		if err != nil {
+			return ok, failed, fmt.Errorf("error claiming retry job:%w", err)
+		}
+		jobConf := jobConfig(conf, job.AID, job.Year, job.Months)
+		jobConf.IdempotencyKey = job.IdempotencyKey
+		recs, runErr := run(ctx, jobConf, job.Paths, job.Flagged, nil, batch)
+		if runErr == nil {
+			ok++
+			job := job
+			done := func() error {
+				notifyBackup(ctx, jobConf, job.Paths, recs, nil)
+				if _, err := coll.DeleteOne(ctx, bson.M{"_id": job.ID}); err != nil {
+					return fmt.Errorf("error removing retry job(%s):%w", job.ID.Hex(), err)
+				}
+				log.Printf("Retry of %s %d/%s succeeded", job.AID, job.Year, monthsLabel(job.Months))
+				return nil
+			}
+			if batchedPolicy(jobConf.RecordPolicy) {
+				err = batch.add(ctx, recs, done)
+			} else {
+				// written by run.
+				err = done()
+			}
+			if err != nil {
+				return ok, failed, err
+			}
+			continue
+		}
+		notifyBackup(ctx, jobConf, job.Paths, recs, runErr)
+		failed++
+		attempts := job.Attempts + 1
+		log.Printf("Retry %d/%d of %s %d/%s failed: %v", attempts, conf.RetryQueueMaxAttempts, job.AID, job.Year, monthsLabel(job.Months), runErr)
+		now := time.Now().UTC()
+		_, err = coll.UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": bson.M{
+			"attempts":      attempts,
+			"last_error":    runErr.Error(),
+			"error_class":   errorClass(runErr),
+			"next_retry_at": now.Add(retryBackoff(conf.RetryQueueBackoff, attempts)),
+			"updated_at":    now,
+		}})
+		if err != nil {
+			return ok, failed, fmt.Errorf("error updating retry job(%s):%w", job.ID.Hex(), err)
+		}
+	}
+}
+
+// retryDueCmd processes the due retry jobs once, or every --every interval
+// when running as a daemon loop.
+func retryDueCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("retry-due", flag.ContinueOnError)
+	every := fs.Duration("every", 0, "keep running, processing due jobs at this interval")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkWritable(conf.ReadOnly, "process retry jobs"); err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoRetryColl)
+	if conf.BulkWriteSize < 1 {
+		return fmt.Errorf("BULK_WRITE_SIZE must be at least 1")
+	}
+	batch := &recordBatch{coll: db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl), size: conf.BulkWriteSize}
+	if conf.ChainLog {
+		batch.chain = db.Database(conf.MongoDBName).Collection(conf.MongoChainColl)
+	}
+	if conf.ObjectVersioning != "" {
+		batch.versions = db.Database(conf.MongoDBName).Collection(conf.MongoVersionsColl)
+	}
+
+	for {
+		ok, failed, err := processDueRetries(ctx, conf, coll, batch)
+		if err != nil {
+			return err
+		}
+		log.Printf("Processed retry jobs: %d succeeded, %d failed", ok, failed)
+		if *every == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*every):
+		}
+	}
+}
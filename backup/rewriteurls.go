@@ -0,0 +1,210 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rewriteURL returns url with the prefix from replaced by to, and whether
+// it had it.
+func rewriteURL(url, from, to string) (string, bool) {
+	if !strings.HasPrefix(url, from) {
+		return url, false
+	}
+	return to + strings.TrimPrefix(url, from), true
+}
+
+// rewriteRecordURLs replaces the prefix from of the URLs of the objects of
+// rec, and of the objects its replicas are copies of, returning the
+// rewritten objects.
+func rewriteRecordURLs(rec *Record, from, to string) []storage.Backup {
+	var changed []storage.Backup
+	rewrite := func(b *storage.Backup) {
+		var ok bool
+		if b.URL, ok = rewriteURL(b.URL, from, to); ok {
+			changed = append(changed, *b)
+		}
+	}
+	for i := range rec.Backups {
+		rewrite(&rec.Backups[i])
+	}
+	if rec.SHA256Sums != nil {
+		rewrite(rec.SHA256Sums)
+	}
+	if rec.Provenance != nil {
+		rewrite(rec.Provenance)
+	}
+	if rec.Manifest != nil {
+		rewrite(rec.Manifest)
+	}
+	if rec.Input != nil {
+		rewrite(rec.Input)
+	}
+	for i := range rec.BagIt {
+		rewrite(&rec.BagIt[i])
+	}
+	for i := range rec.Replicas {
+		rec.Replicas[i].Object, _ = rewriteURL(rec.Replicas[i].Object, from, to)
+	}
+	return changed
+}
+
+// rewriteURLsCmd replaces the --from prefix of the recorded URLs, as when
+// the provider moves its public endpoint, with --to, by default the storage
+// URL of the configured Swift account (picked from the catalog by
+// SWIFT_REGION, or SWIFT_STORAGEURL). A record is only updated once every
+// new URL of it resolves to an object with the recorded hash and size.
+func rewriteURLsCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("rewrite-urls", flag.ContinueOnError)
+	from := fs.String("from", "", "URL prefix to replace, e.g. the old storage URL")
+	to := fs.String("to", "", "new URL prefix (default: the storage URL of the configured account)")
+	agency := fs.String("aid", "", "only rewrite the records of this agency")
+	dryRun := fs.Bool("dry-run", false, "only verify and list the records that would be rewritten")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("usage: rewrite-urls --from prefix [--to prefix] [--aid aid] [--dry-run]")
+	}
+	if !*dryRun {
+		if err := checkWritable(conf.ReadOnly, "rewrite backup urls"); err != nil {
+			return err
+		}
+	}
+	cloud := newSwiftClient(conf)
+	if *to == "" {
+		if err := cloud.authenticate(ctx); err != nil {
+			return err
+		}
+		*to = cloud.conn.StorageUrl + "/"
+		if !strings.HasSuffix(*from, "/") {
+			*to = strings.TrimSuffix(*to, "/")
+		}
+	}
+	if *to == *from {
+		return fmt.Errorf("--from and --to are the same prefix (%s)", *from)
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+	coll := mdb.Collection(conf.MongoBackupColl)
+
+	filter := bson.M{}
+	if *agency != "" {
+		filter = splitAID(strings.ToLower(*agency), conf.AIDSeparator).filter()
+	}
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("error querying backup records:%w", err)
+	}
+	defer cur.Close(ctx)
+
+	log.Printf("Rewriting %s to %s", *from, *to)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECORD\tAID\tYEAR\tMONTH\tOBJECTS\tSTATUS")
+	// problems of the new URLs already checked, objects being shared by
+	// the records of runs covering several months.
+	checked := make(map[string]string)
+	var rewritten, failed int
+	for cur.Next(ctx) {
+		var rec Record
+		if err := cur.Decode(&rec); err != nil {
+			return fmt.Errorf("error decoding backup record:%w", err)
+		}
+		changed := rewriteRecordURLs(&rec, *from, *to)
+		if len(changed) == 0 {
+			continue
+		}
+		status := ""
+		for _, f := range rec.Files {
+			// only swift objects can be checked for now.
+			if f.Backend != "" && f.Backend != backendSwift {
+				status = "skipped: stored in another backend"
+			}
+		}
+		for _, b := range changed {
+			if status != "" {
+				break
+			}
+			problem, ok := checked[b.URL]
+			if !ok {
+				size := int64(-1)
+				for i, bk := range rec.Backups {
+					if bk.URL == b.URL && len(rec.Files) == len(rec.Backups) {
+						size = rec.Files[i].Bytes
+					}
+				}
+				s, want, got := verifyObject(ctx, cloud, b, size)
+				if s != "" {
+					problem = fmt.Sprintf("%s %s", s, b.URL)
+					if want != "" || got != "" {
+						problem += fmt.Sprintf(" (expected %s, got %s)", want, got)
+					}
+				}
+				checked[b.URL] = problem
+			}
+			if problem != "" {
+				status = "failed: " + problem
+			}
+		}
+		if status != "" {
+			failed++
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", rec.ID.Hex(), rec.agency(), rec.Year, rec.Month, len(changed), status)
+			continue
+		}
+		status = "would rewrite"
+		if !*dryRun {
+			set := bson.M{"backups": rec.Backups}
+			if rec.SHA256Sums != nil {
+				set["sha256sums"] = rec.SHA256Sums
+			}
+			if rec.Provenance != nil {
+				set["provenance"] = rec.Provenance
+			}
+			if len(rec.BagIt) > 0 {
+				set["bagit"] = rec.BagIt
+			}
+			if len(rec.Replicas) > 0 {
+				set["replicas"] = rec.Replicas
+			}
+			if _, err := coll.UpdateByID(ctx, rec.ID, bson.M{"$set": set}); err != nil {
+				return fmt.Errorf("error rewriting record(%s):%w", rec.ID.Hex(), err)
+			}
+			if conf.ChainLog {
+				if err := appendChain(ctx, mdb.Collection(conf.MongoChainColl), coll, rec.ID); err != nil {
+					return err
+				}
+			}
+			status = "rewritten"
+		}
+		rewritten++
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", rec.ID.Hex(), rec.agency(), rec.Year, rec.Month, len(changed), status)
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("error reading backup records:%w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	verb := "Rewrote"
+	if *dryRun {
+		verb = "Would rewrite"
+	}
+	log.Printf("%s the urls of %d records, %d failed verification or were skipped", verb, rewritten, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d record(s) were left unchanged", failed)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadDurationBuckets are the upper bounds, in seconds, of the buckets of
+// the upload duration histogram.
+var uploadDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// runMetrics collects what the uploads of the run in progress did, pushed
+// to METRICS_ENDPOINT when it ends.
+type runMetrics struct {
+	mu        sync.Mutex
+	started   time.Time
+	files     int
+	bytes     int64
+	durations []float64
+	// failures counts the failed upload attempts, retried or not.
+	failures int
+}
+
+// uploadStats is reset by every run and fed by retryUpload.
+var uploadStats = &runMetrics{started: time.Now()}
+
+func (m *runMetrics) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = time.Now()
+	m.files, m.bytes, m.durations, m.failures = 0, 0, nil, 0
+}
+
+// elapsed is how long the run in progress, or the latest one, has taken.
+func (m *runMetrics) elapsed() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Since(m.started)
+}
+
+func (m *runMetrics) uploaded(bytes int64, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files++
+	m.bytes += bytes
+	m.durations = append(m.durations, d.Seconds())
+}
+
+func (m *runMetrics) failed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures++
+}
+
+// write writes the metrics of the run in the Prometheus text exposition
+// format, success telling whether it succeeded.
+func (m *runMetrics) write(w io.Writer, success bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+	}
+	ok := 0.0
+	if success {
+		ok = 1
+	}
+	gauge("salvador_backup_run_success", "Whether the latest backup run of the agency succeeded.", ok)
+	gauge("salvador_backup_run_timestamp_seconds", "Unix time the latest backup run of the agency ended.", float64(time.Now().Unix()))
+	gauge("salvador_backup_run_duration_seconds", "Duration of the latest backup run of the agency.", time.Since(m.started).Seconds())
+	gauge("salvador_backup_run_files", "Files uploaded by the latest backup run of the agency.", float64(m.files))
+	gauge("salvador_backup_run_uploaded_bytes", "Bytes uploaded by the latest backup run of the agency.", float64(m.bytes))
+	gauge("salvador_backup_run_upload_failures", "Failed upload attempts of the latest backup run of the agency.", float64(m.failures))
+
+	const h = "salvador_backup_run_upload_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the uploads of the latest backup run of the agency, retries included.\n# TYPE %s histogram\n", h, h)
+	var sum float64
+	for _, d := range m.durations {
+		sum += d
+	}
+	for _, le := range uploadDurationBuckets {
+		n := 0
+		for _, d := range m.durations {
+			if d <= le {
+				n++
+			}
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h, le, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h, len(m.durations), h, sum, h, len(m.durations))
+}
+
+// pushRunMetrics PUTs the metrics of the run to the Pushgateway at
+// METRICS_ENDPOINT, grouped by METRICS_JOB and agency, replacing those of
+// its previous run.
+func pushRunMetrics(ctx context.Context, conf Config, runErr error) error {
+	var body bytes.Buffer
+	uploadStats.write(&body, runErr == nil)
+	agency := splitAID(conf.AID, conf.AIDSeparator)
+	target := fmt.Sprintf("%s/metrics/job/%s/aid/%s", strings.TrimRight(conf.MetricsEndpoint, "/"), url.PathEscape(conf.MetricsJob), url.PathEscape(agency.AID))
+	if agency.Sub != "" {
+		target += "/sub_aid/" + url.PathEscape(agency.Sub)
+	}
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, &body)
+	if err != nil {
+		return fmt.Errorf("error creating metrics request:%w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error pushing metrics(%s):%w", req.URL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error pushing metrics(%s): status %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
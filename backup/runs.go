@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+)
+
+// runDocument is what a run of the stage did, kept in MONGODB_RUNS_COLL
+// whether it succeeded or not, so the months attempted and failed leave a
+// trace in the database.
+type runDocument struct {
+	ID     string `bson:"_id" json:"id"`
+	AID    string `bson:"aid" json:"aid"`
+	SubAID string `bson:"sub_aid,omitempty" json:"sub_aid,omitempty"`
+	Year   int    `bson:"year" json:"year"`
+	Months []int  `bson:"months" json:"months"`
+	Status string `bson:"status" json:"status"`
+	Error  string `bson:"error,omitempty" json:"error,omitempty"`
+	// ErrorClass is the class of the storage error the run failed with, if
+	// it did storing files.
+	ErrorClass string `bson:"error_class,omitempty" json:"error_class,omitempty"`
+	// Files are the paths the run was given.
+	Files   []string             `bson:"files" json:"files"`
+	Records []primitive.ObjectID `bson:"records,omitempty" json:"records,omitempty"`
+	Bytes   int64                `bson:"bytes" json:"bytes"`
+	// IdempotencyKey is the key of the run, if it had one.
+	IdempotencyKey  string    `bson:"idempotency_key,omitempty" json:"idempotency_key,omitempty"`
+	StartedAt       time.Time `bson:"started_at" json:"started_at"`
+	EndedAt         time.Time `bson:"ended_at" json:"ended_at"`
+	DurationSeconds float64   `bson:"duration_seconds" json:"duration_seconds"`
+	Build           buildInfo `bson:"build" json:"build"`
+}
+
+const runsIndex = "aid_started_at"
+
+// newRunDocument describes the run runID of conf, started at started, that
+// backed up paths into recs or failed with runErr.
+func newRunDocument(conf Config, runID string, months []int, paths []string, started time.Time, recs []Record, runErr error) runDocument {
+	agency := splitAID(conf.AID, conf.AIDSeparator)
+	ended := time.Now().UTC()
+	doc := runDocument{
+		ID:              runID,
+		AID:             agency.AID,
+		SubAID:          agency.Sub,
+		Year:            int(conf.Year),
+		Months:          months,
+		Status:          runSucceeded,
+		Files:           paths,
+		IdempotencyKey:  conf.IdempotencyKey,
+		StartedAt:       started.UTC(),
+		EndedAt:         ended,
+		DurationSeconds: ended.Sub(started).Seconds(),
+		Build:           currentBuild(),
+	}
+	if runErr != nil {
+		doc.Status, doc.Error, doc.ErrorClass = runFailed, runErr.Error(), errorClass(runErr)
+	}
+	for _, r := range recs {
+		doc.Records = append(doc.Records, r.ID)
+		doc.Bytes += r.TotalBytes
+	}
+	return doc
+}
+
+// recordRun stores doc in coll, indexed by agency and start time for the
+// dashboards.
+func recordRun(ctx context.Context, coll *mongo.Collection, doc runDocument) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "aid", Value: 1}, {Key: "sub_aid", Value: 1}, {Key: "started_at", Value: -1}},
+		Options: options.Index().SetName(runsIndex),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating index(%s) of the runs:%w", runsIndex, err)
+	}
+	if _, err := coll.InsertOne(ctx, doc); err != nil {
+		return fmt.Errorf("error recording run(%s):%w", doc.ID, err)
+	}
+	return nil
+}
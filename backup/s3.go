@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryptions of S3_SSE.
+const (
+	// sseS3 encrypts objects with keys managed by S3.
+	sseS3 = "s3"
+	// sseKMS encrypts objects with a key of KMS.
+	sseKMS = "kms"
+)
+
+func checkS3SSE(mode, keyID string) error {
+	switch mode {
+	case "", sseS3, sseKMS:
+	default:
+		return fmt.Errorf("%q must be empty, %q or %q", mode, sseS3, sseKMS)
+	}
+	if keyID != "" && mode != sseKMS {
+		return fmt.Errorf("S3_SSE_KMS_KEY_ID needs S3_SSE=%s", sseKMS)
+	}
+	return nil
+}
+
+// s3Client stores the files of the stage in a bucket of S3 or an S3
+// compatible service such as MinIO.
+type s3Client struct {
+	client     *minio.Client
+	core       minio.Core
+	bucket     string
+	readOnly   bool
+	attempts   int
+	retryDelay time.Duration
+	timeout    time.Duration
+	// files bigger than partSize are uploaded in parts of (about) that
+	// size, checkpoints keeping how far their unfinished uploads got, see
+	// uploadMultipart. Streams of unknown size are buffered a part at a
+	// time.
+	partSize    byteSize
+	checkpoints map[string]*partCheckpoint
+	// sse encrypts the uploads at rest, nil without S3_SSE.
+	sse      encrypt.ServerSide
+	sseMode  string
+	sseKeyID string
+	// mu guards checkpoints, files being uploaded concurrently with
+	// BACKUP_CONCURRENCY.
+	mu sync.Mutex
+}
+
+// newS3Client connects to S3_ENDPOINT with the credentials of the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables or,
+// without them, of the AWS shared credentials file or, without it, the
+// ambient ones: the web identity of AWS_WEB_IDENTITY_TOKEN_FILE (IRSA), the
+// ECS task role or the EC2 instance role.
+func newS3Client(conf Config) (*s3Client, error) {
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	client, err := minio.New(conf.S3Endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    !conf.S3Insecure,
+		Region:    conf.AWSRegion,
+		Transport: countingTransport(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating s3 client(%s):%w", conf.S3Endpoint, err)
+	}
+	var sse encrypt.ServerSide
+	switch conf.S3SSE {
+	case sseS3:
+		sse = encrypt.NewSSE()
+	case sseKMS:
+		if sse, err = encrypt.NewSSEKMS(conf.S3SSEKMSKeyID, nil); err != nil {
+			return nil, fmt.Errorf("error configuring SSE-KMS(%s):%w", conf.S3SSEKMSKeyID, err)
+		}
+	}
+	return &s3Client{
+		client:      client,
+		core:        minio.Core{Client: client},
+		bucket:      conf.S3Bucket,
+		readOnly:    conf.ReadOnly,
+		attempts:    conf.UploadAttempts,
+		retryDelay:  conf.UploadRetryDelay,
+		timeout:     conf.UploadTimeout,
+		partSize:    conf.S3PartSize,
+		checkpoints: map[string]*partCheckpoint{},
+		sse:         sse,
+		sseMode:     conf.S3SSE,
+		sseKeyID:    conf.S3SSEKMSKeyID,
+	}, nil
+}
+
+func (c *s3Client) objectURL(name string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(c.client.EndpointURL().String(), "/"), c.bucket, name)
+}
+
+func (c *s3Client) put(ctx context.Context, name string, r io.Reader, size int64) (storage.Backup, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, err
+	}
+	info, err := c.client.PutObject(ctx, c.bucket, name, throttledUpload(ctx, r), size, minio.PutObjectOptions{PartSize: uint64(c.partSize), ServerSideEncryption: c.sse})
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error uploading object(%s/%s):%w", c.bucket, name, err)
+	}
+	return storage.Backup{URL: c.objectURL(name), Hash: info.ETag}, nil
+}
+
+func (c *s3Client) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	return c.put(ctx, name, r, -1)
+}
+
+func (c *s3Client) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for i, p := range paths {
+		b, f, err := retryUpload(ctx, c.attempts, c.retryDelay, c.timeout, names[i], func(ctx context.Context) (storage.Backup, FileEntry, error) {
+			return c.uploadFile(ctx, p, names[i])
+		})
+		if err != nil {
+			c.dropCheckpoint(context.Background(), names[i])
+			return backups, files, err
+		}
+		backups = append(backups, b)
+		files = append(files, f)
+	}
+	return backups, files, nil
+}
+
+func (c *s3Client) uploadFile(ctx context.Context, path, name string) (storage.Backup, FileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	entry := FileEntry{Name: name, Container: c.bucket, Bytes: fi.Size(), Backend: backendS3, SSE: c.sseMode, SSEKeyID: c.sseKeyID}
+	// hashed as it is read for the upload, sparing a pass over the file.
+	sum := newDigestWriter()
+	var b storage.Backup
+	if entry.Bytes > int64(c.partSize) {
+		// hashed part by part, to resume with the upload.
+		b, entry.SHA256, err = c.uploadMultipart(ctx, name, f, &entry)
+		return b, entry, err
+	}
+	b, err = c.put(ctx, name, io.TeeReader(f, sum), fi.Size())
+	if err == nil {
+		entry.SHA256, err = sum.check(path, entry.Bytes)
+	}
+	return b, entry, err
+}
+
+// discard deletes the object f was stored as.
+func (c *s3Client) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	if err := checkWritable(c.readOnly, "delete "+f.Name); err != nil {
+		return err
+	}
+	if err := c.client.RemoveObject(ctx, c.bucket, f.Name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("error deleting object(%s/%s):%w", c.bucket, f.Name, err)
+	}
+	return nil
+}
+
+// digest returns the SHA-256 and size of the object of b.
+func (c *s3Client) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	name := strings.TrimPrefix(b.URL, c.objectURL(""))
+	obj, err := c.client.GetObject(ctx, c.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("error downloading object(%s/%s):%w", c.bucket, name, err)
+	}
+	defer obj.Close()
+	w := newDigestWriter()
+	if _, err := buffers.copy(ctx, w, obj); err != nil {
+		return "", 0, fmt.Errorf("error downloading object(%s/%s):%w", c.bucket, name, err)
+	}
+	return w.sum(), w.n, nil
+}
+
+// ping checks the bucket exists.
+func (c *s3Client) ping(ctx context.Context) error {
+	ok, err := c.client.BucketExists(ctx, c.bucket)
+	if err != nil {
+		return fmt.Errorf("error reading bucket info(%s):%w (likely cause: %s)", c.bucket, err, diagnoseS3(err, c.bucket))
+	}
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", c.bucket)
+	}
+	return nil
+}
+
+// canary writes, reads back and deletes a tiny object.
+func (c *s3Client) canary(ctx context.Context, runID string) error {
+	name := ".canary/" + runID
+	content := []byte("salvador-backups canary " + time.Now().UTC().Format(time.RFC3339Nano))
+	if _, err := c.put(ctx, name, bytes.NewReader(content), int64(len(content))); err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseS3(err, c.bucket))
+	}
+	obj, err := c.client.GetObject(ctx, c.bucket, name, minio.GetObjectOptions{})
+	var got []byte
+	if err == nil {
+		got, err = io.ReadAll(obj)
+		obj.Close()
+	}
+	if rmErr := c.client.RemoveObject(ctx, c.bucket, name, minio.RemoveObjectOptions{}); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	if err != nil {
+		return fmt.Errorf("error running canary:%w (likely cause: %s)", err, diagnoseS3(err, c.bucket))
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("error running canary: object %s read back with different content", name)
+	}
+	return nil
+}
+
+// diagnoseS3 explains the likely cause of an S3 error.
+func diagnoseS3(err error, bucket string) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "network error (check connectivity to S3_ENDPOINT)"
+	}
+	var resp minio.ErrorResponse
+	errors.As(err, &resp)
+	switch resp.Code {
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+		return "authentication failed (check AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN)"
+	case "AccessDenied":
+		return fmt.Sprintf("access denied (check the policy of bucket %s)", bucket)
+	case "NoSuchBucket":
+		return fmt.Sprintf("bucket %s not found (check S3_BUCKET, S3_ENDPOINT and AWS_REGION)", bucket)
+	case "SlowDown":
+		return "rate limited by s3"
+	}
+	return "unexpected error"
+}
+
+// presign signs a link to get the object at url, valid for ttl, with the
+// credentials of the client.
+func (c *s3Client) presign(ctx context.Context, url string, ttl time.Duration) (string, error) {
+	name := strings.TrimPrefix(url, c.objectURL(""))
+	u, err := c.client.PresignedGetObject(ctx, c.bucket, name, ttl, nil)
+	if err != nil {
+		return "", fmt.Errorf("error presigning object(%s/%s):%w", c.bucket, name, err)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/minio/minio-go/v7"
+)
+
+// S3 refuses parts smaller than 5MiB, but the last one, and uploads of more
+// than 10000 parts.
+const (
+	s3PartMinSize = 5 << 20
+	s3MaxParts    = 10000
+)
+
+// partCheckpoint is how far the multipart upload of a file to S3 got, as
+// uploadCheckpoint is for Swift segments: the parts stored, up to offset,
+// and the state of the SHA-256 of the bytes before it.
+type partCheckpoint struct {
+	uploadID  string
+	partSize  int64
+	offset    int64
+	hashState []byte
+	parts     []minio.CompletePart
+}
+
+// s3PartSize is the size of the parts a file of size bytes is uploaded in:
+// the client's part size, grown for the parts to fit in an upload.
+func (c *s3Client) s3PartSize(size int64) int64 {
+	n := int64(c.partSize)
+	if least := (size + s3MaxParts - 1) / s3MaxParts; least > n {
+		n = least
+	}
+	return n
+}
+
+// uploadMultipart stores f as the object name, uploading it part by part,
+// and returns the SHA-256 of f along with the backup. Only a part at a time
+// is read, so memory doesn't grow with the file, and the upload is
+// checkpointed after every part, a new attempt only uploading and hashing
+// what is past the last checkpoint.
+func (c *s3Client) uploadMultipart(ctx context.Context, name string, f *os.File, entry *FileEntry) (storage.Backup, string, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, "", err
+	}
+	c.mu.Lock()
+	cp := c.checkpoints[name]
+	c.mu.Unlock()
+	if cp == nil {
+		id, err := c.core.NewMultipartUpload(ctx, c.bucket, name, minio.PutObjectOptions{ServerSideEncryption: c.sse})
+		if err != nil {
+			return storage.Backup{}, "", fmt.Errorf("error starting multipart upload(%s/%s):%w", c.bucket, name, err)
+		}
+		cp = &partCheckpoint{uploadID: id, partSize: c.s3PartSize(entry.Bytes)}
+		c.mu.Lock()
+		c.checkpoints[name] = cp
+		c.mu.Unlock()
+	}
+	sum := &digestWriter{h: sha256.New(), n: cp.offset}
+	if cp.hashState != nil {
+		if err := sum.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.hashState); err != nil {
+			return storage.Backup{}, "", fmt.Errorf("error restoring hash checkpoint(%s):%w", name, err)
+		}
+		log.Printf("Resuming upload of %s at byte %d of %d (part %d)", name, cp.offset, entry.Bytes, len(cp.parts)+1)
+	}
+	for cp.offset < entry.Bytes {
+		size := cp.partSize
+		if rest := entry.Bytes - cp.offset; rest < size {
+			size = rest
+		}
+		n := len(cp.parts) + 1
+		part, err := c.core.PutObjectPart(ctx, c.bucket, name, cp.uploadID, n, throttledUpload(ctx, io.TeeReader(io.NewSectionReader(f, cp.offset, size), sum)), size, "", "", nil)
+		if err != nil {
+			return storage.Backup{}, "", fmt.Errorf("error uploading part %d(%s/%s):%w", n, c.bucket, name, err)
+		}
+		if sum.n != cp.offset+size {
+			return storage.Backup{}, "", fmt.Errorf("file %s changed while read: %d bytes read, %d expected", f.Name(), sum.n, entry.Bytes)
+		}
+		state, err := sum.h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return storage.Backup{}, "", fmt.Errorf("error checkpointing hash(%s):%w", name, err)
+		}
+		cp.parts = append(cp.parts, minio.CompletePart{PartNumber: n, ETag: part.ETag})
+		cp.offset += size
+		cp.hashState = state
+	}
+	etag, err := c.core.CompleteMultipartUpload(ctx, c.bucket, name, cp.uploadID, cp.parts, minio.PutObjectOptions{})
+	if err != nil {
+		return storage.Backup{}, "", fmt.Errorf("error completing multipart upload(%s/%s):%w", c.bucket, name, err)
+	}
+	digest, err := sum.check(f.Name(), entry.Bytes)
+	if err != nil {
+		return storage.Backup{}, "", err
+	}
+	entry.Parts = len(cp.parts)
+	c.mu.Lock()
+	delete(c.checkpoints, name)
+	c.mu.Unlock()
+	return storage.Backup{URL: c.objectURL(name), Hash: etag}, digest, nil
+}
+
+// dropCheckpoint aborts the unfinished multipart upload of name, if any,
+// once it is given up, S3 keeping (and billing) its parts otherwise.
+func (c *s3Client) dropCheckpoint(ctx context.Context, name string) {
+	c.mu.Lock()
+	cp := c.checkpoints[name]
+	delete(c.checkpoints, name)
+	c.mu.Unlock()
+	if cp == nil {
+		return
+	}
+	if err := c.core.AbortMultipartUpload(ctx, c.bucket, name, cp.uploadID); err != nil {
+		warnings.warnf(warnPartialUpload, "error aborting multipart upload of %s:%v", name, err)
+	}
+}
@@ -0,0 +1,323 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const recordSchemaID = "https://github.com/dadosjusbr/salvador-backups/schemas/backup-record.json"
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) describing the
+// backup record, and checked by validate.
+type jsonSchema struct {
+	Schema     string                 `json:"$schema,omitempty"`
+	ID         string                 `json:"$id,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Type       schemaTypes            `json:"type,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+	Pattern    string                 `json:"pattern,omitempty"`
+	Minimum    *float64               `json:"minimum,omitempty"`
+	Maximum    *float64               `json:"maximum,omitempty"`
+	Items      *jsonSchema            `json:"items,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	// AdditionalProperties is false for structs, the schema of the values
+	// for maps.
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes is the type keyword, a single type unless null is allowed.
+type schemaTypes []string
+
+func (t schemaTypes) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+)
+
+// recordSchema describes Record as it is encoded to JSON, by the
+// stdout and file sinks and the export, its fields being required unless
+// omitted when empty. It is generated from the struct so it can't drift
+// from what is written.
+var recordSchema = func() *jsonSchema {
+	s := typeSchema(reflect.TypeOf(Record{}))
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.ID = recordSchemaID
+	s.Title = "salvador-backups backup record"
+	month := func(s *jsonSchema) {
+		lo, hi := 1.0, 12.0
+		s.Minimum, s.Maximum = &lo, &hi
+	}
+	month(s.Properties["month"])
+	month(s.Properties["months"].Items)
+	year := 1.0
+	s.Properties["year"].Minimum = &year
+	return s
+}()
+
+// schemaPatterns constrain the strings of the fields of these names,
+// wherever they are.
+var schemaPatterns = map[string]string{
+	"sha256": "^[0-9a-f]{64}$",
+}
+
+func typeSchema(t reflect.Type) *jsonSchema {
+	switch {
+	case t == timeType:
+		return &jsonSchema{Type: schemaTypes{"string"}, Format: "date-time"}
+	case t == objectIDType:
+		return patternSchema("^[0-9a-f]{24}$")
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(typeSchema(t.Elem()))
+	case reflect.String:
+		return &jsonSchema{Type: schemaTypes{"string"}}
+	case reflect.Bool:
+		return &jsonSchema{Type: schemaTypes{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: schemaTypes{"integer"}}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: schemaTypes{"number"}}
+	case reflect.Slice, reflect.Array:
+		return nullable(&jsonSchema{Type: schemaTypes{"array"}, Items: typeSchema(t.Elem())})
+	case reflect.Map:
+		return nullable(&jsonSchema{Type: schemaTypes{"object"}, AdditionalProperties: typeSchema(t.Elem())})
+	case reflect.Struct:
+		s := &jsonSchema{Type: schemaTypes{"object"}, Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if f.PkgPath != "" || tag == "-" {
+				continue
+			}
+			name := f.Name
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			omitEmpty := false
+			for _, o := range parts[1:] {
+				omitEmpty = omitEmpty || o == "omitempty"
+			}
+			p := typeSchema(f.Type)
+			if pattern, ok := schemaPatterns[name]; ok && f.Type.Kind() == reflect.String {
+				p = patternSchema(pattern)
+			}
+			if omitEmpty {
+				// omitted rather than null.
+				if len(p.Type) > 1 {
+					p.Type = p.Type[:1]
+				}
+			} else {
+				s.Required = append(s.Required, name)
+			}
+			s.Properties[name] = p
+		}
+		sort.Strings(s.Required)
+		return s
+	}
+	// interface{}: anything.
+	return &jsonSchema{}
+}
+
+func patternSchema(pattern string) *jsonSchema {
+	return &jsonSchema{Type: schemaTypes{"string"}, Pattern: pattern, pattern: regexp.MustCompile(pattern)}
+}
+
+func nullable(s *jsonSchema) *jsonSchema {
+	if len(s.Type) == 1 {
+		s.Type = append(s.Type, "null")
+	}
+	return s
+}
+
+// validate checks v, decoded with UseNumber, against s, returning the
+// first mismatch found with the path to it.
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		return fmt.Errorf("%s: %s is not %s", path, jsonKind(v), strings.Join(s.Type, " or "))
+	}
+	switch v := v.(type) {
+	case string:
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: %q doesn't match %s", path, v, s.Pattern)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, v)
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s: %s is below %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("%s: %s is above %v", path, v, *s.Maximum)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing %s", path, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := s.Properties[name]
+			if p == nil {
+				extra, ok := s.AdditionalProperties.(*jsonSchema)
+				if !ok {
+					if s.AdditionalProperties == false {
+						return fmt.Errorf("%s: unexpected %s", path, name)
+					}
+					continue
+				}
+				p = extra
+			}
+			if err := p.validate(v[name], path+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t schemaTypes) match(v interface{}) bool {
+	kind := jsonKind(v)
+	for _, want := range t {
+		if want == kind {
+			return true
+		}
+		if want == "number" && kind == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonKind is the JSON Schema type of v.
+func jsonKind(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// validateJSON checks the JSON document b against s.
+func (s *jsonSchema) validateJSON(b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return fmt.Errorf("error decoding record:%w", err)
+	}
+	return s.validate(v, "")
+}
+
+// checkRecordSchema checks rec against recordSchema before it is written, so
+// a change in its shape fails the run instead of the consumers.
+func checkRecordSchema(rec Record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error encoding record(%s, %d, %d):%w", rec.AID, rec.Year, rec.Month, err)
+	}
+	if err := recordSchema.validateJSON(b); err != nil {
+		return fmt.Errorf("record(%s, %d, %d) doesn't match its schema: %v", rec.AID, rec.Year, rec.Month, err)
+	}
+	return nil
+}
+
+// schemaCmd prints the JSON Schema of the backup record or, with --check,
+// validates JSON lines records, such as a METADATA_FILE, against it.
+func schemaCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ContinueOnError)
+	check := fs.String("check", "", "validate the JSON lines records of this file (- for stdin) instead of printing the schema")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *check == "" {
+		b, err := json.MarshalIndent(recordSchema, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding schema:%w", err)
+		}
+		_, err = fmt.Println(string(b))
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *check != "-" {
+		f, err := os.Open(*check)
+		if err != nil {
+			return fmt.Errorf("error opening records(%s):%w", *check, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	n, bad := 0, 0
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		n++
+		if err := recordSchema.validateJSON(sc.Bytes()); err != nil {
+			bad++
+			fmt.Printf("line %d: %v\n", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("error reading records(%s):%w", *check, err)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d records don't match the schema", bad, n)
+	}
+	fmt.Printf("%d records match the schema\n", n)
+	return nil
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// interrupt is how the stage learns it was asked to stop, by SIGINT or
+// SIGTERM (as Kubernetes does before killing a pod): the context of the run
+// is canceled, the upload in progress abandoned and the uploads of the run
+// rolled back, and the stage exits with exitCode. A second signal exits
+// right away.
+type interrupt struct {
+	mu  sync.Mutex
+	sig os.Signal
+}
+
+// notifyInterrupt returns a copy of parent canceled by the first SIGINT or
+// SIGTERM, stop undoing it.
+func notifyInterrupt(parent context.Context) (ctx context.Context, intr *interrupt, stop func()) {
+	ctx, cancel := context.WithCancel(parent)
+	intr = &interrupt{}
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			intr.mu.Lock()
+			intr.sig = sig
+			intr.mu.Unlock()
+			log.Printf("Warning: got %v, stopping the backup", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			removeWorkFiles()
+			log.Printf("Error: interrupted again by %v, exiting", sig)
+			os.Exit(exitCode(sig))
+		case <-done:
+		}
+	}()
+	return ctx, intr, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+// signal is the signal received, nil if none.
+func (i *interrupt) signal() os.Signal {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.sig
+}
+
+// exitCode is what shells report for a process killed by sig, 130 for
+// SIGINT and 143 for SIGTERM, so callers can tell an interrupted stage from
+// a failed one (1).
+func exitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// detachedContext keeps the values of its parent but never is done.
+type detachedContext struct{ parent context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// withGrace returns a context outliving parent by grace: once parent is done
+// (interrupted or past BACKUP_TIMEOUT) it is only canceled grace later, so
+// a run whose files are all stored can still write its records.
+func withGrace(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(detachedContext{parent})
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		log.Printf("Warning: finishing the backup, %s left (%v)", grace, parent.Err())
+		t := time.NewTimer(grace)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
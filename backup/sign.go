@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// signedURL is a temporary link to an object of a backup record.
+type signedURL struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// signRecord issues links to get every object of rec, valid for ttl: Swift
+// Temp-URLs, signed with the container key, or S3 presigned URLs for the
+// objects in S3_BUCKET. They give no access to anything else and hold no
+// credentials. Objects are named as restore would write them.
+func signRecord(ctx context.Context, conf Config, rec Record, ttl time.Duration) ([]signedURL, error) {
+	cloud := newSwiftClient(conf)
+	var s3 *s3Client
+	if conf.S3Bucket != "" {
+		c, err := newS3Client(conf)
+		if err != nil {
+			return nil, err
+		}
+		s3 = c
+	}
+	original, err := originalNames(ctx, cloud, rec)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	var urls []signedURL
+	for _, b := range rec.objects() {
+		var u, name string
+		if s3 != nil && strings.HasPrefix(b.URL, s3.objectURL("")) {
+			name = strings.TrimPrefix(b.URL, s3.objectURL(""))
+			if u, err = s3.presign(ctx, b.URL, ttl); err != nil {
+				return nil, err
+			}
+		} else {
+			if _, name, err = cloud.objectPath(ctx, b.URL); err != nil {
+				return nil, err
+			}
+			if u, err = cloud.tempURL(ctx, b.URL, http.MethodGet, ttl); err != nil {
+				return nil, err
+			}
+		}
+		urls = append(urls, signedURL{Name: restorePath(rec.objectPrefix(), original(name)), URL: u, Expires: expires})
+	}
+	return urls, nil
+}
+
+// signCmd prints temporary download links to the objects of one version of
+// a month's backup, e.g. for the public site to hand out the raw package.
+// Issuing them is logged as an access, beforehand.
+func signCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	m := monthFlags(fs, conf)
+	version := fs.String("version", "latest", "version to sign: latest or v1, v2, ...")
+	ttl := fs.Duration("ttl", conf.SignTTL, "how long the links are valid")
+	format := fs.String("format", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *ttl <= 0 {
+		return fmt.Errorf("--ttl must be positive")
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("--format must be table or json")
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+	recs, err := findVersions(ctx, mdb.Collection(conf.MongoBackupColl), m.aid(), m.year, m.month)
+	if err != nil {
+		return err
+	}
+	rec, err := pickVersion(recs, *version)
+	if err != nil {
+		return fmt.Errorf("error picking version(%s, %d, %d):%w", m.aid(), m.year, m.month, err)
+	}
+	e := accessEntry{
+		Action:   accessTempURL,
+		AID:      rec.AID,
+		SubAID:   rec.SubAID,
+		Year:     rec.Year,
+		Month:    rec.Month,
+		RecordID: rec.ID,
+		Detail:   fmt.Sprintf("%s for %s", http.MethodGet, *ttl),
+	}
+	for _, b := range rec.objects() {
+		e.Objects = append(e.Objects, b.URL)
+	}
+	if err := logAccess(ctx, conf, mdb.Collection(conf.MongoAccessColl), e); err != nil {
+		return err
+	}
+	urls, err := signRecord(ctx, conf, rec, *ttl)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, u := range urls {
+			if err := enc.Encode(u); err != nil {
+				return fmt.Errorf("error writing links:%w", err)
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tEXPIRES\tURL")
+	for _, u := range urls {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", u.Name, u.Expires.Format(time.RFC3339), u.URL)
+	}
+	return w.Flush()
+}
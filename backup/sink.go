@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	sinkMongo    = "mongo"
+	sinkStdout   = "stdout"
+	sinkFile     = "file"
+	sinkPostgres = "postgres"
+	// sinkNone keeps no records, for ad-hoc archival where only the objects
+	// matter, OUTPUT_FORMAT=json still telling where they are.
+	sinkNone = "none"
+)
+
+// checkMetadataSink validates METADATA_SINK against the features that need
+// the records to be in mongo.
+func checkMetadataSink(conf Config) error {
+	switch conf.MetadataSink {
+	case sinkMongo:
+		return nil
+	case sinkStdout, sinkNone:
+	case sinkFile:
+		if conf.MetadataFile == "" {
+			return fmt.Errorf("%q needs METADATA_FILE", conf.MetadataSink)
+		}
+	case sinkPostgres:
+		if conf.PostgresURI == "" {
+			return fmt.Errorf("%q needs POSTGRES_URI", conf.MetadataSink)
+		}
+		if !postgresTable.MatchString(conf.PostgresTable) {
+			return fmt.Errorf("invalid POSTGRES_TABLE %q: must be a lower case table name, optionally schema qualified", conf.PostgresTable)
+		}
+	default:
+		if _, ok := registeredStore(conf.MetadataSink); !ok {
+			return fmt.Errorf("%q must be %q, %q, %q, %q, %q or a registered store", conf.MetadataSink, sinkMongo, sinkStdout, sinkFile, sinkPostgres, sinkNone)
+		}
+	}
+	if conf.ChainLog {
+		return fmt.Errorf("%q can't be used with CHAIN_LOG", conf.MetadataSink)
+	}
+	if conf.ResultCache {
+		return fmt.Errorf("%q can't be used with RESULT_CACHE", conf.MetadataSink)
+	}
+	if conf.SkipUnchanged {
+		return fmt.Errorf("%q can't be used with SKIP_UNCHANGED", conf.MetadataSink)
+	}
+	if conf.RetryQueue {
+		return fmt.Errorf("%q can't be used with RETRY_QUEUE", conf.MetadataSink)
+	}
+	if conf.BackoffState {
+		return fmt.Errorf("%q can't be used with BACKOFF_STATE", conf.MetadataSink)
+	}
+	return nil
+}
+
+// storeRecords writes the records of a successful run to the file,
+// postgres or registered sinks; mongo records are inserted by run and
+// stdout ones printed once the input was passed through. The none sink
+// drops them.
+func storeRecords(ctx context.Context, conf Config, recs []Record) error {
+	switch conf.MetadataSink {
+	case sinkMongo, sinkStdout:
+		return nil
+	case sinkNone:
+		finishJournals(recs)
+		return nil
+	case sinkFile:
+		if err := appendRecords(conf.MetadataFile, recs); err != nil {
+			return withFailClass(failOutput, err)
+		}
+		finishJournals(recs)
+		return nil
+	case sinkPostgres:
+		if err := insertPostgres(ctx, conf.PostgresURI, conf.PostgresTable, recs); err != nil {
+			return withFailClass(failDatabase, err)
+		}
+		finishJournals(recs)
+		return nil
+	}
+	s, ok := registeredStore(conf.MetadataSink)
+	if !ok {
+		return fmt.Errorf("unknown METADATA_SINK %q", conf.MetadataSink)
+	}
+	if err := s.WriteRecords(ctx, recs); err != nil {
+		return withFailClass(failDatabase, fmt.Errorf("error writing records to %s:%w", conf.MetadataSink, err))
+	}
+	finishJournals(recs)
+	return nil
+}
+
+// writeRecords prints the delimiter line followed by every record as a JSON
+// line, so consumers can split them from the passed through input.
+func writeRecords(w io.Writer, delimiter string, recs []Record) error {
+	if _, err := fmt.Fprintln(w, delimiter); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("error encoding record(%s, %d, %d):%w", r.AID, r.Year, r.Month, err)
+		}
+	}
+	finishJournals(recs)
+	return nil
+}
+
+// appendRecords adds every record as a JSON line to the file at path,
+// creating it if needed, so the runs of an ad-hoc archival accumulate their
+// manifest without a database.
+func appendRecords(path string, recs []Record) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening metadata file(%s):%w", path, err)
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return fmt.Errorf("error encoding record(%s, %d, %d):%w", r.AID, r.Year, r.Month, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing metadata file(%s):%w", path, err)
+	}
+	return nil
+}
+
+// readRecordsFile reads the records appended to the file at path by
+// appendRecords, oldest first.
+func readRecordsFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening metadata file(%s):%w", path, err)
+	}
+	defer f.Close()
+	var recs []Record
+	dec := json.NewDecoder(f)
+	for {
+		var r Record
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding record %d of metadata file(%s):%w", len(recs)+1, path, err)
+		}
+		recs = append(recs, r)
+	}
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckMetadataSinkNone(t *testing.T) {
+	conf := testConfig(t)
+	conf.MetadataSink = sinkNone
+	if err := checkMetadataSink(conf); err != nil {
+		t.Errorf("METADATA_SINK=%s: %v", sinkNone, err)
+	}
+	conf.RetryQueue = true
+	if err := checkMetadataSink(conf); err == nil {
+		t.Errorf("METADATA_SINK=%s accepted with RETRY_QUEUE, which needs mongo", sinkNone)
+	}
+}
+
+func TestStageWithoutMetadataSink(t *testing.T) {
+	paths := writeTestFiles(t, "a.csv", "a,b\n1,2\n")
+	stdin := strings.Join(paths, "\n") + "\n"
+	out, code := runStage(t, []string{"METADATA_SINK=" + sinkNone, "METADATA_FILE="}, stdin)
+	if code != 0 || out != stdin {
+		t.Errorf("stage printed %q with status %d, want the input %q with status 0", out, code, stdin)
+	}
+}
+
+func TestReadConfigMetadataStore(t *testing.T) {
+	setEnv(t, "METADATA_SINK", "")
+	setEnv(t, "METADATA_BACKEND", "")
+	setEnv(t, "METADATA_STORE", sinkNone)
+	conf, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.MetadataSink != sinkNone {
+		t.Errorf("METADATA_SINK is %q with METADATA_STORE=%s, want %q", conf.MetadataSink, sinkNone, sinkNone)
+	}
+
+	setEnv(t, "METADATA_SINK", sinkMongo)
+	if conf, err = readConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !hasProblem(configProblems(conf), "METADATA_STORE") {
+		t.Errorf("METADATA_STORE=%s accepted with METADATA_SINK=%s", sinkNone, sinkMongo)
+	}
+}
+
+func TestStageMetadataStoreNone(t *testing.T) {
+	dir := t.TempDir()
+	records := filepath.Join(dir, "records.jsonl")
+	paths := writeTestFiles(t, "a.csv", "a,b\n1,2\n")
+	stdin := strings.Join(paths, "\n") + "\n"
+	out, code := runStage(t, []string{"METADATA_SINK", "METADATA_STORE=" + sinkNone, "METADATA_FILE=" + records, "LOCAL_DIR=" + filepath.Join(dir, "store")}, stdin)
+	if code != 0 || out != stdin {
+		t.Fatalf("stage printed %q with status %d, want the input %q with status 0", out, code, stdin)
+	}
+	if _, err := os.Stat(records); !os.IsNotExist(err) {
+		t.Errorf("METADATA_STORE=%s wrote records to %s (%v)", sinkNone, records, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "store", "trt1", "a.csv")); err != nil {
+		t.Errorf("file not backed up: %v", err)
+	}
+}
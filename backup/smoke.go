@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// smokeStep is a step of the smoke test and how it went.
+type smokeStep struct {
+	name   string
+	status string
+	took   time.Duration
+	detail string
+}
+
+// smokeConfig is conf pointed at a month of the test agency aid, without
+// what a test run can't undo or shouldn't trigger: retries, escrowed
+// records and the extra objects next to the files.
+func smokeConfig(conf Config, aid string, now time.Time) Config {
+	conf.AID = aid
+	conf.Year, conf.Month, conf.Months = decInt(now.Year()), decInt(now.Month()), ""
+	conf.IdempotencyKey = ""
+	conf.RetryQueue = false
+	conf.DryRun = false
+	conf.EscrowRecipients = nil
+	conf.EmitSHA256Sums = false
+	conf.EmitBagIt = false
+	conf.Provenance = false
+	conf.StoreInput = false
+	return conf
+}
+
+// smokeCmd runs a miniature backup cycle against the live configuration,
+// with a random file backed up for a dedicated test agency: the backup is
+// verified by downloading it, restored (files stored in swift only) and
+// compared to the original, and everything it stored is then deleted,
+// unless --keep. It prints how every step went and fails if any did,
+// meant to be run after every deployment.
+func smokeCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("smoke", flag.ContinueOnError)
+	aid := fs.String("aid", "smoke-test", "test agency the backup is made for")
+	size := fs.Int("size", 64<<10, "bytes of the test file")
+	keep := fs.Bool("keep", false, "keep what was backed up, and the test file, instead of cleaning up")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *size <= 0 {
+		return fmt.Errorf("invalid --size %d: must be positive", *size)
+	}
+	if err := checkWritable(conf.ReadOnly, "run the smoke test"); err != nil {
+		return err
+	}
+	conf = smokeConfig(conf, *aid, time.Now())
+
+	var steps []smokeStep
+	failed := false
+	step := func(name string, f func() (string, error)) {
+		if failed {
+			steps = append(steps, smokeStep{name: name, status: "skipped"})
+			return
+		}
+		start := time.Now()
+		detail, err := f()
+		s := smokeStep{name: name, status: "ok", took: time.Since(start), detail: detail}
+		if err != nil {
+			s.status, s.detail, failed = "failed", err.Error(), true
+		}
+		steps = append(steps, s)
+	}
+
+	dir, err := ioutil.TempDir("", "salvador-smoke-")
+	if err != nil {
+		return fmt.Errorf("error creating smoke test directory:%w", err)
+	}
+	if !*keep {
+		defer os.RemoveAll(dir)
+	}
+	content := make([]byte, *size)
+	path := filepath.Join(dir, "smoke-"+newRunID()+".bin")
+	step("generate", func() (string, error) {
+		if _, err := rand.Read(content); err != nil {
+			return "", fmt.Errorf("error generating test file:%w", err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return "", fmt.Errorf("error writing test file(%s):%w", path, err)
+		}
+		return fmt.Sprintf("%s, %d bytes", path, *size), nil
+	})
+
+	var recs []Record
+	step("backup", func() (string, error) {
+		var err error
+		if recs, err = run(ctx, conf, []string{path}, nil, nil, nil); err != nil {
+			return "", err
+		}
+		if len(recs) == 0 || len(recs[0].Backups) == 0 {
+			return "", fmt.Errorf("the run wrote no backup")
+		}
+		return fmt.Sprintf("%s %d/%02d, record %s, %s", conf.AID, conf.Year, conf.Month, recs[0].ID.Hex(), recs[0].Backups[0].URL), nil
+	})
+
+	backends := make(map[string]backuper)
+	backendOf := func(name string) (backuper, error) {
+		if name == "" {
+			name = backendSwift
+		}
+		if b, ok := backends[name]; ok {
+			return b, nil
+		}
+		b, err := newNamedBackuper(conf, name)
+		if err != nil {
+			return nil, err
+		}
+		backends[name] = b
+		return b, nil
+	}
+	step("verify", func() (string, error) {
+		n := 0
+		for _, rec := range recs {
+			for i, f := range rec.Files {
+				be, err := backendOf(f.Backend)
+				if err != nil {
+					return "", err
+				}
+				if err := verifyUploads(ctx, be, rec.Backups[i:i+1], rec.Files[i:i+1]); err != nil {
+					return "", err
+				}
+				n++
+			}
+		}
+		return fmt.Sprintf("%d objects downloaded and checked", n), nil
+	})
+
+	restored := filepath.Join(dir, "restored")
+	step("restore", func() (string, error) {
+		rec := recs[0]
+		for _, f := range rec.Files {
+			if f.Backend != "" && f.Backend != backendSwift {
+				return fmt.Sprintf("skipped, stored in %s: only swift backups are restored", f.Backend), nil
+			}
+		}
+		local := func(name string) (string, error) { return restored, nil }
+		if _, err := restoreFiles(ctx, newSwiftClient(conf), rec.Backups, recordFiles(rec), local, 1); err != nil {
+			return "", err
+		}
+		return restored, nil
+	})
+	step("compare", func() (string, error) {
+		got, err := ioutil.ReadFile(restored)
+		if errors.Is(err, os.ErrNotExist) {
+			return "skipped, nothing restored", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading restored file(%s):%w", restored, err)
+		}
+		if !bytes.Equal(got, content) {
+			return "", fmt.Errorf("restored file has %d bytes differing from the %d of the original", len(got), len(content))
+		}
+		return "restored file matches the original", nil
+	})
+
+	// cleaning up whatever was stored, even after a failed step.
+	if *keep {
+		steps = append(steps, smokeStep{name: "cleanup", status: "skipped", detail: "--keep"})
+	} else if len(recs) > 0 {
+		start := time.Now()
+		s := smokeStep{name: "cleanup", status: "ok"}
+		n, err := cleanupSmoke(ctx, conf, recs, backendOf)
+		s.took, s.detail = time.Since(start), fmt.Sprintf("%d objects deleted", n)
+		if conf.MetadataSink == sinkMongo {
+			s.detail += fmt.Sprintf(", with %d records", len(recs))
+		}
+		if err != nil {
+			s.status, s.detail, failed = "failed", err.Error(), true
+		}
+		steps = append(steps, s)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tTOOK\tDETAIL")
+	for _, s := range steps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.name, s.status, s.took.Round(time.Millisecond), s.detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("smoke test failed")
+	}
+	log.Printf("Smoke test passed")
+	return nil
+}
+
+// cleanupSmoke deletes the objects of recs, with their replicas, and the
+// records themselves when they are in mongo, returning how many objects it
+// deleted.
+func cleanupSmoke(ctx context.Context, conf Config, recs []Record, backendOf func(name string) (backuper, error)) (int, error) {
+	n := 0
+	for _, rec := range recs {
+		for i, f := range rec.Files {
+			be, err := backendOf(f.Backend)
+			if err != nil {
+				return n, err
+			}
+			if err := be.discard(ctx, rec.Backups[i], f); err != nil {
+				return n, err
+			}
+			n++
+			for _, r := range rec.Replicas {
+				if r.Object != rec.Backups[i].URL {
+					continue
+				}
+				be, err := backendOf(r.Backend)
+				if err != nil {
+					return n, err
+				}
+				// replicas are uploaded under the same name, to the
+				// configured container or bucket.
+				entry := FileEntry{Name: f.Name, Container: conf.SwiftContainer, Backend: r.Backend}
+				if err := be.discard(ctx, storage.Backup{URL: r.URL}, entry); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+	}
+	if conf.MetadataSink != sinkMongo {
+		return n, nil
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return n, fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+	for _, rec := range recs {
+		if _, err := mdb.Collection(conf.MongoBackupColl).DeleteOne(ctx, bson.M{"_id": rec.ID}); err != nil {
+			return n, fmt.Errorf("error deleting backup record(%s):%w", rec.ID.Hex(), err)
+		}
+		if rec.ObjectPrefix != "" {
+			if err := dropVersion(ctx, mdb.Collection(conf.MongoVersionsColl), rec.ID); err != nil {
+				return n, err
+			}
+		}
+		if conf.ChainLog {
+			if err := appendChainDeletion(ctx, mdb.Collection(conf.MongoChainColl), rec.ID); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
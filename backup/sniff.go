@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	sniffLen = 512
+
+	policyReject = "reject"
+	policyFlag   = "flag"
+)
+
+// sniffContentType returns a short content kind (csv, json, pdf, xlsx, ods,
+// xls, zip, html, xml, text or unknown) detected from the file contents. The
+// file extension is only used to break ties between text formats.
+func sniffContentType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("error reading file(%s):%w", path, err)
+	}
+	head = head[:n]
+
+	ct := http.DetectContentType(head)
+	switch {
+	case strings.HasPrefix(ct, "application/pdf"):
+		return "pdf", nil
+	case strings.HasPrefix(ct, "text/html"):
+		return "html", nil
+	case strings.HasPrefix(ct, "text/xml"):
+		return "xml", nil
+	case strings.HasPrefix(ct, "application/zip"):
+		return sniffZip(path)
+	case bytes.HasPrefix(head, []byte{0xD0, 0xCF, 0x11, 0xE0}):
+		// OLE2 compound document, used by legacy Excel spreadsheets.
+		return "xls", nil
+	case strings.HasPrefix(ct, "text/plain"):
+		return sniffText(path, head), nil
+	}
+	return "unknown", nil
+}
+
+// kindMIMETypes is the MIME type of the content kinds of sniffContentType.
+var kindMIMETypes = map[string]string{
+	"csv":  "text/csv",
+	"json": "application/json",
+	"pdf":  "application/pdf",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	"xls":  "application/vnd.ms-excel",
+	"zip":  "application/zip",
+	"html": "text/html",
+	"xml":  "application/xml",
+	"text": "text/plain",
+}
+
+// mimeType returns the MIME type of the file at path, detected from its
+// contents by sniffContentType, or from its extension when its kind is
+// unknown.
+func mimeType(path string) (string, error) {
+	kind, err := sniffContentType(path)
+	if err != nil {
+		return "", err
+	}
+	if t, ok := kindMIMETypes[kind]; ok {
+		return t, nil
+	}
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// sniffZip tells apart office documents, which are zip containers, from plain
+// zip archives.
+func sniffZip(path string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		// Looked like a zip but has no valid central directory.
+		return "unknown", nil
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, "xl/") {
+			return "xlsx", nil
+		}
+		if f.Name == "mimetype" {
+			rc, err := f.Open()
+			if err != nil {
+				return "", fmt.Errorf("error reading zip member(%s:%s):%w", path, f.Name, err)
+			}
+			mt, err := io.ReadAll(io.LimitReader(rc, 128))
+			rc.Close()
+			if err != nil {
+				return "", fmt.Errorf("error reading zip member(%s:%s):%w", path, f.Name, err)
+			}
+			if string(mt) == "application/vnd.oasis.opendocument.spreadsheet" {
+				return "ods", nil
+			}
+		}
+	}
+	return "zip", nil
+}
+
+func sniffText(path string, head []byte) string {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return "json"
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return "csv"
+	}
+	firstLine := trimmed
+	if i := bytes.IndexByte(trimmed, '\n'); i >= 0 {
+		firstLine = trimmed[:i]
+	}
+	if bytes.ContainsAny(firstLine, ",;\t") {
+		return "csv"
+	}
+	return "text"
+}
+
+// checkContentTypes sniffs every path and returns the ones whose content kind
+// is not in the allowlist, mapped to the detected kind. An empty allowlist
+// disables the check.
+func checkContentTypes(paths []string, allowlist []string) (map[string]string, error) {
+	if len(allowlist) == 0 {
+		return nil, nil
+	}
+	allowed := make(map[string]bool, len(allowlist))
+	for _, k := range allowlist {
+		allowed[strings.ToLower(strings.TrimSpace(k))] = true
+	}
+	unexpected := make(map[string]string)
+	for _, p := range paths {
+		kind, err := sniffContentType(p)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed[kind] {
+			unexpected[p] = kind
+		}
+	}
+	return unexpected, nil
+}
+
+// applyContentTypePolicy checks paths against CONTENT_TYPE_ALLOWLIST,
+// failing on unexpected files under the reject policy and returning them,
+// sorted, under the flag policy, and validates them with VALIDATE_FILES as
+// VALIDATION_POLICY says. Being strict, flagged files fail too.
+func applyContentTypePolicy(conf Config, paths []string) ([]string, error) {
+	since := warnings.count()
+	unexpected, err := checkContentTypes(paths, conf.ContentTypeAllowlist)
+	if err != nil {
+		return nil, fmt.Errorf("error checking content types:%w", err)
+	}
+	var flagged []string
+	for p, kind := range unexpected {
+		if conf.ContentTypePolicy == policyReject {
+			return nil, withFailClass(failInvalidFile, fmt.Errorf("file %s has unexpected content type %q (allowed: %v)", p, kind, conf.ContentTypeAllowlist))
+		}
+		warnings.warnf(warnContentType, "file %s has unexpected content type %q (allowed: %v)", p, kind, conf.ContentTypeAllowlist)
+		flagged = append(flagged, p)
+	}
+	if conf.ValidateFiles {
+		invalid, err := validateFiles(paths)
+		if err != nil {
+			return nil, fmt.Errorf("error validating files:%w", err)
+		}
+		for p, problem := range invalid {
+			if conf.ValidationPolicy == policyReject {
+				return nil, withFailClass(failInvalidFile, fmt.Errorf("file %s %s", p, problem))
+			}
+			warnings.warnf(warnInvalidFile, "file %s %s", p, problem)
+			if _, ok := unexpected[p]; !ok {
+				flagged = append(flagged, p)
+			}
+		}
+	}
+	if err := warnings.strictErr(since); err != nil {
+		return nil, err
+	}
+	sort.Strings(flagged)
+	return flagged, nil
+}
@@ -0,0 +1,1304 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mgoConnTimeout = 60 * time.Second
+)
+
+// O tipo decInt é necessário pois a biblioteca converte usando ParseInt passando
+// zero na base. Ou seja, meses como 08 passam a ser inválidos pois são tratados
+// como números octais.
+type decInt int
+
+func (i *decInt) Decode(value string) error {
+	v, err := strconv.Atoi(value)
+	*i = decInt(v)
+	return err
+}
+
+type Config struct {
+	Month decInt `envconfig:"MONTH"`
+	// MONTHS covers several months in a single run (e.g. "1-12" for annual
+	// archives), writing one record per month. It takes precedence over MONTH.
+	Months string `envconfig:"MONTHS"`
+	Year   decInt `envconfig:"YEAR"`
+	AID    string `envconfig:"AID"`
+	// Splits composite AIDs (e.g. "/" for mpf/prr1) into the aid and sub_aid
+	// record fields, nesting the sub-agency objects under the agency's.
+	AIDSeparator string `envconfig:"AID_SEPARATOR"`
+	// Directory with per-agency overlays, <aid>.env files whose KEY=VALUE
+	// lines are applied over the environment, e.g. to use another
+	// container for an agency.
+	ConfigOverlayDir string `envconfig:"CONFIG_OVERLAY_DIR"`
+	// Format of stdin: paths, one per line, coleta-json, the ResultadoColeta
+	// JSON of the pipeline, or pipeline-proto and pipeline-prototext, its
+	// ResultadoExecucao protobuf (see envelope.go). The agency, year and
+	// month of the collection are used where AID, YEAR and MONTH are not set
+	// (a run fails when they are set to something else). Overlays only apply
+	// with the AID variable. The input is passed through unchanged.
+	InputFormat string `envconfig:"INPUT_FORMAT" default:"paths"`
+	// Input directories are replaced by the files under them, and glob
+	// patterns (out/*.csv) by what they match, leaving out the files and
+	// directories whose name or path matches one of INPUT_EXCLUDE. Links
+	// found in directories are followed with INPUT_FOLLOW_SYMLINKS, skipped
+	// otherwise. NAME_COLLISION=path keeps the tree of nested files.
+	InputExclude        []string `envconfig:"INPUT_EXCLUDE"`
+	InputFollowSymlinks bool     `envconfig:"INPUT_FOLLOW_SYMLINKS"`
+
+	// Backup URL store
+	MongoURI        string `envconfig:"MONGODB_URI" secret:"uri"`
+	MongoDBName     string `envconfig:"MONGODB_DBNAME"`
+	MongoBackupColl string `envconfig:"MONGODB_BCOLL"`
+	// Where backup records go: mongo, stdout to print them as JSON lines
+	// after the passed through input and a METADATA_DELIMITER line, file,
+	// postgres or none, not keeping them.
+	MetadataSink      string `envconfig:"METADATA_SINK" default:"mongo"`
+	MetadataDelimiter string `envconfig:"METADATA_DELIMITER" default:"---"`
+	// METADATA_BACKEND is another name of METADATA_SINK, used when
+	// METADATA_SINK isn't set.
+	MetadataBackend string `envconfig:"METADATA_BACKEND"`
+	// METADATA_STORE is one more, METADATA_BACKEND taking precedence, as in
+	// METADATA_STORE=none for archiving without a database.
+	MetadataStore string `envconfig:"METADATA_STORE"`
+	// With METADATA_SINK=file, no database is used either: records are
+	// appended to METADATA_FILE as JSON lines.
+	MetadataFile string `envconfig:"METADATA_FILE"`
+	// With METADATA_SINK=postgres, records are inserted into POSTGRES_TABLE
+	// of the database at POSTGRES_URI, one row per file (aid, year, month,
+	// url, hash, size, created_at), instead of mongo.
+	PostgresURI   string `envconfig:"POSTGRES_URI" secret:"uri"`
+	PostgresTable string `envconfig:"POSTGRES_TABLE" default:"backups"`
+	// What the stage prints: passthrough, its input as is, or json, the
+	// input paths with the URL, hashes and size of their backups and the
+	// records written (see output.go), then no METADATA_SINK=stdout lines.
+	OutputFormat string `envconfig:"OUTPUT_FORMAT" default:"passthrough"`
+
+	// Token set by the orchestrator for a job. A run whose key already has
+	// records returns them instead of uploading the files again.
+	IdempotencyKey string `envconfig:"IDEMPOTENCY_KEY"`
+	// Skip runs whose input (the path list and the content of every file)
+	// is the one of the latest backup of every month, returning its
+	// records instead, as when the orchestrator retries downstream stages.
+	ResultCache bool `envconfig:"RESULT_CACHE"`
+	// With PREVIEW=true the record keeps a preview of every file: the first
+	// PREVIEW_ROWS rows of csvs, the pages of pdfs and the members of zip
+	// and tar archives, shown by "list --previews".
+	Preview     bool `envconfig:"PREVIEW"`
+	PreviewRows int  `envconfig:"PREVIEW_ROWS" default:"5"`
+	// Skip runs whose files (by object name and content, wherever they are
+	// read from) are those of the latest backup of every month, returning
+	// its records instead.
+	SkipUnchanged bool `envconfig:"SKIP_UNCHANGED"`
+	// What a run does when its month already has a record (see
+	// recordpolicy.go): version keeps both, replace overwrites it, append
+	// adds the new files to it, merge only those with a hash it doesn't
+	// have and fail refuses the run. Every policy but version keeps a
+	// unique index on (aid, sub_aid, year, month).
+	RecordPolicy string `envconfig:"RECORD_POLICY" default:"version"`
+	// With OBJECT_VERSIONING the objects of a run are named under
+	// <aid>/<version>, the run start time (timestamp) or its id (run),
+	// instead of overwriting those of earlier runs of the month. The
+	// versions of every month are also listed in MONGODB_VERSIONSCOLL, with
+	// a pointer to the latest one. It needs RECORD_POLICY=version.
+	ObjectVersioning  string `envconfig:"OBJECT_VERSIONING"`
+	MongoVersionsColl string `envconfig:"MONGODB_VERSIONSCOLL" default:"backup_versions"`
+	// What a run does with the files it uploaded when another upload fails
+	// (see partial.go): rollback deletes them, record writes the records of
+	// the run with them, flagged incomplete, before failing. record needs
+	// METADATA_SINK=mongo and RECORD_POLICY=version; retried runs always
+	// roll back.
+	PartialFailurePolicy string `envconfig:"PARTIAL_FAILURE_POLICY" default:"rollback"`
+
+	// Refuse every mutating operation (uploads, deletions and metadata
+	// writes), so audits can run with production credentials.
+	ReadOnly bool `envconfig:"READ_ONLY"`
+
+	// Concurrent-run locking. A second run for the same (aid, year, month)
+	// waits up to LOCK_WAIT for the lease (zero fails fast), then fails as
+	// in_progress or, with LOCK_HELD_POLICY=exit, exits cleanly: neither is
+	// queued for retry.
+	MongoLockColl  string        `envconfig:"MONGODB_LOCKCOLL" default:"backup_locks"`
+	LockTTL        time.Duration `envconfig:"LOCK_TTL" default:"30m"`
+	LockWait       time.Duration `envconfig:"LOCK_WAIT" default:"0s"`
+	LockHeldPolicy string        `envconfig:"LOCK_HELD_POLICY" default:"fail"`
+
+	// Files are uploaded BACKUP_CONCURRENCY at a time, in any order, their
+	// backups being kept in the order of the files. Once one fails no
+	// other is started and the error lists every file that failed.
+	BackupConcurrency int `envconfig:"BACKUP_CONCURRENCY" default:"1"`
+
+	// A run taking longer than BACKUP_TIMEOUT (zero never) is stopped as
+	// when the stage gets SIGTERM: the upload in progress is abandoned and
+	// the files uploaded are rolled back, unless they all were, in which
+	// case the run gets SHUTDOWN_GRACE to write its records. An interrupted
+	// stage exits with 128 plus the signal number (143 for SIGTERM).
+	BackupTimeout time.Duration `envconfig:"BACKUP_TIMEOUT" default:"0s"`
+	ShutdownGrace time.Duration `envconfig:"SHUTDOWN_GRACE" default:"20s"`
+
+	// Retry queue. Failed runs are persisted and processed by retry-due,
+	// waiting RETRY_QUEUE_BACKOFF (doubled on every failure) between attempts.
+	RetryQueue            bool          `envconfig:"RETRY_QUEUE"`
+	MongoRetryColl        string        `envconfig:"MONGODB_RETRYCOLL" default:"backup_retries"`
+	RetryQueueMaxAttempts int           `envconfig:"RETRY_QUEUE_MAX_ATTEMPTS" default:"5"`
+	RetryQueueBackoff     time.Duration `envconfig:"RETRY_QUEUE_BACKOFF" default:"10m"`
+	// retry-due writes the records of its jobs in bulk operations of up to
+	// BULK_WRITE_SIZE records.
+	BulkWriteSize int `envconfig:"BULK_WRITE_SIZE" default:"100"`
+
+	// Where files are stored: swift, s3 for S3 and S3 compatible services
+	// (see S3 Conf), azure for Azure Blob Storage (see Azure Conf), gcs for
+	// Google Cloud Storage (see GCS Conf), or local, copying them under
+	// LOCAL_DIR for development and offline testing. Restores, the janitor and temp urls are Swift
+	// only. With more than one (swift,s3) every file goes to one of them,
+	// picked by how fast they answer a probe repeated every
+	// BACKEND_PROBE_INTERVAL.
+	StorageBackend       []string      `envconfig:"STORAGE_BACKEND" default:"swift"`
+	BackendProbeInterval time.Duration `envconfig:"BACKEND_PROBE_INTERVAL" default:"5m"`
+	// Every object is also copied to each of MIRROR_BACKENDS (swift, s3,
+	// azure, gcs or local, not among STORAGE_BACKEND), the record listing the URLs of the
+	// copies. A failed copy fails the run with MIRROR_FAILURE_POLICY=fail,
+	// or is a warning with warn.
+	MirrorBackends      []string `envconfig:"MIRROR_BACKENDS"`
+	MirrorFailurePolicy string   `envconfig:"MIRROR_FAILURE_POLICY" default:"fail"`
+
+	// Connections to the storage backends and mongo go through the SOCKS5
+	// proxy at ALL_PROXY (socks5://[user:password@]host:port), but those to
+	// the hosts, domains and networks in NO_PROXY (comma separated).
+	// HTTP_PROXY and HTTPS_PROXY still apply to storage requests, the HTTP
+	// proxy being reached through the SOCKS5 one.
+	AllProxy string `envconfig:"ALL_PROXY" secret:"uri"`
+	NoProxy  string `envconfig:"NO_PROXY"`
+
+	// Swift Conf
+	SwiftUsername  string `envconfig:"SWIFT_USERNAME"`
+	SwiftAPIKey    string `envconfig:"SWIFT_APIKEY" secret:"true"`
+	SwiftAuthURL   string `envconfig:"SWIFT_AUTHURL"`
+	SwiftDomain    string `envconfig:"SWIFT_DOMAIN"`
+	SwiftContainer string `envconfig:"SWIFT_CONTAINER"`
+	// Auth protocol: 1 for v1/tempauth endpoints (as in Swift-all-in-one,
+	// SWIFT_USERNAME being "account:user"), 2 or 3 for Keystone. 0 picks it
+	// from SWIFT_AUTHURL.
+	SwiftAuthVersion int `envconfig:"SWIFT_AUTH_VERSION"`
+	// Region used to pick the storage endpoint from the Keystone catalog. If
+	// SWIFT_STORAGEURL is set it is used instead of the catalog endpoint.
+	SwiftRegion     string `envconfig:"SWIFT_REGION"`
+	SwiftStorageURL string `envconfig:"SWIFT_STORAGEURL"`
+	// S3 Conf. Credentials are read from AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the AWS shared
+	// credentials file or are the ambient ones of IRSA, the ECS task or the
+	// EC2 instance. S3_INSECURE talks plain http, e.g. to a local MinIO.
+	S3Endpoint string `envconfig:"S3_ENDPOINT" default:"s3.amazonaws.com"`
+	S3Bucket   string `envconfig:"S3_BUCKET"`
+	S3Insecure bool   `envconfig:"S3_INSECURE"`
+	AWSRegion  string `envconfig:"AWS_REGION"`
+	// S3 files bigger than S3_PART_SIZE are uploaded in parts of that size
+	// (bigger for files of more than 10000 parts), a failed or timed out
+	// attempt resuming the upload, and the hashing, from the last stored
+	// part. Uploads of unknown size hold a part in memory at a time.
+	S3PartSize byteSize `envconfig:"S3_PART_SIZE" default:"64M"`
+	// S3_SSE has S3 encrypt the objects at rest: s3 with keys managed by
+	// S3 (SSE-S3), kms with the KMS key S3_SSE_KMS_KEY_ID or, without it,
+	// the default key of the bucket (SSE-KMS).
+	S3SSE         string `envconfig:"S3_SSE"`
+	S3SSEKMSKeyID string `envconfig:"S3_SSE_KMS_KEY_ID"`
+	// Azure Conf. Credentials are read from AZURE_STORAGE_CONNECTION_STRING
+	// or AZURE_STORAGE_ACCOUNT with AZURE_STORAGE_KEY or
+	// AZURE_STORAGE_SAS_TOKEN. Blobs are uploaded in blocks of 8MiB, each
+	// one checked by the service against its MD5. AZURE_BLOB_ENDPOINT
+	// overrides the account's endpoint, e.g. with a local Azurite.
+	// AZURE_MANAGED_IDENTITY authenticates with the identity of the host
+	// (an Azure managed identity, AZURE_CLIENT_ID picking a user-assigned
+	// one, or AKS workload identity) instead, as is done without a key or
+	// SAS token.
+	AzureContainer       string `envconfig:"AZURE_CONTAINER"`
+	AzureEndpoint        string `envconfig:"AZURE_BLOB_ENDPOINT"`
+	AzureManagedIdentity bool   `envconfig:"AZURE_MANAGED_IDENTITY"`
+	// GCS Conf. Credentials are the application default ones
+	// (GOOGLE_APPLICATION_CREDENTIALS, gcloud or the metadata server);
+	// STORAGE_EMULATOR_HOST talks to an emulator instead. Objects whose
+	// CRC32C doesn't match the one of what was sent are deleted and
+	// uploaded again.
+	GCSBucket string `envconfig:"GCS_BUCKET"`
+	// STORAGE_BACKEND=local lays objects out as LOCAL_DIR/<SWIFT_CONTAINER>/
+	// <object name> (LOCAL_DIR/<object name> with no container set), the
+	// records having file:// URLs.
+	LocalDir string `envconfig:"LOCAL_DIR"`
+	// Links issued by "sign" are valid for SIGN_TTL, unless its --ttl says
+	// otherwise.
+	SignTTL time.Duration `envconfig:"SIGN_TTL" default:"1h"`
+	// Route big files to other containers, e.g. "1G=backups-cold" sends
+	// files of 1GB or more to backups-cold. The container of every file is
+	// kept in the record.
+	SizeTiers sizeTiers `envconfig:"SIZE_TIERS"`
+	// Store files bigger than 1MiB as Static Large Object manifests of
+	// content-defined chunks kept in CHUNK_CONTAINER, uploading only the
+	// chunks not stored yet, so near-identical archives of consecutive
+	// months share most of their content. Deleting a backup leaves its
+	// chunks in place, as other backups may use them.
+	ChunkContainer string `envconfig:"CHUNK_CONTAINER"`
+	// With PACKAGE_MODE=targz the files of a run are uploaded as a single
+	// <aid>-<year>-<months>-<start time>.tar.gz archive, the record listing
+	// its members.
+	PackageMode string `envconfig:"PACKAGE_MODE"`
+	// Files are encrypted with BACKUP_ENCRYPTION_KEY (32 bytes, hex or
+	// base64 encoded) before upload when it is set, restores decrypting
+	// them with the same key.
+	EncryptionKey string `envconfig:"BACKUP_ENCRYPTION_KEY" secret:"true"`
+	// Files are scanned before upload by the clamd at CLAMD_ADDR (host:port,
+	// or the path of its unix socket), the verdicts stored in the records.
+	// Infected files fail the run with CLAMD_POLICY=fail, are left out of
+	// the backup with skip, and are also moved to CLAMD_QUARANTINE_DIR with
+	// quarantine.
+	ClamdAddr          string        `envconfig:"CLAMD_ADDR"`
+	ClamdPolicy        string        `envconfig:"CLAMD_POLICY" default:"fail"`
+	ClamdQuarantineDir string        `envconfig:"CLAMD_QUARANTINE_DIR"`
+	ClamdTimeout       time.Duration `envconfig:"CLAMD_TIMEOUT" default:"5m"`
+	// With OBJECT_LAYOUT=content files are stored under
+	// objects/sha256/<their SHA-256>, a file with the content of another
+	// one being stored once, and every run uploads a manifest mapping its
+	// original names to the objects, restores reading names back from it.
+	// With the mongo sink, content any record (of any agency) already
+	// refers to isn't uploaded again, its file entry being marked
+	// deduplicated.
+	ObjectLayout string `envconfig:"OBJECT_LAYOUT" default:"name"`
+	// KEY_TEMPLATE, a text/template, names the objects of the files instead,
+	// e.g. {{.Agency}}/{{.Year}}/{{.Month}}/{{.Filename}}-{{.Timestamp}}
+	// (see keyData for the fields). The records keep it, and every file
+	// entry the name the file would otherwise have had, restores placing
+	// files by that name.
+	KeyTemplate string `envconfig:"KEY_TEMPLATE"`
+	// Failed uploads of a file are retried up to UPLOAD_ATTEMPTS times in
+	// total, waiting UPLOAD_RETRY_DELAY (doubled every time) in between.
+	// Permanent errors, such as failed authentication, aren't retried.
+	UploadAttempts   int           `envconfig:"UPLOAD_ATTEMPTS" default:"3"`
+	UploadRetryDelay time.Duration `envconfig:"UPLOAD_RETRY_DELAY" default:"2s"`
+	// Every upload attempt of a file is abandoned after UPLOAD_TIMEOUT
+	// (zero never), and retried. Swift files bigger than SEGMENT_SIZE go to
+	// SEGMENT_CONTAINER as segments of that size behind a Static Large
+	// Object manifest, a failed or timed out attempt resuming the upload,
+	// and the hashing, from the last stored segment.
+	UploadTimeout    time.Duration `envconfig:"UPLOAD_TIMEOUT" default:"0s"`
+	SegmentContainer string        `envconfig:"SEGMENT_CONTAINER"`
+	SegmentSize      byteSize      `envconfig:"SEGMENT_SIZE" default:"100M"`
+	// Within an attempt, Swift authentications are given up after
+	// SWIFT_AUTH_TIMEOUT, so a hung Keystone endpoint fails fast. Requests
+	// wait up to SWIFT_FIRST_BYTE_TIMEOUT to connect and start moving data,
+	// then abort when no data moves for SWIFT_STALL_TIMEOUT, however long
+	// the transfer takes as a whole. Authentications redone by a request
+	// whose token expired are bounded by SWIFT_FIRST_BYTE_TIMEOUT.
+	SwiftAuthTimeout      time.Duration `envconfig:"SWIFT_AUTH_TIMEOUT" default:"10s"`
+	SwiftFirstByteTimeout time.Duration `envconfig:"SWIFT_FIRST_BYTE_TIMEOUT" default:"10s"`
+	SwiftStallTimeout     time.Duration `envconfig:"SWIFT_STALL_TIMEOUT" default:"60s"`
+	// Backup record writes failing on network errors or timeouts are
+	// retried the same way.
+	MongoWriteAttempts int           `envconfig:"MONGODB_WRITE_ATTEMPTS" default:"3"`
+	MongoRetryDelay    time.Duration `envconfig:"MONGODB_RETRY_DELAY" default:"1s"`
+	// Every retry delay is spread randomly by up to RETRY_JITTER of it
+	// either way (0.2 is ±20%).
+	RetryJitter float64 `envconfig:"RETRY_JITTER" default:"0.2"`
+	// With BACKOFF_STATE=true how the latest run of an agency failed
+	// uploading is kept in MONGODB_BACKOFFCOLL, for when the orchestrator
+	// retries the stage: a run retried after being throttled waits out the
+	// backoff, doubled by every failed run up to BACKOFF_MAX, before
+	// uploading, and starts its upload retries from it. A successful run
+	// clears it.
+	BackoffState     bool          `envconfig:"BACKOFF_STATE"`
+	MongoBackoffColl string        `envconfig:"MONGODB_BACKOFFCOLL" default:"backup_backoff"`
+	BackoffMax       time.Duration `envconfig:"BACKOFF_MAX" default:"15m"`
+	// Warn about uploads of big files slower than SLOW_UPLOAD_RATE (bytes
+	// per second, e.g. 1M; 0 never warns) and, after a run, about
+	// containers or the account using more than QUOTA_WARN_RATIO of their
+	// quota.
+	SlowUploadRate byteRate `envconfig:"SLOW_UPLOAD_RATE" default:"0"`
+	QuotaWarnRatio float64  `envconfig:"QUOTA_WARN_RATIO" default:"0.9"`
+	// Uploads to Swift and S3 are throttled to MAX_UPLOAD_RATE bytes per
+	// second (e.g. 10MB/s; 0 is unlimited), all the uploads of the process
+	// sharing it, so concurrent jobs and workers don't saturate the uplink.
+	MaxUploadRate byteRate `envconfig:"MAX_UPLOAD_RATE" default:"0"`
+
+	// Tamper-evident log. Every record written is appended to a hash chain
+	// kept in MONGODB_CHAINCOLL, checked with "chain verify".
+	ChainLog       bool   `envconfig:"CHAIN_LOG"`
+	MongoChainColl string `envconfig:"MONGODB_CHAINCOLL" default:"backup_chain"`
+
+	// Purge moves what it deletes to a trash, the objects under
+	// .trash/<record id>/ in their container and the records, marked with
+	// the time they were deleted, to MONGODB_TRASHCOLL. undelete brings them
+	// back until they are deleted for good, by the first purge after
+	// TRASH_RETENTION.
+	MongoTrashColl string        `envconfig:"MONGODB_TRASHCOLL" default:"backup_trash"`
+	TrashRetention time.Duration `envconfig:"TRASH_RETENTION" default:"720h"`
+
+	// The advise command prices the storage by PRICE_TABLE, a JSON file of
+	// the price per GiB of every <backend>:<container> (see advise.go).
+	PriceTable string `envconfig:"PRICE_TABLE"`
+
+	// Every run reaching mongo, successful or not, is recorded in
+	// MONGODB_RUNS_COLL with its status, error, files and duration (see
+	// runs.go), an empty name turning it off.
+	MongoRunsColl string `envconfig:"MONGODB_RUNS_COLL" default:"backup_runs"`
+
+	// Every restore and signed URL is recorded in MONGODB_ACCESSCOLL, listed
+	// with the audit command, as done by ACCESS_ACTOR (user@host by default).
+	MongoAccessColl string `envconfig:"MONGODB_ACCESSCOLL" default:"access_log"`
+	AccessActor     string `envconfig:"ACCESS_ACTOR"`
+
+	// The usage command snapshots the objects and bytes of every agency
+	// into MONGODB_USAGECOLL.
+	MongoUsageColl string `envconfig:"MONGODB_USAGECOLL" default:"usage_history"`
+
+	// Content type enforcement. Allowed kinds are csv, json, pdf, xlsx, ods,
+	// xls, zip, html, xml, text and unknown. Files outside the allowlist are
+	// either rejected (the run fails) or flagged in the backup record.
+	ContentTypeAllowlist []string `envconfig:"CONTENT_TYPE_ALLOWLIST"`
+	ContentTypePolicy    string   `envconfig:"CONTENT_TYPE_POLICY" default:"reject"`
+	// With VALIDATE_FILES empty files, files whose content doesn't match
+	// their extension (an HTML error page saved as .xlsx) and zip, xlsx,
+	// ods and csv files that don't parse are rejected or flagged, as
+	// VALIDATION_POLICY says.
+	ValidateFiles    bool   `envconfig:"VALIDATE_FILES"`
+	ValidationPolicy string `envconfig:"VALIDATION_POLICY" default:"reject"`
+
+	// What to do when several files would get the same object name: error,
+	// hash (suffix a short content hash) or path (keep relative paths).
+	NameCollision string `envconfig:"NAME_COLLISION" default:"error"`
+
+	// Stage input bigger than this (in bytes) is spooled to a temporary file
+	// instead of being kept in memory until it is passed through.
+	PassthroughMemLimit int64 `envconfig:"PASSTHROUGH_MEM_LIMIT" default:"8388608"`
+	// Temporary files go to WORK_DIR (the system temp dir by default) and
+	// are removed even when the run fails or is interrupted. Leftovers of
+	// killed runs older than WORK_DIR_STALE_AFTER are removed on startup.
+	WorkDir           string        `envconfig:"WORK_DIR"`
+	WorkDirStaleAfter time.Duration `envconfig:"WORK_DIR_STALE_AFTER" default:"24h"`
+
+	// Memory (in MiB) available to the buffers used to hash and upload
+	// files. Work waits for a free buffer instead of allocating more.
+	MaxMemoryMB int64 `envconfig:"MAX_MEMORY_MB" default:"64"`
+
+	// How log lines are written to stderr: text, or json records (one per
+	// line) with the run id, agency and months of the run in progress and,
+	// when it applies, the file and duration. LOG_LEVEL (debug, info, warn
+	// or error) drops the lines below it, debug adding one per upload.
+	LogFormat string `envconfig:"LOG_FORMAT" default:"text"`
+	LogLevel  string `envconfig:"LOG_LEVEL" default:"info"`
+	// How warnings are written to stderr: text log lines, or json records
+	// (one per line) the orchestrator can surface.
+	WarningsFormat string `envconfig:"WARNINGS_FORMAT" default:"text"`
+	// With STRICT=true any warning fails the run, e.g. in a canary
+	// environment. Runs fail before writing their records when they can.
+	Strict bool `envconfig:"STRICT"`
+	// With DRY_RUN=true the files are read and the backends pinged, the
+	// records a run would write being printed instead of the backup.
+	DryRun bool `envconfig:"DRY_RUN"`
+
+	// Round trip a tiny object before touching the inputs, failing fast with
+	// a diagnosis when swift is unusable.
+	Canary bool `envconfig:"CANARY"`
+
+	// With BATCH_FILE the stage doesn't read stdin but backs up every job of
+	// the file, a CSV or JSON lines file of aid, year, month(s) and paths
+	// (globs), in turn, logging how each went and printing a summary. It
+	// exits non-zero if any job failed.
+	BatchFile string `envconfig:"BATCH_FILE"`
+
+	// Before reading its input, the stage checks every variable it needs
+	// and pings mongo and the storage backends, giving up on them after
+	// PREFLIGHT_TIMEOUT, and exits listing every problem found.
+	PreflightTimeout time.Duration `envconfig:"PREFLIGHT_TIMEOUT" default:"30s"`
+
+	// Upload a SHA256SUMS file, verifiable with "sha256sum -c", next to the
+	// backed up files.
+	EmitSHA256Sums bool `envconfig:"EMIT_SHA256SUMS"`
+	// Upload the tag files of a BagIt bag (bagit.txt, bag-info.txt and the
+	// sha256 manifests) next to the backed up files, restore --bagit laying
+	// the backup out as the bag, ready to deposit in preservation systems.
+	// BAGIT_SOURCE_ORGANIZATION goes in bag-info.txt.
+	EmitBagIt               bool   `envconfig:"EMIT_BAGIT"`
+	BagItSourceOrganization string `envconfig:"BAGIT_SOURCE_ORGANIZATION"`
+	// Download every file again after it is uploaded and check its SHA-256
+	// and size, catching uploads corrupted or truncated on the way.
+	VerifyUploads bool `envconfig:"VERIFY_UPLOADS"`
+
+	// Upload an in-toto/SLSA provenance statement describing the run (input
+	// file hashes, configuration, builder) and link it from the record.
+	Provenance          bool   `envconfig:"PROVENANCE"`
+	ProvenanceBuilderID string `envconfig:"PROVENANCE_BUILDER_ID" default:"https://github.com/dadosjusbr/salvador-backups"`
+	// Upload the input of the stage as read from stdin (the paths, or the
+	// message of the pipeline) and link it from the record, so the run can
+	// be replayed when debugging.
+	StoreInput bool `envconfig:"STORE_INPUT"`
+
+	// With ESCROW_RECIPIENTS (age X25519 public keys, age1...) the records
+	// of every run are also uploaded, age encrypted, to ESCROW_CONTAINER of
+	// the Swift account in the ESCROW_ACCOUNT file (SWIFT_ variables as
+	// KEY=VALUE lines, the main account by default), surviving the loss of
+	// mongo. Failing to escrow is a warning.
+	EscrowRecipients []string `envconfig:"ESCROW_RECIPIENTS"`
+	EscrowAccount    string   `envconfig:"ESCROW_ACCOUNT"`
+	EscrowContainer  string   `envconfig:"ESCROW_CONTAINER"`
+
+	// Warn when a run's total size is this many times bigger or smaller than
+	// the agency's historical median. Zero disables the check.
+	SizeAnomalyFactor float64 `envconfig:"SIZE_ANOMALY_FACTOR" default:"10"`
+
+	// CloudEvents published when a run completes or fails: POSTed to
+	// http(s) URLs, or published on EVENTS_NATS_SUBJECT for nats:// URLs.
+	// This and the other URLs of services the stage posts to are hidden
+	// whole by config dump, webhooks having their token in the path.
+	EventsURL string `envconfig:"EVENTS_URL" secret:"true"`
+	// The metrics of every run (files and bytes uploaded, upload durations
+	// and failures) are pushed to the Prometheus Pushgateway at
+	// METRICS_ENDPOINT, grouped by METRICS_JOB and agency, the process
+	// being too short-lived to be scraped.
+	MetricsEndpoint   string `envconfig:"METRICS_ENDPOINT" secret:"true"`
+	MetricsJob        string `envconfig:"METRICS_JOB" default:"salvador_backups"`
+	EventsNATSSubject string `envconfig:"EVENTS_NATS_SUBJECT" default:"salvador.backups"`
+	// A JSON summary of every run (status, files and their sizes,
+	// duration) is POSTed to NOTIFY_URL, retried NOTIFY_RETRIES times.
+	// With NOTIFY_SECRET it is signed: X-Salvador-Signature is
+	// "sha256=" and the hex HMAC-SHA256 of X-Salvador-Timestamp, a dot
+	// and the body. NOTIFY_FORMAT slack or discord posts a message for
+	// their incoming webhooks instead.
+	NotifyURL     string `envconfig:"NOTIFY_URL" secret:"true"`
+	NotifySecret  string `envconfig:"NOTIFY_SECRET" secret:"true"`
+	NotifyFormat  string `envconfig:"NOTIFY_FORMAT" default:"json"`
+	NotifyRetries int    `envconfig:"NOTIFY_RETRIES" default:"3"`
+	// gaps --enqueue asks for the months without backups to be backfilled
+	// by running BACKFILL_COMMAND (with sh -c, AID, SUB_AID, YEAR and MONTH
+	// set) and POSTing {"aid","sub_aid","year","month"} to BACKFILL_URL,
+	// for every month.
+	BackfillCommand string `envconfig:"BACKFILL_COMMAND"`
+	BackfillURL     string `envconfig:"BACKFILL_URL" secret:"true"`
+	// With JOURNAL_DIR, a local directory, every run writes an entry there
+	// before uploading its files, removed once their records are stored.
+	// The first run of the stage rolls back the objects of the entries left
+	// by the runs of this host that died in between, those a record refers
+	// to being kept.
+	JournalDir string `envconfig:"JOURNAL_DIR"`
+
+	// NATS JetStream worker ("nats-worker"). Jobs are consumed by the
+	// NATS_DURABLE pull consumer; NATS_ACK_WAIT is kept alive while a job is
+	// being uploaded.
+	NATSURL            string        `envconfig:"NATS_URL" secret:"uri"`
+	NATSStream         string        `envconfig:"NATS_STREAM"`
+	NATSJobsSubject    string        `envconfig:"NATS_JOBS_SUBJECT" default:"salvador.jobs"`
+	NATSResultsSubject string        `envconfig:"NATS_RESULTS_SUBJECT" default:"salvador.results"`
+	NATSDurable        string        `envconfig:"NATS_DURABLE" default:"salvador-backups"`
+	NATSAckWait        time.Duration `envconfig:"NATS_ACK_WAIT" default:"30m"`
+	NATSMaxDeliver     int           `envconfig:"NATS_MAX_DELIVER" default:"5"`
+	// Jobs published to NATS_URGENT_JOBS_SUBJECT, if set, are consumed
+	// before the others, by the NATS_DURABLE-urgent consumer.
+	NATSUrgentJobsSubject string `envconfig:"NATS_URGENT_JOBS_SUBJECT"`
+
+	// Mongo job worker ("job-worker"). Jobs inserted in MONGODB_JOBSCOLL are
+	// claimed with a JOB_LEASE lease, kept alive while a job is being
+	// uploaded, the collection being polled every JOB_POLL_INTERVAL when
+	// there are none.
+	MongoJobsColl   string        `envconfig:"MONGODB_JOBSCOLL" default:"backup_jobs"`
+	JobLease        time.Duration `envconfig:"JOB_LEASE" default:"10m"`
+	JobPollInterval time.Duration `envconfig:"JOB_POLL_INTERVAL" default:"5s"`
+	// Both workers take urgent jobs (NATS_URGENT_JOBS_SUBJECT, or jobs with
+	// priority "urgent") before the scheduled ones, at most
+	// JOB_URGENT_CONCURRENCY and JOB_SCHEDULED_CONCURRENCY of each running
+	// at once across the workers (0 is no limit), so the backfill can be
+	// kept from taking every worker.
+	JobUrgentConcurrency    int `envconfig:"JOB_URGENT_CONCURRENCY" default:"0"`
+	JobScheduledConcurrency int `envconfig:"JOB_SCHEDULED_CONCURRENCY" default:"0"`
+
+	// Public index ("publish-index"). Only the agencies in PUBLIC_AIDS (an
+	// aid also covering its sub-agencies) are listed, under
+	// PUBLIC_INDEX_PREFIX in SWIFT_CONTAINER.
+	PublicAIDs        []string `envconfig:"PUBLIC_AIDS"`
+	PublicIndexPrefix string   `envconfig:"PUBLIC_INDEX_PREFIX" default:"index"`
+
+	// Daemon mode
+	MetricsAddr string `envconfig:"METRICS_ADDR" default:":9090"`
+}
+
+// Main runs the stage, or the command named by its first argument after the
+// flags (see cliFlags). Failing, it exits with the dadosjusbr status code of
+// the class of the error (see failCodes), a JSON line on stderr telling
+// which.
+func Main() {
+	if len(os.Args) > 1 && (os.Args[1] == "--version" || os.Args[1] == "-version") {
+		fmt.Println(currentBuild())
+		return
+	}
+	log.Println(currentBuild())
+
+	// flags and the --config file are set in the environment first.
+	cli, args, err := parseCLIFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil {
+		err = cli.apply()
+	}
+	if err != nil {
+		exitWith(withFailClass(failInvalidConfig, err))
+	}
+
+	// parsing environment variables.
+	conf, err := readConfig()
+	if err != nil {
+		exitWith(withFailClass(failInvalidConfig, err))
+	}
+	conf.AID = strings.ToLower(conf.AID)
+	// logging first, so the problems are logged in LOG_FORMAT.
+	if err := Setup(conf); err != nil {
+		exitWith(withFailClass(failInvalidConfig, err))
+	}
+	if problems := configProblems(conf); len(problems) > 0 {
+		fatalProblems(failInvalidConfig, problems)
+	}
+
+	ctx := context.Background()
+	if len(args) > 0 {
+		cmd, ok := commands[args[0]]
+		if !ok {
+			exitWith(withFailClass(failInvalidConfig, fmt.Errorf("unknown command %q", args[0])))
+		}
+		if cli.paths != nil {
+			exitWith(withFailClass(failInvalidConfig, fmt.Errorf("--paths can't be used with command %s", args[0])))
+		}
+		// commands run until interrupted too, workers stopping cleanly.
+		ctx, intr, stop := notifyInterrupt(ctx)
+		err := cmd(ctx, conf, args[1:])
+		stop()
+		if sig := intr.signal(); sig != nil && err != nil {
+			exitInterrupted(sig, err)
+		}
+		if err != nil {
+			exitWith(err)
+		}
+		return
+	}
+	if cli.paths != nil && (conf.BatchFile != "" || conf.InputFormat != inputPaths) {
+		exitWith(withFailClass(failInvalidConfig, fmt.Errorf("--paths can't be used with BATCH_FILE or INPUT_FORMAT=%s", conf.InputFormat)))
+	}
+
+	if problems := preflight(ctx, conf); len(problems) > 0 {
+		fatalProblems(failInvalidConfig, problems)
+	}
+
+	ctx, intr, stop := notifyInterrupt(ctx)
+	defer stop()
+
+	if conf.BatchFile != "" {
+		err := runBatch(ctx, conf)
+		if sig := intr.signal(); sig != nil {
+			exitInterrupted(sig, err)
+		}
+		if err != nil {
+			exitWith(err)
+		}
+		return
+	}
+
+	// reading and parsing stdin, keeping a copy to pass it through later.
+	in := newSpool(conf.PassthroughMemLimit)
+	defer in.Close()
+	var paths []string
+	switch conf.InputFormat {
+	case inputColeta, inputPipeline, inputPipelineText:
+		var env coletaEnvelope
+		var pkg string
+		var err error
+		if conf.InputFormat == inputColeta {
+			env, err = readEnvelope(io.TeeReader(os.Stdin, in))
+		} else {
+			env, pkg, err = readPipeline(io.TeeReader(os.Stdin, in), conf.InputFormat == inputPipelineText)
+		}
+		if err != nil {
+			in.Close()
+			exitWith(withFailClass(failInvalidInput, fmt.Errorf("error reading from stdin: %w", err)))
+		}
+		if conf, err = applyEnvelope(conf, env); err != nil {
+			in.Close()
+			exitWith(withFailClass(failInvalidInput, err))
+		}
+		if problems := runProblems(conf); len(problems) > 0 {
+			in.Close()
+			fatalProblems(failInvalidInput, problems)
+		}
+		warnings = newWarner(conf)
+		paths = env.Coleta.Arquivos
+		if pkg != "" {
+			paths = append(paths, pkg)
+		}
+	default:
+		var err error
+		if cli.paths != nil {
+			// nothing read, nothing passed through.
+			paths = cli.paths
+		} else if paths, err = readPaths(io.TeeReader(os.Stdin, in)); err != nil {
+			in.Close()
+			exitWith(withFailClass(failInvalidInput, fmt.Errorf("error reading from stdin: %w", err)))
+		}
+	}
+
+	paths, err = expandPaths(paths, conf.InputExclude, conf.InputFollowSymlinks)
+	if err != nil {
+		in.Close()
+		exitWith(err)
+	}
+
+	// checking content types before touching any backend.
+	flagged, err := applyContentTypePolicy(conf, paths)
+	if err != nil {
+		in.Close()
+		exitWith(err)
+	}
+
+	if conf.DryRun {
+		recs, err := dryRun(ctx, conf, paths, flagged)
+		if err == nil {
+			err = writePlan(os.Stdout, recs)
+		}
+		in.Close()
+		if err != nil {
+			exitWith(err)
+		}
+		return
+	}
+
+	recs, err := run(ctx, conf, paths, flagged, in, nil)
+	if err == nil {
+		// warnings of the cleanups, after the records were written.
+		err = warnings.strictErr(0)
+	}
+	sig := intr.signal()
+	if sig != nil {
+		// still reporting and queueing the interrupted run.
+		ctx = detachedContext{ctx}
+	}
+	if errors.Is(err, errLeaseHeld) && conf.LockHeldPolicy == lockHeldExit {
+		log.Printf("Exiting: %v", err)
+		// the run holding the lease writes the records.
+		if err := writeOutput(conf, paths, in, nil, true); err != nil {
+			in.Close()
+			exitWith(err)
+		}
+		return
+	}
+	notifyBackup(ctx, conf, paths, recs, err)
+	if err != nil {
+		// the run holding the lease is doing the backup.
+		if conf.RetryQueue && !errors.Is(err, errReadOnly) && !errors.Is(err, errStrict) && !errors.Is(err, errLeaseHeld) {
+			if qErr := enqueueRetry(ctx, conf, paths, flagged, err); qErr != nil {
+				warnings.warnf(warnRetryQueue, "%v", qErr)
+			}
+		}
+		in.Close()
+		if sig != nil {
+			exitInterrupted(sig, err)
+		}
+		exitWith(err)
+	}
+	if err := storeRecords(ctx, conf, recs); err != nil {
+		in.Close()
+		exitWith(err)
+	}
+
+	if err := writeOutput(conf, paths, in, recs, false); err != nil {
+		in.Close()
+		exitWith(err)
+	}
+}
+
+// writeOutput writes what the stage prints once recs are stored: the Result
+// with OUTPUT_FORMAT=json, the input otherwise, followed by the records with
+// METADATA_SINK=stdout. inProgress tells the month is being backed up by
+// another run.
+func writeOutput(conf Config, paths []string, in *spool, recs []Record, inProgress bool) error {
+	if conf.OutputFormat == outputJSON {
+		res, err := buildResult(conf, paths, recs)
+		if err == nil {
+			res.InProgress = inProgress
+			err = writeResult(os.Stdout, res)
+		}
+		if err != nil {
+			return withFailClass(failOutput, err)
+		}
+		return nil
+	}
+
+	// Printing the same input it gets. Acting as a proxy stage.
+	if _, err := in.WriteTo(os.Stdout); err != nil {
+		return withFailClass(failOutput, fmt.Errorf("error writing to stdout: %w", err))
+	}
+	if conf.MetadataSink == sinkStdout {
+		if err := writeRecords(os.Stdout, conf.MetadataDelimiter, recs); err != nil {
+			return withFailClass(failOutput, fmt.Errorf("error writing metadata to stdout: %w", err))
+		}
+	}
+	return nil
+}
+
+// run backs up paths and returns the records written. It returns instead of
+// exiting so deferred cleanups (lease release, mongo disconnection) always
+// happen. With the stdout, file and postgres metadata sinks mongo is not
+// used at all:
+// records are only returned, and neither leases nor the size anomaly check
+// apply.
+//
+// input is what the stage read from stdin, stored with STORE_INPUT; runs
+// not reading it pass nil. With a batch and RECORD_POLICY=version the records
+// are queued in it instead of being inserted, and are only stored once the
+// batch is flushed. The other policies update the record of the month, so
+// they are written while the run holds the month leases.
+func run(ctx context.Context, conf Config, paths, flagged []string, input *spool, batch *recordBatch) (written []Record, runErr error) {
+	if err := checkWritable(conf.ReadOnly, "back up files"); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	meter := startUsage()
+	since := warnings.count()
+	months, err := runMonths(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.BackupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.BackupTimeout)
+		defer cancel()
+	}
+	runID := newRunID()
+	agency := splitAID(conf.AID, conf.AIDSeparator)
+	// where the objects of the run are named, see OBJECT_VERSIONING.
+	prefix := versionPrefix(conf, agency, runID, started)
+	logs.setRun(runID, agency, int(conf.Year), months)
+	defer logs.clearRun()
+	uploadStats.reset()
+
+	// infected files are left out before anything is hashed or stored.
+	var scan *scanReport
+	if conf.ClamdAddr != "" {
+		if paths, scan, err = scanFiles(ctx, conf, paths); err != nil {
+			return nil, err
+		}
+		var kept []string
+		for _, p := range flagged {
+			if !scan.infected(p) {
+				kept = append(kept, p)
+			}
+		}
+		flagged = kept
+	}
+
+	// files are otherwise hashed as they are uploaded, the input hash and
+	// the check for changes being done before.
+	var inHash string
+	var inDigests []string
+	if conf.ResultCache || conf.SkipUnchanged || conf.ObjectLayout == layoutContent {
+		if inDigests, err = fileDigests(paths); err != nil {
+			return nil, fmt.Errorf("error computing checksums:%w", err)
+		}
+	}
+	if conf.ResultCache {
+		inHash = inputHash(paths, inDigests)
+	}
+
+	// configuring mongodb and cloud backup clients.
+	var mdb *mongo.Database
+	var dbColl *mongo.Collection
+	if conf.MetadataSink == sinkMongo {
+		db, err := connect(ctx, conf.MongoURI)
+		if err != nil {
+			return nil, withFailClass(failDatabase, fmt.Errorf("error connecting to mongo:%w", err))
+		}
+		defer disconnect(db)
+		mdb = db.Database(conf.MongoDBName)
+		dbColl = mdb.Collection(conf.MongoBackupColl)
+		if conf.MongoRunsColl != "" {
+			defer func() {
+				doc := newRunDocument(conf, runID, months, paths, started, written, runErr)
+				if err := recordRun(detachedContext{ctx}, mdb.Collection(conf.MongoRunsColl), doc); err != nil {
+					warnings.warnf(warnRunLog, "%v", err)
+				}
+			}()
+		}
+		if err := ensureRecordIndex(ctx, dbColl, conf.RecordPolicy); err != nil {
+			return nil, err
+		}
+
+		// making sure no other run is working on the same agency/months.
+		// Leases are taken in month order so overlapping ranges can't
+		// deadlock.
+		for _, m := range months {
+			l, err := acquireLease(ctx, mdb.Collection(conf.MongoLockColl), leaseKey(conf.AID, int(conf.Year), m), runID, conf.LockTTL, conf.LockWait)
+			if err != nil {
+				return nil, err
+			}
+			defer func() {
+				if err := l.release(); err != nil {
+					warnings.warnf(warnLease, "%v", err)
+				}
+			}()
+		}
+
+		if conf.IdempotencyKey != "" {
+			prior, err := findByIdempotencyKey(ctx, dbColl, conf.IdempotencyKey)
+			if err != nil {
+				return nil, err
+			}
+			if len(prior) > 0 {
+				log.Printf("Backup with idempotency key %q already completed, skipping", conf.IdempotencyKey)
+				return prior, nil
+			}
+		}
+		if conf.ResultCache {
+			cached, err := findCached(ctx, dbColl, agency, int(conf.Year), months, inHash)
+			if err != nil {
+				return nil, err
+			}
+			if cached != nil {
+				log.Printf("Same input already backed up (input hash %s), skipping", inHash)
+				return cached, nil
+			}
+		}
+		if conf.SkipUnchanged {
+			names, err := objectNames(agency.prefix(), paths, conf.NameCollision)
+			if err != nil {
+				return nil, err
+			}
+			unchanged, err := findUnchanged(ctx, dbColl, agency, int(conf.Year), months, names, inDigests)
+			if err != nil {
+				return nil, err
+			}
+			if unchanged != nil {
+				log.Printf("Files unchanged since the latest backup, skipping")
+				return unchanged, nil
+			}
+		}
+	}
+
+	if mdb != nil && conf.BackoffState {
+		coll := mdb.Collection(conf.MongoBackoffColl)
+		prev, err := loadBackoff(ctx, coll, agency.prefix())
+		if err != nil {
+			return nil, err
+		}
+		if err := prev.pace(ctx, &conf); err != nil {
+			return nil, err
+		}
+		defer func() {
+			sctx, cancel := context.WithTimeout(context.Background(), mgoConnTimeout)
+			defer cancel()
+			if err := saveBackoff(sctx, coll, agency.prefix(), prev, runErr, conf); err != nil {
+				warnings.warnf(warnBackoff, "%v", err)
+			}
+		}()
+	}
+
+	cloud, err := newBackuper(conf)
+	if err != nil {
+		return nil, err
+	}
+	journalRecovery.Do(func() { recoverJournals(ctx, conf, cloud, dbColl) })
+	if conf.Canary {
+		if err := cloud.canary(ctx, runID); err != nil {
+			return nil, err
+		}
+	}
+
+	var totalBytes int64
+	sizes := make([]int64, len(paths))
+	for i, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file info(%s):%w", p, err)
+		}
+		sizes[i] = fi.Size()
+		totalBytes += fi.Size()
+	}
+	if dbColl != nil && conf.SizeAnomalyFactor > 0 {
+		median, err := medianBackupSize(ctx, dbColl, agency)
+		if err != nil {
+			return nil, err
+		}
+		if msg := sizeAnomaly(totalBytes, median, conf.SizeAnomalyFactor); msg != "" {
+			warnings.warnf(warnSizeAnomaly, "anomalous backup size for %s %d/%s: %s", conf.AID, conf.Year, monthsLabel(months), msg)
+		}
+	}
+
+	names, err := objectNames(prefix, paths, conf.NameCollision)
+	if err != nil {
+		return nil, err
+	}
+	upload, links, err := dedupLinks(paths, names)
+	if err != nil {
+		return nil, err
+	}
+	var previews []filePreview
+	if conf.Preview {
+		seen := make(map[string]bool)
+		for i, p := range paths {
+			if seen[names[i]] {
+				continue
+			}
+			seen[names[i]] = true
+			pv, err := previewFile(p, names[i], conf.PreviewRows)
+			if err != nil {
+				warnings.warnf(warnPreview, "%v", err)
+				continue
+			}
+			previews = append(previews, pv)
+		}
+	}
+	// content already stored by any record is referred to, not uploaded
+	// again. Mirrored runs upload it anyway, for the replicas to be
+	// recorded.
+	var stored map[string]storedObject
+	var nStored int
+	if conf.ObjectLayout == layoutContent {
+		var same []fileLink
+		upload, same = dedupContent(upload, names, inDigests)
+		links = append(links, same...)
+		if dbColl != nil && len(conf.MirrorBackends) == 0 {
+			var digests []string
+			for _, i := range upload {
+				digests = append(digests, inDigests[i])
+			}
+			if stored, err = findStoredContent(ctx, dbColl, digests, conf.StorageBackend); err != nil {
+				return nil, err
+			}
+			upload, nStored = splitStored(upload, inDigests, stored)
+			if nStored > 0 {
+				log.Printf("Content of %d file(s) already stored, not uploading it again", nStored)
+			}
+		}
+	}
+	var uploadPaths, uploadNames []string
+	for _, i := range upload {
+		uploadPaths = append(uploadPaths, paths[i])
+		uploadNames = append(uploadNames, names[i])
+	}
+	// the digest of every uploaded name, computed by whatever reads the
+	// file first: packaging, encryption or the upload.
+	digestOf := make(map[string]string)
+	linked := links
+	var members []packageMember
+	var uploadDigests []string
+	if conf.PackageMode == packageTarGz {
+		archive, sum, m, err := createPackage(prefix, uploadPaths, uploadNames, links)
+		if err != nil {
+			return nil, err
+		}
+		defer removeWorkFile(archive)
+		for k, n := range uploadNames {
+			digestOf[n] = m[k].SHA256
+		}
+		members, links = m, nil
+		uploadPaths = []string{archive}
+		uploadNames = []string{packageName(prefix, int(conf.Year), months, started)}
+		uploadDigests = []string{sum}
+	}
+	var encryptions []*fileEncryption
+	if conf.EncryptionKey != "" {
+		key, err := parseEncryptionKey(conf.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_ENCRYPTION_KEY:%w", err)
+		}
+		encrypted := make([]string, len(uploadPaths))
+		uploadDigests = make([]string, len(uploadPaths))
+		for k, p := range uploadPaths {
+			e, sum, enc, err := encryptFile(key, p)
+			if err != nil {
+				return nil, err
+			}
+			defer removeWorkFile(e)
+			encrypted[k] = e
+			uploadDigests[k] = sum
+			encryptions = append(encryptions, enc)
+		}
+		uploadPaths = encrypted
+	}
+	objectNames := uploadNames
+	if conf.ObjectLayout == layoutContent {
+		objectNames = make([]string, len(upload))
+		uploadDigests = make([]string, len(upload))
+		for k, i := range upload {
+			objectNames[k] = contentName(inDigests[i])
+			uploadDigests[k] = inDigests[i]
+		}
+	}
+	if conf.KeyTemplate != "" {
+		if objectNames, err = objectKeys(conf.KeyTemplate, agency, int(conf.Year), months, started, runID, prefix, uploadNames); err != nil {
+			return nil, err
+		}
+	}
+	var backups []storage.Backup
+	var files []FileEntry
+	for _, i := range upload[:nStored] {
+		o := stored[inDigests[i]]
+		f := o.file
+		f.Attempts, f.LastError, f.Deduplicated = 0, "", true
+		backups, files = append(backups, o.backup), append(files, f)
+	}
+	journal, err := openJournal(conf, runID, agency, months, started, objectNames[nStored:])
+	if err != nil {
+		return nil, err
+	}
+	uploaded, uploadedFiles, err := backupConcurrently(ctx, cloud, uploadPaths[nStored:], objectNames[nStored:], conf.BackupConcurrency)
+	journal.uploaded(uploaded, uploadedFiles)
+	backups, files = append(backups, uploaded...), append(files, uploadedFiles...)
+	var uploadErr error
+	var missing []string
+	if err != nil {
+		uploadErr = fmt.Errorf("error backing up files %v:%w", uploadPaths, err)
+		if conf.BackupTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			uploadErr = fmt.Errorf("error backing up files %v: BACKUP_TIMEOUT of %s exceeded:%w", uploadPaths, conf.BackupTimeout, err)
+		}
+		if conf.PartialFailurePolicy != partialRecord || dbColl == nil || batch != nil || len(files) == 0 || ctx.Err() != nil {
+			rollbackUploads(context.Background(), cloud, dbColl, backups, files)
+			journal.finish()
+			return nil, uploadErr
+		}
+		missing = uploadNames[len(files):]
+		log.Printf("Recording the %d file(s) uploaded before failing, %d missing", len(files), len(missing))
+	}
+	for k := range files {
+		if uploadDigests != nil {
+			files[k].SHA256 = uploadDigests[k]
+		}
+		if encryptions != nil {
+			files[k].Encryption = encryptions[k]
+		}
+		if conf.KeyTemplate != "" {
+			files[k].Original = uploadNames[k]
+		}
+		if conf.PackageMode != packageTarGz {
+			digestOf[uploadNames[k]] = files[k].SHA256
+		}
+	}
+	if conf.PackageMode == packageTarGz {
+		for k := range files {
+			files[k].ContentType = "application/gzip"
+		}
+	} else {
+		sources := make([]string, len(files))
+		for k := range files {
+			sources[k] = paths[upload[k]]
+		}
+		if err := describeSources(files, sources, commonDir(paths)); err != nil {
+			return nil, err
+		}
+	}
+	// links and repeated paths share the digest of the name they are
+	// stored as.
+	for _, l := range linked {
+		digestOf[l.Name] = digestOf[l.Target]
+	}
+	digests := make([]string, len(paths))
+	for i, n := range names {
+		digests[i] = digestOf[n]
+	}
+	if conf.VerifyUploads {
+		if err := verifyUploads(ctx, cloud, backups, files); err != nil {
+			return nil, err
+		}
+	}
+	// the files being stored, what is left of the run is quick: it is
+	// finished even if interrupted now, given SHUTDOWN_GRACE.
+	ctx, cancelGrace := withGrace(ctx, conf.ShutdownGrace)
+	defer cancelGrace()
+	if q, ok := cloud.(quotaChecker); ok && conf.QuotaWarnRatio > 0 {
+		if err := q.checkQuotas(ctx, files, conf.QuotaWarnRatio); err != nil {
+			warnings.warnf(warnNearQuota, "%v", err)
+		}
+	}
+
+	// the checksums, bag and provenance of an incomplete backup would list
+	// files it doesn't have.
+	var sums *storage.Backup
+	if conf.EmitSHA256Sums && uploadErr == nil {
+		content := sha256Sums(prefix, names, digests)
+		b, err := cloud.upload(ctx, sha256SumsName(prefix, int(conf.Year), months), bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("error backing up checksums:%w", err)
+		}
+		sums = &b
+	}
+	var bag []storage.Backup
+	if conf.EmitBagIt && uploadErr == nil {
+		dir := bagDir(prefix, int(conf.Year), months)
+		for _, f := range bagTagFiles(prefix, int(conf.Year), months, names, digests, sizes, conf.BagItSourceOrganization, started) {
+			b, err := cloud.upload(ctx, dir+"/"+f.name, bytes.NewReader(f.content))
+			if err != nil {
+				return nil, fmt.Errorf("error backing up bagit tag file(%s):%w", f.name, err)
+			}
+			bag = append(bag, b)
+		}
+	}
+	var provenance *storage.Backup
+	if conf.Provenance && uploadErr == nil {
+		content, err := buildProvenance(conf, runID, months, paths, names, digests, started)
+		if err != nil {
+			return nil, err
+		}
+		b, err := cloud.upload(ctx, provenanceName(prefix, int(conf.Year), months), bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("error backing up provenance:%w", err)
+		}
+		provenance = &b
+	}
+
+	var storedInput *storage.Backup
+	if conf.StoreInput && input != nil {
+		r, err := input.reader()
+		if err != nil {
+			return nil, err
+		}
+		b, err := cloud.upload(ctx, inputName(prefix, int(conf.Year), months, started), r)
+		if err != nil {
+			return nil, fmt.Errorf("error backing up input:%w", err)
+		}
+		storedInput = &b
+	}
+	// the manifest lists what an incomplete backup has, being how it is
+	// restored.
+	var manifest *storage.Backup
+	if conf.ObjectLayout == layoutContent {
+		content, err := buildManifest(files, uploadNames, links)
+		if err != nil {
+			return nil, err
+		}
+		b, err := cloud.upload(ctx, manifestName(prefix, int(conf.Year), months, started), bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("error backing up manifest:%w", err)
+		}
+		manifest = &b
+	}
+
+	if err := warnings.strictErr(since); err != nil && uploadErr == nil {
+		return nil, err
+	}
+
+	usage := meter.usage()
+	logs.infof(time.Since(started), "Run used %.2fs of CPU in %.2fs, peak RSS %d bytes, %d bytes sent and %d received", usage.CPUSeconds, usage.WallSeconds, usage.PeakRSSBytes, usage.SentBytes, usage.ReceivedBytes)
+
+	// mongo keeps milliseconds, truncating upfront keeps what we wrote
+	// identical to what is read back.
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	// the records left to the other sinks or to the batch.
+	queued := dbColl == nil || (batch != nil && batchedPolicy(conf.RecordPolicy))
+	var recs []Record
+	for _, m := range months {
+		rec := Record{
+			AID:            agency.AID,
+			SubAID:         agency.Sub,
+			IdempotencyKey: conf.IdempotencyKey,
+			InputHash:      inHash,
+			Year:           int(conf.Year),
+			Month:          m,
+			Backups:        backups,
+			Files:          files,
+			Build:          currentBuild(),
+			Links:          links,
+			Timestamp:      now,
+			TotalBytes:     totalBytes,
+			Flagged:        flagged,
+			SHA256Sums:     sums,
+			BagIt:          bag,
+			Provenance:     provenance,
+			Usage:          &usage,
+			Members:        members,
+			Previews:       previews,
+			Manifest:       manifest,
+			Input:          storedInput,
+			Scan:           scan,
+		}
+		if prefix != agency.prefix() {
+			rec.ObjectPrefix = prefix
+		}
+		rec.KeyTemplate = conf.KeyTemplate
+		if len(months) > 1 {
+			rec.Months = months
+		}
+		if m, ok := cloud.(*mirror); ok {
+			rec.Replicas = m.replicasOf(rec.objects())
+		}
+		if uploadErr != nil {
+			// never returned as the result of the idempotency key or input.
+			rec.IdempotencyKey, rec.InputHash = "", ""
+			rec.Incomplete, rec.Missing = true, missing
+		}
+		if err := checkRecordSchema(rec); err != nil {
+			return nil, err
+		}
+		if queued {
+			rec.ID = primitive.NewObjectID()
+			recs = append(recs, rec)
+			continue
+		}
+		if rec.ID, err = writeRecordRetrying(ctx, dbColl, rec, conf.RecordPolicy, conf.MongoWriteAttempts, conf.MongoRetryDelay); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+		if conf.ObjectVersioning != "" {
+			if err := addVersion(ctx, mdb.Collection(conf.MongoVersionsColl), rec); err != nil {
+				return nil, err
+			}
+		}
+		if conf.ChainLog {
+			if err := appendChain(ctx, mdb.Collection(conf.MongoChainColl), dbColl, rec.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// the other sinks store the records once they are returned.
+	if queued {
+		journal.pending(recs)
+	} else {
+		journal.finish()
+	}
+	if len(conf.EscrowRecipients) > 0 {
+		name := escrowName(agency.prefix(), int(conf.Year), months, started, runID)
+		if err := escrowRecords(ctx, conf, name, recs); err != nil {
+			warnings.warnf(warnEscrow, "%v", err)
+		}
+	}
+	return recs, uploadErr
+}
+
+func connect(ctx context.Context, url string) (*mongo.Client, error) {
+	c, err := mongo.NewClient(options.Client().ApplyURI(url).SetDialer(newCountingDialer()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating mongo client(%s):%w", url, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, mgoConnTimeout)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("error connecting to mongo(%s):%w", url, err)
+	}
+	return c, nil
+}
+
+func disconnect(c *mongo.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := c.Disconnect(ctx); err != nil {
+		return fmt.Errorf("error disconnecting from mongo:%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// usageSnapshot is what an agency prefix of a container held at a point in
+// time, one document per prefix and snapshot in MONGODB_USAGECOLL.
+type usageSnapshot struct {
+	Time      time.Time `bson:"time" json:"time"`
+	Container string    `bson:"container" json:"container"`
+	Prefix    string    `bson:"prefix" json:"prefix"`
+	Objects   int64     `bson:"objects" json:"objects"`
+	Bytes     int64     `bson:"bytes" json:"bytes"`
+}
+
+// snapshotUsage lists containers, totalling objects and bytes by their first
+// path segment, the agency prefix. Canary and probe objects are left out.
+func snapshotUsage(ctx context.Context, c *swiftClient, containers []string) ([]usageSnapshot, error) {
+	if err := c.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	var snaps []usageSnapshot
+	for _, container := range containers {
+		objs, err := c.conn.ObjectsAll(ctx, container, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error listing objects(%s):%w", container, err)
+		}
+		byPrefix := make(map[string]*usageSnapshot)
+		for _, o := range objs {
+			prefix := o.Name
+			if i := strings.Index(o.Name, "/"); i >= 0 {
+				prefix = o.Name[:i]
+			}
+			if prefix == ".canary" || prefix == ".probe" {
+				continue
+			}
+			s, ok := byPrefix[prefix]
+			if !ok {
+				s = &usageSnapshot{Time: now, Container: container, Prefix: prefix}
+				byPrefix[prefix] = s
+			}
+			s.Objects++
+			s.Bytes += o.Bytes
+		}
+		for _, s := range byPrefix {
+			snaps = append(snaps, *s)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		if snaps[i].Container != snaps[j].Container {
+			return snaps[i].Container < snaps[j].Container
+		}
+		return snaps[i].Prefix < snaps[j].Prefix
+	})
+	return snaps, nil
+}
+
+// usageCmd snapshots the storage used by every agency into
+// MONGODB_USAGECOLL, once or every --every interval, so growth can be
+// charted without listing the containers on demand.
+func usageCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	every := fs.Duration("every", 0, "keep running, taking a snapshot at this interval")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkWritable(conf.ReadOnly, "store usage snapshots"); err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoUsageColl)
+
+	cloud := newSwiftClient(conf)
+	containers := []string{conf.SwiftContainer}
+	for _, t := range conf.SizeTiers {
+		containers = append(containers, t.container)
+	}
+	for {
+		if err := storeUsage(ctx, cloud, containers, coll); err != nil {
+			return err
+		}
+		if *every == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*every):
+		}
+	}
+}
+
+func storeUsage(ctx context.Context, cloud *swiftClient, containers []string, coll *mongo.Collection) error {
+	snaps, err := snapshotUsage(ctx, cloud, containers)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		log.Printf("No objects in %s, nothing to snapshot", strings.Join(containers, ", "))
+		return nil
+	}
+	docs := make([]interface{}, len(snaps))
+	for i, s := range snaps {
+		docs[i] = s
+	}
+	if _, err := coll.InsertMany(ctx, docs); err != nil {
+		return fmt.Errorf("error storing usage snapshot:%w", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tPREFIX\tOBJECTS\tBYTES")
+	for _, s := range snaps {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", s.Container, s.Prefix, s.Objects, s.Bytes)
+	}
+	return w.Flush()
+}
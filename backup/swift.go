@@ -0,0 +1,381 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/ncw/swift/v2"
+	"golang.org/x/time/rate"
+)
+
+// swiftClient gives access to the objects stored by the stage in Swift.
+type swiftClient struct {
+	conn       *swift.Connection
+	container  string
+	storageURL string
+	readOnly   bool
+	tiers      sizeTiers
+	// uploads and restores of a file are tried up to attempts times,
+	// waiting retryDelay (doubled every time) in between.
+	attempts   int
+	retryDelay time.Duration
+	// downloads is shared by every download when they are throttled.
+	downloads *rate.Limiter
+	// uploads of files of at least slowUploadMinBytes slower than slowRate
+	// (bytes per second) are warned about.
+	slowRate float64
+	// chunks is the container of the chunks of deduplicated files, empty
+	// if files are stored whole. chunkStored caches the chunks known to be
+	// there.
+	chunks      string
+	chunkStored map[string]bool
+	// segments is the container of the segments of files bigger than
+	// segmentSize, empty if they are stored whole. checkpoints keeps how
+	// far their unfinished uploads got, see uploadSegmented.
+	segments    string
+	segmentSize byteSize
+	checkpoints map[string]*uploadCheckpoint
+	// every upload attempt of a file is abandoned after timeout, if set.
+	timeout time.Duration
+	// authentications are abandoned after authTimeout.
+	authTimeout time.Duration
+	// encryptionKey decrypts restored files encrypted at backup time.
+	encryptionKey string
+	// mu guards chunkStored, checkpoints and the authentication of conn,
+	// files being uploaded concurrently with BACKUP_CONCURRENCY.
+	mu sync.Mutex
+}
+
+// slowUploadMinBytes leaves out small files, whose upload time is mostly the
+// request latency.
+const slowUploadMinBytes = 10 << 20
+
+func newSwiftClient(conf Config) *swiftClient {
+	return &swiftClient{
+		conn: &swift.Connection{
+			UserName:    conf.SwiftUsername,
+			ApiKey:      conf.SwiftAPIKey,
+			AuthUrl:     conf.SwiftAuthURL,
+			AuthVersion: conf.SwiftAuthVersion,
+			Domain:      conf.SwiftDomain,
+			Region:      conf.SwiftRegion,
+			Transport:   countingTransport(),
+			// the library waits ConnectTimeout for a request to get going,
+			// then Timeout for data between reads and writes.
+			ConnectTimeout: conf.SwiftFirstByteTimeout,
+			Timeout:        conf.SwiftStallTimeout,
+		},
+		authTimeout:   conf.SwiftAuthTimeout,
+		container:     conf.SwiftContainer,
+		storageURL:    strings.TrimRight(conf.SwiftStorageURL, "/"),
+		readOnly:      conf.ReadOnly,
+		tiers:         conf.SizeTiers,
+		attempts:      conf.UploadAttempts,
+		retryDelay:    conf.UploadRetryDelay,
+		slowRate:      float64(conf.SlowUploadRate),
+		chunks:        conf.ChunkContainer,
+		chunkStored:   map[string]bool{},
+		segments:      conf.SegmentContainer,
+		segmentSize:   conf.SegmentSize,
+		checkpoints:   map[string]*uploadCheckpoint{},
+		timeout:       conf.UploadTimeout,
+		encryptionKey: conf.EncryptionKey,
+	}
+}
+
+// fixedStorageURL reports the configured storage URL instead of the one
+// picked from the Keystone catalog, including after re-authentications.
+type fixedStorageURL struct {
+	swift.Authenticator
+	url string
+}
+
+func (a fixedStorageURL) StorageUrl(Internal bool) string {
+	return a.url
+}
+
+// errAuthTimeout fails authentications that took longer than
+// SWIFT_AUTH_TIMEOUT.
+var errAuthTimeout = errors.New("authentication timed out")
+
+func (c *swiftClient) authenticate(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn.Authenticated() {
+		return nil
+	}
+	actx := ctx
+	if c.authTimeout > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithTimeout(ctx, c.authTimeout)
+		defer cancel()
+	}
+	if err := c.conn.Authenticate(actx); err != nil {
+		if ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("error authenticating to swift:%w after %s: %v", errAuthTimeout, c.authTimeout, err)
+		}
+		return fmt.Errorf("error authenticating to swift:%w", err)
+	}
+	// once wrapped, conn takes the storage URL from Auth when it
+	// authenticates again by itself, while other requests read it.
+	if _, ok := c.conn.Auth.(fixedStorageURL); c.storageURL != "" && !ok {
+		c.conn.Auth = fixedStorageURL{Authenticator: c.conn.Auth, url: c.storageURL}
+		c.conn.StorageUrl = c.storageURL
+	}
+	return nil
+}
+
+// objectPath splits a backup URL, which has the form
+// <storage url>/<container>/<object name>, into container and object name.
+func (c *swiftClient) objectPath(ctx context.Context, url string) (string, string, error) {
+	if err := c.authenticate(ctx); err != nil {
+		return "", "", err
+	}
+	rest := strings.TrimPrefix(url, c.conn.StorageUrl+"/")
+	if rest == url {
+		return "", "", fmt.Errorf("backup url %s does not belong to storage %s", url, c.conn.StorageUrl)
+	}
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("backup url %s has no object name", url)
+	}
+	return rest[:i], rest[i+1:], nil
+}
+
+// upload stores the content of r as the object name in the client's
+// container, returning the object URL and the ETag reported by Swift.
+func (c *swiftClient) upload(ctx context.Context, name string, r io.Reader) (storage.Backup, error) {
+	return c.uploadTo(ctx, c.container, name, r)
+}
+
+// uploadTo is upload into container.
+func (c *swiftClient) uploadTo(ctx context.Context, container, name string, r io.Reader) (storage.Backup, error) {
+	if err := checkWritable(c.readOnly, "upload "+name); err != nil {
+		return storage.Backup{}, err
+	}
+	if err := c.authenticate(ctx); err != nil {
+		return storage.Backup{}, err
+	}
+	w, err := c.conn.ObjectCreate(ctx, container, name, true, "", "", nil)
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error uploading object(%s/%s):%w", container, name, err)
+	}
+	if _, err := buffers.copy(ctx, w, throttledUpload(ctx, r)); err != nil {
+		w.CloseWithError(err)
+		return storage.Backup{}, fmt.Errorf("error uploading object(%s/%s):%w", container, name, err)
+	}
+	if err := w.Close(); err != nil {
+		return storage.Backup{}, fmt.Errorf("error uploading object(%s/%s):%w", container, name, err)
+	}
+	headers, err := w.Headers()
+	if err != nil {
+		return storage.Backup{}, fmt.Errorf("error uploading object(%s/%s):%w", container, name, err)
+	}
+	return storage.Backup{URL: fmt.Sprintf("%s/%s/%s", c.conn.StorageUrl, container, name), Hash: headers["Etag"]}, nil
+}
+
+// backup uploads every file as the object of the same index in names, into
+// the container picked by the size tiers.
+func (c *swiftClient) backup(ctx context.Context, paths, names []string) ([]storage.Backup, []FileEntry, error) {
+	backups := []storage.Backup{}
+	var files []FileEntry
+	for i, p := range paths {
+		b, f, err := c.uploadFileRetrying(ctx, p, names[i])
+		if err != nil {
+			return backups, files, err
+		}
+		backups = append(backups, b)
+		files = append(files, f)
+	}
+	return backups, files, nil
+}
+
+// uploadFileRetrying is uploadFile retried on failure, the attempts being
+// kept in the returned entry. The segments of a segmented upload given up
+// are deleted.
+func (c *swiftClient) uploadFileRetrying(ctx context.Context, path, name string) (storage.Backup, FileEntry, error) {
+	b, entry, err := retryUpload(ctx, c.attempts, c.retryDelay, c.timeout, name, func(ctx context.Context) (storage.Backup, FileEntry, error) {
+		return c.uploadFile(ctx, path, name)
+	})
+	if err != nil {
+		c.dropCheckpoint(context.Background(), name)
+	}
+	return b, entry, err
+}
+
+func (c *swiftClient) uploadFile(ctx context.Context, path, name string) (storage.Backup, FileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return storage.Backup{}, FileEntry{}, fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	entry := FileEntry{Name: name, Container: c.tiers.container(fi.Size(), c.container), Bytes: fi.Size(), Backend: backendSwift}
+	start := time.Now()
+	var b storage.Backup
+	// hashed as it is read for the upload, sparing a pass over the file.
+	sum := newDigestWriter()
+	switch {
+	case c.chunks != "" && entry.Bytes > chunkMinSize:
+		b, err = c.uploadChunked(ctx, entry.Container, name, io.TeeReader(f, sum), f, &entry)
+	case c.segments != "" && entry.Bytes > int64(c.segmentSize):
+		// hashed segment by segment, to resume with the upload.
+		b, entry.SHA256, err = c.uploadSegmented(ctx, entry.Container, name, f, &entry)
+	default:
+		b, err = c.uploadTo(ctx, entry.Container, name, io.TeeReader(f, sum))
+	}
+	if err == nil && entry.SHA256 == "" {
+		entry.SHA256, err = sum.check(path, entry.Bytes)
+	}
+	if err == nil && c.slowRate > 0 && entry.Bytes >= slowUploadMinBytes {
+		if r := float64(entry.Bytes) / time.Since(start).Seconds(); r < c.slowRate {
+			warnings.warnf(warnSlowUpload, "upload of %s (%d bytes) ran at %.0f bytes/s, below %.0f", name, entry.Bytes, r, c.slowRate)
+		}
+	}
+	return b, entry, err
+}
+
+// checkQuotas warns when the account, the client's container or any
+// container files went to uses more than ratio of its quota. Quotas are read
+// from the Quota-Bytes metadata set by the Swift quota middlewares.
+func (c *swiftClient) checkQuotas(ctx context.Context, files []FileEntry, ratio float64) error {
+	if err := c.authenticate(ctx); err != nil {
+		return err
+	}
+	containers := []string{c.container}
+	seen := map[string]bool{c.container: true}
+	for _, f := range files {
+		if !seen[f.Container] {
+			seen[f.Container] = true
+			containers = append(containers, f.Container)
+		}
+	}
+	account, headers, err := c.conn.Account(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading account info:%w", err)
+	}
+	nearQuota("account", account.BytesUsed, headers["X-Account-Meta-Quota-Bytes"], ratio)
+	for _, name := range containers {
+		info, headers, err := c.conn.Container(ctx, name)
+		if err != nil {
+			return fmt.Errorf("error reading container info(%s):%w", name, err)
+		}
+		nearQuota("container "+name, info.Bytes, headers["X-Container-Meta-Quota-Bytes"], ratio)
+	}
+	return nil
+}
+
+func nearQuota(what string, used int64, quota string, ratio float64) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return
+	}
+	if float64(used) > ratio*float64(q) {
+		warnings.warnf(warnNearQuota, "%s uses %d of its %d bytes quota (%.0f%%)", what, used, q, 100*float64(used)/float64(q))
+	}
+}
+
+// download writes the object at url into w.
+func (c *swiftClient) download(ctx context.Context, url string, w io.Writer) error {
+	return c.downloadFrom(ctx, url, 0, w)
+}
+
+// digest returns the SHA-256 and size of the object of b.
+func (c *swiftClient) digest(ctx context.Context, b storage.Backup) (string, int64, error) {
+	w := newDigestWriter()
+	if err := c.download(ctx, b.URL, w); err != nil {
+		return "", 0, err
+	}
+	return w.sum(), w.n, nil
+}
+
+// downloadFrom writes the object at url into w, starting at offset. Only
+// whole downloads are checked against the object's ETag.
+func (c *swiftClient) downloadFrom(ctx context.Context, url string, offset int64, w io.Writer) error {
+	container, name, err := c.objectPath(ctx, url)
+	if err != nil {
+		return err
+	}
+	if c.downloads != nil {
+		w = limitedWriter{ctx: ctx, w: w, l: c.downloads}
+	}
+	var h swift.Headers
+	if offset > 0 {
+		h = swift.Headers{"Range": fmt.Sprintf("bytes=%d-", offset)}
+	}
+	if _, err := c.conn.ObjectGet(ctx, container, name, w, offset == 0, h); err != nil {
+		return fmt.Errorf("error downloading object(%s/%s):%w", container, name, err)
+	}
+	return nil
+}
+
+// remove deletes the object name from the client's container.
+func (c *swiftClient) remove(ctx context.Context, name string) error {
+	return c.removeFrom(ctx, c.container, name)
+}
+
+// removeFrom deletes the object name from container.
+func (c *swiftClient) removeFrom(ctx context.Context, container, name string) error {
+	if err := checkWritable(c.readOnly, "delete "+name); err != nil {
+		return err
+	}
+	if err := c.authenticate(ctx); err != nil {
+		return err
+	}
+	if err := c.conn.ObjectDelete(ctx, container, name); err != nil {
+		return fmt.Errorf("error deleting object(%s/%s):%w", container, name, err)
+	}
+	return nil
+}
+
+// discard deletes the object f was stored as, with its segments if it was
+// segmented. Chunks of a chunk manifest are kept, being shared by every
+// file with the same content.
+func (c *swiftClient) discard(ctx context.Context, b storage.Backup, f FileEntry) error {
+	if f.Segments > 0 {
+		return c.removeSegmented(ctx, f.Container, f.Name)
+	}
+	return c.removeFrom(ctx, f.Container, f.Name)
+}
+
+// stat returns the metadata of the object at url.
+func (c *swiftClient) stat(ctx context.Context, url string) (swift.Object, error) {
+	container, name, err := c.objectPath(ctx, url)
+	if err != nil {
+		return swift.Object{}, err
+	}
+	info, _, err := c.conn.Object(ctx, container, name)
+	if err != nil {
+		return swift.Object{}, fmt.Errorf("error reading object info(%s/%s):%w", container, name, err)
+	}
+	return info, nil
+}
+
+// containerInfo returns the metadata of the client's container.
+func (c *swiftClient) containerInfo(ctx context.Context) (swift.Container, error) {
+	if err := c.authenticate(ctx); err != nil {
+		return swift.Container{}, err
+	}
+	info, _, err := c.conn.Container(ctx, c.container)
+	if err != nil {
+		return swift.Container{}, fmt.Errorf("error reading container info(%s):%w", c.container, err)
+	}
+	return info, nil
+}
+
+// ping reads the metadata of the client's container.
+func (c *swiftClient) ping(ctx context.Context) error {
+	_, err := c.containerInfo(ctx)
+	return err
+}
@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// validateRecord reports why a record can't be promoted, if it can't.
+func validateRecord(r Record) error {
+	switch {
+	case r.ID.IsZero():
+		return errors.New("missing _id")
+	case r.AID == "":
+		return errors.New("missing aid")
+	case r.Year < 1:
+		return fmt.Errorf("invalid year %d", r.Year)
+	case r.Month < 1 || r.Month > 12:
+		return fmt.Errorf("invalid month %d", r.Month)
+	}
+	for i, b := range r.Backups {
+		if b.URL == "" {
+			return fmt.Errorf("backup %d has no url", i)
+		}
+	}
+	return nil
+}
+
+// syncStats counts the outcome of a metadata sync.
+type syncStats struct {
+	copied, unchanged, conflicts, invalid int
+}
+
+// syncRecords copies every record matching filter from src to dst. Records
+// are compared by the SHA-256 of their BSON: one already in dst with the
+// same _id but different content is a conflict and is left untouched.
+// Copies are read back and checked against the source checksum.
+func syncRecords(ctx context.Context, src, dst *mongo.Collection, filter bson.M, dryRun bool) (syncStats, error) {
+	var st syncStats
+	cur, err := src.Find(ctx, filter)
+	if err != nil {
+		return st, fmt.Errorf("error querying source records:%w", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		raw := append(bson.Raw(nil), cur.Current...)
+		var r Record
+		if err := bson.Unmarshal(raw, &r); err != nil {
+			st.invalid++
+			log.Printf("Invalid record %v: %v", raw.Lookup("_id"), err)
+			continue
+		}
+		if err := validateRecord(r); err != nil {
+			st.invalid++
+			log.Printf("Invalid record %s (%s, %d, %d): %v", r.ID.Hex(), r.AID, r.Year, r.Month, err)
+			continue
+		}
+		sum := rawHash(raw)
+
+		existing, err := dst.FindOne(ctx, bson.M{"_id": r.ID}).DecodeBytes()
+		switch {
+		case err == nil:
+			if rawHash(existing) == sum {
+				st.unchanged++
+			} else {
+				st.conflicts++
+				log.Printf("Conflict on record %s (%s, %d, %d): destination differs from source", r.ID.Hex(), r.AID, r.Year, r.Month)
+			}
+			continue
+		case !errors.Is(err, mongo.ErrNoDocuments):
+			return st, fmt.Errorf("error reading destination record(%s):%w", r.ID.Hex(), err)
+		}
+
+		if dryRun {
+			st.copied++
+			log.Printf("Would copy record %s (%s, %d, %d)", r.ID.Hex(), r.AID, r.Year, r.Month)
+			continue
+		}
+		if _, err := dst.InsertOne(ctx, raw); err != nil {
+			return st, fmt.Errorf("error copying record(%s):%w", r.ID.Hex(), err)
+		}
+		back, err := dst.FindOne(ctx, bson.M{"_id": r.ID}).DecodeBytes()
+		if err != nil {
+			return st, fmt.Errorf("error reading back record(%s):%w", r.ID.Hex(), err)
+		}
+		if !bytes.Equal(back, raw) {
+			return st, fmt.Errorf("record %s was stored with checksum %s, expected %s", r.ID.Hex(), rawHash(back), sum)
+		}
+		st.copied++
+	}
+	if err := cur.Err(); err != nil {
+		return st, fmt.Errorf("error reading source records:%w", err)
+	}
+	return st, nil
+}
+
+// syncMetadataCmd copies backup records between two mongo deployments, e.g.
+// to promote a staging backfill to production.
+func syncMetadataCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("sync-metadata", flag.ContinueOnError)
+	from := fs.String("from", "", "source mongo URI")
+	to := fs.String("to", "", "destination mongo URI")
+	aid := fs.String("aid", "", "only copy this agency")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return fmt.Errorf("usage: sync-metadata --from <uri> --to <uri>")
+	}
+	if !*dryRun {
+		if err := checkWritable(conf.ReadOnly, "copy backup records"); err != nil {
+			return err
+		}
+	}
+	src, err := connect(ctx, *from)
+	if err != nil {
+		return fmt.Errorf("error connecting to source mongo:%w", err)
+	}
+	defer disconnect(src)
+	dst, err := connect(ctx, *to)
+	if err != nil {
+		return fmt.Errorf("error connecting to destination mongo:%w", err)
+	}
+	defer disconnect(dst)
+
+	filter := bson.M{}
+	if *aid != "" {
+		filter["aid"] = *aid
+	}
+	st, err := syncRecords(ctx,
+		src.Database(conf.MongoDBName).Collection(conf.MongoBackupColl),
+		dst.Database(conf.MongoDBName).Collection(conf.MongoBackupColl),
+		filter, *dryRun)
+	log.Printf("Synced backup records: %d copied, %d unchanged, %d conflicts, %d invalid", st.copied, st.unchanged, st.conflicts, st.invalid)
+	if err != nil {
+		return err
+	}
+	if st.conflicts > 0 || st.invalid > 0 {
+		return fmt.Errorf("%d conflicting and %d invalid records were not copied", st.conflicts, st.invalid)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+const (
+	tempURLKeyHeader  = "X-Container-Meta-Temp-Url-Key"
+	tempURLKey2Header = "X-Container-Meta-Temp-Url-Key-2"
+)
+
+// tempURLKeys returns the container's current and previous Temp-URL keys.
+// Swift accepts signatures made with either, so rotating keeps the links
+// signed with the previous key working until the next rotation.
+func (c *swiftClient) tempURLKeys(ctx context.Context, container string) (string, string, error) {
+	if err := c.authenticate(ctx); err != nil {
+		return "", "", err
+	}
+	_, headers, err := c.conn.Container(ctx, container)
+	if err != nil {
+		return "", "", fmt.Errorf("error reading container info(%s):%w", container, err)
+	}
+	return headers[tempURLKeyHeader], headers[tempURLKey2Header], nil
+}
+
+func (c *swiftClient) setTempURLKeys(ctx context.Context, container, key, key2 string) error {
+	if err := checkWritable(c.readOnly, "set temp url keys of "+container); err != nil {
+		return err
+	}
+	if err := c.authenticate(ctx); err != nil {
+		return err
+	}
+	h := swift.Headers{tempURLKeyHeader: key}
+	if key2 != "" {
+		h[tempURLKey2Header] = key2
+	}
+	if err := c.conn.ContainerUpdate(ctx, container, h); err != nil {
+		return fmt.Errorf("error setting temp url keys(%s):%w", container, err)
+	}
+	return nil
+}
+
+// tempURL signs a link to the object at url, valid for ttl.
+func (c *swiftClient) tempURL(ctx context.Context, url, method string, ttl time.Duration) (string, error) {
+	container, name, err := c.objectPath(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	key, _, err := c.tempURLKeys(ctx, container)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", fmt.Errorf("container %s has no temp url key, set one with \"tempurl key rotate\"", container)
+	}
+	return c.conn.ObjectTempUrl(container, name, key, method, time.Now().Add(ttl)), nil
+}
+
+func newTempURLKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating temp url key:%w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// tempURLCmd manages the container's Temp-URL keys and issues temporary
+// URLs for backed up objects, so links can be shared without the account
+// credentials:
+//
+//	tempurl key show
+//	tempurl key set <key>
+//	tempurl key rotate
+//	tempurl sign [--ttl 24h] [--method GET] <object name or url>
+func tempURLCmd(ctx context.Context, conf Config, args []string) error {
+	usage := fmt.Errorf("usage: tempurl key show|set <key>|rotate, or tempurl sign [--ttl 24h] [--method GET] <object>")
+	if len(args) == 0 {
+		return usage
+	}
+	cloud := newSwiftClient(conf)
+	switch args[0] {
+	case "key":
+		if len(args) < 2 {
+			return usage
+		}
+		key, key2, err := cloud.tempURLKeys(ctx, cloud.container)
+		if err != nil {
+			return err
+		}
+		switch {
+		case args[1] == "show" && len(args) == 2:
+			fmt.Printf("key:   %s\nkey-2: %s\n", key, key2)
+			return nil
+		case args[1] == "set" && len(args) == 3:
+			return cloud.setTempURLKeys(ctx, cloud.container, args[2], "")
+		case args[1] == "rotate" && len(args) == 2:
+			newKey, err := newTempURLKey()
+			if err != nil {
+				return err
+			}
+			// the current key becomes the secondary one, so issued links
+			// keep working.
+			if err := cloud.setTempURLKeys(ctx, cloud.container, newKey, key); err != nil {
+				return err
+			}
+			fmt.Println(newKey)
+			return nil
+		}
+		return usage
+	case "sign":
+		fs := flag.NewFlagSet("tempurl sign", flag.ContinueOnError)
+		ttl := fs.Duration("ttl", 24*time.Hour, "how long the URL is valid")
+		method := fs.String("method", http.MethodGet, "HTTP method the URL allows")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return usage
+		}
+		target := fs.Arg(0)
+		if err := cloud.authenticate(ctx); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(target, cloud.conn.StorageUrl+"/") {
+			target = fmt.Sprintf("%s/%s/%s", cloud.conn.StorageUrl, cloud.container, strings.TrimPrefix(target, "/"))
+		}
+		db, err := connect(ctx, conf.MongoURI)
+		if err != nil {
+			return fmt.Errorf("error connecting to mongo:%w", err)
+		}
+		defer disconnect(db)
+		u, err := cloud.tempURL(ctx, target, strings.ToUpper(*method), *ttl)
+		if err != nil {
+			return err
+		}
+		err = logAccess(ctx, conf, db.Database(conf.MongoDBName).Collection(conf.MongoAccessColl), accessEntry{
+			Action:  accessTempURL,
+			Objects: []string{target},
+			Detail:  fmt.Sprintf("%s for %s", strings.ToUpper(*method), *ttl),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(u)
+		return nil
+	}
+	return usage
+}
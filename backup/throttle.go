@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// parseByteRate parses a rate in bytes per second such as 500K, 10M or
+// 1.5GB/s (decimal units). Zero means unlimited.
+func parseByteRate(s string) (float64, error) {
+	n, err := parseByteSize(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: must be bytes per second, e.g. 500K, 10M or 1G", s)
+	}
+	return n, nil
+}
+
+// parseByteSize parses a size such as 512, 500K, 10MB or 1.5G (decimal
+// units).
+func parseByteSize(s string) (float64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := 1.0
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'K':
+			mult = 1e3
+		case 'M':
+			mult = 1e6
+		case 'G':
+			mult = 1e9
+		}
+		if mult != 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q: must be bytes, e.g. 512, 500K, 10M or 1G", s)
+	}
+	return n * mult, nil
+}
+
+// byteRate is a rate in bytes per second read from the environment, in the
+// format of parseByteRate.
+type byteRate float64
+
+func (r *byteRate) Decode(value string) error {
+	n, err := parseByteRate(value)
+	*r = byteRate(n)
+	return err
+}
+
+// newByteLimiter returns a limiter of bytesPerSec, or nil when unlimited.
+func newByteLimiter(bytesPerSec float64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSec)
+	if burst > bufferSize {
+		burst = bufferSize
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// uploads is shared by every upload of the process, its workers included,
+// when MAX_UPLOAD_RATE is set.
+var uploads *rate.Limiter
+
+// limitedWriter throttles writes to w. A limiter shared by several writers
+// caps their combined throughput.
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rate.Limiter
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > lw.l.Burst() {
+			n = lw.l.Burst()
+		}
+		if err := lw.l.WaitN(lw.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// limitedReader throttles reads from r, as limitedWriter does writes.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	if len(p) > lr.l.Burst() {
+		p = p[:lr.l.Burst()]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if wErr := lr.l.WaitN(lr.ctx, n); wErr != nil {
+			return n, wErr
+		}
+	}
+	return n, err
+}
+
+// throttledUpload returns r throttled by uploads, if set.
+func throttledUpload(ctx context.Context, r io.Reader) io.Reader {
+	if uploads == nil {
+		return r
+	}
+	return limitedReader{ctx: ctx, r: r, l: uploads}
+}
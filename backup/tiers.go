@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sizeTier sends files of at least min bytes to container.
+type sizeTier struct {
+	min       int64
+	container string
+}
+
+// sizeTiers are the SIZE_TIERS routing rules, as a comma separated list of
+// <min size>=<container> (e.g. "100M=backups-warm,1G=backups-cold"). Files
+// smaller than every threshold go to SWIFT_CONTAINER.
+type sizeTiers []sizeTier
+
+func (t *sizeTiers) Decode(value string) error {
+	var tiers sizeTiers
+	for _, rule := range strings.Split(value, ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		i := strings.Index(rule, "=")
+		if i <= 0 || strings.TrimSpace(rule[i+1:]) == "" {
+			return fmt.Errorf("invalid size tier %q: must be <min size>=<container>", rule)
+		}
+		min, err := parseByteSize(rule[:i])
+		if err != nil {
+			return fmt.Errorf("invalid size tier %q:%w", rule, err)
+		}
+		tiers = append(tiers, sizeTier{min: int64(min), container: strings.TrimSpace(rule[i+1:])})
+	}
+	// biggest threshold first, so the first match is the right tier.
+	sort.SliceStable(tiers, func(i, j int) bool { return tiers[i].min > tiers[j].min })
+	*t = tiers
+	return nil
+}
+
+func (t sizeTiers) String() string {
+	rules := make([]string, len(t))
+	for i, tier := range t {
+		rules[i] = fmt.Sprintf("%d=%s", tier.min, tier.container)
+	}
+	return strings.Join(rules, ",")
+}
+
+// container returns where a file of size bytes goes.
+func (t sizeTiers) container(size int64, def string) string {
+	for _, tier := range t {
+		if size >= tier.min {
+			return tier.container
+		}
+	}
+	return def
+}
@@ -0,0 +1,324 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ncw/swift/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// trashPrefix is where purged objects are moved, in their container, until
+// they are deleted for good.
+const trashPrefix = ".trash/"
+
+// trashedObject is an object of a purged record, moved to the trash.
+type trashedObject struct {
+	URL       string `bson:"url" json:"url"`
+	Container string `bson:"container" json:"container"`
+	Name      string `bson:"name" json:"name"`
+	// Trash is the name of the object in the trash, in Container.
+	Trash string `bson:"trash" json:"trash"`
+	// Segmented objects are large object manifests, only the manifest
+	// being moved to the trash.
+	Segmented bool `bson:"segmented,omitempty" json:"segmented,omitempty"`
+}
+
+// trashedRecord is a purged record as kept in MONGODB_TRASHCOLL, with when
+// it was purged and the objects moved to the trash with it. Objects other
+// records referred to were left in place and aren't listed.
+type trashedRecord struct {
+	Record    `bson:",inline"`
+	DeletedAt time.Time       `bson:"deleted_at" json:"deleted_at"`
+	Objects   []trashedObject `bson:"trashed_objects,omitempty" json:"trashed_objects,omitempty"`
+}
+
+func trashName(id primitive.ObjectID, name string) string {
+	return trashPrefix + id.Hex() + "/" + name
+}
+
+// move renames the object name of container to dst. Only the manifest of a
+// large object is moved, its segments staying where they are.
+func (c *swiftClient) move(ctx context.Context, container, name, dst string) error {
+	if err := checkWritable(c.readOnly, "move "+name); err != nil {
+		return err
+	}
+	if err := c.authenticate(ctx); err != nil {
+		return err
+	}
+	info, _, err := c.conn.Object(ctx, container, name)
+	if err != nil {
+		return fmt.Errorf("error reading object info(%s/%s):%w", container, name, err)
+	}
+	switch info.ObjectType {
+	case swift.StaticLargeObjectType:
+		err = c.conn.StaticLargeObjectMove(ctx, container, name, container, dst)
+	case swift.DynamicLargeObjectType:
+		err = c.conn.DynamicLargeObjectMove(ctx, container, name, container, dst)
+	default:
+		err = c.conn.ObjectMove(ctx, container, name, container, dst)
+	}
+	if err != nil {
+		return fmt.Errorf("error moving object(%s/%s) to %s:%w", container, name, dst, err)
+	}
+	return nil
+}
+
+// exists tells whether container has the object name.
+func (c *swiftClient) exists(ctx context.Context, container, name string) (bool, error) {
+	if err := c.authenticate(ctx); err != nil {
+		return false, err
+	}
+	_, _, err := c.conn.Object(ctx, container, name)
+	if errors.Is(err, swift.ObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading object info(%s/%s):%w", container, name, err)
+	}
+	return true, nil
+}
+
+// trashRecord moves objs, the objects of rec no other record refers to, to
+// the trash, and rec to MONGODB_TRASHCOLL. The trashed record is written
+// first, listing the objects, and the record deleted last, so a purge that
+// failed halfway is resumed by running it again.
+func trashRecord(ctx context.Context, conf Config, mdb *mongo.Database, cloud *swiftClient, rec Record, objs []trashedObject) error {
+	trash := mdb.Collection(conf.MongoTrashColl)
+	t := trashedRecord{Record: rec, DeletedAt: time.Now().UTC()}
+	var earlier trashedRecord
+	err := trash.FindOne(ctx, bson.M{"_id": rec.ID}).Decode(&earlier)
+	switch {
+	case err == nil:
+		// objects moved by the purge that failed are no longer found.
+		t.DeletedAt = earlier.DeletedAt
+		listed := make(map[string]bool)
+		for _, o := range objs {
+			listed[o.URL] = true
+		}
+		for _, o := range earlier.Objects {
+			if !listed[o.URL] {
+				objs = append(objs, o)
+			}
+		}
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return fmt.Errorf("error reading trashed record(%s):%w", rec.ID.Hex(), err)
+	}
+	t.Objects = objs
+	if _, err := trash.ReplaceOne(ctx, bson.M{"_id": rec.ID}, t, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("error trashing backup record(%s):%w", rec.ID.Hex(), err)
+	}
+	for _, o := range objs {
+		ok, err := cloud.exists(ctx, o.Container, o.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := cloud.move(ctx, o.Container, o.Name, o.Trash); err != nil {
+			return err
+		}
+	}
+	if _, err := mdb.Collection(conf.MongoBackupColl).DeleteOne(ctx, bson.M{"_id": rec.ID}); err != nil {
+		return fmt.Errorf("error deleting backup record(%s):%w", rec.ID.Hex(), err)
+	}
+	if rec.ObjectPrefix != "" {
+		if err := dropVersion(ctx, mdb.Collection(conf.MongoVersionsColl), rec.ID); err != nil {
+			return err
+		}
+	}
+	if conf.ChainLog {
+		if err := appendChainDeletion(ctx, mdb.Collection(conf.MongoChainColl), rec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyTrash deletes for good the records of the trash matching filter
+// that were purged more than TRASH_RETENTION ago, with their objects,
+// returning how many records and objects it deleted.
+func emptyTrash(ctx context.Context, conf Config, mdb *mongo.Database, cloud *swiftClient, filter bson.M, dryRun bool) (int, int, error) {
+	trash := mdb.Collection(conf.MongoTrashColl)
+	expired := bson.M{"deleted_at": bson.M{"$lte": time.Now().UTC().Add(-conf.TrashRetention)}}
+	for k, v := range filter {
+		expired[k] = v
+	}
+	cur, err := trash.Find(ctx, expired, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error querying trashed records:%w", err)
+	}
+	var recs []trashedRecord
+	if err := cur.All(ctx, &recs); err != nil {
+		return 0, 0, fmt.Errorf("error decoding trashed records:%w", err)
+	}
+	var records, objects int
+	for _, t := range recs {
+		for _, o := range t.Objects {
+			ok, err := cloud.exists(ctx, o.Container, o.Trash)
+			if err != nil {
+				return records, objects, err
+			}
+			if !ok {
+				continue
+			}
+			if !dryRun {
+				remove := cloud.removeFrom
+				if o.Segmented {
+					remove = cloud.removeSegmented
+				}
+				if err := remove(ctx, o.Container, o.Trash); err != nil {
+					return records, objects, err
+				}
+			}
+			objects++
+		}
+		if !dryRun {
+			if _, err := trash.DeleteOne(ctx, bson.M{"_id": t.ID}); err != nil {
+				return records, objects, fmt.Errorf("error deleting trashed record(%s):%w", t.ID.Hex(), err)
+			}
+		}
+		records++
+	}
+	return records, objects, nil
+}
+
+// undeleteRecord brings the trashed record t back, with its objects. It
+// refuses to overwrite an object backed up again since it was purged.
+func undeleteRecord(ctx context.Context, conf Config, mdb *mongo.Database, cloud *swiftClient, t trashedRecord) error {
+	for _, o := range t.Objects {
+		back, err := cloud.exists(ctx, o.Container, o.Name)
+		if err != nil {
+			return err
+		}
+		trashed, err := cloud.exists(ctx, o.Container, o.Trash)
+		if err != nil {
+			return err
+		}
+		switch {
+		case back && !trashed:
+			// moved back by an undelete that failed.
+			continue
+		case back:
+			return fmt.Errorf("object %s/%s was backed up again since record %s was purged, not overwriting it", o.Container, o.Name, t.ID.Hex())
+		case !trashed:
+			return fmt.Errorf("object %s/%s of record %s is missing from the trash", o.Container, o.Trash, t.ID.Hex())
+		}
+	}
+	for _, o := range t.Objects {
+		ok, err := cloud.exists(ctx, o.Container, o.Trash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := cloud.move(ctx, o.Container, o.Trash, o.Name); err != nil {
+			return err
+		}
+	}
+	coll := mdb.Collection(conf.MongoBackupColl)
+	n, err := coll.CountDocuments(ctx, bson.M{"_id": t.ID})
+	if err != nil {
+		return fmt.Errorf("error looking up backup record(%s):%w", t.ID.Hex(), err)
+	}
+	if n == 0 {
+		if _, err := coll.InsertOne(ctx, t.Record); err != nil {
+			return fmt.Errorf("error restoring backup record(%s):%w", t.ID.Hex(), err)
+		}
+	}
+	if t.ObjectPrefix != "" {
+		if err := restoreVersion(ctx, mdb.Collection(conf.MongoVersionsColl), t.Record); err != nil {
+			return err
+		}
+	}
+	if conf.ChainLog {
+		if err := appendChain(ctx, mdb.Collection(conf.MongoChainColl), coll, t.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := mdb.Collection(conf.MongoTrashColl).DeleteOne(ctx, bson.M{"_id": t.ID}); err != nil {
+		return fmt.Errorf("error deleting trashed record(%s):%w", t.ID.Hex(), err)
+	}
+	return nil
+}
+
+// undeleteCmd brings back records purged less than TRASH_RETENTION ago,
+// with their objects: the one of --id, or every one of a month, or lists
+// the trash with --list.
+func undeleteCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("undelete", flag.ContinueOnError)
+	sel := monthFlags(fs, conf)
+	id := fs.String("id", "", "undelete this record")
+	list := fs.Bool("list", false, "list the trash, of --aid if set, instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filter := bson.M{}
+	switch {
+	case *id != "":
+		oid, err := primitive.ObjectIDFromHex(*id)
+		if err != nil {
+			return fmt.Errorf("invalid record id %q:%w", *id, err)
+		}
+		filter["_id"] = oid
+	case *list:
+		if sel.agency != "" {
+			filter = sel.aid().filter()
+		}
+	case sel.agency != "" && sel.year > 0 && sel.month > 0:
+		filter = sel.aid().filter()
+		filter["year"], filter["month"] = sel.year, sel.month
+	default:
+		return fmt.Errorf("usage: undelete --id id | --aid aid --year y --month m | --list [--aid aid]")
+	}
+	if !*list {
+		if err := checkWritable(conf.ReadOnly, "undelete backups"); err != nil {
+			return err
+		}
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	mdb := db.Database(conf.MongoDBName)
+	cur, err := mdb.Collection(conf.MongoTrashColl).Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("error querying trashed records:%w", err)
+	}
+	var recs []trashedRecord
+	if err := cur.All(ctx, &recs); err != nil {
+		return fmt.Errorf("error decoding trashed records:%w", err)
+	}
+
+	if *list {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RECORD\tAID\tYEAR\tMONTH\tCREATED\tDELETED\tPURGED AFTER\tOBJECTS")
+		for _, t := range recs {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%d\n", t.ID.Hex(), t.agency(), t.Year, t.Month, t.createdAt().Format(time.RFC3339), t.DeletedAt.Format(time.RFC3339), t.DeletedAt.Add(conf.TrashRetention).Format(time.RFC3339), len(t.Objects))
+		}
+		return w.Flush()
+	}
+	if len(recs) == 0 {
+		return fmt.Errorf("no trashed records found")
+	}
+	cloud := newSwiftClient(conf)
+	for _, t := range recs {
+		if err := undeleteRecord(ctx, conf, mdb, cloud, t); err != nil {
+			return err
+		}
+		log.Printf("Undeleted record %s (%s %d/%02d) and %d objects", t.ID.Hex(), t.agency(), t.Year, t.Month, len(t.Objects))
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package backup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dadosjusbr/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tuiCmd starts an interactive browser of the backups: agencies, then their
+// months, then the files of the latest version of a month, which can be
+// restored or verified one by one.
+func tuiCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	dir := fs.String("dir", ".", "directory files are restored into")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	m := &tuiModel{
+		ctx:    ctx,
+		conf:   conf,
+		coll:   db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl),
+		access: db.Database(conf.MongoDBName).Collection(conf.MongoAccessColl),
+		cloud:  newSwiftClient(conf),
+		dir:    *dir,
+	}
+	return tea.NewProgram(m, tea.WithAltScreen()).Start()
+}
+
+const (
+	levelAgencies = iota
+	levelMonths
+	levelFiles
+)
+
+type tuiMonth struct {
+	Year     int `bson:"year"`
+	Month    int `bson:"month"`
+	Versions int `bson:"versions"`
+}
+
+type tuiFile struct {
+	url, name, hash string
+	size            int64
+	enc             *fileEncryption
+	status          string
+}
+
+// tuiLoaded carries the result of a background query for one level.
+type tuiLoaded struct {
+	level    int
+	agencies []agencyID
+	months   []tuiMonth
+	rec      Record
+	version  string
+	files    []tuiFile
+	err      error
+}
+
+// tuiDone carries the outcome of an action on the file at index.
+type tuiDone struct {
+	index  int
+	status string
+}
+
+type tuiModel struct {
+	ctx    context.Context
+	conf   Config
+	coll   *mongo.Collection
+	access *mongo.Collection
+	cloud  *swiftClient
+	dir    string
+
+	level    int
+	cursor   [3]int
+	agencies []agencyID
+	months   []tuiMonth
+	rec      Record
+	version  string
+	files    []tuiFile
+	loading  bool
+	err      error
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	m.loading = true
+	return m.loadAgencies
+}
+
+func (m *tuiModel) loadAgencies() tea.Msg {
+	cur, err := m.coll.Aggregate(m.ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"aid": "$aid", "sub_aid": "$sub_aid"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$_id"}}},
+		{{Key: "$sort", Value: bson.D{{Key: "aid", Value: 1}, {Key: "sub_aid", Value: 1}}}},
+	})
+	if err != nil {
+		return tuiLoaded{err: fmt.Errorf("error listing agencies:%w", err)}
+	}
+	var aids []agencyID
+	if err := cur.All(m.ctx, &aids); err != nil {
+		return tuiLoaded{err: fmt.Errorf("error decoding agencies:%w", err)}
+	}
+	return tuiLoaded{level: levelAgencies, agencies: aids}
+}
+
+func (m *tuiModel) loadMonths(aid agencyID) tea.Cmd {
+	return func() tea.Msg {
+		cur, err := m.coll.Aggregate(m.ctx, mongo.Pipeline{
+			{{Key: "$match", Value: aid.filter()}},
+			{{Key: "$group", Value: bson.M{
+				"_id":      bson.M{"year": "$year", "month": "$month"},
+				"year":     bson.M{"$first": "$year"},
+				"month":    bson.M{"$first": "$month"},
+				"versions": bson.M{"$sum": 1},
+			}}},
+			{{Key: "$sort", Value: bson.D{{Key: "year", Value: -1}, {Key: "month", Value: -1}}}},
+		})
+		if err != nil {
+			return tuiLoaded{err: fmt.Errorf("error listing months(%s):%w", aid, err)}
+		}
+		var months []tuiMonth
+		if err := cur.All(m.ctx, &months); err != nil {
+			return tuiLoaded{err: fmt.Errorf("error decoding months(%s):%w", aid, err)}
+		}
+		return tuiLoaded{level: levelMonths, months: months}
+	}
+}
+
+func (m *tuiModel) loadFiles(aid agencyID, year, month int) tea.Cmd {
+	return func() tea.Msg {
+		recs, err := findVersions(m.ctx, m.coll, aid, year, month)
+		if err != nil {
+			return tuiLoaded{err: err}
+		}
+		rec, err := pickVersion(recs, "latest")
+		if err != nil {
+			return tuiLoaded{err: err}
+		}
+		var files []tuiFile
+		for i, b := range rec.Backups {
+			_, name, err := m.cloud.objectPath(m.ctx, b.URL)
+			if err != nil {
+				return tuiLoaded{err: err}
+			}
+			f := tuiFile{url: b.URL, name: name, hash: b.Hash, size: -1}
+			if len(rec.Files) == len(rec.Backups) {
+				f.enc = rec.Files[i].Encryption
+				f.name = rec.Files[i].originalName()
+			}
+			if info, err := m.cloud.stat(m.ctx, b.URL); err != nil {
+				f.status = "missing"
+			} else {
+				f.size = info.Bytes
+			}
+			files = append(files, f)
+		}
+		return tuiLoaded{level: levelFiles, rec: rec, version: versionLabel(len(recs) - 1), files: files}
+	}
+}
+
+func (m *tuiModel) restore(i int) tea.Cmd {
+	f := m.files[i]
+	dst := filepath.Join(m.dir, filepath.FromSlash(restorePath(m.rec.objectPrefix(), f.name)))
+	rec := m.rec
+	return func() tea.Msg {
+		entry, err := logRestore(m.ctx, m.conf, m.access, rec, []storage.Backup{{URL: f.url, Hash: f.hash}}, dst)
+		if err != nil {
+			return tuiDone{index: i, status: err.Error()}
+		}
+		check, err := restoreFile(m.ctx, m.cloud, storage.Backup{URL: f.url, Hash: f.hash}, FileEntry{Bytes: -1, Encryption: f.enc}, dst)
+		if check != nil {
+			if rErr := recordPartsChecks(m.ctx, m.access, entry, []partsCheck{*check}); rErr != nil && err == nil {
+				err = rErr
+			}
+		}
+		if err != nil {
+			return tuiDone{index: i, status: err.Error()}
+		}
+		return tuiDone{index: i, status: "restored to " + dst}
+	}
+}
+
+func (m *tuiModel) verify(i int) tea.Cmd {
+	f := m.files[i]
+	return func() tea.Msg {
+		info, err := m.cloud.stat(m.ctx, f.url)
+		switch {
+		case err != nil:
+			return tuiDone{index: i, status: err.Error()}
+		case f.hash != "" && info.Hash != f.hash:
+			return tuiDone{index: i, status: fmt.Sprintf("MISMATCH: stored %s, recorded %s", info.Hash, f.hash)}
+		}
+		return tuiDone{index: i, status: "ok"}
+	}
+}
+
+func (m *tuiModel) rows() int {
+	switch m.level {
+	case levelAgencies:
+		return len(m.agencies)
+	case levelMonths:
+		return len(m.months)
+	}
+	return len(m.files)
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tuiLoaded:
+		m.loading = false
+		if msg.err != nil {
+			m.err = msg.err
+			return m, nil
+		}
+		m.level = msg.level
+		m.cursor[m.level] = 0
+		switch m.level {
+		case levelAgencies:
+			m.agencies = msg.agencies
+		case levelMonths:
+			m.months = msg.months
+		case levelFiles:
+			m.rec, m.version, m.files = msg.rec, msg.version, msg.files
+		}
+	case tuiDone:
+		if msg.index < len(m.files) {
+			m.files[msg.index].status = msg.status
+		}
+	case tea.KeyMsg:
+		if m.loading {
+			if msg.String() == "ctrl+c" {
+				return m, tea.Quit
+			}
+			return m, nil
+		}
+		m.err = nil
+		c := &m.cursor[m.level]
+		switch msg.String() {
+		case "ctrl+c", "q":
+			return m, tea.Quit
+		case "up", "k":
+			if *c > 0 {
+				*c--
+			}
+		case "down", "j":
+			if *c < m.rows()-1 {
+				*c++
+			}
+		case "esc", "backspace", "left", "h":
+			if m.level > levelAgencies {
+				m.level--
+			}
+		case "enter", "right", "l":
+			if m.rows() == 0 {
+				return m, nil
+			}
+			switch m.level {
+			case levelAgencies:
+				m.loading = true
+				return m, m.loadMonths(m.agencies[*c])
+			case levelMonths:
+				m.loading = true
+				mo := m.months[*c]
+				return m, m.loadFiles(m.agencies[m.cursor[levelAgencies]], mo.Year, mo.Month)
+			}
+		case "r":
+			if m.level == levelFiles && m.rows() > 0 {
+				m.files[*c].status = "restoring..."
+				return m, m.restore(*c)
+			}
+		case "v":
+			if m.level == levelFiles && m.rows() > 0 {
+				m.files[*c].status = "verifying..."
+				return m, m.verify(*c)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	switch m.level {
+	case levelAgencies:
+		b.WriteString("Agencies\n\n")
+		for i, a := range m.agencies {
+			m.row(&b, i, a.String())
+		}
+	case levelMonths:
+		fmt.Fprintf(&b, "%s\n\n", m.agencies[m.cursor[levelAgencies]])
+		for i, mo := range m.months {
+			m.row(&b, i, fmt.Sprintf("%d/%02d  %d version(s)", mo.Year, mo.Month, mo.Versions))
+		}
+	case levelFiles:
+		fmt.Fprintf(&b, "%s %d/%02d, %s (%s)\n\n", m.rec.agency(), m.rec.Year, m.rec.Month, m.version, m.rec.createdAt().Format("2006-01-02T15:04:05Z"))
+		for i, f := range m.files {
+			line := fmt.Sprintf("%-50s %12d  %s", restorePath(m.rec.objectPrefix(), f.name), f.size, f.hash)
+			if f.status != "" {
+				line += "  " + f.status
+			}
+			m.row(&b, i, line)
+		}
+	}
+	if m.rows() == 0 && !m.loading {
+		b.WriteString("  (empty)\n")
+	}
+	b.WriteString("\n")
+	switch {
+	case m.loading:
+		b.WriteString("loading...\n")
+	case m.err != nil:
+		fmt.Fprintf(&b, "Error: %v\n", m.err)
+	}
+	help := "enter: open  esc: back  q: quit"
+	if m.level == levelFiles {
+		help = "r: restore  v: verify  esc: back  q: quit"
+	}
+	b.WriteString(help + "\n")
+	return b.String()
+}
+
+func (m *tuiModel) row(b *strings.Builder, i int, text string) {
+	cursor := "  "
+	if m.cursor[m.level] == i {
+		cursor = "> "
+	}
+	b.WriteString(cursor + text + "\n")
+}
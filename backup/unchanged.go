@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// storedDigests maps the restore path of every file a record backs up,
+// archive members and links included, to its digest. Paths, unlike object
+// names, are the same whatever version of the month the record is.
+func storedDigests(rec Record) map[string]string {
+	digests := make(map[string]string)
+	prefix := rec.objectPrefix()
+	if len(rec.Members) > 0 {
+		for _, m := range rec.Members {
+			if m.Link == "" {
+				digests[m.Name] = m.SHA256
+			}
+		}
+		for _, m := range rec.Members {
+			if m.Link != "" {
+				digests[m.Name] = digests[m.Link]
+			}
+		}
+	} else {
+		for _, f := range rec.Files {
+			digests[restorePath(prefix, f.originalName())] = f.SHA256
+		}
+	}
+	for _, l := range rec.Links {
+		digests[restorePath(prefix, l.Name)] = digests[restorePath(prefix, l.Target)]
+	}
+	return digests
+}
+
+// sameFiles tells whether rec backs up exactly the files names, named under
+// prefix, with digests.
+func sameFiles(rec Record, prefix string, names, digests []string) bool {
+	if rec.Incomplete {
+		return false
+	}
+	stored := storedDigests(rec)
+	want := make(map[string]string)
+	for i, n := range names {
+		want[restorePath(prefix, n)] = digests[i]
+	}
+	if len(stored) != len(want) {
+		return false
+	}
+	for n, sum := range want {
+		if sum == "" || stored[n] != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// findUnchanged returns the latest record of every month if all of them
+// back up the files names with the same content, nil otherwise. Unlike
+// findCached, where the files are read from doesn't matter.
+func findUnchanged(ctx context.Context, coll *mongo.Collection, aid agencyID, year int, months []int, names, digests []string) ([]Record, error) {
+	var recs []Record
+	for _, m := range months {
+		versions, err := findVersions(ctx, coll, aid, year, m)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 || !sameFiles(versions[len(versions)-1], aid.prefix(), names, digests) {
+			return nil, nil
+		}
+		recs = append(recs, versions[len(versions)-1])
+	}
+	return recs, nil
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Bytes sent and received by every connection to the backends, counted by
+// countingDialer.
+var netSent, netReceived int64
+
+// countingConn counts the bytes going through a connection.
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&netReceived, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&netSent, int64(n))
+	return n, err
+}
+
+// countingDialer opens connections whose traffic is counted, through the
+// SOCKS5 proxy of ALL_PROXY if set.
+type countingDialer struct {
+	net.Dialer
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{c}, nil
+}
+
+func newCountingDialer() *countingDialer {
+	return &countingDialer{net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}}
+}
+
+// countingTransport is http.DefaultTransport with its traffic counted.
+func countingTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newCountingDialer().DialContext
+	return t
+}
+
+// runUsage is the resources used by a run, to size the containers running
+// the stage. The peak RSS is the one of the process, which may have run
+// other jobs before.
+type runUsage struct {
+	WallSeconds   float64 `bson:"wall_seconds" json:"wall_seconds"`
+	CPUSeconds    float64 `bson:"cpu_seconds" json:"cpu_seconds"`
+	PeakRSSBytes  int64   `bson:"peak_rss_bytes" json:"peak_rss_bytes"`
+	SentBytes     int64   `bson:"sent_bytes" json:"sent_bytes"`
+	ReceivedBytes int64   `bson:"received_bytes" json:"received_bytes"`
+}
+
+// usageMeter measures the resources used since it was started.
+type usageMeter struct {
+	start          time.Time
+	cpu            time.Duration
+	sent, received int64
+}
+
+func startUsage() usageMeter {
+	return usageMeter{
+		start:    time.Now(),
+		cpu:      cpuTime(),
+		sent:     atomic.LoadInt64(&netSent),
+		received: atomic.LoadInt64(&netReceived),
+	}
+}
+
+func (m usageMeter) usage() runUsage {
+	return runUsage{
+		WallSeconds:   time.Since(m.start).Seconds(),
+		CPUSeconds:    (cpuTime() - m.cpu).Seconds(),
+		PeakRSSBytes:  peakRSS(),
+		SentBytes:     atomic.LoadInt64(&netSent) - m.sent,
+		ReceivedBytes: atomic.LoadInt64(&netReceived) - m.received,
+	}
+}
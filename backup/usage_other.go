@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package backup
+
+import "time"
+
+// cpuTime is not measured on this platform.
+func cpuTime() time.Duration {
+	return 0
+}
+
+// peakRSS is not measured on this platform.
+func peakRSS() int64 {
+	return 0
+}
@@ -0,0 +1,160 @@
+package backup
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extensionKinds is the content kind files with these extensions must have,
+// an HTML error page saved as a spreadsheet being what VALIDATE_FILES is
+// after.
+var extensionKinds = map[string]string{
+	".csv":  "csv",
+	".json": "json",
+	".pdf":  "pdf",
+	".xlsx": "xlsx",
+	".ods":  "ods",
+	".xls":  "xls",
+	".zip":  "zip",
+	".xml":  "xml",
+}
+
+// validateFile returns what is wrong with the file at path, if anything: it
+// is empty, its content doesn't match its extension, or it isn't a well
+// formed zip, spreadsheet or csv.
+func validateFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading file info(%s):%w", path, err)
+	}
+	if fi.Size() == 0 {
+		return "is empty", nil
+	}
+	kind, err := sniffContentType(path)
+	if err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	want, known := extensionKinds[ext]
+	switch {
+	case !known:
+		want = kind
+	case want == "csv" && kind == "text":
+		// a single column.
+		kind = "csv"
+	case want == "zip" && (kind == "xlsx" || kind == "ods"):
+		kind = "zip"
+	}
+	if kind == "unknown" && (want == "zip" || want == "xlsx" || want == "ods") {
+		// sniffZip couldn't read its central directory.
+		return "is not a valid zip archive", nil
+	}
+	if kind != want {
+		return fmt.Sprintf("has the %s extension but %s content", ext, kind), nil
+	}
+	switch want {
+	case "zip", "xlsx", "ods":
+		return checkZip(path, want)
+	case "csv":
+		return checkCSV(path)
+	}
+	return "", nil
+}
+
+// checkZip reads every member of the archive at path, checking their CRC,
+// and that spreadsheets have their workbook.
+func checkZip(path, kind string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "is not a valid zip archive", nil
+	}
+	defer r.Close()
+	if len(r.File) == 0 {
+		return "is an empty zip archive", nil
+	}
+	members := make(map[string]bool)
+	for _, f := range r.File {
+		members[f.Name] = true
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Sprintf("has an unreadable member %s: %v", f.Name, err), nil
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Sprintf("has a corrupt member %s: %v", f.Name, err), nil
+		}
+	}
+	switch {
+	case kind == "xlsx" && !members["xl/workbook.xml"]:
+		return "is an xlsx without xl/workbook.xml", nil
+	case kind == "ods" && !members["content.xml"]:
+		return "is an ods without content.xml", nil
+	}
+	return "", nil
+}
+
+// checkCSV parses the file at path, delimited by whichever of , ; and tab
+// its first line has the most of, every record having to have as many
+// fields as the first one.
+func checkCSV(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("error opening file(%s):%w", path, err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", fmt.Errorf("error reading file(%s):%w", path, err)
+	}
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	r := csv.NewReader(br)
+	r.Comma = ','
+	for _, d := range []rune{';', '\t'} {
+		if bytes.Count(head, []byte(string(d))) > bytes.Count(head, []byte(string(r.Comma))) {
+			r.Comma = d
+		}
+	}
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+	n := 0
+	for {
+		_, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Sprintf("is not well formed csv: %v", err), nil
+		}
+		n++
+	}
+	if n == 0 {
+		return "is a csv without records", nil
+	}
+	return "", nil
+}
+
+// validateFiles returns the paths that fail validateFile, mapped to why.
+func validateFiles(paths []string) (map[string]string, error) {
+	invalid := make(map[string]string)
+	for _, p := range paths {
+		problem, err := validateFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			invalid[p] = problem
+		}
+	}
+	return invalid, nil
+}
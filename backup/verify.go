@@ -0,0 +1,171 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dadosjusbr/storage"
+	"github.com/ncw/swift/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Problems found by verify.
+const (
+	verifyMissing      = "missing"
+	verifySizeMismatch = "size_mismatch"
+	verifyHashMismatch = "hash_mismatch"
+	verifyError        = "error"
+)
+
+// verifyProblem is an object of a record that isn't stored as recorded.
+type verifyProblem struct {
+	RecordID string `json:"record_id"`
+	AID      string `json:"aid"`
+	Year     int    `json:"year"`
+	Month    int    `json:"month"`
+	URL      string `json:"url"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Got      string `json:"got,omitempty"`
+}
+
+// verifyReport is the outcome of verify. Objects shared by several records
+// (runs covering several months) are checked once.
+type verifyReport struct {
+	Records  int             `json:"records"`
+	Objects  int             `json:"objects"`
+	Skipped  int             `json:"skipped"`
+	Problems []verifyProblem `json:"problems"`
+}
+
+// verifyObject reads the metadata of the object of b, returning what is
+// wrong with it, if anything, and the expected and found values. size is the
+// recorded one, -1 when unknown.
+func verifyObject(ctx context.Context, cloud *swiftClient, b storage.Backup, size int64) (string, string, string) {
+	info, err := cloud.stat(ctx, b.URL)
+	if errors.Is(err, swift.ObjectNotFound) {
+		return verifyMissing, "", ""
+	}
+	if err != nil {
+		return verifyError, "", err.Error()
+	}
+	if size >= 0 && info.Bytes != size {
+		return verifySizeMismatch, fmt.Sprint(size), fmt.Sprint(info.Bytes)
+	}
+	// large objects are checked by size only, their ETag being of the
+	// manifest.
+	if b.Hash != "" && info.ObjectType == swift.RegularObjectType && info.Hash != b.Hash {
+		return verifyHashMismatch, b.Hash, info.Hash
+	}
+	return "", "", ""
+}
+
+// verifyCmd checks the objects of every backup record, or of those of an
+// agency or year, are still stored as recorded, with one HEAD request per
+// object. It fails when any of them isn't, for periodic integrity audits.
+func verifyCmd(ctx context.Context, conf Config, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	agency := fs.String("aid", "", "only verify this agency")
+	year := fs.Int("year", 0, "only verify this year")
+	format := fs.String("format", "json", "report format: json or text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "text" {
+		return fmt.Errorf("invalid --format %q: must be json or text", *format)
+	}
+	db, err := connect(ctx, conf.MongoURI)
+	if err != nil {
+		return fmt.Errorf("error connecting to mongo:%w", err)
+	}
+	defer disconnect(db)
+	coll := db.Database(conf.MongoDBName).Collection(conf.MongoBackupColl)
+
+	filter := bson.M{}
+	if *agency != "" {
+		filter = splitAID(strings.ToLower(*agency), conf.AIDSeparator).filter()
+	}
+	if *year != 0 {
+		filter["year"] = *year
+	}
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return fmt.Errorf("error querying backup records:%w", err)
+	}
+	defer cur.Close(ctx)
+
+	cloud := newSwiftClient(conf)
+	report := verifyReport{Problems: []verifyProblem{}}
+	checked := make(map[string]bool)
+	for cur.Next(ctx) {
+		var rec Record
+		if err := cur.Decode(&rec); err != nil {
+			return fmt.Errorf("error decoding backup record:%w", err)
+		}
+		report.Records++
+		for i, b := range rec.objects() {
+			if checked[b.URL] {
+				continue
+			}
+			checked[b.URL] = true
+			size := int64(-1)
+			if i < len(rec.Backups) && len(rec.Files) == len(rec.Backups) {
+				f := rec.Files[i]
+				// only swift objects can be checked for now.
+				if f.Backend != "" && f.Backend != backendSwift {
+					report.Skipped++
+					continue
+				}
+				size = f.Bytes
+			}
+			report.Objects++
+			status, want, got := verifyObject(ctx, cloud, b, size)
+			if status == "" {
+				continue
+			}
+			report.Problems = append(report.Problems, verifyProblem{
+				RecordID: rec.ID.Hex(),
+				AID:      rec.agency().String(),
+				Year:     rec.Year,
+				Month:    rec.Month,
+				URL:      b.URL,
+				Status:   status,
+				Expected: want,
+				Got:      got,
+			})
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("error reading backup records:%w", err)
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RECORD\tAID\tYEAR\tMONTH\tSTATUS\tEXPECTED\tGOT\tURL")
+		for _, p := range report.Problems {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", p.RecordID, p.AID, p.Year, p.Month, p.Status, p.Expected, p.Got, p.URL)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	log.Printf("Verified %d objects of %d records, %d skipped", report.Objects, report.Records, report.Skipped)
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d object(s) are missing or don't match their records", len(report.Problems))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X salvador-backups/backup.version=v1.2.0 -X salvador-backups/backup.commit=$(git rev-parse HEAD) -X salvador-backups/backup.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// buildInfo identifies the binary that produced a backup.
+type buildInfo struct {
+	Version   string `bson:"version" json:"version"`
+	Commit    string `bson:"commit" json:"commit"`
+	BuildDate string `bson:"build_date" json:"build_date"`
+	GoVersion string `bson:"go_version" json:"go_version"`
+}
+
+func currentBuild() buildInfo {
+	return buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("salvador-backups %s (commit %s, built %s, %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How the objects of a run are kept apart from those of earlier runs of the
+// same month, set by OBJECT_VERSIONING. Without it they are overwritten.
+const (
+	// versionTimestamp names them under <aid>/<run start time>.
+	versionTimestamp = "timestamp"
+	// versionRun names them under <aid>/<run id>.
+	versionRun = "run"
+)
+
+func checkObjectVersioning(conf Config) error {
+	switch conf.ObjectVersioning {
+	case "":
+		return nil
+	case versionTimestamp, versionRun:
+	default:
+		return fmt.Errorf("%q must be empty, %q or %q", conf.ObjectVersioning, versionTimestamp, versionRun)
+	}
+	// the other policies keep a single record of the month, losing track
+	// of the versions.
+	if conf.RecordPolicy != policyVersion {
+		return fmt.Errorf("%q needs RECORD_POLICY=%s", conf.ObjectVersioning, policyVersion)
+	}
+	return nil
+}
+
+// versionPrefix returns the prefix the objects of a run started at started
+// are named under.
+func versionPrefix(conf Config, agency agencyID, runID string, started time.Time) string {
+	switch conf.ObjectVersioning {
+	case versionTimestamp:
+		return agency.prefix() + "/" + started.UTC().Format("20060102T150405Z")
+	case versionRun:
+		return agency.prefix() + "/" + runID
+	}
+	return agency.prefix()
+}
+
+// monthVersion is a version of the backup of a month, as listed by its
+// monthVersions.
+type monthVersion struct {
+	RecordID     primitive.ObjectID `bson:"record_id" json:"record_id"`
+	ObjectPrefix string             `bson:"object_prefix" json:"object_prefix"`
+	Timestamp    time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+// monthVersions lists the versions of the backup of a month, oldest first,
+// Latest pointing to the record consumers should read.
+type monthVersions struct {
+	Key      string             `bson:"_id" json:"id"`
+	AID      string             `bson:"aid" json:"aid"`
+	SubAID   string             `bson:"sub_aid,omitempty" json:"sub_aid,omitempty"`
+	Year     int                `bson:"year" json:"year"`
+	Month    int                `bson:"month" json:"month"`
+	Versions []monthVersion     `bson:"versions" json:"versions"`
+	Latest   primitive.ObjectID `bson:"latest" json:"latest"`
+}
+
+// addVersion lists rec as the latest version of its month in coll.
+func addVersion(ctx context.Context, coll *mongo.Collection, rec Record) error {
+	key := leaseKey(rec.agency().prefix(), rec.Year, rec.Month)
+	v := monthVersion{RecordID: rec.ID, ObjectPrefix: rec.objectPrefix(), Timestamp: rec.Timestamp}
+	update := bson.M{
+		"$setOnInsert": bson.M{"aid": rec.AID, "sub_aid": rec.SubAID, "year": rec.Year, "month": rec.Month},
+		"$push":        bson.M{"versions": v},
+		"$set":         bson.M{"latest": rec.ID},
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": key}, update, options.Update().SetUpsert(true)); err != nil {
+		return fmt.Errorf("error listing version(%s):%w", key, err)
+	}
+	return nil
+}
+
+// dropVersion removes the record id from the versions of its month. Purge
+// keeping the latest version, the pointer to it is left as is.
+func dropVersion(ctx context.Context, coll *mongo.Collection, id primitive.ObjectID) error {
+	_, err := coll.UpdateMany(ctx, bson.M{"versions.record_id": id}, bson.M{"$pull": bson.M{"versions": bson.M{"record_id": id}}})
+	if err != nil {
+		return fmt.Errorf("error removing version(%s):%w", id.Hex(), err)
+	}
+	return nil
+}
+
+// restoreVersion lists the undeleted rec back among the versions of its
+// month, in the order they were created, the latest one being left as is.
+func restoreVersion(ctx context.Context, coll *mongo.Collection, rec Record) error {
+	key := leaseKey(rec.agency().prefix(), rec.Year, rec.Month)
+	n, err := coll.CountDocuments(ctx, bson.M{"_id": key, "versions.record_id": rec.ID})
+	if err != nil {
+		return fmt.Errorf("error reading versions(%s):%w", key, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	v := monthVersion{RecordID: rec.ID, ObjectPrefix: rec.objectPrefix(), Timestamp: rec.Timestamp}
+	update := bson.M{
+		"$setOnInsert": bson.M{"aid": rec.AID, "sub_aid": rec.SubAID, "year": rec.Year, "month": rec.Month, "latest": rec.ID},
+		"$push":        bson.M{"versions": bson.M{"$each": []monthVersion{v}, "$sort": bson.M{"timestamp": 1}}},
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": key}, update, options.Update().SetUpsert(true)); err != nil {
+		return fmt.Errorf("error listing version(%s):%w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	warningsText = "text"
+	warningsJSON = "json"
+)
+
+// Kinds of warnings, letting the orchestrator tell them apart.
+const (
+	warnUploadRetry   = "upload_retry"
+	warnMongoRetry    = "mongo_retry"
+	warnSlowUpload    = "slow_upload"
+	warnNearQuota     = "near_quota"
+	warnContentType   = "content_type"
+	warnSizeAnomaly   = "size_anomaly"
+	warnLease         = "lease"
+	warnNotification  = "notification"
+	warnRetryQueue    = "retry_queue"
+	warnWorkDir       = "work_dir"
+	warnBackend       = "backend"
+	warnEscrow        = "escrow"
+	warnPartialUpload = "partial_upload"
+	warnMirror        = "mirror"
+	warnMetrics       = "metrics"
+	warnPreview       = "preview"
+	warnBackoff       = "backoff"
+	warnRunLog        = "run_log"
+	warnInfected      = "infected"
+	warnJournal       = "journal"
+	warnInvalidFile   = "invalid_file"
+)
+
+// warningRecord is how warnings are written to stderr with
+// WARNINGS_FORMAT=json, one per line.
+type warningRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Kind    string    `json:"kind"`
+	AID     string    `json:"aid,omitempty"`
+	Message string    `json:"message"`
+}
+
+// errStrict is returned by runs that had warnings when STRICT is set.
+var errStrict = errors.New("strict mode")
+
+// warner reports the non-fatal problems of a run. Warnings always go to
+// stderr, stdout being the pass-through of the stage. It counts them so
+// that, being strict, they can fail the run.
+type warner struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	aid    string
+	strict bool
+	n      int
+	last   string
+}
+
+// warnings is set up from the config in main.
+var warnings = &warner{w: os.Stderr, format: warningsText}
+
+func newWarner(conf Config) *warner {
+	return &warner{w: os.Stderr, format: conf.WarningsFormat, aid: conf.AID, strict: conf.Strict}
+}
+
+func (w *warner) warnf(kind, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	w.mu.Lock()
+	w.n++
+	w.last = msg
+	w.mu.Unlock()
+	if w.format != warningsJSON {
+		log.Printf("Warning: %s", msg)
+		return
+	}
+	b, err := json.Marshal(warningRecord{Time: time.Now().UTC(), Level: "warning", Kind: kind, AID: w.aid, Message: msg})
+	if err != nil {
+		log.Printf("Warning: %s", msg)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w.Write(append(b, '\n'))
+}
+
+// count returns how many warnings were reported so far.
+func (w *warner) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.n
+}
+
+// strictErr fails when being strict and warnings were reported since the
+// count was since.
+func (w *warner) strictErr(since int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.strict || w.n <= since {
+		return nil
+	}
+	return fmt.Errorf("%w: %d warning(s), the last one being: %s", errStrict, w.n-since, w.last)
+}
@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// workFilePrefix starts the name of every temporary file of the stage, so
+// leftovers of crashed runs can be told apart from the rest of WORK_DIR.
+const workFilePrefix = "salvador-"
+
+// workFiles tracks the temporary files of the run, removed on exit or when
+// interrupted.
+var workFiles = struct {
+	sync.Mutex
+	dir   string
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// setupWorkDir creates dir, making it where temporary files go, and removes
+// the ones left there by runs that were killed staleAfter or more ago.
+func setupWorkDir(dir string, staleAfter time.Duration) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating work dir(%s):%w", dir, err)
+	}
+	workFiles.Lock()
+	workFiles.dir = dir
+	workFiles.Unlock()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading work dir(%s):%w", dir, err)
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), workFilePrefix) || e.IsDir() || time.Since(e.ModTime()) < staleAfter {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if err := os.Remove(p); err != nil {
+			warnings.warnf(warnWorkDir, "error removing stale work file(%s): %v", p, err)
+			continue
+		}
+		log.Printf("Removed stale work file %s", p)
+	}
+	return nil
+}
+
+// createWorkFile creates a temporary file in the work dir, pattern being as
+// in os.CreateTemp.
+func createWorkFile(pattern string) (*os.File, error) {
+	workFiles.Lock()
+	defer workFiles.Unlock()
+	f, err := os.CreateTemp(workFiles.dir, workFilePrefix+pattern)
+	if err != nil {
+		return nil, err
+	}
+	workFiles.paths[f.Name()] = true
+	return f, nil
+}
+
+// removeWorkFile removes a file created by createWorkFile.
+func removeWorkFile(path string) error {
+	workFiles.Lock()
+	defer workFiles.Unlock()
+	delete(workFiles.paths, path)
+	return os.Remove(path)
+}
+
+// removeWorkFiles removes every temporary file still around.
+func removeWorkFiles() {
+	workFiles.Lock()
+	defer workFiles.Unlock()
+	for p := range workFiles.paths {
+		os.Remove(p)
+		delete(workFiles.paths, p)
+	}
+}
@@ -3,7 +3,24 @@ module salvador-backups
 go 1.16
 
 require (
+	cloud.google.com/go/storage v1.18.2
+	github.com/Azure/azure-pipeline-go v0.2.3
+	github.com/Azure/azure-storage-blob-go v0.14.0
+	github.com/charmbracelet/bubbletea v0.19.3
+	github.com/dadosjusbr/coletores v0.0.0-20201216050911-0186b4dcc191
+	github.com/dadosjusbr/proto v0.0.0-20211004174721-e51d25d61af2
 	github.com/dadosjusbr/storage v0.0.0-20211022224243-00a21c711bab
+	github.com/golang/protobuf v1.5.2
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.10.4
+	github.com/minio/minio-go/v7 v7.0.14
+	github.com/nats-io/nats.go v1.13.0
+	github.com/ncw/swift/v2 v2.0.1
+	github.com/xitongsys/parquet-go v1.6.2
 	go.mongodb.org/mongo-driver v1.7.4
+	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b
+	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
+	google.golang.org/api v0.58.0
+	gopkg.in/yaml.v3 v3.0.1
 )